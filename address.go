@@ -0,0 +1,147 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var hostnameRegex = regexp.MustCompile(`^[\w\.\-]+$`)
+
+// addressesRejected counts the server addresses left out of the configuration by the address
+// policy, by service name.
+var addressesRejected = expvar.NewMap("addresses_rejected")
+
+// addressPolicy decides which server addresses vulcand is configured to proxy to.
+type addressPolicy struct {
+	// strict requires a URL, rejecting bare host:port addresses
+	strict bool
+	// schemes allowed, any when empty
+	schemes map[string]bool
+	minPort int
+	maxPort int
+}
+
+// addressValidation is the policy set with VCB_ADDRESS_POLICY, VCB_ADDRESS_SCHEMES and
+// VCB_ADDRESS_PORTS.
+var addressValidation = addressPolicy{minPort: 1, maxPort: 65535}
+
+// parseAddressPolicy reads a policy of lenient or strict, comma separated schemes and a port range
+// such as 8000-8999, each optional.
+func parseAddressPolicy(policy string, schemes string, ports string) (addressPolicy, error) {
+	p := addressPolicy{minPort: 1, maxPort: 65535}
+	switch policy {
+	case "", "lenient":
+	case "strict":
+		p.strict = true
+	default:
+		return p, fmt.Errorf("unknown policy %s", policy)
+	}
+	for _, scheme := range strings.Split(schemes, ",") {
+		if scheme = strings.TrimSpace(scheme); scheme != "" {
+			if p.schemes == nil {
+				p.schemes = make(map[string]bool)
+			}
+			p.schemes[scheme] = true
+		}
+	}
+	if ports != "" {
+		bounds := strings.SplitN(ports, "-", 2)
+		var err error
+		if p.minPort, err = strconv.Atoi(bounds[0]); err != nil {
+			return p, fmt.Errorf("invalid port range %s", ports)
+		}
+		p.maxPort = p.minPort
+		if len(bounds) == 2 {
+			if p.maxPort, err = strconv.Atoi(bounds[1]); err != nil {
+				return p, fmt.Errorf("invalid port range %s", ports)
+			}
+		}
+		if p.minPort < 1 || p.maxPort > 65535 || p.minPort > p.maxPort {
+			return p, fmt.Errorf("invalid port range %s", ports)
+		}
+	}
+	return p, nil
+}
+
+// check returns why vulcand shouldn't proxy to a server address, or nil if it can: the address
+// must be a URL with a host and port and nothing after them, e.g. http://host1:8080 or
+// http://[fd00::1]:8080, or unless the policy is strict a bare host and port.
+func (p addressPolicy) check(address string) error {
+	hostport := address
+	scheme := ""
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return err
+		}
+		if u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("only a scheme, host and port are allowed")
+		}
+		hostport = u.Host
+		scheme = u.Scheme
+	} else if p.strict {
+		return fmt.Errorf("a URL is required")
+	}
+	if scheme != "" && p.schemes != nil && !p.schemes[scheme] {
+		return fmt.Errorf("scheme %s is not allowed", scheme)
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return fmt.Errorf("a host and port are required")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	if n < p.minPort || n > p.maxPort {
+		return fmt.Errorf("port %d is outside %d-%d", n, p.minPort, p.maxPort)
+	}
+	if strings.Contains(host, ":") {
+		// an IPv6 literal, which SplitHostPort only accepts in brackets, maybe with a zone
+		if net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+			return fmt.Errorf("invalid IPv6 address %s", host)
+		}
+		return nil
+	}
+	if !hostnameRegex.MatchString(host) {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	return nil
+}
+
+// defaultScheme is prepended to bare host:port server addresses, unless a service sets its own,
+// or "" to leave them as they are.
+var defaultScheme string
+
+func validScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// serverURL returns the URL of a server of the service: its address, with the service's default
+// scheme, or the global one, prepended to a bare host:port.
+func (s Service) serverURL(address string) string {
+	scheme := s.DefaultScheme
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	if scheme == "" || strings.Contains(address, "://") {
+		return address
+	}
+	return scheme + "://" + address
+}
+
+// validAddress reports whether the address policy allows a server address.
+func validAddress(address string) bool {
+	return addressValidation.check(address) == nil
+}
+
+// httpURL returns the http URL of a host and port, bracketing IPv6 literals.
+func httpURL(host string, port int) string {
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
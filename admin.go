@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// requireToken rejects requests which don't carry the bearer token. An empty token lets every
+// request through.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vcb"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serves the privileged endpoints on their own address, over TLS when given a
+// certificate and key. A failure to set up TLS stops vcb rather than serving them in the clear.
+func serveAdmin(address string, handler http.Handler, certFile string, keyFile string, clientCAFile string) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			log.Fatalf("VCB_ADMIN_CLIENT_CA requires VCB_ADMIN_TLS_CERT and VCB_ADMIN_TLS_KEY\n")
+		}
+		serveHTTP(address, handler)
+		return
+	}
+	if certFile == "" || keyFile == "" {
+		log.Fatalf("VCB_ADMIN_TLS_CERT and VCB_ADMIN_TLS_KEY must both be set\n")
+	}
+	cfg, err := adminTLSConfig(clientCAFile)
+	if err != nil {
+		log.Fatalf("failed to configure admin TLS: %v\n", err)
+	}
+	server := &http.Server{Addr: address, Handler: handler, TLSConfig: cfg}
+	log.Printf("listening for https requests on %s\n", address)
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+		log.Fatalf("admin https server failed: %v\n", err)
+	}
+}
+
+// adminTLSConfig requires and verifies client certificates against the CAs in the PEM file, when
+// one is given.
+func adminTLSConfig(clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	b, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
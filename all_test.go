@@ -1,12 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/coreos/etcd/client"
 	etcderr "github.com/coreos/etcd/error"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
 )
 
 func TestReadServices(t *testing.T) {
@@ -21,22 +60,47 @@ func TestReadServices(t *testing.T) {
 	}
 
 	if err := setValues(kapi, map[string]string{
-		"/ft/services/service-a/healthcheck":        "true",
-		"/ft/services/service-a/servers/srv1":       "http://host1:80",
-		"/ft/services/service-a/path-regex/bananas": "/bananas/.*",
-		"/ft/services/service-b/healthcheck":        "false",
-		"/ft/services/service-b/servers/srv1":       "http://host1:80",
-		"/ft/services/service-b/servers/srv2":       "http://host2:80",
-		"/ft/services/service-b/path-regex/content": "/content/.*",
-		"/ft/services/service-b/path-regex/bananas": "/bananas/.*",
-		"/ft/services/service-b/path-host/bananas":  "custom-host",
-		"/ft/services/service-b/failover-predicate": "IsNetworkError()",
+		"/ft/services/service-a/healthcheck":                     "true",
+		"/ft/services/service-a/servers/srv1":                    "http://host1:80",
+		"/ft/services/service-a/path-regex/bananas":              "/bananas/.*",
+		"/ft/services/service-b/healthcheck":                     "false",
+		"/ft/services/service-b/servers/srv1":                    "http://host1:80",
+		"/ft/services/service-b/servers/srv2":                    "http://host2:80",
+		"/ft/services/service-b/weights/srv2":                    "3",
+		"/ft/services/service-b/healthcheck-paths/srv2":          "healthz",
+		"/ft/services/service-b/servers/canary-srv3":             "http://host3:80",
+		"/ft/services/service-b/canary/srv4":                     "http://host4:80",
+		"/ft/services/service-b/canary-weight":                   "10",
+		"/ft/services/service-b/path-regex/content":              "/content/.*",
+		"/ft/services/service-b/path-regex/bananas":              "/bananas/.*",
+		"/ft/services/service-b/path-host/bananas":               "custom-host",
+		"/ft/services/service-b/path-priority/bananas":           "10",
+		"/ft/services/service-b/path-host-regex/content":         ".*\\.example\\.com",
+		"/ft/services/service-b/path-normalise/content":          "true",
+		"/ft/services/service-b/path-strip-prefix/content":       "true",
+		"/ft/services/service-b/path-rewrite/bananas":            `{"Regexp": "/bananas/(.*)", "Replacement": "/fruit/$1"}`,
+		"/ft/services/service-b/path-rewrite/content":            `{"Regexp": "("}`,
+		"/ft/services/service-b/failover-predicate":              "IsNetworkError()",
+		"/ft/services/service-b/path-failover-predicate/content": "false",
+		"/ft/services/service-b/path-methods/content":            "get, head",
+		"/ft/services/service-b/path-header-regex/content":       "X-Api-Version: 2\\..*",
+		"/ft/services/service-b/host-aliases":                    "b.example.com, bee.example.com",
+		"/ft/services/service-b/middlewares/ratelimit":           `{"Id":"ratelimit", "Type":"ratelimit", "Priority":2}`,
+		"/ft/services/service-b/middlewares/rewrite":             `{"Id":"rewrite"}`,
+		"/ft/services/service-b/middlewares/broken":              `{`,
+		"/ft/services/service-b/ratelimit/requests":              "100",
+		"/ft/services/service-b/ratelimit/period":                "1m",
+		"/ft/services/service-b/connlimit/connections":           "20",
+		"/ft/services/service-b/middleware-priorities/connlimit": "3",
+		"/ft/services/service-b/cbreaker/condition":              "NetworkErrorRatio() > 0.5",
+		"/ft/services/service-b/cbreaker/fallback":               `{"Type":"response","Action":{"StatusCode":503}}`,
+		"/ft/services/service-b/cbreaker/fallback-duration":      "10s",
 	}); err != nil {
 		t.Error(err)
 	}
 
 	smap := make(map[string]Service)
-	for _, s := range readServices(kapi) {
+	for _, s := range readServices(kapi, "/ft/services/") {
 		smap[s.Name] = s
 	}
 	if len(smap) != 2 {
@@ -44,26 +108,61 @@ func TestReadServices(t *testing.T) {
 	}
 
 	a := Service{
-		Name:           "service-a",
-		HasHealthCheck: true,
-		Addresses:      map[string]string{"srv1": "http://host1:80"},
-		PathHosts:      make(map[string]string),
+		Name:                 "service-a",
+		HasHealthCheck:       true,
+		Addresses:            map[string]string{"srv1": "http://host1:80"},
+		Weights:              make(map[string]int),
+		HealthCheckPaths:     make(map[string]string),
+		Middlewares:          make(map[string]string),
+		MiddlewarePriorities: make(map[string]int),
+		PathHosts:            make(map[string]string),
+		PathHostRegexes:      make(map[string]string),
 		PathPrefixes: map[string]string{
 			"bananas": "/bananas/.*",
 		},
-		FailoverPredicate: "",
+		PathNormalise:          make(map[string]bool),
+		PathStripPrefix:        make(map[string]bool),
+		PathRewrites:           make(map[string]vulcanRewriteMw),
+		PathMethods:            make(map[string][]string),
+		PathHeaders:            make(map[string]headerMatcher),
+		PathFailoverPredicates: make(map[string]string),
+		PathPriorities:         make(map[string]int),
+		FailoverPredicate:      "",
 	}
 
 	if !reflect.DeepEqual(a, smap["service-a"]) {
 		t.Errorf("service does not match. expected and acual are :\n%v\n%v\n", a, smap["service-a"])
 	}
 
+	canaryWeight := 10
 	b := Service{
 		Name:           "service-b",
 		HasHealthCheck: false,
+		HostAliases:    []string{"b.example.com", "bee.example.com"},
 		Addresses: map[string]string{
-			"srv1": "http://host1:80",
-			"srv2": "http://host2:80",
+			"srv1":        "http://host1:80",
+			"srv2":        "http://host2:80",
+			"canary-srv4": "http://host4:80",
+		},
+		Weights: map[string]int{
+			"srv2": 3,
+		},
+		HealthCheckPaths: map[string]string{
+			"srv2": "/healthz",
+		},
+		CanaryWeight: &canaryWeight,
+		Middlewares: map[string]string{
+			"ratelimit": `{"Id":"ratelimit", "Type":"ratelimit", "Priority":2}`,
+		},
+		RateLimit: &rateLimit{Requests: 100, PeriodSeconds: 60, Burst: 1, Variable: "client.ip"},
+		ConnLimit: &connLimit{Connections: 20, Variable: "client.ip"},
+		MiddlewarePriorities: map[string]int{
+			"connlimit": 3,
+		},
+		CircuitBreaker: &circuitBreaker{
+			Condition:        "NetworkErrorRatio() > 0.5",
+			Fallback:         json.RawMessage(`{"Type":"response","Action":{"StatusCode":503}}`),
+			FallbackDuration: "10s",
 		},
 		PathPrefixes: map[string]string{
 			"bananas": "/bananas/.*",
@@ -72,13 +171,276 @@ func TestReadServices(t *testing.T) {
 		PathHosts: map[string]string{
 			"bananas": "custom-host",
 		},
+		PathHostRegexes: map[string]string{
+			"content": ".*\\.example\\.com",
+		},
+		PathNormalise: map[string]bool{
+			"content": true,
+		},
+		PathStripPrefix: map[string]bool{
+			"content": true,
+		},
+		PathRewrites: map[string]vulcanRewriteMw{
+			"bananas": vulcanRewriteMw{Regexp: "/bananas/(.*)", Replacement: "/fruit/$1"},
+		},
+		PathMethods: map[string][]string{
+			"content": []string{"GET", "HEAD"},
+		},
+		PathHeaders: map[string]headerMatcher{
+			"content": headerMatcher{Name: "X-Api-Version", Value: "2\\..*", Regexp: true},
+		},
+		PathFailoverPredicates: map[string]string{
+			"content": "false",
+		},
+		PathPriorities: map[string]int{
+			"bananas": 10,
+		},
 		FailoverPredicate: "IsNetworkError()",
 	}
+	// the reserved and broken middlewares, the server named like a canary and the broken rewrite
+	// are reported
+	if problems := smap["service-b"].problems; len(problems) != 4 {
+		t.Errorf("expected 4 problems with service-b, got %v", problems)
+	}
+	actualB := smap["service-b"]
+	actualB.problems = nil
+	smap["service-b"] = actualB
 	if !reflect.DeepEqual(b, smap["service-b"]) {
 		t.Errorf("service does not match:\n%v\n%v\n", b, smap["service-b"])
 	}
 }
 
+func TestServiceDocument(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/ft/test-documents/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{
+		"/ft/test-documents/service-a/config":       "healthcheck: true\nservers:\n  srv1: http://host1:80\nweights:\n  srv1: 2\npath-regex:\n  content: /content/.*\n",
+		"/ft/test-documents/service-a/servers/srv1": "http://host2:80",
+		"/ft/test-documents/service-b/config":       `{"servers": {"srv1": "http://host3:80"}, "failover-predicate": "IsNetworkError()"}`,
+		"/ft/test-documents/service-c/config":       `[`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	smap := make(map[string]Service)
+	for _, s := range readServices(kapi, "/ft/test-documents/") {
+		smap[s.Name] = s
+	}
+
+	a := smap["service-a"]
+	if !a.HasHealthCheck || a.Weights["srv1"] != 2 || a.PathPrefixes["content"] != "/content/.*" {
+		t.Errorf("expected the YAML document to be read, got %+v", a)
+	}
+	if a.Addresses["srv1"] != "http://host2:80" {
+		t.Errorf("expected the server key to override the document, got %v", a.Addresses)
+	}
+	b := smap["service-b"]
+	if b.Addresses["srv1"] != "http://host3:80" || b.FailoverPredicate != "IsNetworkError()" {
+		t.Errorf("expected the JSON document to be read, got %+v", b)
+	}
+	if problems := smap["service-c"].problems; len(problems) != 1 {
+		t.Errorf("expected the broken document to be reported, got %v", problems)
+	}
+}
+
+func TestCheckPredicate(t *testing.T) {
+	valid := []string{
+		"IsNetworkError()",
+		"IsNetworkError() && Attempts() <= 2",
+		`(RequestMethod() == "GET" || ResponseCode() == 408) && !IsNetworkError()`,
+		"false",
+	}
+	for _, predicate := range valid {
+		if err := checkPredicate(predicate, failoverPredicateFunctions); err != nil {
+			t.Errorf("expected %s to be valid: %v", predicate, err)
+		}
+	}
+	invalid := []string{
+		"IsNetworkError(",
+		"IsNetworkErrors()",
+		"Attempts() + 1 > 2",
+		"os.Exit(1)",
+		"NetworkErrorRatio() > 0.5",
+	}
+	for _, predicate := range invalid {
+		if err := checkPredicate(predicate, failoverPredicateFunctions); err == nil {
+			t.Errorf("expected %s to be invalid", predicate)
+		}
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	services := []Service{
+		{Name: "good", Addresses: map[string]string{"srv1": "http://host1:80"}},
+		parseService(&client.Node{Key: "/ft/services/bad", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/bad/servers", Dir: true, Nodes: []*client.Node{{Key: "/ft/services/bad/servers/srv1", Value: "host1"}}},
+			{Key: "/ft/services/bad/path-regex", Dir: true, Nodes: []*client.Node{{Key: "/ft/services/bad/path-regex/content", Value: "/content/(.*"}}},
+			{Key: "/ft/services/bad/failover-predicate", Value: "IsNetworkError() &&"},
+			{Key: "/ft/services/bad/helthcheck", Value: "true"},
+		}}),
+	}
+
+	report := validateServices(services)
+	if _, found := report.Services["good"]; found {
+		t.Errorf("expected no violations for the good service, got %v", report.Services["good"])
+	}
+	if violations := report.Services["bad"]; len(violations) != 4 {
+		t.Errorf("expected 4 violations for the bad service, got %v", violations)
+	}
+	if len(services[1].PathPrefixes) != 0 || services[1].FailoverPredicate != "" {
+		t.Errorf("expected the invalid path and predicate to be skipped, got %+v", services[1])
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcb-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "content-api.yaml"), []byte("servers:\n  srv1: http://host1:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := validateCommand([]string{dir}); code != 0 {
+		t.Errorf("expected valid services to exit with 0, got %d", code)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "search-api.yaml"), []byte("servers:\n  srv1: host1\nhelthcheck: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := validateCommand([]string{"--json", dir}); code != 1 {
+		t.Errorf("expected services with violations to exit with 1, got %d", code)
+	}
+	if code := validateCommand([]string{filepath.Join(dir, "missing")}); code != 1 {
+		t.Errorf("expected an unreadable directory to exit with 1, got %d", code)
+	}
+	if code := validateCommand([]string{dir, dir}); code != 2 {
+		t.Errorf("expected a usage error to exit with 2, got %d", code)
+	}
+}
+
+func TestParseServicesPrefixes(t *testing.T) {
+	tests := []struct {
+		list     string
+		single   string
+		expected []string
+	}{
+		{"", "", []string{"/ft/services/"}},
+		{"", "/org/services", []string{"/org/services/"}},
+		{"/team-a/services/, /team-b/services", "/org/services/", []string{"/team-a/services/", "/team-b/services/"}},
+	}
+	for _, test := range tests {
+		if actual := parseServicesPrefixes(test.list, test.single); !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("fail. expected and actual are \n%v\n%v\n", test.expected, actual)
+		}
+	}
+}
+
+func TestDesiredStateWithDynamicAddresses(t *testing.T) {
+	f, err := ioutil.TempFile("", "desired-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{
+		"service-a": {"healthcheck": true, "priority": 2, "servers": {"srv9": "http://ignored:80"}, "path-regex": {"content": "/content/.*"}},
+		"service-b": {}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	d := &desiredState{path: f.Name()}
+	registered := []Service{
+		{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}},
+		{Name: "service-c", Addresses: map[string]string{"srv1": "http://host3:80"}},
+	}
+	services := withDynamicAddresses(d.services(), registered)
+
+	if len(services) != 2 || services[0].Name != "service-a" || services[1].Name != "service-b" {
+		t.Fatalf("unexpected services %v", services)
+	}
+	a := services[0]
+	if !a.HasHealthCheck || a.Priority != 2 || a.PathPrefixes["content"] != "/content/.*" {
+		t.Errorf("routes not read from the desired state: %v", a)
+	}
+	if !reflect.DeepEqual(a.Addresses, map[string]string{"srv1": "http://host1:80"}) {
+		t.Errorf("servers not read from etcd: %v", a.Addresses)
+	}
+	if len(services[1].Addresses) != 0 {
+		t.Errorf("unexpected servers for service-b: %v", services[1].Addresses)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if again := d.services(); len(again) != 2 {
+		t.Errorf("expected the last good desired state to be kept, got %v", again)
+	}
+}
+
+func TestResolveHostConflicts(t *testing.T) {
+	services := []Service{
+		{Name: "service-a", Addresses: map[string]string{"s1": "http://team-b:80"}, Priority: 1},
+		{Name: "service-b"},
+		{Name: "service-a", Addresses: map[string]string{"s1": "http://team-a:80"}, Priority: 2},
+	}
+
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{conflictPolicyAlphabetical, []string{"http://team-b:80"}},
+		{conflictPolicyPriority, []string{"http://team-a:80"}},
+		{conflictPolicyReject, nil},
+	}
+	for _, test := range tests {
+		resolved, conflicts := resolveHostConflicts(services, test.policy)
+		var actual []string
+		for _, s := range resolved {
+			if s.Name == "service-a" {
+				actual = append(actual, s.Addresses["s1"])
+			}
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("policy %s: expected and actual are \n%v\n%v\n", test.policy, test.expected, actual)
+		}
+		if len(conflicts) != 1 || conflicts[0].Host != "service-a" {
+			t.Errorf("policy %s: unexpected conflicts %v", test.policy, conflicts)
+		}
+	}
+}
+
+func TestResolveHostAliasConflicts(t *testing.T) {
+	services := []Service{
+		{Name: "service-a", HostAliases: []string{"api.example.com", "service-b"}},
+		{Name: "service-b", HostAliases: []string{"API.example.com"}, Priority: 1},
+	}
+
+	resolved, conflicts := resolveHostConflicts(services, conflictPolicyPriority)
+	if len(resolved) != 2 || len(conflicts) != 2 {
+		t.Fatalf("unexpected resolution %v %v", resolved, conflicts)
+	}
+
+	vc := buildVulcanConf(resolved)
+	expected := map[string]string{
+		"vcb-byhostheader-service-a": "PathRegexp(`/.*`) && Host(`service-a`)",
+		"vcb-byhostheader-service-b": "PathRegexp(`/.*`) && (Host(`service-b`) || Host(`API.example.com`))",
+	}
+	for name, route := range expected {
+		if actual := vc.FrontEnds[name].Route; actual != route {
+			t.Errorf("route for %s: expected %s but got %s", name, route, actual)
+		}
+	}
+}
+
 func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 	a := Service{
 		Name:           "service-a",
@@ -94,6 +456,7 @@ func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 	vc := buildVulcanConf([]Service{a})
 
 	expected := vulcanConf{
+		services: []string{"service-a"},
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{},
@@ -113,7 +476,7 @@ func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 				BackendID: "vcb-service-a",
 				Route:     "PathRegexp(`/__service-a/.*`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -121,14 +484,14 @@ func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 						Regexp:      "/__service-a(/.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 			},
 			"vcb-health-service-a-srv1": vulcanFrontend{
 				BackendID: "vcb-service-a-srv1",
 				Route:     "Path(`/health/service-a-srv1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -136,18 +499,18 @@ func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 						Regexp:      "/health/service-a-srv1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 				FailoverPredicate: "",
 			},
 			"vcb-service-a-path-regex-bananas": vulcanFrontend{
 				BackendID:         "vcb-service-a",
-				Route:             "PathRegexp(`/bananas/.*`)",
+				Route:             "PathRegexp(`^/bananas/.*`)",
 				Type:              "http",
 				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 			},
 			"vcb-service-a-path-regex-cheese": vulcanFrontend{
 				BackendID:         "vcb-service-a",
-				Route:             "PathRegexp(`/cheese/.*`)",
+				Route:             "PathRegexp(`^/cheese/.*`)",
 				Type:              "http",
 				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 			},
@@ -160,6 +523,351 @@ func TestBuildInvalidServerVulcanConfSingleBackend(t *testing.T) {
 
 }
 
+func TestBuildVulcanConfCustomHealthCheckPath(t *testing.T) {
+	a := Service{
+		Name:             "service-a",
+		HasHealthCheck:   true,
+		HealthCheckPath:  "/healthz",
+		Addresses:        map[string]string{"srv1": "http://host1:80", "srv2": "http://host2:80"},
+		HealthCheckPaths: map[string]string{"srv2": "/status"},
+	}
+
+	vc := buildVulcanConf([]Service{a})
+
+	expected := vulcanFrontend{
+		BackendID: "vcb-service-a-srv1",
+		Route:     "Path(`/health/service-a-srv1/__health`)",
+		Type:      "http",
+		rewrites: []vulcanRewrite{{
+			ID:       "rewrite",
+			Type:     "rewrite",
+			Priority: 1,
+			Middleware: vulcanRewriteMw{
+				Regexp:      "/health/service-a-srv1/__health",
+				Replacement: "/healthz",
+			},
+		}},
+	}
+
+	if actual := vc.FrontEnds["vcb-health-service-a-srv1"]; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("health frontend failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+	if actual := vc.FrontEnds["vcb-health-service-a-srv2"].rewrites[0].Middleware.Replacement; actual != "/status" {
+		t.Errorf("expected the server's own health check path, got %s", actual)
+	}
+}
+
+func TestVulcanConfToEtcdKeysServiceMiddlewares(t *testing.T) {
+	a := Service{
+		Name:         "service-a",
+		Addresses:    map[string]string{"srv1": "http://host1:80"},
+		PathPrefixes: map[string]string{"content": "/content/.*"},
+		Middlewares:  map[string]string{"ratelimit": `{"Id":"ratelimit"}`},
+	}
+
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+
+	for _, fe := range []string{"vcb-byhostheader-service-a", "vcb-internal-service-a", "vcb-service-a-path-regex-content"} {
+		k := "/vulcand/frontends/" + fe + "/middlewares/ratelimit"
+		if keys[k] != `{"Id":"ratelimit"}` {
+			t.Errorf("expected middleware %s, got %q\n", k, keys[k])
+		}
+	}
+	if _, found := keys["/vulcand/frontends/vcb-internal-service-a/middlewares/rewrite"]; !found {
+		t.Error("internal rewrite middleware is missing")
+	}
+
+	a.RateLimit = &rateLimit{Requests: 10, PeriodSeconds: 1, Burst: 2, Variable: "client.ip"}
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+	expected := `{"Id":"ratelimit","Middleware":{"Requests":10,"PeriodSeconds":1,"Burst":2,"Variable":"client.ip"},"Priority":0,"Type":"ratelimit"}`
+	if actual := keys["/vulcand/frontends/vcb-internal-service-a/middlewares/ratelimit"]; actual != expected {
+		t.Errorf("ratelimit middleware failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+
+	a.ConnLimit = &connLimit{Connections: 5, Variable: "request.header.X-Client"}
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+	expected = `{"Id":"connlimit","Middleware":{"Connections":5,"Variable":"request.header.X-Client"},"Priority":0,"Type":"connlimit"}`
+	if actual := keys["/vulcand/frontends/vcb-service-a-path-regex-content/middlewares/connlimit"]; actual != expected {
+		t.Errorf("connlimit middleware failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+
+	a.Headers = &headers{AddRequestHeaders: map[string]string{"X-Request-Id": "{{.Request.Id}}"}, RemoveResponseHeaders: []string{"Server"}}
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+	expected = `{"Id":"headers","Middleware":{"AddRequestHeaders":{"X-Request-Id":"{{.Request.Id}}"},"RemoveResponseHeaders":["Server"]},"Priority":0,"Type":"headers"}`
+	if actual := keys["/vulcand/frontends/vcb-byhostheader-service-a/middlewares/headers"]; actual != expected {
+		t.Errorf("headers middleware failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+
+	a.HasHealthCheck = true
+	a.CircuitBreaker = &circuitBreaker{Condition: "NetworkErrorRatio() > 0.5", Fallback: json.RawMessage(`{"Type":"response"}`)}
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+	expected = `{"Id":"cbreaker","Middleware":{"Condition":"NetworkErrorRatio() > 0.5","Fallback":{"Type":"response"}},"Priority":0,"Type":"cbreaker"}`
+	for _, fe := range []string{"vcb-byhostheader-service-a", "vcb-internal-service-a", "vcb-service-a-path-regex-content"} {
+		if actual := keys["/vulcand/frontends/"+fe+"/middlewares/cbreaker"]; actual != expected {
+			t.Errorf("cbreaker middleware of %s failed. expected and actual are:\n%v\n%v\n", fe, expected, actual)
+		}
+	}
+	if _, found := keys["/vulcand/frontends/vcb-health-service-a-srv1/middlewares/cbreaker"]; found {
+		t.Error("unexpected cbreaker middleware on the health frontend")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	node := &client.Node{Key: "/ft/services/service-a/headers", Dir: true, Nodes: []*client.Node{
+		{Key: "/ft/services/service-a/headers/request-add", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/service-a/headers/request-add/X-Forwarded-Service", Value: "service-a"},
+		}},
+		{Key: "/ft/services/service-a/headers/response-remove", Value: "Server, X-Powered-By"},
+	}}
+	expected := &headers{
+		AddRequestHeaders:     map[string]string{"X-Forwarded-Service": "service-a"},
+		RemoveResponseHeaders: []string{"Server", "X-Powered-By"},
+	}
+	if actual, err := parseHeaders(node); err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %+v, got %+v, %v", expected, actual, err)
+	}
+
+	node.Nodes[1].Value = "Server Name"
+	if _, err := parseHeaders(node); err == nil {
+		t.Error("expected the invalid header name to be rejected")
+	}
+	if _, err := parseHeaders(&client.Node{Key: "/ft/services/service-a/headers", Dir: true}); err == nil {
+		t.Error("expected headers without anything to add or remove to be rejected")
+	}
+}
+
+func TestVulcanConfToEtcdKeysUniqueRewriteIDs(t *testing.T) {
+	rewrite := vulcanRewrite{ID: "rewrite", Type: "rewrite", Priority: 2, Middleware: vulcanRewriteMw{Regexp: "/a", Replacement: "/b"}}
+	keys := vulcanConfToEtcdKeys(vulcanConf{
+		FrontEnds: map[string]vulcanFrontend{
+			"vcb-foo": vulcanFrontend{
+				Type:        "http",
+				BackendID:   "vcb-foo",
+				Route:       "Path(`/`)",
+				rewrites:    []vulcanRewrite{rewrite, rewrite},
+				middlewares: map[string]string{"rewrite-2": `{"Id":"rewrite-2"}`},
+			},
+		},
+	})
+
+	for id, expected := range map[string]string{
+		"rewrite":   `{"Id":"rewrite","Type":"rewrite","Priority":2,"Middleware":{"Regexp":"/a","Replacement":"/b"}}`,
+		"rewrite-2": `{"Id":"rewrite-2"}`,
+		"rewrite-3": `{"Id":"rewrite-3","Type":"rewrite","Priority":2,"Middleware":{"Regexp":"/a","Replacement":"/b"}}`,
+	} {
+		if actual := keys["/vulcand/frontends/vcb-foo/middlewares/"+id]; actual != expected {
+			t.Errorf("middleware %s failed. expected and actual are:\n%v\n%v\n", id, expected, actual)
+		}
+	}
+}
+
+func TestBuildVulcanConfPathMethods(t *testing.T) {
+	a := Service{
+		Name: "service-a",
+		PathPrefixes: map[string]string{
+			"read":  "/content/.*",
+			"write": "/content/.*",
+		},
+		PathMethods: map[string][]string{
+			"read":  []string{"GET", "HEAD"},
+			"write": []string{"POST"},
+		},
+	}
+
+	vc := buildVulcanConf([]Service{a})
+
+	expected := map[string]string{
+		"vcb-service-a-path-regex-read":  "PathRegexp(`^/content/.*`) && (Method(`GET`) || Method(`HEAD`))",
+		"vcb-service-a-path-regex-write": "PathRegexp(`^/content/.*`) && Method(`POST`)",
+	}
+	for name, route := range expected {
+		if actual := vc.FrontEnds[name].Route; actual != route {
+			t.Errorf("route for %s: expected %s but got %s", name, route, actual)
+		}
+	}
+}
+
+func TestServerDrains(t *testing.T) {
+	d := newServerDrains(time.Minute)
+	start := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	services := func(addresses map[string]string) []Service {
+		return []Service{{Name: "service-a", Addresses: addresses}}
+	}
+
+	d.apply(services(map[string]string{"srv1": "http://host1:80", "srv2": "http://host2:80"}), start)
+	if d.next(start) != nil {
+		t.Error("expected nothing to drain")
+	}
+
+	drained := d.apply(services(map[string]string{"srv1": "http://host1:80"}), start.Add(time.Second))
+	if drained[0].Addresses["srv2"] != "http://host2:80" || !drained[0].draining["srv2"] || drained[0].draining["srv1"] {
+		t.Errorf("expected srv2 to be draining, got %+v", drained[0])
+	}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf(drained))
+	if actual := keys["/vulcand/backends/vcb-service-a/servers/srv2"]; actual != `{"url":"http://host2:80","weight":0}` {
+		t.Errorf("expected the draining server to be weighted 0, got %s", actual)
+	}
+	if _, found := keys["/vulcand/backends/vcb-service-a-srv2/backend"]; !found {
+		t.Error("expected the instance backend of the draining server to be kept")
+	}
+	if d.next(start.Add(time.Second)) == nil {
+		t.Error("expected a rebuild to be scheduled when srv2 has drained")
+	}
+
+	still := d.apply(services(map[string]string{"srv1": "http://host1:80"}), start.Add(30*time.Second))
+	if !still[0].draining["srv2"] {
+		t.Errorf("expected srv2 to still be draining, got %+v", still[0])
+	}
+	gone := d.apply(services(map[string]string{"srv1": "http://host1:80"}), start.Add(61*time.Second))
+	if _, found := gone[0].Addresses["srv2"]; found || d.next(start) != nil {
+		t.Errorf("expected srv2 to be removed once drained, got %+v", gone[0])
+	}
+}
+
+func TestMainBackendWeights(t *testing.T) {
+	canaryWeight := 25
+	s := Service{
+		Addresses: map[string]string{
+			"srv1":        "http://host1:80",
+			"srv2":        "http://host2:80",
+			"srv3":        "http://host3:80",
+			"canary-srv1": "http://host4:80",
+		},
+		Weights:      map[string]int{"srv3": 2},
+		CanaryWeight: &canaryWeight,
+	}
+	// the stable servers' weights of 1, 1 and 2 share 75% of the requests
+	expected := map[string]int{"srv1": 3, "srv2": 3, "srv3": 6, "canary-srv1": 4}
+	if actual := s.mainBackendWeights(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+
+	canaryWeight = 0
+	expected = map[string]int{"srv1": 1, "srv2": 1, "srv3": 2}
+	if actual := s.mainBackendWeights(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+
+	s.CanaryWeight = nil
+	expected = map[string]int{"srv1": 0, "srv2": 0, "srv3": 2, "canary-srv1": 0}
+	if actual := s.mainBackendWeights(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+}
+
+func TestBuildVulcanConfMaintenance(t *testing.T) {
+	a := Service{
+		Name:           "service-a",
+		HasHealthCheck: true,
+		Maintenance:    true,
+		Addresses:      map[string]string{"srv1": "http://host1:80"},
+		PathPrefixes:   map[string]string{"content": "/content/.*"},
+		CircuitBreaker: &circuitBreaker{Condition: "NetworkErrorRatio() > 0.5", Fallback: json.RawMessage(`{"Type":"response"}`)},
+	}
+
+	vc := buildVulcanConf([]Service{a})
+	for _, fe := range []string{"vcb-byhostheader-service-a", "vcb-service-a-path-regex-content"} {
+		if _, found := vc.FrontEnds[fe]; found {
+			t.Errorf("expected public frontend %s to be removed", fe)
+		}
+	}
+	for _, fe := range []string{"vcb-internal-service-a", "vcb-health-service-a-srv1"} {
+		if _, found := vc.FrontEnds[fe]; !found {
+			t.Errorf("expected frontend %s to be kept", fe)
+		}
+	}
+
+	maintenanceBackend = "maintenance-page"
+	defer func() { maintenanceBackend = "" }()
+	vc = buildVulcanConf([]Service{a})
+	for _, fe := range []string{"vcb-byhostheader-service-a", "vcb-service-a-path-regex-content"} {
+		if actual := vc.FrontEnds[fe].BackendID; actual != "maintenance-page" {
+			t.Errorf("expected %s to route to the maintenance backend, got %q", fe, actual)
+		}
+		if _, found := vc.FrontEnds[fe].middlewares["cbreaker"]; found {
+			t.Errorf("expected %s not to have the service's circuit breaker", fe)
+		}
+	}
+	if actual := vc.FrontEnds["vcb-internal-service-a"].BackendID; actual != "vcb-service-a" {
+		t.Errorf("expected the internal frontend to route to the service, got %q", actual)
+	}
+}
+
+func TestBuildVulcanConfPathPriorities(t *testing.T) {
+	a := Service{
+		Name:           "service-a",
+		PathPrefixes:   map[string]string{"content": "/content/.*"},
+		PathPriorities: map[string]int{"content": 10},
+	}
+	b := Service{
+		Name:         "service-b",
+		PathPrefixes: map[string]string{"catchall": "/.*"},
+	}
+
+	vc := buildVulcanConf([]Service{a, b})
+
+	expected := map[string]string{
+		"vcb-service-a-path-regex-content":  "PathRegexp(`^/content/.*`)",
+		"vcb-service-b-path-regex-catchall": "PathRegexp(`(?:)^/.*`)",
+	}
+	for name, route := range expected {
+		if actual := vc.FrontEnds[name].Route; actual != route {
+			t.Errorf("route for %s: expected %s but got %s", name, route, actual)
+		}
+	}
+
+	// vulcand tries the routes in reverse lexical order: the paths by priority, and then the host
+	// header frontends, as without priorities
+	a.Addresses = map[string]string{"srv1": "http://host1:80"}
+	b.Addresses = map[string]string{"srv1": "http://host2:80"}
+	vc = buildVulcanConf([]Service{a, b})
+	hostHeader := vc.FrontEnds["vcb-byhostheader-service-a"].Route
+	if !strings.HasPrefix(hostHeader, "PathRegexp(`(?:)(?:)/.*`) && ") {
+		t.Errorf("expected the host header route to sort after every path, got %s", hostHeader)
+	}
+	routes := []string{hostHeader, vc.FrontEnds["vcb-service-b-path-regex-catchall"].Route, vc.FrontEnds["vcb-service-a-path-regex-content"].Route}
+	sort.Sort(sort.Reverse(sort.StringSlice(routes)))
+	if routes[0] != expected["vcb-service-a-path-regex-content"] || routes[1] != expected["vcb-service-b-path-regex-catchall"] || routes[2] != hostHeader {
+		t.Errorf("unexpected order of routes %v", routes)
+	}
+
+	// without priorities the routes are left as they are
+	a.PathPriorities = nil
+	vc = buildVulcanConf([]Service{a, b})
+	if actual := vc.FrontEnds["vcb-service-b-path-regex-catchall"].Route; actual != "PathRegexp(`^/.*`)" {
+		t.Errorf("expected the route to be unchanged without priorities, got %s", actual)
+	}
+	if actual := vc.FrontEnds["vcb-byhostheader-service-a"].Route; !strings.HasPrefix(actual, "PathRegexp(`/.*`) && ") {
+		t.Errorf("expected the host header route to be unchanged without priorities, got %s", actual)
+	}
+}
+
+func TestBuildVulcanConfPathHeaders(t *testing.T) {
+	a := Service{
+		Name: "service-a",
+		PathPrefixes: map[string]string{
+			"v1": "/content/.*",
+			"v2": "/content/.*",
+		},
+		PathHeaders: map[string]headerMatcher{
+			"v1": headerMatcher{Name: "X-Api-Version", Value: "1"},
+			"v2": headerMatcher{Name: "X-Api-Version", Value: "2\\..*", Regexp: true},
+		},
+	}
+
+	vc := buildVulcanConf([]Service{a})
+
+	expected := map[string]string{
+		"vcb-service-a-path-regex-v1": "PathRegexp(`^/content/.*`) && Header(`X-Api-Version`, `1`)",
+		"vcb-service-a-path-regex-v2": "PathRegexp(`^/content/.*`) && HeaderRegexp(`X-Api-Version`, `2\\..*`)",
+	}
+	for name, route := range expected {
+		if actual := vc.FrontEnds[name].Route; actual != route {
+			t.Errorf("route for %s: expected %s but got %s", name, route, actual)
+		}
+	}
+}
+
 func TestBuildVulcanConfSingleBackend(t *testing.T) {
 	a := Service{
 		Name:           "service-a",
@@ -172,21 +880,25 @@ func TestBuildVulcanConfSingleBackend(t *testing.T) {
 		PathHosts: map[string]string{
 			"bananas": "custom-host",
 		},
+		PathFailoverPredicates: map[string]string{
+			"cheese": "IsNetworkError() && Attempts() <= 2",
+		},
 		FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 	}
 
 	vc := buildVulcanConf([]Service{a})
 
 	expected := vulcanConf{
+		services: []string{"service-a"},
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 			"vcb-service-a-srv1": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 		},
@@ -201,7 +913,7 @@ func TestBuildVulcanConfSingleBackend(t *testing.T) {
 				BackendID: "vcb-service-a",
 				Route:     "PathRegexp(`/__service-a/.*`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -209,14 +921,14 @@ func TestBuildVulcanConfSingleBackend(t *testing.T) {
 						Regexp:      "/__service-a(/.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 			},
 			"vcb-health-service-a-srv1": vulcanFrontend{
 				BackendID: "vcb-service-a-srv1",
 				Route:     "Path(`/health/service-a-srv1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -224,20 +936,20 @@ func TestBuildVulcanConfSingleBackend(t *testing.T) {
 						Regexp:      "/health/service-a-srv1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 				FailoverPredicate: "",
 			},
 			"vcb-service-a-path-regex-bananas": vulcanFrontend{
 				BackendID:         "vcb-service-a",
-				Route:             "PathRegexp(`/bananas/.*`) && Host(`custom-host`)",
+				Route:             "PathRegexp(`^/bananas/.*`) && Host(`custom-host`)",
 				Type:              "http",
 				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
 			},
 			"vcb-service-a-path-regex-cheese": vulcanFrontend{
 				BackendID:         "vcb-service-a",
-				Route:             "PathRegexp(`/cheese/.*`)",
+				Route:             "PathRegexp(`^/cheese/.*`)",
 				Type:              "http",
-				FailoverPredicate: "(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1",
+				FailoverPredicate: "IsNetworkError() && Attempts() <= 2",
 			},
 		},
 	}
@@ -248,10 +960,303 @@ func TestBuildVulcanConfSingleBackend(t *testing.T) {
 
 }
 
-func TestApplyVulcanConfigInitial(t *testing.T) {
-	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
-	if err != nil {
-		t.Fatal(err)
+func TestNormalisePathRegex(t *testing.T) {
+	for regex, expected := range map[string]string{
+		"/foo/.*":    "^/foo(/.*)?$",
+		"^/foo/.*":   "^/foo(/.*)?$",
+		"/foo/":      "^/foo/?$",
+		"/foo":       "^/foo",
+		"/":          "^/",
+		"/foo/bar$":  "^/foo/bar$",
+		"/foo/[a-z]": "^/foo/[a-z]",
+	} {
+		if actual := normalisePathRegex(regex); actual != expected {
+			t.Errorf("normalising %s: expected %s but got %s", regex, expected, actual)
+		}
+	}
+
+	for regex, paths := range map[string]map[string]bool{
+		"/foo/.*": {"/foo": true, "/foo/": true, "/foo/bar": true, "/foobar": false, "/foo-admin": false, "/bar/foo/": false},
+		"/foo/":   {"/foo": true, "/foo/": true, "/foo/bar": false, "/foobar": false},
+	} {
+		r := regexp.MustCompile(normalisePathRegex(regex))
+		for path, expected := range paths {
+			if actual := r.MatchString(path); actual != expected {
+				t.Errorf("expected %s normalised to match %s: %t, got %t", regex, path, expected, actual)
+			}
+		}
+	}
+
+	// every path is anchored, and only normalised with path-normalise
+	s := Service{
+		PathPrefixes:  map[string]string{"plain": "/foo/.*", "anchored": "^/foo/.*", "normalised": "/foo/.*"},
+		PathNormalise: map[string]bool{"normalised": true},
+	}
+	for name, expected := range map[string]string{"plain": "^/foo/.*", "anchored": "^/foo/.*", "normalised": "^/foo(/.*)?$"} {
+		if actual := s.pathRegex(name); actual != expected {
+			t.Errorf("path %s: expected %s but got %s", name, expected, actual)
+		}
+	}
+	if regexp.MustCompile(s.pathRegex("plain")).MatchString("/bar/foo/") {
+		t.Error("expected the path regex not to match below another path")
+	}
+}
+
+func TestVulcanConfToEtcdKeysServerWeights(t *testing.T) {
+	keys := vulcanConfToEtcdKeys(vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-service-a": vulcanBackend{
+				Servers: map[string]vulcanServer{
+					"srv1": vulcanServer{URL: "http://host1:80", Weight: 5},
+					"srv2": vulcanServer{URL: "http://host2:80"},
+				},
+			},
+		},
+	})
+
+	expected := map[string]string{
+		"/vulcand/backends/vcb-service-a/backend":      `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
+		"/vulcand/backends/vcb-service-a/servers/srv1": `{"url":"http://host1:80","weight":5}`,
+		"/vulcand/backends/vcb-service-a/servers/srv2": `{"url":"http://host2:80"}`,
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, keys)
+	}
+}
+
+func TestKeyValuesEscaped(t *testing.T) {
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-a": vulcanBackend{Servers: map[string]vulcanServer{"s1": vulcanServer{URL: "http://a:80", Draining: true}}},
+		},
+		FrontEnds: map[string]vulcanFrontend{
+			"vcb-a": vulcanFrontend{
+				Type:              "http",
+				BackendID:         "vcb-a",
+				Route:             `PathRegexp("/a\\.b") && Header("X-Tag", "v")`,
+				FailoverPredicate: `RequestHeader("X-Retry") == "yes"`,
+				rewrites: []vulcanRewrite{{ID: "rewrite", Type: "rewrite", Priority: 1,
+					Middleware: vulcanRewriteMw{Regexp: `/a"(.*)`, Replacement: `\1`}}},
+			},
+		},
+	}
+	keys := vulcanConfToEtcdKeys(vc)
+
+	var frontend struct {
+		Route    string
+		Settings struct{ FailoverPredicate string }
+	}
+	if err := json.Unmarshal([]byte(keys["/vulcand/frontends/vcb-a/frontend"]), &frontend); err != nil {
+		t.Fatalf("invalid frontend value: %v", err)
+	}
+	if frontend.Route != vc.FrontEnds["vcb-a"].Route || frontend.Settings.FailoverPredicate != vc.FrontEnds["vcb-a"].FailoverPredicate {
+		t.Errorf("frontend value not escaped, got %s", keys["/vulcand/frontends/vcb-a/frontend"])
+	}
+	var rewrite struct{ Middleware vulcanRewriteMw }
+	if err := json.Unmarshal([]byte(keys["/vulcand/frontends/vcb-a/middlewares/rewrite"]), &rewrite); err != nil {
+		t.Fatalf("invalid rewrite value: %v", err)
+	}
+	if rewrite.Middleware != vc.FrontEnds["vcb-a"].rewrites[0].Middleware {
+		t.Errorf("rewrite value not escaped, got %s", keys["/vulcand/frontends/vcb-a/middlewares/rewrite"])
+	}
+	if actual := keys["/vulcand/backends/vcb-a/servers/s1"]; actual != `{"url":"http://a:80","weight":0}` {
+		t.Errorf("expected the draining server to be weighted 0, got %s", actual)
+	}
+}
+
+func TestFrontendSettings(t *testing.T) {
+	if _, err := parseFrontendSettings(`{"TrustForwardHeader": "yes"}`); err == nil {
+		t.Error("expected a non-boolean TrustForwardHeader to be rejected")
+	}
+	if _, err := parseFrontendSettings(`{"Bogus": true}`); err == nil {
+		t.Error("expected an unsupported setting to be rejected")
+	}
+
+	settings, err := parseFrontendSettings(`{"Limits": {"MaxBodyBytes": 1024}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultFrontendSettings = map[string]interface{}{"TrustForwardHeader": true}
+	defer func() { defaultFrontendSettings = nil }()
+
+	a := Service{
+		Name:              "service-a",
+		Addresses:         map[string]string{"srv1": "http://host1:80"},
+		FrontendSettings:  settings,
+		FailoverPredicate: "IsNetworkError()",
+	}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+
+	expected := "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\",\"Settings\":{\"FailoverPredicate\":\"IsNetworkError()\",\"Limits\":{\"MaxBodyBytes\":1024},\"TrustForwardHeader\":true}}"
+	if actual := keys["/vulcand/frontends/vcb-byhostheader-service-a/frontend"]; actual != expected {
+		t.Errorf("frontend settings failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+}
+
+func TestStickiness(t *testing.T) {
+	a := Service{
+		Name:           "service-a",
+		HasHealthCheck: true,
+		Addresses:      map[string]string{"srv1": "http://host1:80"},
+		PathPrefixes:   map[string]string{"content": "/content/.*"},
+		StickyCookie:   "vcb-sticky",
+	}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+
+	for _, fe := range []string{"vcb-byhostheader-service-a", "vcb-internal-service-a", "vcb-service-a-path-regex-content"} {
+		if actual := keys["/vulcand/frontends/"+fe+"/frontend"]; !strings.Contains(actual, `"Stickiness":{"CookieName":"vcb-sticky"}`) {
+			t.Errorf("expected %s to be sticky, got %s", fe, actual)
+		}
+	}
+	if actual := keys["/vulcand/frontends/vcb-health-service-a-srv1/frontend"]; strings.Contains(actual, "Stickiness") {
+		t.Errorf("expected the health check frontend not to be sticky, got %s", actual)
+	}
+}
+
+func TestPathStripPrefix(t *testing.T) {
+	a := Service{
+		Name:            "service-a",
+		Addresses:       map[string]string{"srv1": "http://host1:80"},
+		PathPrefixes:    map[string]string{"x": "/products/x/.*", "root": "/.*"},
+		PathStripPrefix: map[string]bool{"x": true, "root": true},
+	}
+	vc := buildVulcanConf([]Service{a})
+
+	expected := []vulcanRewrite{{
+		ID:         "rewrite",
+		Type:       "rewrite",
+		Priority:   1,
+		Middleware: vulcanRewriteMw{Regexp: "/products/x/?(.*)", Replacement: "/$1"},
+	}}
+	if actual := vc.FrontEnds["vcb-service-a-path-regex-x"].rewrites; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected rewrites %v, got %v", expected, actual)
+	}
+	if actual := vc.FrontEnds["vcb-service-a-path-regex-root"].rewrites; len(actual) != 0 {
+		t.Errorf("expected no rewrite for a path without a prefix, got %v", actual)
+	}
+
+	a.PathRewrites = map[string]vulcanRewriteMw{"x": {Regexp: "/products/x/(.*)", Replacement: "/v2/$1"}}
+	vc = buildVulcanConf([]Service{a})
+	expected[0].Middleware = a.PathRewrites["x"]
+	if actual := vc.FrontEnds["vcb-service-a-path-regex-x"].rewrites; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected the path rewrite to replace stripping the prefix, got %v", actual)
+	}
+
+	for pathRegex, expected := range map[string]string{
+		"/products/x/.*":      "/products/x",
+		"^/products/x(/.*)?":  "/products/x",
+		"^/products/x(/.*)?$": "/products/x",
+		"^/products/x/?$":     "/products/x",
+		"/products/x.*":       "/products/x",
+		"/products/x/":        "/products/x",
+		"/.*":                 "",
+	} {
+		if actual := strippedPrefix(pathRegex); actual != expected {
+			t.Errorf("expected the prefix of %s to be %s, got %s", pathRegex, expected, actual)
+		}
+	}
+}
+
+func TestPathHostRegex(t *testing.T) {
+	a := Service{
+		Name:            "service-a",
+		Addresses:       map[string]string{"srv1": "http://host1:80"},
+		PathPrefixes:    map[string]string{"content": "/content/.*"},
+		PathHostRegexes: map[string]string{"content": `.*\.example\.com`},
+	}
+	vc := buildVulcanConf([]Service{a})
+	expected := "PathRegexp(`^/content/.*`) && HostRegexp(`.*\\.example\\.com`)"
+	if actual := vc.FrontEnds["vcb-service-a-path-regex-content"].Route; actual != expected {
+		t.Errorf("expected route %s, got %s", expected, actual)
+	}
+}
+
+func TestFrontendType(t *testing.T) {
+	node := &client.Node{Key: "/ft/services/notifications-push", Dir: true, Nodes: []*client.Node{
+		{Key: "/ft/services/notifications-push/healthcheck", Value: "true"},
+		{Key: "/ft/services/notifications-push/frontend-type", Value: "websocket"},
+		{Key: "/ft/services/notifications-push/servers", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/notifications-push/servers/srv1", Value: "http://host1:80"},
+		}},
+		{Key: "/ft/services/notifications-push/path-regex", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/notifications-push/path-regex/push", Value: "/content/notifications-push"},
+		}},
+	}}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{parseService(node)}))
+
+	for _, fe := range []string{"vcb-byhostheader-notifications-push", "vcb-internal-notifications-push", "vcb-notifications-push-path-regex-push"} {
+		if actual := keys["/vulcand/frontends/"+fe+"/frontend"]; !strings.Contains(actual, `"Type":"websocket"`) {
+			t.Errorf("expected %s to be a websocket frontend, got %s", fe, actual)
+		}
+	}
+	if actual := keys["/vulcand/frontends/vcb-health-notifications-push-srv1/frontend"]; !strings.Contains(actual, `"Type":"http"`) {
+		t.Errorf("expected the health check frontend to stay http, got %s", actual)
+	}
+
+	node.Nodes[1].Value = "Web Socket"
+	if s := parseService(node); s.FrontendType != "" || len(s.problems) != 1 {
+		t.Errorf("expected the invalid frontend-type to be reported, got %+v", s)
+	}
+}
+
+func TestBackendSettings(t *testing.T) {
+	if _, err := parseBackendSettings(`{"Bogus": {}}`); err == nil {
+		t.Error("expected unknown setting to be rejected")
+	}
+	if _, err := parseBackendSettings(`{"Timeouts": "10s"}`); err == nil {
+		t.Error("expected non-object setting to be rejected")
+	}
+
+	settings, err := parseBackendSettings(`{"Timeouts": {"Read": "10s"}, "KeepAlive": {"Period": "60s"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{{
+		Name:            "service-a",
+		Addresses:       map[string]string{"srv1": "http://host1:80"},
+		BackendSettings: settings,
+	}}))
+
+	expected := `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"60s"},"Timeouts":{"Read":"10s"}}}`
+	for _, k := range []string{"/vulcand/backends/vcb-service-a/backend", "/vulcand/backends/vcb-service-a-srv1/backend"} {
+		if keys[k] != expected {
+			t.Errorf("%s: expected and actual are \n%v\n%v\n", k, expected, keys[k])
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"Timeouts": {"Read": "soon"}}`,
+		`{"Timeouts": {"Read": 10}}`,
+		`{"Timeouts": {"Bogus": "10s"}}`,
+		`{"KeepAlive": {"MaxIdleConnsPerHost": 1.5}}`,
+	} {
+		if _, err := parseBackendSettings(invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+
+	// the configured defaults are merged over the built in ones, and under the service's
+	configuredBackendSettings, err = parseBackendSettings(`{"Timeouts": {"Read": "30s", "Dial": "5s"}, "KeepAlive": {"MaxIdleConnsPerHost": 64}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configuredBackendSettings = nil }()
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{{
+		Name:            "service-a",
+		Addresses:       map[string]string{"srv1": "http://host1:80"},
+		BackendSettings: settings,
+	}}))
+	expected = `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":64,"Period":"60s"},"Timeouts":{"Dial":"5s","Read":"10s"}}}`
+	if actual := keys["/vulcand/backends/vcb-service-a/backend"]; actual != expected {
+		t.Errorf("expected and actual are \n%v\n%v\n", expected, actual)
+	}
+}
+
+func TestApplyVulcanConfigInitial(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
 	}
 	kapi := client.NewKeysAPI(etcd)
 
@@ -277,12 +1282,12 @@ func TestApplyVulcanConfigRemoval(t *testing.T) {
 	if err := setValues(kapi, map[string]string{
 		"/vulcand/backends/foo/backend":                  `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
 		"/vulcand/backends/foo/servers/s1":               `{"url":"http://host1.baz.com:12345"}`,
-		"/vulcand/backends/vcb-foo/backend":              `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-foo/backend":              `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-foo/servers/s1":           `{"url":"http://host1.baz.com:12345"}`,
 		"/vulcand/frontends/foo/frontend":                `{"Type":"http", "BackendId":"foo", "Route":"Path(\"foo-b\")"}`,
 		"/vulcand/frontends/foo/middlewares/rewrite":     `{"Id":"rewrite", "Type":"rewrite", "Priority":1, "Middleware": {"Regexp":"/foo/(.*)", "Replacement":"$1"}}`,
 		"/vulcand/frontends/vcb-foo/frontend":            `{"Type":"http", "BackendId":"vcb-foo", "Route":"Path(\"foo-a\")"}`,
-		"/vulcand/frontends/vcb-foo/middlewares/rewrite": `{"Id":"rewrite", "Type":"rewrite", "Priority":1, "Middleware": {"Regexp":"/foo/(.*)", "Replacement":"$1"}}`,
+		"/vulcand/frontends/vcb-foo/middlewares/rewrite": `{"Id":"rewrite","Type":"rewrite","Priority":1,"Middleware":{"Regexp":"/foo/(.*)","Replacement":"$1"}}`,
 	}); err != nil {
 		t.Error(err)
 	}
@@ -321,12 +1326,12 @@ func TestApplyVulcanConfigCreate(t *testing.T) {
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 			"vcb-service-a-srv1": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 		},
@@ -340,7 +1345,7 @@ func TestApplyVulcanConfigCreate(t *testing.T) {
 				BackendID: "vcb-service-a-srv1",
 				Route:     "Path(`/health/service-a-srv1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -348,7 +1353,7 @@ func TestApplyVulcanConfigCreate(t *testing.T) {
 						Regexp:      "/health/service-a-srv1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 			},
 			"vcb-service-a-path-regex-bananas": vulcanFrontend{
 				BackendID: "vcb-service-a",
@@ -372,15 +1377,15 @@ func TestApplyVulcanConfigCreate(t *testing.T) {
 	}
 
 	expected := map[string]string{
-		"/vulcand/backends/vcb-service-a/backend":                          `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a/backend":                          `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a/servers/srv1":                     `{"url":"http://host1:80"}`,
-		"/vulcand/backends/vcb-service-a-srv1/backend":                     `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a-srv1/backend":                     `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a-srv1/servers/srv1":                `{"url":"http://host1:80"}`,
-		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":           "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-srv1/frontend":            "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a-srv1\", \"Route\":\"Path(`/health/service-a-srv1/__health`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-srv1/middlewares/rewrite": `{"Id":"rewrite", "Type":"rewrite", "Priority":1, "Middleware": {"Regexp":"/health/service-a-srv1(.*)", "Replacement":"$1"}}`,
-		"/vulcand/frontends/vcb-service-a-path-regex-bananas/frontend":     "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/bananas/.*`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-service-a-path-regex-toast/frontend":       "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/toast/.*`)\", \"Settings\": {\"FailoverPredicate\":\"(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1\"}}",
+		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":           "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-srv1/frontend":            "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a-srv1\",\"Route\":\"Path(`/health/service-a-srv1/__health`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-srv1/middlewares/rewrite": `{"Id":"rewrite","Type":"rewrite","Priority":1,"Middleware":{"Regexp":"/health/service-a-srv1(.*)","Replacement":"$1"}}`,
+		"/vulcand/frontends/vcb-service-a-path-regex-bananas/frontend":     "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/bananas/.*`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-service-a-path-regex-toast/frontend":       "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/toast/.*`)\",\"Settings\":{\"FailoverPredicate\":\"(IsNetworkError() || ResponseCode() == 503 || ResponseCode() == 500) && Attempts() <= 1\"}}",
 	}
 
 	if !reflect.DeepEqual(expected, values) {
@@ -404,12 +1409,12 @@ func TestApplyVulcanConfigReplaceIdentical(t *testing.T) {
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"s1": vulcanServer{"http://hostz:1"},
+					"s1": vulcanServer{URL: "http://hostz:1"},
 				},
 			},
 			"vcb-service-a-s1": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"s1": vulcanServer{"http://hostz:1"},
+					"s1": vulcanServer{URL: "http://hostz:1"},
 				},
 			},
 		},
@@ -423,7 +1428,7 @@ func TestApplyVulcanConfigReplaceIdentical(t *testing.T) {
 				BackendID: "vcb-service-a-s1",
 				Route:     "Path(`/health/service-a-s1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -431,7 +1436,7 @@ func TestApplyVulcanConfigReplaceIdentical(t *testing.T) {
 						Regexp:      "/health/service-a-s1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 			},
 			"vcb-service-a-path-regex-toast1": vulcanFrontend{
 				BackendID: "vcb-service-a",
@@ -452,14 +1457,14 @@ func TestApplyVulcanConfigReplaceIdentical(t *testing.T) {
 	}
 
 	expected := map[string]string{
-		"/vulcand/backends/vcb-service-a/backend":                        `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a/backend":                        `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a/servers/s1":                     `{"url":"http://hostz:1"}`,
-		"/vulcand/backends/vcb-service-a-s1/backend":                     `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a-s1/backend":                     `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a-s1/servers/s1":                  `{"url":"http://hostz:1"}`,
-		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":         "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-s1/frontend":            "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a-s1\", \"Route\":\"Path(`/health/service-a-s1/__health`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-s1/middlewares/rewrite": `{"Id":"rewrite", "Type":"rewrite", "Priority":1, "Middleware": {"Regexp":"/health/service-a-s1(.*)", "Replacement":"$1"}}`,
-		"/vulcand/frontends/vcb-service-a-path-regex-toast1/frontend":    "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/toast1/.*`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":         "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-s1/frontend":            "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a-s1\",\"Route\":\"Path(`/health/service-a-s1/__health`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-s1/middlewares/rewrite": `{"Id":"rewrite","Type":"rewrite","Priority":1,"Middleware":{"Regexp":"/health/service-a-s1(.*)","Replacement":"$1"}}`,
+		"/vulcand/frontends/vcb-service-a-path-regex-toast1/frontend":    "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/toast1/.*`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
 	}
 
 	if !reflect.DeepEqual(expected, values) {
@@ -482,12 +1487,12 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 			"vcb-service-a-srv1": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"srv1": vulcanServer{"http://host1:80"},
+					"srv1": vulcanServer{URL: "http://host1:80"},
 				},
 			},
 		},
@@ -501,7 +1506,7 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 				BackendID: "vcb-service-a-srv1",
 				Route:     "Path(`/health/service-a-srv1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -509,7 +1514,7 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 						Regexp:      "/health/service-a-srv1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 			},
 			"vcb-service-a-path-regex-bananas": vulcanFrontend{
 				BackendID: "vcb-service-a",
@@ -528,12 +1533,12 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 		Backends: map[string]vulcanBackend{
 			"vcb-service-a": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"s1": vulcanServer{"http://hostz:1"},
+					"s1": vulcanServer{URL: "http://hostz:1"},
 				},
 			},
 			"vcb-service-a-s1": vulcanBackend{
 				Servers: map[string]vulcanServer{
-					"s1": vulcanServer{"http://hostz:1"},
+					"s1": vulcanServer{URL: "http://hostz:1"},
 				},
 			},
 		},
@@ -547,7 +1552,7 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 				BackendID: "vcb-service-a-s1",
 				Route:     "Path(`/health/service-a-s1/__health`)",
 				Type:      "http",
-				rewrite: vulcanRewrite{
+				rewrites: []vulcanRewrite{{
 					ID:       "rewrite",
 					Type:     "rewrite",
 					Priority: 1,
@@ -555,7 +1560,7 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 						Regexp:      "/health/service-a-s1(.*)",
 						Replacement: "$1",
 					},
-				},
+				}},
 			},
 			"vcb-service-a-path-regex-toast1": vulcanFrontend{
 				BackendID: "vcb-service-a",
@@ -571,14 +1576,14 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 	}
 
 	expected := map[string]string{
-		"/vulcand/backends/vcb-service-a/backend":                        `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a/backend":                        `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a/servers/s1":                     `{"url":"http://hostz:1"}`,
-		"/vulcand/backends/vcb-service-a-s1/backend":                     `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`,
+		"/vulcand/backends/vcb-service-a-s1/backend":                     `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
 		"/vulcand/backends/vcb-service-a-s1/servers/s1":                  `{"url":"http://hostz:1"}`,
-		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":         "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-s1/frontend":            "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a-s1\", \"Route\":\"Path(`/health/service-a-s1/__health`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
-		"/vulcand/frontends/vcb-health-service-a-s1/middlewares/rewrite": `{"Id":"rewrite", "Type":"rewrite", "Priority":1, "Middleware": {"Regexp":"/health/service-a-s1(.*)", "Replacement":"$1"}}`,
-		"/vulcand/frontends/vcb-service-a-path-regex-toast1/frontend":    "{\"Type\":\"http\", \"BackendId\":\"vcb-service-a\", \"Route\":\"PathRegexp(`/toast1/.*`)\", \"Settings\": {\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-byhostheader-service-a/frontend":         "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/.*`) && Host(`service-a`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-s1/frontend":            "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a-s1\",\"Route\":\"Path(`/health/service-a-s1/__health`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
+		"/vulcand/frontends/vcb-health-service-a-s1/middlewares/rewrite": `{"Id":"rewrite","Type":"rewrite","Priority":1,"Middleware":{"Regexp":"/health/service-a-s1(.*)","Replacement":"$1"}}`,
+		"/vulcand/frontends/vcb-service-a-path-regex-toast1/frontend":    "{\"Type\":\"http\",\"BackendId\":\"vcb-service-a\",\"Route\":\"PathRegexp(`/toast1/.*`)\",\"Settings\":{\"FailoverPredicate\":\"\"}}",
 	}
 
 	if !reflect.DeepEqual(expected, values) {
@@ -586,6 +1591,3003 @@ func TestApplyVulcanConfigReplace(t *testing.T) {
 	}
 }
 
+func TestPostApplyWebhookReceivesChanges(t *testing.T) {
+	received := make(chan []keyChange, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var changes []keyChange
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			t.Error(err)
+		}
+		received <- changes
+	}))
+	defer srv.Close()
+
+	changes := []keyChange{
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", NewValue: "{}"},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-bar/frontend", OldValue: "{}"},
+	}
+	newPostApplyHooks("", srv.URL).run(changes)
+
+	select {
+	case actual := <-received:
+		if !reflect.DeepEqual(changes, actual) {
+			t.Errorf("fail. expected and actual are \n%v\n%v\n", changes, actual)
+		}
+	default:
+		t.Error("webhook was not called")
+	}
+}
+
+func TestNotificationWebhooks(t *testing.T) {
+	received := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	changes := []keyChange{
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/servers/s1", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand/backends/vcb-baz/servers/s2", OldValue: "{}", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand-eu/frontends/vcb-foo/frontend", OldValue: "{}", NewValue: "{}"},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-bar/middlewares/rewrite", OldValue: "{}"},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-bar/frontend", OldValue: "{}"},
+	}
+	h := newPostApplyHooks("", "")
+	h.notify = []string{srv.URL + "/notify"}
+	h.slack = []string{srv.URL + "/slack"}
+	h.run(changes)
+
+	var summary routingSummary
+	if err := json.Unmarshal(received["/notify"], &summary); err != nil {
+		t.Fatal(err)
+	}
+	expected := routingSummary{
+		Changes: 6,
+		Created: routingChange{Backends: []string{"vcb-foo"}},
+		Updated: routingChange{Frontends: []string{"vcb-foo"}, Backends: []string{"vcb-baz"}},
+		Deleted: routingChange{Frontends: []string{"vcb-bar"}},
+	}
+	if !reflect.DeepEqual(expected, summary) {
+		t.Errorf("fail. expected and actual are \n%+v\n%+v\n", expected, summary)
+	}
+	var message struct{ Text string }
+	json.Unmarshal(received["/slack"], &message)
+	if message.Text != "vcb applied 6 changes: created backends vcb-foo; updated frontends vcb-foo; updated backends vcb-baz; deleted frontends vcb-bar" {
+		t.Errorf("unexpected slack message %q", message.Text)
+	}
+
+	received = make(map[string][]byte)
+	h.run([]keyChange{{Action: "set", Key: "/vulcand/hosts/foo.com/host", NewValue: "{}"}})
+	if len(received) != 0 {
+		t.Errorf("expected no notification when only hosts changed, got %v", received)
+	}
+}
+
+func TestHealthHandlerReportsFailedKeys(t *testing.T) {
+	status := &applyStatus{}
+	failures := []keyFailure{{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", Error: "timeout"}}
+	status.update(applyError{failures})
+
+	rec := httptest.NewRecorder()
+	healthHandler(status)(rec, httptest.NewRequest("GET", "/__health", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	var h healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.OK || !reflect.DeepEqual(failures, h.FailedKeys) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", failures, h.FailedKeys)
+	}
+
+	status.update(nil)
+	rec = httptest.NewRecorder()
+	healthHandler(status)(rec, httptest.NewRequest("GET", "/__health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestBuildInfoHandler(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "abc123", "2026-10-16T14:32:00Z"
+
+	rec := httptest.NewRecorder()
+	publicMux(&applyStatus{}).ServeHTTP(rec, httptest.NewRequest("GET", "/__build-info", nil))
+	var info buildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.4.0" || info.Commit != "abc123" || info.BuildDate != "2026-10-16T14:32:00Z" || info.GoVersion == "" {
+		t.Errorf("unexpected build info %+v", info)
+	}
+	if s := info.String(); !strings.HasPrefix(s, "vulcan-config-builder 1.4.0 commit abc123 built 2026-10-16T14:32:00Z with go") {
+		t.Errorf("unexpected version %s", s)
+	}
+}
+
+func TestGTGHandler(t *testing.T) {
+	etcdErr := errors.New("connection refused")
+	status := &applyStatus{etcd: func() error { return etcdErr }}
+
+	gtg := func() int {
+		rec := httptest.NewRecorder()
+		publicMux(status).ServeHTTP(rec, httptest.NewRequest("GET", "/__gtg", nil))
+		return rec.Code
+	}
+	status.update(nil)
+	if code := gtg(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready without etcd, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	healthHandler(status)(rec, httptest.NewRequest("GET", "/__health", nil))
+	var h healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || h.Etcd != "connection refused" {
+		t.Errorf("expected the health check to report etcd, got %d %+v", rec.Code, h)
+	}
+
+	etcdErr = nil
+	status = &applyStatus{etcd: status.etcd}
+	if code := gtg(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready before the first apply, got %d", code)
+	}
+	status.update(errors.New("staging smoke verification failed"))
+	if code := gtg(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready after a failed apply, got %d", code)
+	}
+	status.update(nil)
+	if code := gtg(); code != http.StatusOK {
+		t.Errorf("expected to be ready once an apply succeeded, got %d", code)
+	}
+	// a later failure is reported by the health check, but doesn't make vcb unready
+	status.update(applyError{[]keyFailure{{Action: "set", Key: "/vulcand/backends/vcb-foo/backend"}}})
+	if code := gtg(); code != http.StatusOK {
+		t.Errorf("expected to stay ready after a later failure, got %d", code)
+	}
+}
+
+func TestFailureLimit(t *testing.T) {
+	status := &applyStatus{failureLimit: 2}
+	failed := applyError{[]keyFailure{{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", Error: "timeout"}}}
+
+	status.update(nil)
+	status.update(failed)
+	if err := status.ready(); err != nil {
+		t.Errorf("expected to stay ready below the failure limit, got %v", err)
+	}
+	if n, tooOften := status.failedTooOften(); n != 1 || tooOften {
+		t.Errorf("expected 1 failed apply within the limit, got %d %t", n, tooOften)
+	}
+	total := appliesFailed.Value()
+	status.update(errors.New("staging smoke verification failed"))
+	if err := status.ready(); err == nil || err.Error() != "the last 2 applies failed" {
+		t.Errorf("expected not to be ready at the failure limit, got %v", err)
+	}
+	if h := status.health(); h.ConsecutiveFailures != 2 {
+		t.Errorf("expected the health check to report 2 consecutive failures, got %+v", h)
+	}
+	if appliesFailed.Value() != total+1 || appliesFailedConsecutive.Value() != 2 || applyFailedKeysLast.Value() != 0 {
+		t.Errorf("unexpected metrics %s %s %s", appliesFailed, appliesFailedConsecutive, applyFailedKeysLast)
+	}
+
+	status.update(nil)
+	if err := status.ready(); err != nil {
+		t.Errorf("expected to be ready again once an apply succeeded, got %v", err)
+	}
+	if n, _ := status.failedTooOften(); n != 0 || appliesFailedConsecutive.Value() != 0 {
+		t.Errorf("expected the consecutive failures to be reset, got %d", n)
+	}
+}
+
+func TestApplyWatchdog(t *testing.T) {
+	alerts := make(chan watchdogAlert, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a watchdogAlert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		alerts <- a
+	}))
+	defer server.Close()
+
+	d := newApplyWatchdog(time.Minute, server.URL)
+	status := &applyStatus{watchdog: d}
+	start := time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)
+	if err := d.check(start.Add(time.Hour)); err != nil {
+		t.Errorf("expected no changes not to be stale, got %v", err)
+	}
+	d.notified(start)
+	d.notified(start.Add(30 * time.Second))
+	if err := d.check(start.Add(time.Minute)); err != nil {
+		t.Errorf("expected a change within the window not to be stale, got %v", err)
+	}
+	// an apply started before the change doesn't apply it
+	d.applied(start.Add(-time.Second))
+	err := d.check(start.Add(2 * time.Minute))
+	if err == nil || err.Error() != "no apply has succeeded since a change 2m0s ago" || configStale.Value() != 1 {
+		t.Errorf("expected the configuration to be stale, got %v", err)
+	}
+	d.check(start.Add(3 * time.Minute))
+	if len(alerts) != 1 {
+		t.Fatalf("expected one alert, got %d", len(alerts))
+	}
+	if a := <-alerts; !a.PendingSince.Equal(start) || a.Window != "1m0s" || !strings.Contains(a.Text, "stale") {
+		t.Errorf("unexpected alert %+v", a)
+	}
+
+	d.Lock()
+	d.pending = time.Now().Add(-2 * time.Minute)
+	d.Unlock()
+	if h := status.health(); h.OK || !strings.HasPrefix(h.Stale, "no apply has succeeded") {
+		t.Errorf("expected the health check to report the stale configuration, got %+v", h)
+	}
+	d.applied(time.Now())
+	if h := status.health(); !h.OK || h.Stale != "" || configStale.Value() != 0 {
+		t.Errorf("expected the configuration not to be stale once applied, got %+v", h)
+	}
+
+	d.notified(start)
+	d.setActive(func() bool { return false })
+	if err := d.check(start.Add(time.Hour)); err != nil {
+		t.Errorf("expected a standby's configuration not to be stale, got %v", err)
+	}
+}
+
+func TestRebuildHandler(t *testing.T) {
+	rebuilds := newRebuildTrigger()
+	handler := rebuildHandler(rebuilds)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/__rebuild", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a GET to be refused, got %d", rec.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/__rebuild", nil))
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("expected the rebuild to be accepted, got %d", rec.Code)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), "already") {
+		t.Errorf("expected the second request to find a rebuild requested, got %s", rec.Body.String())
+	}
+	select {
+	case <-rebuilds:
+	default:
+		t.Fatal("expected a rebuild to be requested")
+	}
+	select {
+	case <-rebuilds:
+		t.Error("expected only one rebuild to be requested")
+	default:
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	latest := &latestConfig{}
+	rec := httptest.NewRecorder()
+	configHandler(latest)(rec, httptest.NewRequest("GET", "/__config", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 before the first rebuild, got %d", rec.Code)
+	}
+
+	services := []Service{{Name: "service-a", HasHealthCheck: true, Addresses: map[string]string{"srv1": "http://host1:80"}}}
+	latest.set(buildVulcanConf(services), []string{"service-a", "service-b"}, time.Now())
+	rec = httptest.NewRecorder()
+	configHandler(latest)(rec, httptest.NewRequest("GET", "/__config", nil))
+	var config desiredConfig
+	if err := json.NewDecoder(rec.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	a := config.Services["service-a"]
+	var server struct{ URL string }
+	if a.Backends["vcb-service-a"] != nil {
+		json.Unmarshal(a.Backends["vcb-service-a"].Servers["srv1"], &server)
+	}
+	if server.URL != "http://host1:80" {
+		t.Errorf("expected the backend and its server, got %+v", a.Backends)
+	}
+	health := a.Frontends["vcb-health-service-a-srv1"]
+	if health == nil || len(health.Frontend) == 0 || len(health.Middlewares["rewrite"]) == 0 {
+		t.Errorf("expected the health check frontend and its rewrite, got %+v", a.Frontends)
+	}
+	if b, found := config.Services["service-b"]; !found || len(b.Frontends) != 0 {
+		t.Errorf("expected service-b to be listed without frontends, got %+v", config.Services)
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	production := func() (client.KeysAPI, error) { return kapi, nil }
+
+	latest := &latestConfig{}
+	rec := httptest.NewRecorder()
+	diffHandler(latest, production, nil)(rec, httptest.NewRequest("GET", "/__diff", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 before the first rebuild, got %d", rec.Code)
+	}
+
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80", "srv2": "http://host2:80"}}})
+	keys := vulcanConfToEtcdKeys(vc)
+	delete(keys, "/vulcand/backends/vcb-service-a/servers/srv2")
+	keys["/vulcand/backends/vcb-service-a/servers/srv1"] = `{"url":"http://other:80"}`
+	keys["/vulcand/backends/vcb-gone/backend"] = `{"Type":"http"}`
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	latest.set(vc, []string{"service-a"}, time.Now())
+	rec = httptest.NewRecorder()
+	diffHandler(latest, production, nil)(rec, httptest.NewRequest("GET", "/__diff", nil))
+	var d keyDiff
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := d.Missing["/vulcand/backends/vcb-service-a/servers/srv2"]; !found || len(d.Missing) != 1 {
+		t.Errorf("expected the removed server to be missing, got %v", d.Missing)
+	}
+	if _, found := d.Extra["/vulcand/backends/vcb-gone/backend"]; !found || len(d.Extra) != 1 {
+		t.Errorf("expected the unwanted backend to be extra, got %v", d.Extra)
+	}
+	if v := d.Differing["/vulcand/backends/vcb-service-a/servers/srv1"]; v.Actual != `{"url":"http://other:80"}` || len(d.Differing) != 1 {
+		t.Errorf("expected the changed server to differ, got %v", d.Differing)
+	}
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, vulcanConfToEtcdKeys(vc)); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := diffConf(kapi, vc); err != nil || !d.empty() {
+		t.Errorf("expected no differences once the configuration is applied, got %+v, %v", d, err)
+	}
+}
+
+func TestPrintKeyDiff(t *testing.T) {
+	var b bytes.Buffer
+	if err := printKeyDiff(&b, keyDiff{}); err != nil || b.Len() != 0 {
+		t.Fatalf("expected nothing printed without differences, got %q, %v", b.String(), err)
+	}
+	d := keyDiff{
+		Missing:   map[string]string{"/vulcand/backends/b2/backend": `{"Type":"http"}`},
+		Extra:     map[string]string{"/vulcand/backends/b1/servers/srv2": `{"URL":"http://host2:80"}`},
+		Differing: map[string]valueDiff{"/vulcand/backends/b1/servers/srv1": {Desired: `{"URL":"http://host1:8080"}`, Actual: `{"URL":"http://host1:80"}`}},
+	}
+	if err := printKeyDiff(&b, d); err != nil {
+		t.Fatal(err)
+	}
+	expected := `--- vulcand
++++ generated
+-/vulcand/backends/b1/servers/srv1 {"URL":"http://host1:80"}
++/vulcand/backends/b1/servers/srv1 {"URL":"http://host1:8080"}
+-/vulcand/backends/b1/servers/srv2 {"URL":"http://host2:80"}
++/vulcand/backends/b2/backend {"Type":"http"}
+`
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
+func TestErrorReporter(t *testing.T) {
+	var events []errorEvent
+	var auth, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, path = r.Header.Get("X-Sentry-Auth"), r.URL.Path
+		var event errorEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	if _, err := newErrorReporter(strings.Replace(server.URL, "//", "//key@", 1), 3); err == nil {
+		t.Errorf("expected a DSN without a project to be refused")
+	}
+	reporter, err := newErrorReporter(strings.Replace(server.URL, "//", "//key@", 1)+"/sentry/42", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := applyError{[]keyFailure{{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", Error: "timeout"}}}
+	for _, err := range []error{failure, failure, nil, failure, failure, failure, failure} {
+		reporter.applied(err, 12)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected only the third consecutive failure to be reported, got %+v", events)
+	}
+	if path != "/sentry/api/42/store/" || !strings.Contains(auth, "sentry_key=key") {
+		t.Errorf("unexpected store %s or auth %s", path, auth)
+	}
+	if keys, _ := json.Marshal(events[0].Extra["failedKeys"]); !strings.Contains(string(keys), "vcb-foo") || events[0].Extra["services"] != float64(12) {
+		t.Errorf("expected the failed keys and services to be reported, got %v", events[0].Extra)
+	}
+
+	func() {
+		defer func() { recover() }()
+		defer reporter.recoverPanic()
+		panic("failed to read /vulcand/")
+	}()
+	if len(events) != 2 || events[1].Level != "fatal" || events[1].Message != "panic: failed to read /vulcand/" {
+		t.Errorf("expected the panic to be reported, got %+v", events)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	handler := requireToken("secret", adminMux(&startupConsistency{}, &latestValidation{}))
+
+	for auth, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/__metrics", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("%q: expected status %d but got %d", auth, expected, rec.Code)
+		}
+	}
+}
+
+func TestPprof(t *testing.T) {
+	mux := adminMux(&startupConsistency{}, &latestValidation{})
+	handlePprof(mux)
+	handler := requireToken("secret", mux)
+
+	for auth, expected := range map[string]int{"": http.StatusUnauthorized, "Bearer secret": http.StatusOK} {
+		req := httptest.NewRequest("GET", "/debug/pprof/heap?debug=1", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("%q: expected status %d but got %d", auth, expected, rec.Code)
+		}
+	}
+}
+
+func TestAdminClientCertificates(t *testing.T) {
+	cert, key := testKeyPair(t, "client")
+	caFile, err := ioutil.TempFile("", "vcb-client-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	caFile.WriteString(cert)
+	caFile.Close()
+
+	cfg, err := adminTLSConfig(caFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(adminMux(&startupConsistency{}, &latestValidation{}))
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+
+	if resp, err := server.Client().Get(server.URL + "/__metrics"); err == nil {
+		resp.Body.Close()
+		t.Error("expected a request without a client certificate to be refused")
+	}
+
+	clientCert, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := server.Client()
+	c.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	resp, err := c.Get(server.URL + "/__metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNotifierStopsWatching(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	defer deleteRecursiveIfExists(kapi, "/vcb-test-watch/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newNotifier(ctx, kapi, nil, "/vcb-test-watch/")
+	// the watcher starts in the background, so is notified of one of the changes
+	notified := false
+	for i := 0; i < 20 && !notified; i++ {
+		setValues(kapi, map[string]string{"/vcb-test-watch/key": strconv.Itoa(i)})
+		select {
+		case <-w.notify():
+			notified = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if !notified {
+		t.Fatal("expected a change to be notified while watching")
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	drainChannel(w.notify())
+	setValues(kapi, map[string]string{"/vcb-test-watch/key": "stopped"})
+	select {
+	case <-w.notify():
+		t.Error("expected no change to be notified once the watcher is stopped")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	recent := newRecentApplies(3)
+	started := time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		recent.record(rebuildRecord{
+			ID:      newRebuildID(started.Add(time.Duration(i) * time.Minute)),
+			Started: started.Add(time.Duration(i) * time.Minute),
+			Changes: []keyChange{{Action: "set", Key: "/vulcand/hosts/foo.com/host", NewValue: `{"Name":"foo.com","Settings":{"KeyPair":{"Cert":"cert","Key":"secret"}}}`}},
+		})
+	}
+
+	get := func(url string) (int, []recentApply) {
+		rec := httptest.NewRecorder()
+		historyHandler(recent)(rec, httptest.NewRequest("GET", url, nil))
+		var applies []recentApply
+		json.NewDecoder(rec.Body).Decode(&applies)
+		return rec.Code, applies
+	}
+
+	_, applies := get("/__history")
+	if len(applies) != 3 || applies[0].ID != "20261016T140400.000Z" || applies[2].ID != "20261016T140200.000Z" {
+		t.Errorf("expected the 3 most recent applies, newest first, got %+v", applies)
+	}
+	if strings.Contains(applies[0].Changes[0].NewValue, "secret") {
+		t.Errorf("expected the private key to be redacted, got %s", applies[0].Changes[0].NewValue)
+	}
+	if _, applies := get("/__history?since=2026-10-16T14:03:00Z"); len(applies) != 1 {
+		t.Errorf("expected the applies started after 14:03, got %+v", applies)
+	}
+	if code, _ := get("/__history?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid since to be refused, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	historyHandler(newRecentApplies(3))(rec, httptest.NewRequest("GET", "/__history", nil))
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Errorf("expected no applies before the first, got %s", body)
+	}
+}
+
+// readOnlyKeysAPI fails every write, like an etcd member which has lost quorum.
+type readOnlyKeysAPI struct {
+	client.KeysAPI
+}
+
+func (r readOnlyKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	return nil, errors.New("read only")
+}
+
+func TestReconcileOnce(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})
+	if code := dryRunOnce(kapi, nil, vc, []string{"service-a"}); code != onceChanged {
+		t.Errorf("expected %d from a dry run with changes, got %d", onceChanged, code)
+	}
+	if _, err := kapi.Get(context.Background(), "/vulcand/backends/vcb-service-a/backend", nil); err == nil {
+		t.Error("expected a dry run not to apply the configuration")
+	}
+	if code := reconcileOnce(kapi, kapi, nil, vc, []string{"service-a"}); code != onceChanged {
+		t.Errorf("expected %d once the configuration was applied, got %d", onceChanged, code)
+	}
+	if code := reconcileOnce(kapi, kapi, nil, vc, []string{"service-a"}); code != onceUnchanged {
+		t.Errorf("expected %d when vulcand already has the configuration, got %d", onceUnchanged, code)
+	}
+	if code := dryRunOnce(kapi, nil, vc, []string{"service-a"}); code != onceUnchanged {
+		t.Errorf("expected %d from a dry run without changes, got %d", onceUnchanged, code)
+	}
+
+	if err := setValues(kapi, map[string]string{"/vulcand/backends/vcb-service-a/servers/srv1": `{"url":"http://drifted:80"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if code := reconcileOnce(kapi, readOnlyKeysAPI{kapi}, nil, vc, []string{"service-a"}); code != onceFailed {
+		t.Errorf("expected %d when the drift can't be corrected, got %d", onceFailed, code)
+	}
+	if code := reconcileOnce(kapi, kapi, nil, vc, []string{"service-a"}); code != onceChanged {
+		t.Errorf("expected %d once the drift was corrected, got %d", onceChanged, code)
+	}
+}
+
+func TestApplyVulcanConfigFailFast(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80", "srv2": "http://host2:80"}}})
+	_, err = applyVulcanConf(readOnlyKeysAPI{kapi}, vc)
+	if ae, ok := err.(applyError); !ok || len(ae.Failures) < 2 {
+		t.Errorf("expected a best-effort apply to try every key, got %v", err)
+	}
+
+	vc.failFast = true
+	_, err = applyVulcanConf(readOnlyKeysAPI{kapi}, vc)
+	if ae, ok := err.(applyError); !ok || len(ae.Failures) != 1 {
+		t.Errorf("expected a fail-fast apply to stop at the first failure, got %v", err)
+	}
+	if changes, err := applyVulcanConf(kapi, vc); err != nil || len(changes) == 0 {
+		t.Errorf("expected the retried apply to succeed, got %v, %v", changes, err)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vcb-test-leader/"); err != nil {
+		t.Error(err)
+	}
+	defer deleteRecursiveIfExists(kapi, "/vcb-test-leader/")
+
+	a := newLeaderElection("/vcb-test-leader/leader", 30*time.Second)
+	b := newLeaderElection("/vcb-test-leader/leader", 30*time.Second)
+	b.id = a.id + "-b"
+
+	if !a.campaign(kapi) || b.campaign(kapi) {
+		t.Fatal("expected the first vcb to be elected, and the second to stand by")
+	}
+	// the leader keeps the key
+	if !a.campaign(kapi) || b.campaign(kapi) {
+		t.Error("expected the leader to refresh the key")
+	}
+	resp, err := kapi.Get(context.Background(), "/vcb-test-leader/leader", nil)
+	if err != nil || resp.Node.Value != a.id || resp.Node.TTL <= 0 {
+		t.Errorf("expected the leader to hold the key with a TTL, got %+v, %v", resp, err)
+	}
+
+	select {
+	case <-b.changed:
+		t.Error("expected no change of leadership for the standby")
+	default:
+	}
+	a.resign(kapi)
+	if !b.campaign(kapi) || a.campaign(kapi) {
+		t.Error("expected the standby to take over once the leader resigned")
+	}
+	select {
+	case <-b.changed:
+	default:
+		t.Error("expected the new leader to be notified")
+	}
+}
+
+// unreachableKeysAPI fails every read and write, like an etcd cluster which can't be reached.
+type unreachableKeysAPI struct {
+	client.KeysAPI
+}
+
+func (u unreachableKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	return nil, &client.ClusterError{Errors: []error{errors.New("connection refused")}}
+}
+
+func (u unreachableKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	return nil, &client.ClusterError{Errors: []error{errors.New("connection refused")}}
+}
+
+func (u unreachableKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	return nil, &client.ClusterError{Errors: []error{errors.New("connection refused")}}
+}
+
+func TestLeaderElectionUnreachable(t *testing.T) {
+	e := newLeaderElection("/vcb-test-leader/leader", 30*time.Second)
+	if e.campaign(unreachableKeysAPI{}) {
+		t.Error("expected a standby not to be elected without etcd")
+	}
+
+	e.set(true, time.Now())
+	if !e.campaign(unreachableKeysAPI{}) {
+		t.Error("expected the leader to stay the leader until the key would have expired")
+	}
+	e.set(true, time.Now().Add(-time.Minute))
+	if e.campaign(unreachableKeysAPI{}) || e.isLeader() {
+		t.Error("expected the leader to stand by once the key would have expired")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	defer deleteRecursiveIfExists(kapi, "/vcb-test-heartbeat/")
+
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})
+	other := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host2:80"}}})
+	if configChecksum(vc) != configChecksum(buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})) || configChecksum(vc) == configChecksum(other) {
+		t.Errorf("expected the checksum to identify the configuration")
+	}
+
+	applied := time.Date(2026, 10, 16, 14, 32, 0, 0, time.UTC)
+	writeHeartbeat(kapi, "/vcb-test-heartbeat/last-applied", vc, applied, time.Minute)
+	resp, err := kapi.Get(context.Background(), "/vcb-test-heartbeat/last-applied", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var beat heartbeat
+	if err := json.Unmarshal([]byte(resp.Node.Value), &beat); err != nil {
+		t.Fatal(err)
+	}
+	if !beat.Applied.Equal(applied) || beat.Checksum != configChecksum(vc) || resp.Node.TTL <= 0 {
+		t.Errorf("unexpected heartbeat %s with TTL %d", resp.Node.Value, resp.Node.TTL)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vcb-test-audit/"); err != nil {
+		t.Error(err)
+	}
+	dir, err := ioutil.TempDir("", "vcb-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "audit-2000-01-01.log"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := auditLog{dir: dir, prefix: "/vcb-test-audit/", kapi: kapi, retention: 24 * time.Hour}
+	at := time.Date(2026, 10, 16, 14, 32, 0, 0, time.UTC)
+	a.record("20261016T143200.000Z", at, []keyChange{
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/servers/s1", OldValue: `{"url":"http://old:80"}`, NewValue: `{"url":"http://new:80"}`},
+		{Action: "set", Key: "/vulcand/hosts/foo.com/host", NewValue: `{"Name":"foo.com","Settings":{"KeyPair":{"Cert":"cert","Key":"secret"}}}`},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-gone/frontend", OldValue: "{}"},
+	})
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "audit-2026-10-16.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected an entry per change, got %v", lines)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := auditEntry{Time: at, Rebuild: "20261016T143200.000Z", Action: "set", Key: "/vulcand/backends/vcb-foo/servers/s1", OldValue: `{"url":"http://old:80"}`, NewValue: `{"url":"http://new:80"}`}
+	if !reflect.DeepEqual(expected, entry) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, entry)
+	}
+	if strings.Contains(lines[1], "secret") {
+		t.Errorf("expected the private key to be redacted, got %s", lines[1])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit-2000-01-01.log")); !os.IsNotExist(err) {
+		t.Errorf("expected the audit log older than the retention to be removed, got %v", err)
+	}
+
+	resp, err := kapi.Get(context.Background(), "/vcb-test-audit/", &client.GetOptions{Sort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Node.Nodes) != 3 || resp.Node.Nodes[0].TTL <= 0 || !strings.Contains(resp.Node.Nodes[2].Value, "vcb-gone") {
+		t.Errorf("expected the entries in order under the prefix, expiring, got %v", resp.Node.Nodes)
+	}
+	deleteRecursiveIfExists(kapi, "/vcb-test-audit/")
+}
+
+func TestRebuildHistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcb-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := rebuildHistory{dir: dir, retention: 2}
+	start := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		started := start.Add(time.Duration(i) * time.Minute)
+		h.record(rebuildRecord{
+			ID:      newRebuildID(started),
+			Started: started,
+			Config:  map[string]string{"/vulcand/backends/vcb-foo/backend": "{}"},
+			Changes: []keyChange{{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", NewValue: "{}"}},
+		})
+	}
+
+	ids, err := h.ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"20161101T120100.000Z", "20161101T120200.000Z"}
+	if !reflect.DeepEqual(expected, ids) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, ids)
+	}
+
+	r, err := h.load(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Config["/vulcand/backends/vcb-foo/backend"] != "{}" || len(r.Changes) != 1 {
+		t.Errorf("unexpected rebuild record %v", r)
+	}
+}
+
+func TestOwnerOf(t *testing.T) {
+	services := []string{"foo", "foo-bar", "health"}
+	for name, expected := range map[string]string{
+		"vcb-foo":                  "foo",
+		"vcb-foo-srv1":             "foo",
+		"vcb-foo-bar":              "foo-bar",
+		"vcb-foo-bar-srv1":         "foo-bar",
+		"vcb-byhostheader-foo":     "foo",
+		"vcb-internal-foo-bar":     "foo-bar",
+		"vcb-health-foo-srv1":      "foo",
+		"vcb-health":               "health",
+		"vcb-foo-path-regex-stuff": "foo",
+		"vcb-other":                "",
+	} {
+		if actual := ownerOf(name, services); actual != expected {
+			t.Errorf("owner of %s: expected %q but got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestApplyVulcanConfigLockedService(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/vcb-foo/backend":    `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
+		"/vulcand/backends/vcb-foo/servers/s1": `{"url":"http://old:80"}`,
+	}); err != nil {
+		t.Error(err)
+	}
+
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-foo": vulcanBackend{
+				Servers: map[string]vulcanServer{
+					"s2": vulcanServer{URL: "http://new:80"},
+				},
+			},
+			"vcb-bar": vulcanBackend{
+				Servers: map[string]vulcanServer{
+					"s1": vulcanServer{URL: "http://bar:80"},
+				},
+			},
+		},
+	}
+	vc.frozen = lockedNames(map[string]serviceLock{"foo": serviceLock{Holder: "test"}}, []string{"foo", "bar"})
+
+	applyVulcanConf(kapi, vc)
+
+	values, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := map[string]string{
+		"/vulcand/backends/vcb-foo/backend":    `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
+		"/vulcand/backends/vcb-foo/servers/s1": `{"url":"http://old:80"}`,
+		"/vulcand/backends/vcb-bar/backend":    `{"Type":"http","Settings":{"KeepAlive":{"MaxIdleConnsPerHost":256,"Period":"35s"}}}`,
+		"/vulcand/backends/vcb-bar/servers/s1": `{"url":"http://bar:80"}`,
+	}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, values)
+	}
+}
+
+func TestParseLogLevels(t *testing.T) {
+	levels := parseLogLevels("watcher=warn, applier=DEBUG,bogus,builder=loud")
+	expected := map[string]logLevel{"watcher": levelWarn, "applier": levelDebug}
+	if !reflect.DeepEqual(expected, levels) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, levels)
+	}
+
+	for value, expected := range map[string]logLevel{"": levelInfo, "WARN": levelWarn, " error": levelError, "loud": levelInfo} {
+		if level := parseLogLevel(value); level != expected {
+			t.Errorf("%q: expected level %v, got %v", value, expected, level)
+		}
+	}
+
+	defer func(levels map[string]logLevel, level logLevel) { logLevels, defaultLogLevel = levels, level }(logLevels, defaultLogLevel)
+	logLevels, defaultLogLevel = map[string]logLevel{"applier": levelDebug}, levelWarn
+	if watcherLog.enabled(levelInfo) || !watcherLog.enabled(levelWarn) || !applierLog.enabled(levelDebug) {
+		t.Errorf("expected unconfigured subsystems to log at the default level, and configured ones at theirs")
+	}
+}
+
+type recordingSyslog []string
+
+func (r *recordingSyslog) record(severity, m string) error {
+	*r = append(*r, severity+": "+m)
+	return nil
+}
+
+func (r *recordingSyslog) Debug(m string) error   { return r.record("debug", m) }
+func (r *recordingSyslog) Info(m string) error    { return r.record("info", m) }
+func (r *recordingSyslog) Warning(m string) error { return r.record("warning", m) }
+func (r *recordingSyslog) Err(m string) error     { return r.record("err", m) }
+
+func TestSyslogWriter(t *testing.T) {
+	r := &recordingSyslog{}
+	l := log.New(syslogWriter{r}, "", 0)
+	l.Printf("DEBUG - setting %s\n", "/vulcand/backends/vcb-foo/backend")
+	l.Printf("completed reconfiguration")
+	l.Printf("WARN - The provided VCB_LOG_LEVEL=loud is invalid")
+	l.Printf("ERROR - failed to apply")
+
+	expected := recordingSyslog{
+		"debug: setting /vulcand/backends/vcb-foo/backend",
+		"info: completed reconfiguration",
+		"warning: The provided VCB_LOG_LEVEL=loud is invalid",
+		"err: failed to apply",
+	}
+	if !reflect.DeepEqual(expected, *r) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, *r)
+	}
+
+	for _, address := range []string{"syslog:514", "http://syslog:514", "udp://"} {
+		if err := logToSyslog(address, "vcb"); err == nil {
+			t.Errorf("%s: expected an invalid address to be refused", address)
+		}
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	existing := map[string]string{
+		"/vulcand/backends/vcb-foo/backend":                 "{}",
+		"/vulcand/frontends/vcb-byhostheader-foo/frontend":  "{}",
+		"/vulcand/frontends/vcb-byhostheader-gone/frontend": "{}",
+		"/vulcand/backends/vcb-gone-s1/servers/s1":          "{}",
+		"/vulcand/frontends/manual/frontend":                "{}",
+	}
+
+	report := checkConsistency(existing, []string{"foo", "new"})
+
+	expectedOrphans := []string{"/vulcand/backends/vcb-gone-s1/servers/s1", "/vulcand/frontends/vcb-byhostheader-gone/frontend"}
+	if !reflect.DeepEqual(expectedOrphans, report.OrphanedKeys) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expectedOrphans, report.OrphanedKeys)
+	}
+	if !reflect.DeepEqual([]string{"new"}, report.MissingServices) {
+		t.Errorf("unexpected missing services %v", report.MissingServices)
+	}
+}
+
+func TestUnreadableVulcandFailsTheApply(t *testing.T) {
+	consistency := &startupConsistency{}
+	if err := consistency.check(unreachableKeysAPI{}, []string{"foo"}); err == nil || consistency.get() != nil {
+		t.Errorf("expected the consistency check to fail and be left to the next rebuild, got %v", err)
+	}
+	if _, err := readAllKeysFromEtcd(unreachableKeysAPI{}, "/vulcand/"); err == nil {
+		t.Error("expected reading an unreachable etcd to fail")
+	}
+
+	changes, err := applyVulcanConf(unreachableKeysAPI{}, buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}}))
+	if err == nil || len(changes) != 0 {
+		t.Fatalf("expected the apply to fail without changes, got %v, %v", changes, err)
+	}
+	status := &applyStatus{failureLimit: 1}
+	status.update(err)
+	if failed, tooOften := status.failedTooOften(); failed != 1 || !tooOften {
+		t.Errorf("expected the apply to be counted as failed, got %d", failed)
+	}
+}
+
+func TestReadManagedKeys(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/foo/backend":                  "foo",
+		"/vulcand/backends/vcb-foo/backend":              "vcb-foo",
+		"/vulcand/frontends/vcb-foo/middlewares/rewrite": "rewrite",
+		"/vulcand/hosts/example.com/host":                "host",
+		"/vulcand/hosts/example.com/listeners/https":     "listener",
+		"/vulcand/listeners/http":                        "listener",
+	}); err != nil {
+		t.Error(err)
+	}
+
+	existing, _, err := readManagedKeys(kapi, vulcanConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/vulcand/backends/vcb-foo/backend":              "vcb-foo",
+		"/vulcand/frontends/vcb-foo/middlewares/rewrite": "rewrite",
+	}
+	if !reflect.DeepEqual(expected, existing) {
+		t.Errorf("expected and actual are:\n%v\n%v\n", expected, existing)
+	}
+
+	existing, _, err = readManagedKeys(kapi, vulcanConf{Hosts: map[string]vulcanHost{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing["/vulcand/hosts/example.com/host"] != "host" || len(existing) != 3 {
+		t.Errorf("expected the host keys to be read when hosts are managed, got %v", existing)
+	}
+}
+
+func TestServiceEvents(t *testing.T) {
+	relevant := serviceEvents("/ft/services/")
+	node := func(key, value string) *client.Node {
+		return &client.Node{Key: key, Value: value}
+	}
+
+	tests := []struct {
+		response *client.Response
+		expected bool
+	}{
+		{&client.Response{Action: "set", Node: node("/ft/services/a/servers/srv1", "http://host1:80")}, true},
+		{&client.Response{Action: "set", Node: node("/ft/services/a/servers/srv1", "http://host1:80"), PrevNode: node("/ft/services/a/servers/srv1", "http://host1:80")}, false},
+		{&client.Response{Action: "set", Node: node("/ft/services/a/servers/srv1", "http://host2:80"), PrevNode: node("/ft/services/a/servers/srv1", "http://host1:80")}, true},
+		{&client.Response{Action: "expire", Node: node("/ft/services/a/servers/srv1", ""), PrevNode: node("/ft/services/a/servers/srv1", "http://host1:80")}, true},
+		{&client.Response{Action: "set", Node: node("/ft/services/a/registrator-state", "x")}, false},
+		{&client.Response{Action: "delete", Node: &client.Node{Key: "/ft/services/a", Dir: true}}, true},
+		{nil, true},
+	}
+	for _, test := range tests {
+		if actual := relevant(test.response); actual != test.expected {
+			t.Errorf("expected %v for %+v", test.expected, test.response)
+		}
+	}
+}
+
+func TestParseCleanupRules(t *testing.T) {
+	rules, err := parseCleanupRules("frontends/=middlewares, backends=servers")
+	expected := []cleanupRule{{Dir: "frontends/", Placeholder: "middlewares"}, {Dir: "backends/", Placeholder: "servers"}}
+	if err != nil || !reflect.DeepEqual(expected, rules) {
+		t.Errorf("expected %v, got %v, %v", expected, rules, err)
+	}
+	for _, value := range []string{"", "frontends/", "/ft/services/=servers", "/vulcand/frontends/=middlewares", "/=frontends", "../ft/=servers", "backends/=servers/x"} {
+		if _, err := parseCleanupRules(value); err == nil {
+			t.Errorf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestCleanEmptyEntries(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/vcb-foo/backend":   "{}",
+		"/vulcand/frontends/vcb-foo/frontend": "{}",
+	}); err != nil {
+		t.Error(err)
+	}
+	for _, dir := range []string{"/vulcand/backends/vcb-bar/servers", "/vulcand/frontends/vcb-bar/middlewares"} {
+		if _, err := kapi.Set(context.Background(), dir, "", &client.SetOptions{Dir: true}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the entries left over the limit fail the apply
+	removed, failures := cleanEmptyEntries(kapi, vulcandCleanupRules, 1)
+	if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed over the limit, but removed %v", removed)
+	}
+	if len(failures) != 2 || failures[0].Key != "/vulcand/backends/vcb-bar" || cleanupEntriesLeft.Value() != 2 {
+		t.Errorf("expected the entries left to be failures, got %v and %d left", failures, cleanupEntriesLeft.Value())
+	}
+
+	removed, failures = cleanEmptyEntries(kapi, vulcandCleanupRules, 2)
+	expected := []string{"/vulcand/backends/vcb-bar", "/vulcand/frontends/vcb-bar"}
+	if !reflect.DeepEqual(expected, removed) || len(failures) != 0 || cleanupEntriesLeft.Value() != 0 {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n%v\n", expected, removed, failures)
+	}
+
+	// the rules are relative to the prefix cleaned
+	if err := deleteRecursiveIfExists(kapi, "/vcb-test-cleanup/"); err != nil {
+		t.Error(err)
+	}
+	if _, err := kapi.Set(context.Background(), "/vcb-test-cleanup/backends/vcb-bar/servers", "", &client.SetOptions{Dir: true}); err != nil {
+		t.Error(err)
+	}
+	removed, _ = cleanEmptyEntries(rebasedKeysAPI{KeysAPI: kapi, from: "/vulcand/", to: "/vcb-test-cleanup/"}, vulcandCleanupRules, 0)
+	if !reflect.DeepEqual([]string{"/vulcand/backends/vcb-bar"}, removed) {
+		t.Errorf("expected the entry under the other prefix to be removed, got %v", removed)
+	}
+	if _, err := kapi.Get(context.Background(), "/vcb-test-cleanup/backends/vcb-bar", nil); err == nil {
+		t.Error("expected the entry under the other prefix to be removed")
+	}
+
+	// etcd failing is reported rather than panicking
+	removed, failures = cleanEmptyEntries(unreachableKeysAPI{}, vulcandCleanupRules, 0)
+	if len(removed) != 0 || len(failures) != len(vulcandCleanupRules) || failures[0].Action != "read" {
+		t.Errorf("expected every directory to fail to be read, got %v", failures)
+	}
+
+	// an apply leaving entries over the limit fails
+	defer func(limit int) { cleanupMaxDeletions = limit }(cleanupMaxDeletions)
+	cleanupMaxDeletions = 1
+	for _, dir := range []string{"/vulcand/backends/vcb-bar/servers", "/vulcand/frontends/vcb-bar/middlewares"} {
+		if _, err := kapi.Set(context.Background(), dir, "", &client.SetOptions{Dir: true}); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := applyVulcanConf(kapi, vulcanConf{}); err == nil {
+		t.Error("expected the apply to fail with entries left by the cleanup")
+	}
+}
+
+func TestManagedPrefixOverlap(t *testing.T) {
+	defer func(v string) { managedPrefixValue, managedPrefix = v, defaultManagedPrefix }(managedPrefixValue)
+
+	for value, expected := range map[string]string{
+		"team-b-":     "team-b-",
+		"vcb-team-b-": "vcb-",
+		"vcb-":        "vcb-",
+		"vcbx-":       "vcbx-",
+		"Team-B":      "vcb-",
+	} {
+		managedPrefix = defaultManagedPrefix
+		managedPrefixValue = value
+		configure()
+		if managedPrefix != expected {
+			t.Errorf("expected the prefix %s to give %s, got %s", value, expected, managedPrefix)
+		}
+	}
+
+	// so the default deployment never takes the keys of another as its own
+	managedPrefix = defaultManagedPrefix
+	vc := vulcanConf{}
+	for _, prefix := range []string{"team-b-", "vcbx-"} {
+		if vc.manages("/vulcand/backends/" + prefix + "service-a/backend") {
+			t.Errorf("expected the default prefix not to manage the backends of %s", prefix)
+		}
+	}
+	if !prefixesOverlap("vcb-", "vcb-team-b-") || !prefixesOverlap("team-", "team-b-") || prefixesOverlap("team-a-", "team-b-") {
+		t.Error("unexpected overlap of prefixes")
+	}
+}
+
+func TestPruneOrphans(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/vcb-foo/backend":                 "{}",
+		"/vulcand/backends/vcb-foo-srv1/servers/srv1":       `{"URL":"http://host1:80"}`,
+		"/vulcand/frontends/vcb-internal-foo/frontend":      "{}",
+		"/vulcand/backends/vcb-old-foo/backend":             "{}",
+		"/vulcand/backends/vcb-old-foo/servers/srv1":        `{"URL":"http://host1:80"}`,
+		"/vulcand/frontends/vcb-old-foo/frontend":           "{}",
+		"/vulcand/frontends/vcb-old-foo/middlewares/manual": "{}",
+		"/vulcand/backends/vcb-locked/backend":              "{}",
+		"/vulcand/backends/team-a-bar/backend":              "{}",
+	}); err != nil {
+		t.Error(err)
+	}
+	frozen := func(name string) bool { return name == "vcb-locked" }
+	expected := []string{
+		"/vulcand/frontends/vcb-old-foo/middlewares/manual",
+		"/vulcand/frontends/vcb-old-foo/frontend",
+		"/vulcand/backends/vcb-old-foo/servers/srv1",
+		"/vulcand/backends/vcb-old-foo/backend",
+	}
+
+	changes, err := pruneOrphans(kapi, []string{"foo"}, frozen, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, c := range changes {
+		keys = append(keys, c.Key)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected the keys of vcb-old-foo to be pruned, got %v", keys)
+	}
+	if _, err := kapi.Get(context.Background(), "/vulcand/backends/vcb-old-foo/backend", nil); err != nil {
+		t.Errorf("expected a dry run not to delete anything, got %v", err)
+	}
+
+	if changes, err = pruneOrphans(kapi, []string{"foo"}, frozen, false); err != nil || len(changes) != len(expected) {
+		t.Fatalf("expected %d keys pruned, got %v, %v", len(expected), changes, err)
+	}
+	for _, dir := range []string{"/vulcand/backends/vcb-old-foo", "/vulcand/frontends/vcb-old-foo"} {
+		if _, err := kapi.Get(context.Background(), dir, nil); err == nil {
+			t.Errorf("expected %s to be deleted", dir)
+		}
+	}
+	for _, k := range []string{"/vulcand/backends/vcb-foo/backend", "/vulcand/backends/vcb-foo-srv1/servers/srv1", "/vulcand/frontends/vcb-internal-foo/frontend", "/vulcand/backends/vcb-locked/backend", "/vulcand/backends/team-a-bar/backend"} {
+		if _, err := kapi.Get(context.Background(), k, nil); err != nil {
+			t.Errorf("expected %s to be kept, got %v", k, err)
+		}
+	}
+}
+
+func TestApplyVulcanConfigSupersededMiddleware(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{},
+		FrontEnds: map[string]vulcanFrontend{
+			"vcb-foo": vulcanFrontend{Type: "http", BackendID: "vcb-foo", Route: "Path(`/`)", middlewares: map[string]string{"old": "{}"}},
+		},
+	}
+	if _, err := applyVulcanConf(kapi, vc); err != nil {
+		t.Fatal(err)
+	}
+
+	vc.FrontEnds["vcb-foo"] = vulcanFrontend{Type: "http", BackendID: "vcb-foo", Route: "Path(`/`)", middlewares: map[string]string{"new": "{}"}}
+	changes, err := applyVulcanConf(kapi, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []keyChange{
+		{Action: "set", Key: "/vulcand/frontends/vcb-foo/middlewares/new", NewValue: "{}"},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-foo/middlewares/old", OldValue: "{}"},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf("expected the replacement to be written before the superseded middleware is removed:\n%v\n%v\n", expected, changes)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	hash := "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	if err := setValues(kapi, map[string]string{"/ft/secrets/service-a": hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	services := resolveAuthSecrets(kapi, []Service{
+		{Name: "service-a", Auth: &basicAuth{Username: "ops", PasswordHashKey: "/ft/secrets/service-a"}},
+		{Name: "service-b", Auth: &basicAuth{Username: "ops", PasswordHashKey: "/ft/secrets/missing"}},
+	})
+	if services[0].Auth.PasswordHash != hash {
+		t.Errorf("password hash not read from the secret: %q", services[0].Auth.PasswordHash)
+	}
+	if services[1].Auth.PasswordHash != "" {
+		t.Errorf("expected an empty password hash for a missing secret: %q", services[1].Auth.PasswordHash)
+	}
+
+	a := services[0]
+	a.Addresses = map[string]string{"srv1": "http://host1:80"}
+	a.PathPrefixes = map[string]string{"content": "/content/.*"}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{a}))
+	expected := `{"Id":"auth","Middleware":{"PasswordHash":"` + hash + `","Username":"ops"},"Priority":0,"Type":"auth"}`
+	if actual := keys["/vulcand/frontends/vcb-service-a-path-regex-content/middlewares/auth"]; actual != expected {
+		t.Errorf("auth middleware failed. expected and actual are:\n%v\n%v\n", expected, actual)
+	}
+	if _, found := keys["/vulcand/frontends/vcb-internal-service-a/middlewares/auth"]; found {
+		t.Error("unexpected auth middleware on the internal frontend")
+	}
+}
+
+func TestSelfRegistration(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/ft/test-self/"); err != nil {
+		t.Error(err)
+	}
+
+	r := selfRegistration{prefix: "/ft/test-self/", name: "vcb", id: "host1", address: "http://10.0.0.5:8080", ttl: time.Minute}
+	r.register(kapi)
+
+	services := readServices(kapi, "/ft/test-self/")
+	if len(services) != 1 {
+		t.Fatalf("expected a single service, got %v", services)
+	}
+	if s := services[0]; s.Name != "vcb" || !s.HasHealthCheck || s.Addresses["host1"] != "http://10.0.0.5:8080" {
+		t.Errorf("unexpected registration %v", s)
+	}
+	for _, k := range []string{"/ft/test-self/vcb/healthcheck", "/ft/test-self/vcb/servers/host1"} {
+		if resp, err := kapi.Get(context.Background(), k, nil); err != nil || resp.Node.Expiration == nil {
+			t.Errorf("expected %s to expire", k)
+		}
+	}
+
+	// a standby isn't registered, and the registration is removed when vcb stops
+	if err := deleteRecursiveIfExists(kapi, "/ft/test-self/"); err != nil {
+		t.Error(err)
+	}
+	var leader int32
+	ctx, cancel := context.WithCancel(context.Background())
+	r.ttl = 30 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx, kapi, func() bool { return atomic.LoadInt32(&leader) == 1 })
+		close(done)
+	}()
+	registered := func() bool {
+		_, err := kapi.Get(context.Background(), "/ft/test-self/vcb/servers/host1", nil)
+		return err == nil
+	}
+	time.Sleep(50 * time.Millisecond)
+	if registered() {
+		t.Error("expected a standby not to register")
+	}
+	atomic.StoreInt32(&leader, 1)
+	time.Sleep(50 * time.Millisecond)
+	if !registered() {
+		t.Error("expected the leader to register")
+	}
+	cancel()
+	<-done
+	if registered() {
+		t.Error("expected the registration to be removed on exit")
+	}
+}
+
+func TestConfiguredSettings(t *testing.T) {
+	defer func(cooldown, retry, action string) {
+		cooldownSeconds, applyRetrySeconds, failedAppliesAction = cooldown, retry, action
+	}(cooldownSeconds, applyRetrySeconds, failedAppliesAction)
+
+	// invalid settings fall back to their defaults
+	cooldownSeconds, applyRetrySeconds, failedAppliesAction = "soon", "0", "panic"
+	if cooldown := configuredCooldown(); cooldown != 30*time.Second {
+		t.Errorf("expected the default cooldown, got %v", cooldown)
+	}
+	if retry := configuredApplyRetry(); retry != 10*time.Second {
+		t.Errorf("expected the default retry, got %v", retry)
+	}
+	if status := configuredApplyStatus(unreachableKeysAPI{}); failedAppliesAction != "unready" || status.failureLimit != 0 {
+		t.Errorf("expected the default failed applies action, got %s", failedAppliesAction)
+	}
+
+	cooldownSeconds, applyRetrySeconds = "5", "3"
+	if cooldown, retry := configuredCooldown(), configuredApplyRetry(); cooldown != 5*time.Second || retry != 3*time.Second {
+		t.Errorf("expected the configured cooldown and retry, got %v and %v", cooldown, retry)
+	}
+
+	// subsystems which aren't configured aren't started
+	if configuredLeaderElection(context.Background(), unreachableKeysAPI{}, nil) != nil || configuredStaging(client.Config{}, unreachableKeysAPI{}) != nil || configuredXDS() != nil {
+		t.Error("expected no leader election, staging or xDS without their settings")
+	}
+}
+
+func TestSelfRegistrationExposure(t *testing.T) {
+	for _, test := range []struct {
+		address, adminAddress, adminToken string
+		exposed                           bool
+	}{
+		{"http://10.0.0.5:8080", "", "", true},
+		{"http://10.0.0.5:8080", "", "secret", false},
+		{"http://10.0.0.5:8080", ":8081", "", false},
+		{"http://10.0.0.5:8081", ":8081", "", true},
+		{"http://10.0.0.5:8081", ":8081", "secret", false},
+	} {
+		if err := selfRegistrationExposure(test.address, test.adminAddress, test.adminToken); (err != nil) != test.exposed {
+			t.Errorf("registering %s with admin address %q and token %q: expected exposed %t, got %v", test.address, test.adminAddress, test.adminToken, test.exposed, err)
+		}
+	}
+}
+
+func TestServicesSchemaMatchesParser(t *testing.T) {
+	// the keys parseService switches on
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := make(map[string]bool)
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "parseService" {
+			ast.Inspect(fn, func(n ast.Node) bool {
+				if c, ok := n.(*ast.CaseClause); ok {
+					for _, e := range c.List {
+						if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+							parsed[strings.Trim(lit.Value, `"`)] = true
+						}
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	documented := make(map[string]bool)
+	for k := range serviceKeys() {
+		documented[k] = true
+	}
+	if len(parsed) == 0 || !reflect.DeepEqual(parsed, documented) {
+		t.Errorf("schema keys do not match the keys parsed. parsed and documented are:\n%v\n%v\n", parsed, documented)
+	}
+
+	if _, err := json.Marshal(servicesSchema()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManagedHosts(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	for _, dir := range []string{"/vulcand/", "/ft/test-tls/"} {
+		if err := deleteRecursiveIfExists(kapi, dir); err != nil {
+			t.Error(err)
+		}
+	}
+
+	cert, key := testKeyPair(t, "example.com")
+	if err := setValues(kapi, map[string]string{
+		"/ft/test-tls/example.com/cert":         cert,
+		"/ft/test-tls/example.com/key":          key,
+		"/ft/test-tls/broken.com/cert":          cert,
+		"/ft/test-tls/broken.com/key":           "not a key",
+		"/vulcand/hosts/old.com/host":           `{"Name":"old.com"}`,
+		"/vulcand/hosts/old.com/listeners/http": `{"Protocol":"http"}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vc := vulcanConf{
+		Backends:  map[string]vulcanBackend{},
+		FrontEnds: map[string]vulcanFrontend{},
+		Hosts:     readTLSHosts(kapi, "/ft/test-tls/", ""),
+	}
+	if len(vc.Hosts) != 1 || vc.Hosts["example.com"].Key != key {
+		t.Fatalf("expected only the valid host to be read, got %v", vc.Hosts)
+	}
+
+	changes, err := applyVulcanConf(kapi, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if strings.Contains(c.NewValue, "PRIVATE KEY") {
+			t.Errorf("private key not redacted from change %v", c)
+		}
+	}
+
+	values, err := readAllKeysFromEtcd(kapi, "/vulcand/hosts/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/vulcand/hosts/example.com/host":       hostValue("example.com", vc.Hosts["example.com"]),
+		"/vulcand/hosts/old.com/listeners/http": `{"Protocol":"http"}`,
+	}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, values)
+	}
+}
+
+func testKeyPair(t *testing.T, host string) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{host},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(key)
+}
+
+func TestServiceStatuses(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/ft/test-status/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{"/ft/test-status/gone": "{}"}); err != nil {
+		t.Fatal(err)
+	}
+
+	services := []Service{{
+		Name:         "foo",
+		Addresses:    map[string]string{"s1": "http://foo:80", "s2": "bogus"},
+		PathPrefixes: map[string]string{"content": "/content/.*"},
+		problems:     []string{"invalid priority x for service foo"},
+	}}
+	appliedAt := time.Date(2016, 11, 1, 18, 0, 0, 0, time.UTC)
+	writeServiceStatuses(kapi, "/ft/test-status/", serviceStatuses(services, buildVulcanConf(services), appliedAt, nil))
+
+	values, err := readAllKeysFromEtcd(kapi, "/ft/test-status/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/ft/test-status/foo": `{"appliedAt":"2016-11-01T18:00:00Z","applied":true,"frontends":3,"errors":["invalid priority x for service foo","invalid address bogus for server s2: a host and port are required"]}`,
+	}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, values)
+	}
+}
+
+type fakeResolver struct {
+	addresses map[string]string
+	err       error
+}
+
+func (r *fakeResolver) resolve(value string) (map[string]string, error) {
+	return r.addresses, r.err
+}
+
+func TestExpandAddresses(t *testing.T) {
+	fake := &fakeResolver{addresses: map[string]string{"i-1": "http://10.0.0.1:8080", "i-2": "http://10.0.0.2:8080"}}
+	addressResolvers["fake"] = fake
+	defer delete(addressResolvers, "fake")
+
+	resolved := newResolvedAddresses(0)
+	services := func() []Service {
+		return []Service{{
+			Name:             "foo",
+			Addresses:        map[string]string{"s1": "http://foo:80", "tagged": "fake:content-api"},
+			Weights:          map[string]int{"tagged": 3},
+			HealthCheckPaths: map[string]string{"tagged": "/healthz"},
+		}}
+	}
+
+	expanded, symbolic := resolved.expandAddresses(services())
+	expected := map[string]string{"s1": "http://foo:80", "tagged-i-1": "http://10.0.0.1:8080", "tagged-i-2": "http://10.0.0.2:8080"}
+	if !symbolic || !reflect.DeepEqual(expected, expanded[0].Addresses) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, expanded[0].Addresses)
+	}
+	if expanded[0].Weights["tagged-i-2"] != 3 {
+		t.Errorf("weight not applied to resolved servers: %v", expanded[0].Weights)
+	}
+	if expanded[0].HealthCheckPaths["tagged-i-1"] != "/healthz" {
+		t.Errorf("health check path not applied to resolved servers: %v", expanded[0].HealthCheckPaths)
+	}
+
+	fake.err = errors.New("throttled")
+	expanded, _ = resolved.expandAddresses(services())
+	if !reflect.DeepEqual(expected, expanded[0].Addresses) {
+		t.Errorf("expected the servers last resolved to be kept, got %v", expanded[0].Addresses)
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	for address, valid := range map[string]bool{
+		"http://host1:80":                 true,
+		"https://content-api.ft.com:8443": true,
+		"http://10.0.0.1:8080":            true,
+		"http://[fd00::1]:8080":           true,
+		"http://[fe80::1%25eth0]:80":      true,
+		"host1:80":                        true,
+		"http://host1:":                   false,
+		"http://host1":                    false,
+		"http://host1:80/path":            false,
+		"http://user@host1:80":            false,
+		"http://fd00::1:8080":             false,
+		"http://[not-ip]:8080":            false,
+		"http://host1:99999":              false,
+	} {
+		if validAddress(address) != valid {
+			t.Errorf("expected validAddress(%s) to be %v", address, valid)
+		}
+	}
+
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://[fd00::1]:8080"}}}))
+	if actual := keys["/vulcand/backends/vcb-service-a/servers/srv1"]; actual != `{"url":"http://[fd00::1]:8080"}` {
+		t.Errorf("expected the IPv6 server to be routed, got %s", actual)
+	}
+	if actual := httpURL("fd00::1", 8080); actual != "http://[fd00::1]:8080" {
+		t.Errorf("expected the IPv6 address to be bracketed, got %s", actual)
+	}
+}
+
+func TestAddressPolicy(t *testing.T) {
+	p, err := parseAddressPolicy("strict", "http, https", "8000-8999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, valid := range map[string]bool{
+		"http://host1:8080":     true,
+		"https://host1:8443":    true,
+		"host1:8080":            false,
+		"ftp://host1:8080":      false,
+		"http://host1:80":       false,
+		"http://[fd00::1]:8000": true,
+	} {
+		if err := p.check(address); (err == nil) != valid {
+			t.Errorf("expected %s to be valid=%v, got %v", address, valid, err)
+		}
+	}
+
+	for _, args := range [][]string{{"paranoid", "", ""}, {"", "", "8999-8000"}, {"", "", "http"}, {"", "", "0-80"}} {
+		if _, err := parseAddressPolicy(args[0], args[1], args[2]); err == nil {
+			t.Errorf("expected policy %v to be rejected", args)
+		}
+	}
+
+	buildVulcanConf([]Service{{Name: "service-rejected", Addresses: map[string]string{"srv1": "bogus", "srv2": "http://host2:80"}}})
+	if rejected, ok := addressesRejected.Get("service-rejected").(*expvar.Int); !ok || rejected.Value() != 1 {
+		t.Errorf("expected the rejected address to be counted once, got %v", addressesRejected.Get("service-rejected"))
+	}
+}
+
+func TestDefaultScheme(t *testing.T) {
+	defer func(scheme string) { defaultScheme = scheme }(defaultScheme)
+	defaultScheme = "http"
+
+	node := &client.Node{Key: "/ft/services/service-a", Dir: true, Nodes: []*client.Node{
+		{Key: "/ft/services/service-a/servers", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/service-a/servers/srv1", Value: "host1:8080"},
+			{Key: "/ft/services/service-a/servers/srv2", Value: "https://host2:8443"},
+		}},
+	}}
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{parseService(node)}))
+	if actual := keys["/vulcand/backends/vcb-service-a/servers/srv1"]; actual != `{"url":"http://host1:8080"}` {
+		t.Errorf("expected the default scheme to be prepended, got %s", actual)
+	}
+	if actual := keys["/vulcand/backends/vcb-service-a/servers/srv2"]; actual != `{"url":"https://host2:8443"}` {
+		t.Errorf("expected the URL to be kept, got %s", actual)
+	}
+
+	node.Nodes = append(node.Nodes, &client.Node{Key: "/ft/services/service-a/default-scheme", Value: "https"})
+	keys = vulcanConfToEtcdKeys(buildVulcanConf([]Service{parseService(node)}))
+	if actual := keys["/vulcand/backends/vcb-service-a-srv1/servers/srv1"]; actual != `{"url":"https://host1:8080"}` {
+		t.Errorf("expected the service's default scheme to be prepended, got %s", actual)
+	}
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	node := &client.Node{Key: "/ft/services/service-a", Dir: true, Nodes: []*client.Node{
+		{Key: "/ft/services/service-a/servers", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/service-a/servers/1", Value: `["http://host1:5678", "http://host1:5679"]`},
+			{Key: "/ft/services/service-a/servers/2", Dir: true, Nodes: []*client.Node{
+				{Key: "/ft/services/service-a/servers/2/internal", Value: "http://host2:5678"},
+				{Key: "/ft/services/service-a/servers/2/external", Value: "http://host2:5679"},
+			}},
+			{Key: "/ft/services/service-a/servers/3", Value: `["http://host3:5678"`},
+		}},
+		{Key: "/ft/services/service-a/weights", Dir: true, Nodes: []*client.Node{
+			{Key: "/ft/services/service-a/weights/2", Value: "4"},
+		}},
+	}}
+
+	expanded, symbolic := newResolvedAddresses(0).expandAddresses([]Service{parseService(node)})
+	expected := map[string]string{
+		"1-1":        "http://host1:5678",
+		"1-2":        "http://host1:5679",
+		"2-internal": "http://host2:5678",
+		"2-external": "http://host2:5679",
+	}
+	if symbolic || !reflect.DeepEqual(expected, expanded[0].Addresses) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, expanded[0].Addresses)
+	}
+	if expanded[0].Weights["2-internal"] != 4 || expanded[0].Weights["2-external"] != 4 {
+		t.Errorf("weight not applied to each address of the server: %v", expanded[0].Weights)
+	}
+	if len(expanded[0].problems) != 1 {
+		t.Errorf("expected the broken addresses of server 3 to be reported, got %v", expanded[0].problems)
+	}
+}
+
+func TestEC2Resolver(t *testing.T) {
+	var query url.Values
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet>
+			<item><instanceId>i-1</instanceId><privateIpAddress>10.0.0.1</privateIpAddress></item>
+			<item><instanceId>i-2</instanceId><privateIpAddress>10.0.0.2</privateIpAddress></item>
+		</instancesSet></item></reservationSet></DescribeInstancesResponse>`))
+	}))
+	defer server.Close()
+
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	r := ec2Resolver{
+		endpoint: server.URL + "/",
+		region:   "eu-west-1",
+		client:   server.Client(),
+		now:      func() time.Time { return time.Date(2016, 11, 1, 18, 0, 0, 0, time.UTC) },
+	}
+
+	addresses, err := r.resolve("aws:tag:Name=content-api:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"i-1": "http://10.0.0.1:8080", "i-2": "http://10.0.0.2:8080"}
+	if !reflect.DeepEqual(expected, addresses) {
+		t.Errorf("fail. expected and actual are \n%v\n%v\n", expected, addresses)
+	}
+	if query.Get("Filter.1.Name") != "tag:Name" || query.Get("Filter.1.Value.1") != "content-api" {
+		t.Errorf("unexpected query %v", query)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/20161101/eu-west-1/ec2/aws4_request, SignedHeaders=host;x-amz-date, Signature=") {
+		t.Errorf("unexpected authorization %s", authorization)
+	}
+
+	if _, err := r.resolve("aws:tag:Name=content-api"); err == nil {
+		t.Error("expected a value without a port to be rejected")
+	}
+}
+
+func TestManualMiddlewares(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	a := Service{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}
+	if _, err := applyVulcanConf(kapi, buildVulcanConf([]Service{a})); err != nil {
+		t.Fatal(err)
+	}
+	manual := "/vulcand/frontends/vcb-internal-service-a/middlewares/manual-trace"
+	if err := setValues(kapi, map[string]string{manual: `{"Id":"manual-trace","Type":"trace"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither a changed frontend nor a removed one takes the middleware with it
+	a.Middlewares = map[string]string{"ratelimit": `{"Id":"ratelimit"}`}
+	for _, services := range [][]Service{{a}, {}} {
+		if _, err := applyVulcanConf(kapi, buildVulcanConf(services)); err != nil {
+			t.Fatal(err)
+		}
+		existing, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existing[manual] != `{"Id":"manual-trace","Type":"trace"}` {
+			t.Errorf("expected the manual middleware to be kept, got %v", existing)
+		}
+	}
+
+	report := checkConsistency(map[string]string{manual: "{}"}, []string{})
+	if len(report.OrphanedKeys) != 0 {
+		t.Errorf("expected the manual middleware not to be reported as orphaned, got %v", report.OrphanedKeys)
+	}
+}
+
+func TestManagedPrefix(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	other := map[string]string{
+		"/vulcand/backends/vcb-service-b/backend":    backendValue(nil),
+		"/vulcand/backends/vcb-service-b/servers/s1": `{"url":"http://host2:80"}`,
+		"/vulcand/frontends/vcb-internal-b/frontend": `{"Type":"http","BackendId":"vcb-service-b"}`,
+	}
+	if err := setValues(kapi, other); err != nil {
+		t.Fatal(err)
+	}
+
+	managedPrefix = "team-a-"
+	defer func() { managedPrefix = "vcb-" }()
+	services := []Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}}
+	if _, err := applyVulcanConf(kapi, buildVulcanConf(services)); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range other {
+		if existing[k] != v {
+			t.Errorf("expected the other deployment's %s to be left alone, got %v", k, existing)
+		}
+	}
+	if _, found := existing["/vulcand/frontends/team-a-internal-service-a/frontend"]; !found {
+		t.Errorf("expected the frontends to be named with the prefix, got %v", existing)
+	}
+	if owner := ownerOf("team-a-service-a-srv1", []string{"service-a"}); owner != "service-a" {
+		t.Errorf("expected the prefixed backend to belong to service-a, got %q", owner)
+	}
+	if report := checkConsistency(existing, []string{"service-a"}); len(report.OrphanedKeys) != 0 {
+		t.Errorf("expected the other deployment's keys not to be reported as orphaned, got %v", report.OrphanedKeys)
+	}
+}
+
+func TestRecordChanges(t *testing.T) {
+	count := func(m *expvar.Map, name string) int64 {
+		n, _ := m.Get(name).(*expvar.Int)
+		if n == nil {
+			return 0
+		}
+		return n.Value()
+	}
+	createdBefore, noopBefore := count(applyChangesTotal, "servers_created"), appliesNoop.Value()
+
+	recordChanges([]keyChange{
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/backend", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand/backends/vcb-foo/servers/s1", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand-eu/backends/vcb-foo/servers/s1", NewValue: "{}"},
+		{Action: "set", Key: "/vulcand/frontends/vcb-foo/frontend", OldValue: "{}", NewValue: "{}"},
+		{Action: "delete", Key: "/vulcand/frontends/vcb-bar/middlewares/rewrite", OldValue: "{}"},
+		{Action: "set", Key: "/vulcand/hosts/foo.com/host", NewValue: "{}"},
+	})
+	for name, expected := range map[string]int64{
+		"backends_created":    1,
+		"servers_created":     2,
+		"frontends_updated":   1,
+		"middlewares_deleted": 1,
+		"frontends_created":   0,
+		"servers_deleted":     0,
+	} {
+		if actual := count(applyChangesLast, name); actual != expected {
+			t.Errorf("expected %s to be %d, got %d", name, expected, actual)
+		}
+	}
+	if count(applyChangesTotal, "servers_created") != createdBefore+2 {
+		t.Errorf("expected the servers created to be added to the total")
+	}
+
+	recordChanges(nil)
+	if count(applyChangesLast, "servers_created") != 0 || appliesNoop.Value() != noopBefore+1 {
+		t.Errorf("expected an apply which changed nothing to be counted")
+	}
+}
+
+func TestRebuildTrace(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, rebuild := tracer.Start(context.Background(), "rebuild")
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})
+	vc.trace = ctx
+	if _, err := applyVulcanConf(kapi, vc); err != nil {
+		t.Fatal(err)
+	}
+	endRebuildTrace(rebuild, 1, 3, nil)
+
+	phases := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		if span.Name() == "rebuild" {
+			continue
+		}
+		if span.Parent().SpanID() != rebuild.SpanContext().SpanID() {
+			t.Errorf("expected %s to be traced as part of the rebuild", span.Name())
+		}
+		phases[span.Name()] = true
+	}
+	for _, phase := range []string{"read-existing", "apply-services", "cleanup"} {
+		if !phases[phase] {
+			t.Errorf("expected the %s phase to be traced, got %v", phase, phases)
+		}
+	}
+}
+
+func TestApplyOrdering(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	// index returns the position of the change to the key
+	index := func(changes []keyChange, k string) int {
+		for i, c := range changes {
+			if c.Key == k {
+				return i
+			}
+		}
+		t.Fatalf("no change to %s in %v", k, changes)
+		return -1
+	}
+	before := func(changes []keyChange, keys ...string) {
+		for i := 1; i < len(keys); i++ {
+			if index(changes, keys[i-1]) > index(changes, keys[i]) {
+				t.Errorf("expected %s to be changed before %s, got %v", keys[i-1], keys[i], changes)
+			}
+		}
+	}
+
+	old := buildVulcanConf([]Service{{Name: "service-a", HasHealthCheck: true, Addresses: map[string]string{"srv1": "http://host1:80", "srv2": "http://host2:80"}}})
+	changes, err := applyVulcanConf(kapi, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before(changes,
+		"/vulcand/backends/vcb-service-a/backend",
+		"/vulcand/backends/vcb-service-a/servers/srv1",
+		"/vulcand/frontends/vcb-internal-service-a/frontend",
+		"/vulcand/frontends/vcb-internal-service-a/middlewares/rewrite",
+	)
+
+	// the replacing service's keys are created before the replaced one's are deleted in reverse
+	changes, err = applyVulcanConf(kapi, buildVulcanConf([]Service{{Name: "service-b", Addresses: map[string]string{"srv1": "http://host1:80"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before(changes,
+		"/vulcand/frontends/vcb-internal-service-a/middlewares/rewrite",
+		"/vulcand/frontends/vcb-internal-service-a/frontend",
+		"/vulcand/backends/vcb-service-b/backend",
+		"/vulcand/frontends/vcb-internal-service-b/frontend",
+		"/vulcand/backends/vcb-service-a/servers/srv1",
+		"/vulcand/backends/vcb-service-a/backend",
+	)
+	// and each removed frontend or backend is deleted in one go
+	for _, keys := range [][]string{
+		{"/vulcand/frontends/vcb-health-service-a-srv1/middlewares/rewrite", "/vulcand/frontends/vcb-health-service-a-srv1/frontend"},
+		{"/vulcand/frontends/vcb-health-service-a-srv2/middlewares/rewrite", "/vulcand/frontends/vcb-health-service-a-srv2/frontend"},
+		{"/vulcand/backends/vcb-service-a-srv1/servers/srv1", "/vulcand/backends/vcb-service-a-srv1/backend"},
+		{"/vulcand/backends/vcb-service-a/servers/srv1", "/vulcand/backends/vcb-service-a/backend"},
+	} {
+		if index(changes, keys[0])+1 != index(changes, keys[1]) {
+			t.Errorf("expected %s to be deleted right before %s, got %v", keys[0], keys[1], changes)
+		}
+	}
+
+	// restored keys are created in order too
+	restored := vulcanConf{keys: map[string]string{
+		"/vulcand/backends/vcb-service-c/servers/srv1": `{"url":"http://host1:80"}`,
+		"/vulcand/backends/vcb-service-c/backend":      backendValue(nil),
+	}}
+	if changes, err = applyVulcanConf(kapi, restored); err != nil {
+		t.Fatal(err)
+	}
+	before(changes, "/vulcand/backends/vcb-service-c/backend", "/vulcand/backends/vcb-service-c/servers/srv1")
+}
+
+// largestReadKeysAPI records the most keys returned by a single Get.
+type largestReadKeysAPI struct {
+	client.KeysAPI
+	largest int
+}
+
+func (l *largestReadKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	resp, err := l.KeysAPI.Get(ctx, key, opts)
+	if resp != nil && resp.Node != nil {
+		if n := countKeys(resp.Node); n > l.largest {
+			l.largest = n
+		}
+	}
+	return resp, err
+}
+
+func countKeys(node *client.Node) int {
+	n := 1
+	for _, child := range node.Nodes {
+		n += countKeys(child)
+	}
+	return n
+}
+
+func TestApplyReadsOneEntityAtATime(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	services := func(host string) []Service {
+		var services []Service
+		for i := 0; i < 50; i++ {
+			services = append(services, Service{
+				Name:           "service-" + strconv.Itoa(i),
+				HasHealthCheck: true,
+				Addresses:      map[string]string{"srv1": "http://" + host + "1:80", "srv2": "http://" + host + "2:80"},
+			})
+		}
+		return services
+	}
+	if _, err := applyVulcanConf(kapi, buildVulcanConf(services("old"))); err != nil {
+		t.Fatal(err)
+	}
+
+	largest := &largestReadKeysAPI{KeysAPI: kapi}
+	vc := buildVulcanConf(services("new"))
+	changes, err := applyVulcanConf(largest, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := vulcanConfToEtcdKeys(vc)
+	if len(changes) == 0 || len(keys) < 500 {
+		t.Fatalf("expected a large configuration to be changed, got %d changes to %d keys", len(changes), len(keys))
+	}
+	// the listing of the frontends has an entry for each, but no more than a frontend's keys
+	if largest.largest > len(vc.FrontEnds)+1 {
+		t.Errorf("expected no read of more than one entity's keys, of %d, got one of %d", len(keys), largest.largest)
+	}
+	existing, _ := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if !reflect.DeepEqual(keys, existing) {
+		t.Errorf("expected the configuration to be applied, got %d keys rather than %d", len(existing), len(keys))
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/vcb-gone/backend": `{"Type": "http"}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	vc := buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})
+	p, err := makePlan(kapi, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := len(p.Changes) - 1; last < 0 || p.Changes[last].Action != "delete" || p.Changes[last].Key != "/vulcand/backends/vcb-gone/backend" {
+		t.Errorf("expected the plan to end by deleting the unwanted backend, got %v", p.Changes)
+	}
+	if existing, _ := readAllKeysFromEtcd(kapi, "/vulcand/"); len(existing) != 1 {
+		t.Errorf("expected making a plan not to change anything, got %v", existing)
+	}
+
+	changes, err := applyPlan(kapi, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(p.Changes) {
+		t.Errorf("expected %d changes, got %v", len(p.Changes), changes)
+	}
+	existing, _ := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if !reflect.DeepEqual(vulcanConfToEtcdKeys(vc), existing) {
+		t.Errorf("expected the plan to apply the configuration, got %v", existing)
+	}
+
+	// a plan is refused once the keys it changes have changed
+	if err := setValues(kapi, map[string]string{"/vulcand/backends/vcb-gone/backend": `{"Type": "http"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPlan(kapi, p); err == nil {
+		t.Error("expected a stale plan to be refused")
+	}
+}
+
+func TestKubernetesSource(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "vcb=true" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected request %v", r)
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/content/services":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "service-a", "namespace": "content", "annotations": {"vcb/config": "healthcheck: true\npath-regex:\n  content: /content/.*\n", "vcb/port": "http"}}},
+				{"metadata": {"name": "service-b", "namespace": "content"}}
+			]}`))
+		case "/api/v1/namespaces/content/endpoints":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "service-a", "namespace": "content"}, "subsets": [{
+					"addresses": [{"ip": "10.0.0.1", "targetRef": {"name": "service-a-1"}}, {"ip": "10.0.0.2"}],
+					"ports": [{"name": "metrics", "port": 9100}, {"name": "http", "port": 8080}]
+				}]}
+			]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	k := &kubernetesSource{api: api.URL, token: "token", namespace: "content", selector: "vcb=true", client: api.Client()}
+	services, err := k.services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %v", services)
+	}
+	a := services[0]
+	expected := map[string]string{"service-a-1": "http://10.0.0.1:8080", "10-0-0-2": "http://10.0.0.2:8080"}
+	if a.Name != "service-a" || !a.HasHealthCheck || a.PathPrefixes["content"] != "/content/.*" || !reflect.DeepEqual(expected, a.Addresses) {
+		t.Errorf("unexpected service %+v", a)
+	}
+	if b := services[1]; b.Name != "service-b" || len(b.Addresses) != 0 {
+		t.Errorf("unexpected service %+v", b)
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"consul": [], "service-a": ["vcb"], "service-b": []}`))
+		case "/v1/kv/vcb/services/":
+			config := base64.StdEncoding.EncodeToString([]byte(`{"healthcheck": true}`))
+			w.Write([]byte(`[{"Key": "vcb/services/service-a", "Value": "` + config + `"}]`))
+		case "/v1/health/service/service-a":
+			if r.URL.Query().Get("passing") != "true" || r.URL.Query().Get("tag") != "vcb" {
+				t.Errorf("unexpected query %v", r.URL.Query())
+			}
+			w.Write([]byte(`[
+				{"Node": {"Address": "10.0.0.1"}, "Service": {"ID": "service-a-1", "Port": 8080}},
+				{"Node": {"Address": "10.0.0.1"}, "Service": {"ID": "service-a-2", "Address": "10.0.1.2", "Port": 8081}}
+			]`))
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	c := &consulSource{api: api.URL, tag: "vcb", configPrefix: "vcb/services/", client: api.Client()}
+	services, err := c.services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("expected only the tagged service, got %v", services)
+	}
+	expected := map[string]string{"service-a-1": "http://10.0.0.1:8080", "service-a-2": "http://10.0.1.2:8081"}
+	if a := services[0]; a.Name != "service-a" || !a.HasHealthCheck || !reflect.DeepEqual(expected, a.Addresses) {
+		t.Errorf("unexpected service %+v", a)
+	}
+}
+
+func TestDockerSource(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"Names": ["/content-api-2"], "Labels": {"vcb.service": "content-api", "vcb.port": "8080"},
+				"NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}},
+			{"Names": ["/content-api-1"], "Labels": {"vcb.service": "content-api", "vcb.port": "8080", "vcb.path-regex": "/content/.*", "vcb.config": "healthcheck: true"},
+				"Ports": [{"IP": "0.0.0.0", "PrivatePort": 8080, "PublicPort": 32768}]},
+			{"Names": ["/broken"], "Labels": {"vcb.service": "broken", "vcb.port": "http"}}
+		]`))
+	}))
+	defer api.Close()
+
+	d := &dockerSource{api: api.URL, client: api.Client()}
+	services, err := d.services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected 2 services, got %v", services)
+	}
+	if b := services[0]; b.Name != "broken" || len(b.Addresses) != 0 || len(b.violations()) != 1 {
+		t.Errorf("expected the invalid vcb.port to be reported, got %+v", b)
+	}
+	expected := map[string]string{"content-api-1": "http://127.0.0.1:32768", "content-api-2": "http://172.17.0.3:8080"}
+	a := services[1]
+	if a.Name != "content-api" || !a.HasHealthCheck || !reflect.DeepEqual(expected, a.Addresses) {
+		t.Errorf("unexpected service %+v", a)
+	}
+	if a.PathPrefixes["content-api"] != "/content/.*" {
+		t.Errorf("expected the path regex label to be routed, got %v", a.PathPrefixes)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcb-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"content-api.yaml": "servers:\n  srv1: http://host1:8080\npath-regex:\n  content: /content/.*\n",
+		"broken.yml":       "servers: [",
+		"README.md":        "not a service",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &fileSource{dir: dir}
+	services, err := f.services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected a service per YAML file, got %v", services)
+	}
+	if b := services[0]; b.Name != "broken" || len(b.violations()) != 1 {
+		t.Errorf("expected the broken file to be reported, got %+v", b)
+	}
+	a := services[1]
+	if a.Name != "content-api" || a.Addresses["srv1"] != "http://host1:8080" || a.PathPrefixes["content"] != "/content/.*" {
+		t.Errorf("unexpected service %+v", a)
+	}
+
+	w := &notifier{ch: make(chan struct{}, 1)}
+	f.watch(w)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "search-api.yaml"), []byte("healthcheck: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.notify():
+	case <-time.After(5 * time.Second):
+		t.Error("expected writing a service file to notify")
+	}
+}
+
+func TestStagingTarget(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	for _, dir := range []string{"/vulcand/", "/vulcand-staging/"} {
+		if err := deleteRecursiveIfExists(kapi, dir); err != nil {
+			t.Error(err)
+		}
+	}
+
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-foo": vulcanBackend{Servers: map[string]vulcanServer{"s1": vulcanServer{URL: "http://foo:80"}}},
+		},
+		FrontEnds: map[string]vulcanFrontend{},
+	}
+
+	promoted := 0
+	apply := func(vc vulcanConf) ([]keyChange, error) {
+		promoted++
+		return nil, nil
+	}
+	if _, err := newStagingTarget(kapi, "/vulcand-staging", "grep -q vcb-foo").promote(vc, apply); err != nil || promoted != 1 {
+		t.Errorf("unexpected staging failure: %v", err)
+	}
+	if _, err := newStagingTarget(kapi, "/vulcand-staging", "false").promote(vc, apply); err == nil || promoted != 1 {
+		t.Error("expected the failing smoke verification to stop the promotion")
+	}
+
+	staged, err := readAllKeysFromEtcd(kapi, "/vulcand-staging/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged["/vulcand-staging/backends/vcb-foo/servers/s1"] != `{"url":"http://foo:80"}` {
+		t.Errorf("configuration not applied to staging: %v", staged)
+	}
+	production, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(production) != 0 {
+		t.Errorf("expected production to be untouched, got %v", production)
+	}
+}
+
+func TestStagingPromote(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	for _, dir := range []string{"/vulcand/", "/vulcand-staging/"} {
+		if err := deleteRecursiveIfExists(kapi, dir); err != nil {
+			t.Error(err)
+		}
+	}
+
+	conf := func(url string) vulcanConf {
+		return vulcanConf{
+			Backends: map[string]vulcanBackend{
+				"vcb-foo": vulcanBackend{Servers: map[string]vulcanServer{"s1": vulcanServer{URL: url}}},
+			},
+			FrontEnds: map[string]vulcanFrontend{},
+		}
+	}
+	server := func(prefix string) string {
+		keys, err := readAllKeysFromEtcd(kapi, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys[prefix+"backends/vcb-foo/servers/s1"]
+	}
+	s := newStagingTarget(kapi, "/vulcand-staging", "! grep -q http://bar:80")
+	// production is only applied to once staging has the configuration
+	apply := func(vc vulcanConf) ([]keyChange, error) {
+		if staged := server("/vulcand-staging/"); staged != backendServerValue(vc.Backends["vcb-foo"].Servers["s1"]) {
+			t.Errorf("expected the configuration to be applied to staging before production, got %s", staged)
+		}
+		return applyVulcanConf(kapi, vc)
+	}
+
+	changes, err := s.promote(conf("http://foo:80"), apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server("/vulcand/") != `{"url":"http://foo:80"}` || len(changes) != 2 {
+		t.Errorf("expected the configuration to be promoted to production, got %v", changes)
+	}
+
+	// an unverified configuration is left in staging
+	if changes, err = s.promote(conf("http://bar:80"), apply); err == nil || changes != nil {
+		t.Errorf("expected the failing smoke verification to stop the promotion, got %v", changes)
+	}
+	if server("/vulcand-staging/") != `{"url":"http://bar:80"}` || server("/vulcand/") != `{"url":"http://foo:80"}` {
+		t.Errorf("expected production to keep the verified configuration, got %s", server("/vulcand/"))
+	}
+}
+
+func TestVulcandAPIKeys(t *testing.T) {
+	// a fake vulcand API, holding entities by collection path and id
+	var mu sync.Mutex
+	collections := map[string]map[string]map[string]interface{}{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		i := strings.LastIndex(r.URL.Path, "/")
+		switch r.Method {
+		case "GET":
+			name := r.URL.Path[i+1:]
+			list := []map[string]interface{}{}
+			for _, e := range collections[r.URL.Path] {
+				list = append(list, e)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{strings.Title(name): list})
+		case "POST":
+			var body map[string]map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body) != 1 {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			for _, e := range body {
+				id, _ := e["Id"].(string)
+				if id == "" {
+					id, _ = e["Name"].(string)
+				}
+				if collections[r.URL.Path] == nil {
+					collections[r.URL.Path] = map[string]map[string]interface{}{}
+				}
+				collections[r.URL.Path][id] = e
+			}
+		case "DELETE":
+			entities := collections[r.URL.Path[:i]]
+			if _, found := entities[r.URL.Path[i+1:]]; !found {
+				http.NotFound(w, r)
+				return
+			}
+			delete(entities, r.URL.Path[i+1:])
+			for path := range collections {
+				if strings.HasPrefix(path, r.URL.Path+"/") {
+					delete(collections, path)
+				}
+			}
+		}
+	}))
+	defer api.Close()
+
+	service := Service{
+		Name:            "foo",
+		HasHealthCheck:  true,
+		Addresses:       map[string]string{"s1": "http://foo:80"},
+		PathPrefixes:    map[string]string{"foo": "/foo/.*"},
+		PathStripPrefix: map[string]bool{"foo": true},
+	}
+	vc := buildVulcanConf([]Service{service})
+
+	a := newVulcandAPIKeys(api.URL)
+	if _, err := applyVulcanConf(a, vc); err != nil {
+		t.Fatal(err)
+	}
+	if servers := collections["/v2/backends/vcb-foo/servers"]; servers["s1"]["url"] != "http://foo:80" {
+		t.Errorf("expected server s1 of backend vcb-foo to be created, got %v", servers)
+	}
+	if len(collections["/v2/frontends/vcb-foo-path-regex-foo/middlewares"]) != 1 {
+		t.Errorf("expected the rewrite middleware to be created, got %v", collections)
+	}
+
+	changes, err := applyVulcanConf(a, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected applying the same configuration again to change nothing, got %v", changes)
+	}
+
+	if _, err := applyVulcanConf(a, buildVulcanConf(nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/v2/backends", "/v2/frontends"} {
+		if len(collections[path]) != 0 {
+			t.Errorf("expected everything in %s to be deleted, got %v", path, collections[path])
+		}
+	}
+}
+
+func TestRenderNginx(t *testing.T) {
+	services := []Service{{
+		Name:             "service-a",
+		HasHealthCheck:   true,
+		Addresses:        map[string]string{"s1": "http://10.0.0.1:8080", "s2": "http://10.0.0.2:8080"},
+		Weights:          map[string]int{"s1": 3},
+		HostAliases:      []string{"a.example.com"},
+		HealthCheckPaths: map[string]string{"s2": "/status"},
+		PathPrefixes:     map[string]string{"content": "/content/.*", "read": "/read/.*"},
+		PathStripPrefix:  map[string]bool{"content": true},
+		PathMethods:      map[string][]string{"read": []string{"GET"}},
+		PathPriorities:   map[string]int{"content": 1},
+		draining:         map[string]bool{"s2": true},
+	}}
+	conf := string(renderNginx(services, buildVulcanConf(services)))
+
+	for _, expected := range []string{
+		"upstream vcb-service-a {\n    server 10.0.0.1:8080 weight=3;\n    server 10.0.0.2:8080 down;\n}",
+		"location ^~ /__service-a/ {\n        proxy_pass http://vcb-service-a/;\n    }",
+		"location = /health/service-a-s1/__health {\n        proxy_pass http://vcb-service-a-s1/__health;\n    }",
+		"location = /health/service-a-s2/__health {\n        proxy_pass http://vcb-service-a-s2/status;\n    }",
+		"location ~ \"^/content/.*\" {\n        rewrite \"/content/?(.*)\" \"/$1\" break;\n        proxy_pass http://vcb-service-a;\n    }",
+		"server_name a.example.com;",
+		"server_name service-a;",
+	} {
+		if !strings.Contains(conf, expected) {
+			t.Errorf("expected the configuration to contain\n%s\ngot\n%s", expected, conf)
+		}
+	}
+	if strings.Contains(conf, "/read/") {
+		t.Errorf("expected the path matching methods to be left out, got\n%s", conf)
+	}
+}
+
+func TestRenderHAProxy(t *testing.T) {
+	services := []Service{{
+		Name:            "service-a",
+		HasHealthCheck:  true,
+		Addresses:       map[string]string{"s1": "http://10.0.0.1:8080", "s2": "https://10.0.0.2:8443"},
+		Weights:         map[string]int{"s1": 3},
+		PathPrefixes:    map[string]string{"content": "/content/.*", "read": "/read/.*"},
+		PathStripPrefix: map[string]bool{"content": true},
+		PathMethods:     map[string][]string{"read": []string{"GET", "HEAD"}},
+		PathPriorities:  map[string]int{"read": 1},
+		draining:        map[string]bool{"s2": true},
+	}, {
+		Name:        "service-b",
+		Maintenance: true,
+		Addresses:   map[string]string{"s1": "http://10.0.0.3:8080"},
+	}}
+	defer func(backend string) { maintenanceBackend = backend }(maintenanceBackend)
+	maintenanceBackend = "maintenance"
+	conf := string(renderHAProxy(services, buildVulcanConf(services)))
+
+	for _, expected := range []string{
+		"http-request set-var(txn.route) str(vcb-internal-service-a) if !{ var(txn.route) -m found } { path_beg /__service-a/ }",
+		"http-request set-var(txn.route) str(vcb-service-a-path-regex-read) if !{ var(txn.route) -m found } { path_reg '^/read/.*' } { method GET HEAD }\n" +
+			"    http-request set-var(txn.route) str(vcb-service-a-path-regex-content) if !{ var(txn.route) -m found } { path_reg '^/content/.*' }",
+		"http-request set-var(txn.route) str(vcb-byhostheader-service-a) if !{ var(txn.route) -m found } { req.hdr(host),field(1,:) -i 'service-a' }",
+		"http-request replace-path '/content/?(.*)' '/\\1' if { var(txn.route) -m str vcb-service-a-path-regex-content }",
+		"http-request deny deny_status 503 if { var(txn.route) -m str vcb-byhostheader-service-b }",
+		"use_backend vcb-service-a if { var(txn.route) -m str vcb-service-a-path-regex-content }",
+		"backend vcb-service-a\n    mode http\n    server s1 10.0.0.1:8080 weight 3\n    server s2 10.0.0.2:8443 ssl weight 0\n",
+	} {
+		if !strings.Contains(conf, expected) {
+			t.Errorf("expected the configuration to contain\n%s\ngot\n%s", expected, conf)
+		}
+	}
+}
+
+func TestRenderTraefik(t *testing.T) {
+	services := []Service{{
+		Name:            "service-a",
+		Addresses:       map[string]string{"s1": "http://10.0.0.1:8080", "s2": "http://10.0.0.2:8080"},
+		Weights:         map[string]int{"s1": 3},
+		PathPrefixes:    map[string]string{"content": "/content/.*"},
+		PathStripPrefix: map[string]bool{"content": true},
+		draining:        map[string]bool{"s2": true},
+	}}
+	var conf traefikConfig
+	if err := yaml.Unmarshal(renderTraefik(services, buildVulcanConf(services)), &conf); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedServers := []traefikServer{{URL: "http://10.0.0.1:8080", Weight: 3}}
+	if actual := conf.HTTP.Services["vcb-service-a"].LoadBalancer.Servers; !reflect.DeepEqual(expectedServers, actual) {
+		t.Errorf("expected the draining server to be left out of %v, got %v", expectedServers, actual)
+	}
+	internal, path, host := conf.HTTP.Routers["vcb-internal-service-a"], conf.HTTP.Routers["vcb-service-a-path-regex-content"], conf.HTTP.Routers["vcb-byhostheader-service-a"]
+	if path.Rule != "PathRegexp(`^/content/.*`)" || path.Service != "vcb-service-a" || !reflect.DeepEqual(path.Middlewares, []string{"vcb-service-a-path-regex-content-rewrite"}) {
+		t.Errorf("unexpected path router %+v", path)
+	}
+	if !(internal.Priority > path.Priority && path.Priority > host.Priority && host.Priority > 0) {
+		t.Errorf("expected the internal, path and host routers in priority order, got %d, %d and %d", internal.Priority, path.Priority, host.Priority)
+	}
+	if rewrite := conf.HTTP.Middlewares["vcb-service-a-path-regex-content-rewrite"].ReplacePathRegex; rewrite.Regex != "/content/?(.*)" || rewrite.Replacement != "/$1" {
+		t.Errorf("unexpected rewrite %+v", rewrite)
+	}
+}
+
+func TestEnvoyXDS(t *testing.T) {
+	services := []Service{{
+		Name:            "service-a",
+		HasHealthCheck:  true,
+		Addresses:       map[string]string{"s1": "http://10.0.0.1:8080", "s2": "https://10.0.0.2:8443"},
+		Weights:         map[string]int{"s1": 3},
+		HostAliases:     []string{"a.example.com"},
+		PathPrefixes:    map[string]string{"content": "/content/.*"},
+		PathStripPrefix: map[string]bool{"content": true},
+		PathMethods:     map[string][]string{"content": []string{"GET", "HEAD"}},
+		draining:        map[string]bool{"s2": true},
+	}}
+	vc := buildVulcanConf(services)
+
+	x := newEnvoyXDS()
+	if err := x.update(services, vc); err != nil {
+		t.Fatal(err)
+	}
+	version := x.version
+	if err := x.update(services, buildVulcanConf(services)); err != nil || x.version != version {
+		t.Errorf("expected an unchanged configuration to keep version %s, got %s (%v)", version, x.version, err)
+	}
+	snapshot, err := x.cache.GetSnapshot(envoyRouteConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignment := snapshot.GetResources(resourcev3.EndpointType)["vcb-service-a"].(*endpointv3.ClusterLoadAssignment)
+	lbEndpoints := assignment.Endpoints[0].LbEndpoints
+	if len(lbEndpoints) != 2 || lbEndpoints[0].LoadBalancingWeight.GetValue() != 3 || lbEndpoints[1].HealthStatus != corev3.HealthStatus_DRAINING {
+		t.Errorf("unexpected endpoints %v", lbEndpoints)
+	}
+	if cluster := snapshot.GetResources(resourcev3.ClusterType)["vcb-service-a"].(*clusterv3.Cluster); cluster.TransportSocket == nil {
+		t.Errorf("expected the cluster with an https server to use TLS, got %v", cluster)
+	}
+
+	config := snapshot.GetResources(resourcev3.RouteType)[envoyRouteConfig].(*routev3.RouteConfiguration)
+	var domains []string
+	for _, vh := range config.VirtualHosts {
+		domains = append(domains, vh.Domains...)
+	}
+	expectedDomains := []string{"a.example.com", "a.example.com:*", "service-a", "service-a:*", "*"}
+	if !reflect.DeepEqual(expectedDomains, domains) {
+		t.Errorf("expected virtual hosts for %v, got %v", expectedDomains, domains)
+	}
+	var names []string
+	for _, r := range config.VirtualHosts[0].Routes {
+		names = append(names, r.Name)
+	}
+	expectedNames := []string{"vcb-internal-service-a", "vcb-health-service-a-s1", "vcb-health-service-a-s2", "vcb-service-a-path-regex-content", "vcb-byhostheader-service-a"}
+	if !reflect.DeepEqual(expectedNames, names) {
+		t.Errorf("expected routes %v, got %v", expectedNames, names)
+	}
+	path := config.VirtualHosts[0].Routes[3]
+	if path.Match.GetSafeRegex().GetRegex() != ".*(?:^/content/.*).*" || path.Match.Headers[0].Name != ":method" {
+		t.Errorf("unexpected path route match %v", path.Match)
+	}
+	if rewrite := path.GetRoute().RegexRewrite; rewrite.Pattern.Regex != "/content/?(.*)" || rewrite.Substitution != `/\1` {
+		t.Errorf("unexpected path rewrite %v", rewrite)
+	}
+}
+
+func TestConfigFileWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcb-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "a"
+	f := &configFile{
+		name:          "test",
+		path:          filepath.Join(dir, "proxy.conf"),
+		reloadCommand: "echo reloaded >> " + filepath.Join(dir, "reloads"),
+		render: func(services []Service, vc vulcanConf) []byte {
+			return []byte(content)
+		},
+	}
+	for _, c := range []string{"a", "a", "b"} {
+		content = c
+		if err := f.write(nil, vulcanConf{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if written, _ := ioutil.ReadFile(f.path); string(written) != "b" {
+		t.Errorf("expected the last content to be written, got %q", written)
+	}
+	if reloads, _ := ioutil.ReadFile(filepath.Join(dir, "reloads")); strings.Count(string(reloads), "reloaded") != 2 {
+		t.Errorf("expected a reload per change, got %q", reloads)
+	}
+
+	f.reloadCommand = "false"
+	content = "c"
+	if err := f.write(nil, vulcanConf{}); err == nil {
+		t.Error("expected the failing reload command to be reported")
+	}
+}
+
+func TestEncodeExport(t *testing.T) {
+	e := export{
+		Created: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Keys:    vulcanConfToEtcdKeys(buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}})),
+	}
+	for format, unmarshal := range map[string]func([]byte, interface{}) error{"json": json.Unmarshal, "yaml": yaml.Unmarshal} {
+		b, err := encodeExport(e, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded export
+		if err := unmarshal(b, &decoded); err != nil {
+			t.Fatalf("%s export doesn't decode: %v", format, err)
+		}
+		if !reflect.DeepEqual(e.Keys, decoded.Keys) || !decoded.Created.Equal(e.Created) {
+			t.Errorf("expected the %s export to decode to %v, got %v", format, e, decoded)
+		}
+	}
+	if _, err := encodeExport(e, "toml"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+	if err := setValues(kapi, map[string]string{
+		"/vulcand/backends/vcb-gone/backend":         `{"Type": "http"}`,
+		"/vulcand/backends/vcb-service-a/backend":    `{"Type": "broken"}`,
+		"/vulcand/frontends/other/frontend":          `{"Type": "http"}`,
+		"/vulcand/backends/vcb-service-a/servers/s1": `{"url":"http://host1:80"}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := vulcanConfToEtcdKeys(buildVulcanConf([]Service{{Name: "service-a", Addresses: map[string]string{"srv1": "http://host1:80"}}}))
+	b, err := encodeExport(export{Created: time.Now(), Keys: keys}, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := decodeExport(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Keys["/vulcand/listeners/l1"] = `{"Protocol": "http"}`
+	vc, skipped, err := restoredConf(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, []string{"/vulcand/listeners/l1"}) {
+		t.Errorf("expected the unmanaged key to be skipped, got %v", skipped)
+	}
+	if _, err := applyVulcanConf(kapi, vc); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, _ := readAllKeysFromEtcd(kapi, "/vulcand/")
+	expected := map[string]string{"/vulcand/frontends/other/frontend": `{"Type": "http"}`}
+	for k, v := range keys {
+		expected[k] = v
+	}
+	if !reflect.DeepEqual(expected, existing) {
+		t.Errorf("expected the export to be restored, leaving the unmanaged keys, got %v", existing)
+	}
+
+	for _, keys := range []map[string]string{
+		{"/vulcand/frontends/other/frontend": `{"Type": "http"}`},
+		{"/ft/services/service-a/servers/srv1": "http://host1:80"},
+		{"/vulcand/hosts/example.com/host": hostValue("example.com", vulcanHost{Cert: "cert", Key: "REDACTED"})},
+	} {
+		if _, _, err := restoredConf(export{Keys: keys}); err == nil {
+			t.Errorf("expected %v not to be restored", keys)
+		}
+	}
+}
+
+func TestVulcandSnapshots(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	dir, err := ioutil.TempDir("", "vcb-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"/vulcand/", "/vulcand-backups/"} {
+		if err := deleteRecursiveIfExists(kapi, d); err != nil {
+			t.Error(err)
+		}
+	}
+	first := map[string]string{"/vulcand/backends/vcb-a/backend": `{"Type": "http"}`}
+	if err := setValues(kapi, first); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newVulcandSnapshots(kapi, dir, "/vulcand-backups", 1)
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, id := range []string{"1", "2", "3"} {
+		if i == 2 {
+			if err := setValues(kapi, map[string]string{"/vulcand/backends/vcb-b/backend": `{"Type": "http"}`}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.take(kapi, id, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the unchanged tree isn't copied again, and only the last snapshot is kept
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 || filepath.Base(files[0]) != "3.json" {
+		t.Errorf("expected only snapshot 3 to be kept, got %v", files)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := decodeExport(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromEtcd, err := readEtcdSnapshot(kapi, "/vulcand-backups/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromFile.Keys) != 2 || !reflect.DeepEqual(fromFile.Keys, fromEtcd.Keys) {
+		t.Errorf("expected both snapshots to hold the tree, got %v and %v", fromFile.Keys, fromEtcd.Keys)
+	}
+	if _, err := readEtcdSnapshot(kapi, "/vulcand-backups/1"); err == nil {
+		t.Error("expected the old etcd snapshot to be removed")
+	}
+}
+
+func TestKeyTTL(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+	if err := deleteRecursiveIfExists(kapi, "/vulcand/"); err != nil {
+		t.Error(err)
+	}
+
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-foo": vulcanBackend{Servers: map[string]vulcanServer{"s1": vulcanServer{URL: "http://foo:80"}}},
+		},
+		FrontEnds: map[string]vulcanFrontend{},
+		ttl:       time.Minute,
+	}
+	ttlOf := func(k string) int64 {
+		resp, err := kapi.Get(context.Background(), k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Node.TTL
+	}
+
+	if _, err := applyVulcanConf(kapi, vc); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ttlOf("/vulcand/backends/vcb-foo/servers/s1"); ttl <= 0 || ttl > 60 {
+		t.Errorf("expected the key to be set with the TTL, got %d", ttl)
+	}
+
+	// an unchanged key is refreshed rather than set again
+	if _, err := kapi.Set(context.Background(), "/vulcand/backends/vcb-foo/backend", backendValue(nil), &client.SetOptions{TTL: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := applyVulcanConf(kapi, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected refreshing the TTL to change nothing, got %v", changes)
+	}
+	if ttl := ttlOf("/vulcand/backends/vcb-foo/backend"); ttl <= 5 {
+		t.Errorf("expected the TTL to be refreshed, got %d", ttl)
+	}
+
+	// without a TTL the keys are set again so that they no longer expire
+	vc.ttl = 0
+	changes, err = applyVulcanConf(kapi, vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected both keys to be set again, got %v", changes)
+	}
+	if ttl := ttlOf("/vulcand/backends/vcb-foo/backend"); ttl != 0 {
+		t.Errorf("expected the key not to expire, got a TTL of %d", ttl)
+	}
+}
+
+func TestVulcandTargets(t *testing.T) {
+	etcd, err := client.New(client.Config{Endpoints: []string{"http://localhost:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	for _, dir := range []string{"/vulcand-public/", "/vulcand-internal/"} {
+		if err := deleteRecursiveIfExists(kapi, dir); err != nil {
+			t.Error(err)
+		}
+	}
+
+	targets, err := parseVulcandTargets(kapi, `[{"prefix": "/vulcand-public", "services": "^public-"}, {"prefix": "/vulcand-internal/", "frontends": "^vcb-internal-"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := vulcanBackend{Servers: map[string]vulcanServer{"s1": vulcanServer{URL: "http://foo:80"}}}
+	vc := vulcanConf{
+		Backends: map[string]vulcanBackend{
+			"vcb-public-foo": backend,
+			"vcb-bar":        backend,
+		},
+		FrontEnds: map[string]vulcanFrontend{
+			"vcb-public-foo-path-foo": vulcanFrontend{Type: "http", BackendID: "vcb-public-foo", Route: "PathRegexp(`/foo`)"},
+			"vcb-internal-public-foo": vulcanFrontend{Type: "http", BackendID: "vcb-public-foo", Route: "PathRegexp(`/__public-foo/`)"},
+			"vcb-internal-bar":        vulcanFrontend{Type: "http", BackendID: "vcb-bar", Route: "PathRegexp(`/__bar/`)"},
+		},
+	}
+	changes, err := applyVulcandTargets(targets, vc, []string{"public-foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 || !strings.HasPrefix(changes[0].Key, "/vulcand-") {
+		t.Errorf("expected the changes to be made under the target prefixes, got %v", changes)
+	}
+
+	public, err := readAllKeysFromEtcd(kapi, "/vulcand-public/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal, err := readAllKeysFromEtcd(kapi, "/vulcand-internal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{
+		"/vulcand-public/frontends/vcb-public-foo-path-foo/frontend",
+		"/vulcand-public/frontends/vcb-internal-public-foo/frontend",
+		"/vulcand-internal/frontends/vcb-internal-public-foo/frontend",
+		"/vulcand-internal/frontends/vcb-internal-bar/frontend",
+		"/vulcand-internal/backends/vcb-bar/backend",
+	} {
+		if _, ok := public[k]; !ok {
+			if _, ok := internal[k]; !ok {
+				t.Errorf("expected %s to be set", k)
+			}
+		}
+	}
+	for _, k := range []string{
+		"/vulcand-public/backends/vcb-bar/backend",
+		"/vulcand-public/frontends/vcb-internal-bar/frontend",
+	} {
+		if _, ok := public[k]; ok {
+			t.Errorf("expected %s not to be given to the public target", k)
+		}
+	}
+	if _, ok := internal["/vulcand-internal/frontends/vcb-public-foo-path-foo/frontend"]; ok {
+		t.Error("expected only internal frontends to be given to the internal target")
+	}
+
+	for _, value := range []string{`[]`, `[{"prefix": "vulcand"}]`, `[{"prefix": "/v/", "services": "("}]`, `[{"prefix": "/v/", "other": 1}]`} {
+		if _, err := parseVulcandTargets(kapi, value); err == nil {
+			t.Errorf("expected %s to be rejected", value)
+		}
+	}
+}
+
 func setValues(kapi client.KeysAPI, kvs map[string]string) error {
 	for k, v := range kvs {
 		if _, err := kapi.Set(context.Background(), k, v, &client.SetOptions{}); err != nil {
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// applyStatus records the outcome of the most recent apply, for reporting over HTTP.
+type applyStatus struct {
+	sync.RWMutex
+	lastApply time.Time
+	failures  []keyFailure
+	// err is set when the apply failed as a whole, rather than for some keys
+	err string
+	// applied is set once an apply has succeeded
+	applied bool
+	// failed is the number of applies which have failed since the last one which succeeded, and
+	// failureLimit, when set, the number after which vcb isn't ready
+	failed       int
+	failureLimit int
+	// etcd, when set, checks that etcd can be reached
+	etcd func() error
+	// watchdog, when set, checks that changes are applied
+	watchdog *applyWatchdog
+}
+
+// configuredApplyStatus returns the status checking that etcd can be reached with kapi, and
+// configured by VCB_FAILED_APPLIES_LIMIT, VCB_FAILED_APPLIES_ACTION and VCB_WATCHDOG_SECONDS.
+func configuredApplyStatus(kapi client.KeysAPI) *applyStatus {
+	status := &applyStatus{etcd: etcdReachable(kapi)}
+	if failedAppliesLimit != "" {
+		limit, err := strconv.Atoi(failedAppliesLimit)
+		if err != nil || limit < 0 {
+			log.Printf("WARN - The provided VCB_FAILED_APPLIES_LIMIT=%s is invalid, using no limit", failedAppliesLimit)
+		} else {
+			status.failureLimit = limit
+		}
+	}
+	if watchdogSeconds != "" {
+		seconds, err := strconv.Atoi(watchdogSeconds)
+		if err != nil || seconds < 1 {
+			log.Printf("WARN - The provided VCB_WATCHDOG_SECONDS=%s is invalid, not watching for a stale configuration", watchdogSeconds)
+		} else if dryRun {
+			log.Printf("WARN - VCB_WATCHDOG_SECONDS is ignored in a dry run, which applies nothing")
+		} else {
+			status.watchdog = newApplyWatchdog(time.Duration(seconds)*time.Second, watchdogWebhook)
+		}
+	}
+	switch failedAppliesAction {
+	case "unready", "exit":
+	case "":
+		failedAppliesAction = "unready"
+	default:
+		log.Printf("WARN - The provided VCB_FAILED_APPLIES_ACTION=%s is invalid, using default value=unready", failedAppliesAction)
+		failedAppliesAction = "unready"
+	}
+	return status
+}
+
+func (s *applyStatus) update(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastApply = time.Now()
+	s.failures = nil
+	s.err = ""
+	if ae, ok := err.(applyError); ok {
+		s.failures = ae.Failures
+	} else if err != nil {
+		s.err = err.Error()
+	} else {
+		s.applied = true
+	}
+	if err != nil {
+		s.failed++
+		appliesFailed.Add(1)
+	} else {
+		s.failed = 0
+	}
+	appliesFailedConsecutive.Set(int64(s.failed))
+	applyFailedKeysLast.Set(int64(len(s.failures)))
+}
+
+// failedTooOften reports whether the failure limit has been reached, returning the number of
+// consecutive failed applies.
+func (s *applyStatus) failedTooOften() (int, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.failed, s.failureLimit > 0 && s.failed >= s.failureLimit
+}
+
+type healthResponse struct {
+	OK         bool         `json:"ok"`
+	LastApply  *time.Time   `json:"lastApply,omitempty"`
+	FailedKeys []keyFailure `json:"failedKeys"`
+	Error      string       `json:"error,omitempty"`
+	// ConsecutiveFailures is the number of applies which have failed since the last one which
+	// succeeded
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// Etcd is ok, or why etcd can't be reached
+	Etcd string `json:"etcd,omitempty"`
+	// Stale is why the configuration is stale, see applyWatchdog
+	Stale string `json:"stale,omitempty"`
+}
+
+func (s *applyStatus) health() healthResponse {
+	etcdErr := s.checkEtcd()
+	staleErr := s.watchdog.check(time.Now())
+
+	s.RLock()
+	defer s.RUnlock()
+	h := healthResponse{
+		OK:                  len(s.failures) == 0 && s.err == "" && etcdErr == nil && staleErr == nil,
+		FailedKeys:          append([]keyFailure{}, s.failures...),
+		Error:               s.err,
+		ConsecutiveFailures: s.failed,
+	}
+	if !s.lastApply.IsZero() {
+		lastApply := s.lastApply
+		h.LastApply = &lastApply
+	}
+	if staleErr != nil {
+		h.Stale = staleErr.Error()
+	}
+	if etcdErr != nil {
+		h.Etcd = etcdErr.Error()
+	} else if s.etcd != nil {
+		h.Etcd = "ok"
+	}
+	return h
+}
+
+// ready returns why vcb isn't ready to be relied on, or nil once an apply has succeeded and etcd
+// can be reached, unless the failure limit has been reached since.
+func (s *applyStatus) ready() error {
+	if err := s.checkEtcd(); err != nil {
+		return fmt.Errorf("etcd can't be reached: %v", err)
+	}
+	if failed, tooOften := s.failedTooOften(); tooOften {
+		return fmt.Errorf("the last %d applies failed", failed)
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if !s.applied {
+		return fmt.Errorf("no apply has succeeded yet")
+	}
+	return nil
+}
+
+func (s *applyStatus) checkEtcd() error {
+	if s.etcd == nil {
+		return nil
+	}
+	return s.etcd()
+}
+
+// etcdReachable returns a check that etcd answers a read within a couple of seconds.
+func etcdReachable(kapi client.KeysAPI) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := kapi.Get(ctx, "/", nil)
+		return err
+	}
+}
+
+// publicMux serves the endpoints which are safe to expose to anyone, e.g. through vulcand.
+func publicMux(status *applyStatus) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__health", healthHandler(status))
+	mux.HandleFunc("/__gtg", gtgHandler(status))
+	mux.HandleFunc("/__build-info", buildInfoHandler)
+	return mux
+}
+
+// adminMux serves the privileged endpoints, see serveAdmin.
+func adminMux(consistency *startupConsistency, validation *latestValidation) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__consistency", consistencyHandler(consistency))
+	mux.HandleFunc("/__validation", validationHandler(validation))
+	mux.Handle("/__metrics", expvar.Handler())
+	return mux
+}
+
+// serveEndpoints serves the status on VCB_HTTP_ADDRESS, and the privileged endpoints of admin,
+// protected by VCB_ADMIN_TOKEN, on VCB_ADMIN_ADDRESS or without it alongside the status.
+func serveEndpoints(status *applyStatus, admin *http.ServeMux) {
+	if pprofValue == "true" {
+		log.Printf("serving profiles on /debug/pprof/\n")
+		handlePprof(admin)
+	}
+	protected := requireToken(adminToken, admin)
+	if adminAddress != "" {
+		go serveAdmin(adminAddress, protected, adminTLSCert, adminTLSKey, adminClientCA)
+	} else if adminTLSCert != "" || adminClientCA != "" {
+		log.Printf("WARN - The admin TLS settings are ignored without VCB_ADMIN_ADDRESS")
+	}
+	if httpAddress != "" {
+		mux := publicMux(status)
+		if adminAddress == "" {
+			// without an admin address the privileged endpoints are served alongside the health check
+			mux.Handle("/", protected)
+		}
+		go serveHTTP(httpAddress, mux)
+	}
+}
+
+// handlePprof serves the runtime profiles under /debug/pprof/, e.g. to find out why rebuilds of a
+// large configuration are slow.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func serveHTTP(address string, handler http.Handler) {
+	log.Printf("listening for http requests on %s\n", address)
+	if err := http.ListenAndServe(address, handler); err != nil {
+		log.Fatalf("http server failed: %v\n", err)
+	}
+}
+
+// healthHandler reports the keys that failed to be written or deleted in the most recent apply,
+// so that it is visible which routes may be stale.
+func healthHandler(status *applyStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := status.health()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			log.Printf("failed to write health response: %v\n", err)
+		}
+	}
+}
+
+// gtgHandler reports whether vcb is good to go, i.e. ready: it has applied a configuration and
+// can reach etcd to apply the next one.
+func gtgHandler(status *applyStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := status.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// rebuildTrigger asks the builder loop for a rebuild without waiting for a change or the cooldown
+// period. A rebuild already asked for and not yet started isn't asked for twice.
+type rebuildTrigger chan struct{}
+
+func newRebuildTrigger() rebuildTrigger {
+	return make(rebuildTrigger, 1)
+}
+
+// trigger asks for a rebuild, returning false when one has already been asked for.
+func (t rebuildTrigger) trigger() bool {
+	select {
+	case t <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// onSignal asks for a rebuild whenever the process receives the signal.
+func (t rebuildTrigger) onSignal(sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	go func() {
+		for range signals {
+			log.Printf("received %v, asking for a rebuild\n", sig)
+			t.trigger()
+		}
+	}()
+}
+
+// rebuildHandler asks for a rebuild on a POST, for operators who have just fixed a service and
+// don't want to wait for the cooldown period or restart vcb.
+func rebuildHandler(rebuilds rebuildTrigger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if rebuilds.trigger() {
+			fmt.Fprintln(w, "rebuild requested")
+		} else {
+			fmt.Fprintln(w, "a rebuild is already requested")
+		}
+	}
+}
+
+// consistencyHandler serves the consistency report produced on startup, or a 404 until the first
+// rebuild has produced it.
+func consistencyHandler(consistency *startupConsistency) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := consistency.get()
+		if report == nil {
+			http.Error(w, "consistency check has not run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("failed to write consistency response: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// auditEntry is a change made to /vulcand/, and the rebuild which made it.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Rebuild  string    `json:"rebuild"`
+	Action   string    `json:"action"`
+	Key      string    `json:"key"`
+	OldValue string    `json:"oldValue,omitempty"`
+	NewValue string    `json:"newValue,omitempty"`
+}
+
+// auditLog appends each change made to /vulcand/ to a file per day in dir, and to prefix in etcd,
+// e.g. to find out what changed routing during an incident. Entries older than retention are
+// removed, those in etcd by expiring. An audit log with neither records nothing.
+type auditLog struct {
+	dir       string
+	prefix    string
+	kapi      client.KeysAPI
+	retention time.Duration
+}
+
+// newAuditLog returns the audit log configured by VCB_AUDIT_DIR, VCB_AUDIT_PREFIX and
+// VCB_AUDIT_RETENTION_DAYS.
+func newAuditLog(kapi client.KeysAPI) auditLog {
+	a := auditLog{dir: auditDir, prefix: auditPrefix, kapi: kapi, retention: 30 * 24 * time.Hour}
+	if auditRetentionDays != "" {
+		days, err := strconv.Atoi(auditRetentionDays)
+		if err != nil || days < 1 {
+			log.Printf("WARN - The provided VCB_AUDIT_RETENTION_DAYS=%s is invalid, using default value=30", auditRetentionDays)
+		} else {
+			a.retention = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return a
+}
+
+// record appends the changes made by the rebuild at the time they were made. Private keys are
+// redacted.
+func (a auditLog) record(rebuild string, at time.Time, changes []keyChange) {
+	if (a.dir == "" && a.prefix == "") || len(changes) == 0 {
+		return
+	}
+	var entries []auditEntry
+	for _, c := range changes {
+		entries = append(entries, auditEntry{
+			Time:     at,
+			Rebuild:  rebuild,
+			Action:   c.Action,
+			Key:      c.Key,
+			OldValue: redactValue(c.Key, c.OldValue),
+			NewValue: redactValue(c.Key, c.NewValue),
+		})
+	}
+	if a.dir != "" {
+		if err := a.appendToFile(at, entries); err != nil {
+			log.Printf("WARN - failed to write the audit log of rebuild %s: %v\n", rebuild, err)
+		}
+		a.prune(at)
+	}
+	if a.prefix != "" {
+		if err := a.appendToEtcd(entries); err != nil {
+			log.Printf("WARN - failed to write the audit log of rebuild %s to %s: %v\n", rebuild, a.prefix, err)
+		}
+	}
+}
+
+func (a auditLog) file(day time.Time) string {
+	return filepath.Join(a.dir, "audit-"+day.UTC().Format("2006-01-02")+".log")
+}
+
+func (a auditLog) appendToFile(at time.Time, entries []auditEntry) error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.file(at), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := e.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// appendToEtcd creates the entries in order under the prefix, expiring after the retention.
+func (a auditLog) appendToEtcd(entries []auditEntry) error {
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := a.kapi.CreateInOrder(context.Background(), a.prefix, string(b), &client.CreateInOrderOptions{TTL: a.retention}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune removes the files of the days which are entirely older than the retention.
+func (a auditLog) prune(now time.Time) {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		log.Printf("WARN - failed to list the audit log: %v\n", err)
+		return
+	}
+	oldest := a.file(now.Add(-a.retention))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, "audit-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		if filepath.Join(a.dir, name) < oldest {
+			if err := os.Remove(filepath.Join(a.dir, name)); err != nil {
+				log.Printf("WARN - failed to remove old audit log %s: %v\n", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+var bcryptHashRegex = regexp.MustCompile(`^\$2[aby]?\$[0-9]{2}\$[./A-Za-z0-9]{53}$`)
+
+// basicAuth protects the public path frontends of a service with a vulcand auth middleware. The
+// bcrypt password hash is set either directly or as the etcd key of a secret holding it. A
+// service whose auth can't be resolved keeps an empty hash, so that every request is refused
+// rather than the service being exposed.
+type basicAuth struct {
+	Username        string
+	PasswordHash    string `json:"-"`
+	PasswordHashKey string `json:",omitempty"`
+}
+
+// parseBasicAuth reads an auth directory with the keys username, and password-hash or
+// password-hash-key.
+func parseBasicAuth(node *client.Node) (*basicAuth, error) {
+	auth := &basicAuth{}
+	for _, child := range node.Nodes {
+		switch filepath.Base(child.Key) {
+		case "username":
+			auth.Username = child.Value
+		case "password-hash":
+			auth.PasswordHash = child.Value
+		case "password-hash-key":
+			auth.PasswordHashKey = child.Value
+		default:
+			return &basicAuth{}, fmt.Errorf("%s: unknown key", filepath.Base(child.Key))
+		}
+	}
+	if auth.Username == "" {
+		return &basicAuth{}, fmt.Errorf("username is required")
+	}
+	if (auth.PasswordHash == "") == (auth.PasswordHashKey == "") {
+		return &basicAuth{}, fmt.Errorf("exactly one of password-hash and password-hash-key is required")
+	}
+	if auth.PasswordHash != "" && !bcryptHashRegex.MatchString(auth.PasswordHash) {
+		return &basicAuth{}, fmt.Errorf("password-hash is not a bcrypt hash")
+	}
+	return auth, nil
+}
+
+// resolveAuthSecrets reads the password hashes of services referring to a secret.
+func resolveAuthSecrets(kapi client.KeysAPI, services []Service) []Service {
+	for i, service := range services {
+		if service.Auth == nil || service.Auth.PasswordHashKey == "" {
+			continue
+		}
+		auth := *service.Auth
+		auth.PasswordHash = ""
+		resp, err := kapi.Get(context.Background(), auth.PasswordHashKey, nil)
+		switch {
+		case err != nil:
+			builderLog.Errorf("failed to read password hash of service %s from %s, refusing all requests: %v\n", service.Name, auth.PasswordHashKey, err)
+		case !bcryptHashRegex.MatchString(resp.Node.Value):
+			builderLog.Errorf("password hash of service %s in %s is not a bcrypt hash, refusing all requests\n", service.Name, auth.PasswordHashKey)
+		default:
+			auth.PasswordHash = resp.Node.Value
+		}
+		services[i].Auth = &auth
+	}
+	return services
+}
+
+// withBasicAuth returns the middlewares of a service's public path frontends, which are those of
+// its main frontends plus its auth.
+func withBasicAuth(service Service, middlewares map[string]string) map[string]string {
+	if service.Auth == nil {
+		return middlewares
+	}
+	if _, found := middlewares["auth"]; found {
+		builderLog.Warnf("middleware auth of service %s is replaced by its auth settings\n", service.Name)
+	}
+	spec := map[string]string{"Username": service.Auth.Username, "PasswordHash": service.Auth.PasswordHash}
+	withAuth := map[string]string{"auth": middlewareValue("auth", "auth", service.middlewarePriority("auth", 0), spec)}
+	for id, mw := range middlewares {
+		if id != "auth" {
+			withAuth[id] = mw
+		}
+	}
+	return withAuth
+}
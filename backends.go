@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// configuredBackendSettings are merged over the built in defaults of every backend, and under any
+// per-service backend-settings
+var configuredBackendSettings map[string]interface{}
+
+// the settings used for every backend, which per-service backend-settings are merged over
+func defaultBackendSettings() map[string]interface{} {
+	return mergeSettings(map[string]interface{}{
+		"KeepAlive": map[string]interface{}{
+			"MaxIdleConnsPerHost": 256,
+			"Period":              "35s",
+		},
+	}, configuredBackendSettings)
+}
+
+// the vulcand backend settings which may be set per service, with the kinds of the fields of those
+// which are checked
+var backendSettingsKeys = map[string]map[string]string{
+	"Timeouts": {
+		"Read":         "duration",
+		"Dial":         "duration",
+		"TLSHandshake": "duration",
+	},
+	"KeepAlive": {
+		"Period":              "duration",
+		"MaxIdleConnsPerHost": "count",
+	},
+	"TLS": nil,
+}
+
+// parseBackendSettings parses and validates a JSON fragment of vulcand backend settings, e.g.
+// {"Timeouts": {"Read": "10s", "Dial": "2s"}}.
+func parseBackendSettings(value string) (map[string]interface{}, error) {
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		return nil, err
+	}
+	for k, v := range settings {
+		fields, supported := backendSettingsKeys[k]
+		if !supported {
+			return nil, fmt.Errorf("unsupported setting %s", k)
+		}
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("setting %s must be an object", k)
+		}
+		if fields == nil {
+			continue
+		}
+		for field, value := range object {
+			if err := checkBackendSetting(fields[field], value); err != nil {
+				return nil, fmt.Errorf("setting %s.%s %v", k, field, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// checkBackendSetting checks the value of a field of a backend setting is of its kind.
+func checkBackendSetting(kind string, value interface{}) error {
+	switch kind {
+	case "duration":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("must be a duration, e.g. \"10s\"")
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return fmt.Errorf("must be a duration, e.g. \"10s\": %v", err)
+		}
+	case "count":
+		n, ok := value.(float64)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return fmt.Errorf("must be a whole number")
+		}
+	default:
+		return fmt.Errorf("is not supported")
+	}
+	return nil
+}
+
+// mergeSettings returns a copy of base with overrides deep merged over it.
+func mergeSettings(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		baseChild, baseIsMap := merged[k].(map[string]interface{})
+		overrideChild, overrideIsMap := v.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[k] = mergeSettings(baseChild, overrideChild)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// backendValue returns the /vulcand/backends/<be>/backend value with settings merged over the defaults.
+func backendValue(settings map[string]interface{}) string {
+	return marshalValue(backendKeyValue{
+		Type:     "http",
+		Settings: mergeSettings(defaultBackendSettings(), settings),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import "strings"
+
+// canaryPrefix starts the ids of the servers read from a service's canary directory, which are
+// otherwise servers like any other.
+const canaryPrefix = "canary-"
+
+func isCanary(serverID string) bool {
+	return strings.HasPrefix(serverID, canaryPrefix)
+}
+
+// mainBackendWeights returns the weight of each server in the service's main backend, where 0 is
+// vulcand's default. With a canary weight the canary servers share that percentage of the requests
+// and the other servers the rest, each set split by the servers' own weights. Servers missing from
+// the result are left out of the main backend, e.g. the canary servers at a canary weight of 0, and
+// so are draining servers, which are weighted 0 by buildVulcanConf instead.
+func (s Service) mainBackendWeights() map[string]int {
+	weights := make(map[string]int)
+	weightOf := func(id string) int {
+		if w := s.Weights[id]; w > 0 {
+			return w
+		}
+		return 1
+	}
+
+	stableTotal, canaryTotal := 0, 0
+	for id := range s.Addresses {
+		if s.draining[id] {
+			continue
+		}
+		if isCanary(id) {
+			canaryTotal += weightOf(id)
+		} else {
+			stableTotal += weightOf(id)
+		}
+	}
+	if s.CanaryWeight == nil || stableTotal == 0 || canaryTotal == 0 {
+		// nothing to split between
+		for id := range s.Addresses {
+			if !s.draining[id] {
+				weights[id] = s.Weights[id]
+			}
+		}
+		return weights
+	}
+
+	// stable:canary is stableTotal*canaryTotal*(100-p):stableTotal*canaryTotal*p over the sets
+	divisor := 0
+	for id := range s.Addresses {
+		if s.draining[id] {
+			continue
+		}
+		w := weightOf(id) * canaryTotal * (100 - *s.CanaryWeight)
+		if isCanary(id) {
+			w = weightOf(id) * stableTotal * *s.CanaryWeight
+		}
+		if w > 0 {
+			weights[id] = w
+			divisor = gcd(divisor, w)
+		}
+	}
+	for id := range weights {
+		weights[id] /= divisor
+	}
+	return weights
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
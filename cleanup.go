@@ -0,0 +1,283 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// cleanupRule describes a directory of entries (e.g. frontends) which are removed once they have
+// no content apart from an empty placeholder directory (e.g. "middlewares"). The directory is
+// relative to the vulcand prefix being cleaned, /vulcand/ or that of a target or of staging.
+type cleanupRule struct {
+	Dir         string
+	Placeholder string
+}
+
+// vulcandCleanupRules are the rules of the cleanup after each apply, set with VCB_CLEANUP_RULES.
+var vulcandCleanupRules = []cleanupRule{
+	{Dir: "frontends/", Placeholder: "middlewares"},
+	{Dir: "backends/", Placeholder: "servers"},
+	{Dir: "hosts/", Placeholder: "listeners"},
+}
+
+// cleanupMaxDeletions is the most entries a single cleanup may remove, as a safety net against
+// wiping out the whole configuration. 0 means no limit.
+var cleanupMaxDeletions = 50
+
+// cleanupEntriesLeft is the number of empty entries the most recent cleanup left because there
+// were more than cleanupMaxDeletions of them.
+var cleanupEntriesLeft = expvar.NewInt("cleanup_entries_left")
+
+// parseCleanupRules reads a comma separated list of rules, each a directory relative to the vulcand
+// prefix and the placeholder of its entries, e.g. "frontends=middlewares,backends=servers". The
+// directories can't leave the prefix, so that a mistake can't remove anything else.
+func parseCleanupRules(value string) ([]cleanupRule, error) {
+	var rules []cleanupRule
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || strings.Contains(kv[1], "/") {
+			return nil, fmt.Errorf("expected <directory>=<placeholder>, got %s", part)
+		}
+		dir := strings.TrimSpace(kv[0])
+		if !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		if strings.HasPrefix(dir, "/") || dir == "/" || strings.Contains(dir, "..") {
+			return nil, fmt.Errorf("%s isn't a directory relative to the vulcand prefix", kv[0])
+		}
+		rules = append(rules, cleanupRule{Dir: dir, Placeholder: strings.TrimSpace(kv[1])})
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return rules, nil
+}
+
+// cleanEmptyEntries scans the directories of the rules under /vulcand/, which kapi may rebase onto
+// another prefix, concurrently, and removes their empty entries unless there are more than
+// maxDeletions of them. It returns the keys it removed, and the failures to read a directory or to
+// remove an entry, and the entries left because of the limit, for the apply to report.
+func cleanEmptyEntries(kapi client.KeysAPI, rules []cleanupRule, maxDeletions int) ([]string, []keyFailure) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var candidates []string
+	var failures []keyFailure
+
+	for _, rule := range rules {
+		wg.Add(1)
+		go func(rule cleanupRule) {
+			defer wg.Done()
+			empty, err := findEmptyEntries(kapi, rule)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				applierLog.Errorf("cleanup failed to read %s: %v\n", "/vulcand/"+rule.Dir, err)
+				failures = append(failures, keyFailure{Action: "read", Key: "/vulcand/" + rule.Dir, Error: err.Error()})
+				return
+			}
+			candidates = append(candidates, empty...)
+		}(rule)
+	}
+	wg.Wait()
+	sort.Strings(candidates)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+
+	cleanupEntriesLeft.Set(0)
+	if maxDeletions > 0 && len(candidates) > maxDeletions {
+		applierLog.Errorf("cleanup found %d empty entries, more than the limit of %d, not removing any: %v\n", len(candidates), maxDeletions, candidates)
+		cleanupEntriesLeft.Set(int64(len(candidates)))
+		for _, key := range candidates {
+			failures = append(failures, keyFailure{Action: "delete", Key: key, Error: fmt.Sprintf("more than the cleanup limit of %d empty entries", maxDeletions)})
+		}
+		candidates = nil
+	}
+
+	var removed []string
+	for _, key := range candidates {
+		_, err := kapi.Delete(context.Background(), key, &client.DeleteOptions{Recursive: true})
+		if err != nil {
+			applierLog.Errorf("failed to remove unwanted entry %v\n", key)
+			failures = append(failures, keyFailure{Action: "delete", Key: key, Error: err.Error()})
+			continue
+		}
+		removed = append(removed, key)
+	}
+	if len(removed) > 0 {
+		applierLog.Infof("cleanup removed %d empty entries: %v\n", len(removed), removed)
+	}
+	return removed, failures
+}
+
+func findEmptyEntries(kapi client.KeysAPI, rule cleanupRule) ([]string, error) {
+	dir := "/vulcand/" + rule.Dir
+	resp, err := kapi.Get(context.Background(), dir, nil)
+	if err != nil {
+		if e, ok := err.(client.Error); ok && e.Code == etcderr.EcodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !resp.Node.Dir {
+		applierLog.Warnf("%s is not a directory.\n", dir)
+		return nil, nil
+	}
+
+	// the entries are read one at a time, rather than all of them at once
+	var empty []string
+	for _, entry := range resp.Node.Nodes {
+		hasContent := false
+		if entry.Dir {
+			entryResp, err := kapi.Get(context.Background(), entry.Key, &client.GetOptions{Recursive: true})
+			if err != nil {
+				if e, ok := err.(client.Error); ok && e.Code == etcderr.EcodeKeyNotFound {
+					continue
+				}
+				return nil, err
+			}
+			for _, child := range entryResp.Node.Nodes {
+				// anything apart from an empty placeholder dir means this is needed.
+				if filepath.Base(child.Key) != rule.Placeholder || len(child.Nodes) > 0 {
+					hasContent = true
+					break
+				}
+			}
+		}
+		if !hasContent {
+			empty = append(empty, entry.Key)
+		}
+	}
+	return empty, nil
+}
+
+// findOrphanedKeys returns the keys of the vcb- frontends and backends which none of the services
+// would generate, e.g. those left by an earlier version which named them differently. Those of
+// locked services are left out. They are sorted so that each frontend or backend is deleted after
+// the middlewares or servers under it.
+func findOrphanedKeys(kapi client.KeysAPI, services []string, frozen func(name string) bool) (map[string]string, []string, error) {
+	orphaned := make(map[string]string)
+	for _, dir := range []string{"/vulcand/backends/", "/vulcand/frontends/"} {
+		resp, err := kapi.Get(context.Background(), dir, &client.GetOptions{Recursive: true})
+		if err != nil {
+			if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
+				continue
+			}
+			return nil, nil, err
+		}
+		for _, entry := range resp.Node.Nodes {
+			name := filepath.Base(entry.Key)
+			if !strings.HasPrefix(name, managedPrefix) || ownerOf(name, services) != "" || (frozen != nil && frozen(name)) {
+				continue
+			}
+			addValuesToMap(orphaned, entry)
+		}
+	}
+	keys := make([]string, 0, len(orphaned))
+	for k := range orphaned {
+		keys = append(keys, k)
+	}
+	sortByCreationOrder(keys)
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return orphaned, keys, nil
+}
+
+func addValuesToMap(m map[string]string, node *client.Node) {
+	if node.Dir {
+		for _, child := range node.Nodes {
+			addValuesToMap(m, child)
+		}
+	} else {
+		m[node.Key] = node.Value
+	}
+}
+
+// pruneOrphans deletes the keys of the vcb- frontends and backends which none of the services
+// would generate, or only returns them when dryRun is set.
+func pruneOrphans(kapi client.KeysAPI, services []string, frozen func(name string) bool, dryRun bool) ([]keyChange, error) {
+	orphaned, keys, err := findOrphanedKeys(kapi, services, frozen)
+	if err != nil {
+		return nil, err
+	}
+	var changes []keyChange
+	var failures []keyFailure
+	for _, k := range keys {
+		if !dryRun {
+			if _, err := kapi.Delete(context.Background(), k, nil); err != nil {
+				applierLog.Errorf("failed to prune %s: %v\n", k, err)
+				failures = append(failures, keyFailure{Action: "delete", Key: k, Error: err.Error()})
+				continue
+			}
+		}
+		changes = append(changes, keyChange{Action: "delete", Key: k, OldValue: redactValue(k, orphaned[k])})
+	}
+	if !dryRun && len(changes) > 0 {
+		_, cleanupFailures := cleanEmptyEntries(kapi, vulcandCleanupRules, cleanupMaxDeletions)
+		failures = append(failures, cleanupFailures...)
+	}
+	if len(failures) > 0 {
+		return changes, applyError{failures}
+	}
+	return changes, nil
+}
+
+// pruneCommand deletes the vcb- frontends and backends which don't belong to any of the services,
+// which rebuilds can leave behind, e.g. a frontend still holding middlewares vcb didn't create.
+func pruneCommand(args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the keys which would be deleted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: prune [--dry-run]\n")
+		return 2
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 1
+	}
+	kapi := client.NewKeysAPI(etcd)
+	vc, services, _ := newRebuilder(kapi).generate(context.Background())
+	if len(services) == 0 {
+		// every vcb- frontend and backend would be deleted
+		fmt.Fprintf(os.Stderr, "no services read, not pruning\n")
+		return 1
+	}
+
+	changes, err := pruneOrphans(vulcandKeys(kapi), serviceNames(services), vc.frozen, *dryRun)
+	for _, c := range changes {
+		fmt.Println(c.Key)
+	}
+	if !*dryRun {
+		newAuditLog(kapi).record("prune-"+newRebuildID(time.Now()), time.Now(), changes)
+		if len(changes) > 0 {
+			configuredPostApplyHooks().run(changes)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to prune: %v\n", err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "%d orphaned keys would be deleted\n", len(changes))
+	} else {
+		fmt.Fprintf(os.Stderr, "%d orphaned keys deleted\n", len(changes))
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// commands are run instead of the builder loop when vcb is started with a sub-command,
+// e.g. `vcb show-rebuild <id>`. Each returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"show-rebuild": showRebuildCommand,
+	"schema":       schemaCommand,
+	"plan":         planCommand,
+	"apply":        applyCommand,
+	"export":       exportCommand,
+	"restore":      restoreCommand,
+	"version":      versionCommand,
+	"--version":    versionCommand,
+	"--once":       onceCommand,
+	"validate":     validateCommand,
+	"diff":         diffCommand,
+	"prune":        pruneCommand,
+}
+
+func runCommand(name string, args []string) int {
+	cmd, found := commands[name]
+	if !found {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown command %s, expected one of %v\n", name, names)
+		return 1
+	}
+	return cmd(args)
+}
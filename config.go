@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// desiredConfig is the configuration generated by a rebuild, grouped by the service each frontend
+// and backend belongs to, for finding out why a route is or isn't generated.
+type desiredConfig struct {
+	Generated time.Time                       `json:"generated"`
+	Services  map[string]desiredServiceConfig `json:"services"`
+	// Hosts are only set when hosts are managed
+	Hosts map[string]json.RawMessage `json:"hosts,omitempty"`
+}
+
+type desiredServiceConfig struct {
+	Frontends map[string]*desiredFrontend `json:"frontends"`
+	Backends  map[string]*desiredBackend  `json:"backends"`
+}
+
+type desiredFrontend struct {
+	Frontend    json.RawMessage            `json:"frontend"`
+	Middlewares map[string]json.RawMessage `json:"middlewares,omitempty"`
+}
+
+type desiredBackend struct {
+	Backend json.RawMessage            `json:"backend"`
+	Servers map[string]json.RawMessage `json:"servers,omitempty"`
+}
+
+// describeConfig groups the keys of the configuration by service. Every service is listed, with no
+// frontends or backends when none were generated for it.
+func describeConfig(vc vulcanConf, services []string, generated time.Time) desiredConfig {
+	config := desiredConfig{Generated: generated, Services: make(map[string]desiredServiceConfig)}
+	for _, service := range services {
+		config.Services[service] = desiredServiceConfig{
+			Frontends: make(map[string]*desiredFrontend),
+			Backends:  make(map[string]*desiredBackend),
+		}
+	}
+	if vc.Hosts != nil {
+		config.Hosts = make(map[string]json.RawMessage)
+	}
+
+	emitVulcanConfKeys(vc, func(k, v string) {
+		if isHostKey(k) {
+			name := strings.TrimSuffix(strings.TrimPrefix(k, "/vulcand/hosts/"), "/host")
+			config.Hosts[name] = json.RawMessage(redactValue(k, v))
+			return
+		}
+		name := frontendOrBackendName(k)
+		service, found := config.Services[ownerOf(name, services)]
+		if !found {
+			return
+		}
+		// the path under the frontend or backend, e.g. frontend or middlewares/rewrite
+		parts := strings.SplitN(strings.TrimPrefix(k, entityDir(k)), "/", 2)
+		if strings.HasPrefix(k, "/vulcand/frontends/") {
+			fe := service.Frontends[name]
+			if fe == nil {
+				fe = &desiredFrontend{}
+				service.Frontends[name] = fe
+			}
+			if len(parts) == 2 {
+				if fe.Middlewares == nil {
+					fe.Middlewares = make(map[string]json.RawMessage)
+				}
+				fe.Middlewares[parts[1]] = json.RawMessage(v)
+			} else {
+				fe.Frontend = json.RawMessage(v)
+			}
+			return
+		}
+		be := service.Backends[name]
+		if be == nil {
+			be = &desiredBackend{}
+			service.Backends[name] = be
+		}
+		if len(parts) == 2 {
+			if be.Servers == nil {
+				be.Servers = make(map[string]json.RawMessage)
+			}
+			be.Servers[parts[1]] = json.RawMessage(v)
+		} else {
+			be.Backend = json.RawMessage(v)
+		}
+	})
+	return config
+}
+
+// latestConfig holds the configuration generated by the most recent rebuild. It is only described
+// when it is asked for.
+type latestConfig struct {
+	sync.RWMutex
+	vc        *vulcanConf
+	services  []string
+	generated time.Time
+}
+
+func (c *latestConfig) set(vc vulcanConf, services []string, generated time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.vc = &vc
+	c.services = services
+	c.generated = generated
+}
+
+func (c *latestConfig) get() *desiredConfig {
+	vc, services, generated := c.current()
+	if vc == nil {
+		return nil
+	}
+	config := describeConfig(*vc, services, generated)
+	return &config
+}
+
+// current returns the configuration and the names of the services it was generated from, or nil
+// until the first rebuild.
+func (c *latestConfig) current() (*vulcanConf, []string, time.Time) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.vc, c.services, c.generated
+}
+
+// configHandler serves the configuration generated by the most recent rebuild, or a 404 until
+// there has been one.
+func configHandler(latest *latestConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := latest.get()
+		if config == nil {
+			http.Error(w, "no rebuild has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetEscapeHTML(false)
+		e.SetIndent("", "  ")
+		if err := e.Encode(config); err != nil {
+			builderLog.Errorf("failed to write config response: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	conflictPolicyAlphabetical = "alphabetical"
+	conflictPolicyPriority     = "priority"
+	conflictPolicyReject       = "reject"
+)
+
+// hostConflict records a host claimed by more than one service, and which of them (if any) was
+// allowed to keep it.
+type hostConflict struct {
+	Host     string
+	Services []string
+	Winner   string
+}
+
+// claimedHosts returns the hosts the service wants its host header frontend to match: its name
+// and its aliases.
+func claimedHosts(service Service) []string {
+	return append([]string{service.Name}, service.HostAliases...)
+}
+
+// resolveHostConflicts applies the given precedence policy to hosts claimed by more than one
+// service. Services losing a host have it recorded in rejectedHosts, except where the conflict is
+// between services with the same name; the losers are then dropped completely, because all the
+// keys generated for them would collide with the winner's.
+func resolveHostConflicts(services []Service, policy string) ([]Service, []hostConflict) {
+	claims := make(map[string][]int)
+	for i, service := range services {
+		for _, host := range claimedHosts(service) {
+			claims[strings.ToLower(host)] = append(claims[strings.ToLower(host)], i)
+		}
+	}
+
+	var hosts []string
+	for host, claimants := range claims {
+		if len(claimants) > 1 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	dropped := make(map[int]bool)
+	rejected := make(map[int]map[string]bool)
+	var conflicts []hostConflict
+	for _, host := range hosts {
+		claimants := claims[host]
+		winner := pickHostWinner(services, claimants, policy)
+
+		conflict := hostConflict{Host: host}
+		sameName := 0
+		for _, i := range claimants {
+			if strings.EqualFold(services[i].Name, host) {
+				sameName++
+			}
+		}
+		for _, i := range claimants {
+			conflict.Services = append(conflict.Services, services[i].Name)
+			if i == winner {
+				conflict.Winner = services[i].Name
+				continue
+			}
+			if sameName > 1 && strings.EqualFold(services[i].Name, host) {
+				dropped[i] = true
+				continue
+			}
+			if rejected[i] == nil {
+				rejected[i] = make(map[string]bool)
+			}
+			rejected[i][host] = true
+		}
+		conflicts = append(conflicts, conflict)
+
+		if winner < 0 {
+			builderLog.Errorf("host %s is claimed by services %v, rejecting all of them (policy=%s)\n", host, conflict.Services, policy)
+		} else {
+			builderLog.Errorf("host %s is claimed by services %v, using %s (policy=%s)\n", host, conflict.Services, conflict.Winner, policy)
+		}
+	}
+
+	var resolved []Service
+	for i, service := range services {
+		if dropped[i] {
+			continue
+		}
+		if rejected[i] != nil {
+			service.rejectedHosts = rejected[i]
+		}
+		resolved = append(resolved, service)
+	}
+	return resolved, conflicts
+}
+
+// pickHostWinner returns the index of the service that keeps a contested host, or -1 if nobody does.
+// Ties are broken alphabetically and then by the order the services were read in.
+func pickHostWinner(services []Service, claimants []int, policy string) int {
+	if policy == conflictPolicyReject {
+		return -1
+	}
+	ordered := make([]int, len(claimants))
+	copy(ordered, claimants)
+	sort.SliceStable(ordered, func(a, b int) bool {
+		sa, sb := services[ordered[a]], services[ordered[b]]
+		if policy == conflictPolicyPriority && sa.Priority != sb.Priority {
+			return sa.Priority > sb.Priority
+		}
+		return sa.Name < sb.Name
+	})
+	return ordered[0]
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// consistencyReport compares the vcb- keys found in /vulcand/ with the services they should have
+// been generated from, e.g. to detect corruption after restoring etcd.
+type consistencyReport struct {
+	Checked time.Time `json:"checked"`
+	// vcb- keys which do not belong to any current service
+	OrphanedKeys []string `json:"orphanedKeys"`
+	// services with no vcb- keys at all
+	MissingServices []string `json:"missingServices"`
+}
+
+func checkConsistency(existing map[string]string, services []string) consistencyReport {
+	report := consistencyReport{
+		Checked:         time.Now(),
+		OrphanedKeys:    []string{},
+		MissingServices: []string{},
+	}
+
+	found := make(map[string]bool)
+	for k := range existing {
+		if !strings.HasPrefix(k, "/vulcand/backends/"+managedPrefix) && !strings.HasPrefix(k, "/vulcand/frontends/"+managedPrefix) {
+			continue
+		}
+		if isManualMiddlewareKey(k) {
+			continue
+		}
+		owner := ownerOf(frontendOrBackendName(k), services)
+		if owner == "" {
+			report.OrphanedKeys = append(report.OrphanedKeys, k)
+			continue
+		}
+		found[owner] = true
+	}
+
+	for _, service := range services {
+		if !found[service] {
+			report.MissingServices = append(report.MissingServices, service)
+		}
+	}
+
+	sort.Strings(report.OrphanedKeys)
+	sort.Strings(report.MissingServices)
+	return report
+}
+
+// startupConsistency holds the report produced on the first rebuild.
+type startupConsistency struct {
+	sync.RWMutex
+	report *consistencyReport
+}
+
+func (c *startupConsistency) set(report consistencyReport) {
+	c.Lock()
+	defer c.Unlock()
+	c.report = &report
+}
+
+func (c *startupConsistency) get() *consistencyReport {
+	c.RLock()
+	defer c.RUnlock()
+	return c.report
+}
+
+// check reads the keys under /vulcand/ and records their report, or returns why they couldn't be
+// read, in which case the check is left to the next rebuild.
+func (c *startupConsistency) check(kapi client.KeysAPI, services []string) error {
+	existing, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if err != nil {
+		return fmt.Errorf("startup consistency check failed to read /vulcand/: %v", err)
+	}
+	report := checkConsistency(existing, services)
+	log.Printf("startup consistency check found %d orphaned keys and %d services without keys\n", len(report.OrphanedKeys), len(report.MissingServices))
+	c.set(report)
+	return nil
+}
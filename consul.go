@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// consulSource reads services from the Consul catalog, optionally only those with a tag. The
+// servers of each service are its instances passing their health checks, and the rest of its
+// keys are the document at <config prefix><service> in the KV store, see serviceDocumentNodes.
+type consulSource struct {
+	api          string
+	token        string
+	tag          string
+	configPrefix string
+	client       *http.Client
+}
+
+func newConsulSource() (*consulSource, error) {
+	c := &consulSource{
+		api:          strings.TrimSuffix(os.Getenv("VCB_CONSUL_ADDRESS"), "/"),
+		token:        os.Getenv("VCB_CONSUL_TOKEN"),
+		tag:          os.Getenv("VCB_CONSUL_TAG"),
+		configPrefix: os.Getenv("VCB_CONSUL_CONFIG_PREFIX"),
+		// long enough for the blocking queries
+		client: &http.Client{Timeout: 6 * time.Minute},
+	}
+	if c.api == "" {
+		c.api = "http://127.0.0.1:8500"
+	}
+	if c.configPrefix == "" {
+		c.configPrefix = "vcb/services/"
+	}
+	return c, nil
+}
+
+// get decodes the response to a request of the Consul HTTP API into v, returning its index.
+func (c *consulSource) get(path string, query url.Values, v interface{}) (uint64, error) {
+	req, err := http.NewRequest("GET", c.api+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		// e.g. no keys under the config prefix
+		return index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s from %s", resp.Status, path)
+	}
+	return index, json.NewDecoder(resp.Body).Decode(v)
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+	}
+}
+
+func (c *consulSource) services() ([]Service, error) {
+	var catalog map[string][]string
+	if _, err := c.get("/v1/catalog/services", url.Values{}, &catalog); err != nil {
+		return nil, err
+	}
+	var kv []struct {
+		Key   string
+		Value string
+	}
+	if _, err := c.get("/v1/kv/"+c.configPrefix, url.Values{"recurse": {"true"}}, &kv); err != nil {
+		return nil, err
+	}
+	configs := make(map[string]string)
+	for _, pair := range kv {
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		configs[strings.TrimPrefix(pair.Key, c.configPrefix)] = string(value)
+	}
+
+	var names []string
+	for name, tags := range catalog {
+		if name != "consul" && (c.tag == "" || containsString(tags, c.tag)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var services []Service
+	for _, name := range names {
+		query := url.Values{"passing": {"true"}}
+		if c.tag != "" {
+			query.Set("tag", c.tag)
+		}
+		var entries []consulServiceEntry
+		if _, err := c.get("/v1/health/service/"+url.PathEscape(name), query, &entries); err != nil {
+			return nil, err
+		}
+
+		node := &client.Node{Key: "/" + name, Dir: true}
+		if config, found := configs[name]; found {
+			node.Nodes = append(node.Nodes, &client.Node{Key: node.Key + "/config", Value: config})
+		}
+		service := parseService(node)
+		if len(service.Addresses) > 0 {
+			builderLog.Warnf("ignoring servers in the config of Consul service %s, its healthy instances are used\n", name)
+			service.Addresses = make(map[string]string)
+		}
+		for _, entry := range entries {
+			address := entry.Service.Address
+			if address == "" {
+				address = entry.Node.Address
+			}
+			service.Addresses[entry.Service.ID] = httpURL(address, entry.Service.Port)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// watch notifies on changes to the catalog, the health of any check and the service configs,
+// using Consul's blocking queries.
+func (c *consulSource) watch(w *notifier) {
+	paths := map[string]url.Values{
+		"/v1/catalog/services":     {},
+		"/v1/health/state/any":     {},
+		"/v1/kv/" + c.configPrefix: {"recurse": {"true"}},
+	}
+	for path, query := range paths {
+		go c.block(path, query, w)
+	}
+}
+
+// block repeats the blocking query until vcb exits, notifying whenever its index moves on.
+func (c *consulSource) block(path string, query url.Values, w *notifier) {
+	var index uint64
+	for {
+		q := url.Values{"wait": {"5m"}, "index": {strconv.FormatUint(index, 10)}}
+		for k, v := range query {
+			q[k] = v
+		}
+		var ignored interface{}
+		next, err := c.get(path, q, &ignored)
+		if err != nil {
+			watcherLog.Errorf("blocking query of Consul %s failed: %v\n", path, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if index != 0 && next != index {
+			w.changed("Consul " + path)
+		}
+		if next < index {
+			// the index went backwards, e.g. the Consul servers were restored
+			next = 0
+		}
+		index = next
+	}
+}
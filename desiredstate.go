@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// desiredState reads the services and their routes from a version controlled file instead of
+// etcd. The file is a JSON object keyed by service name, each service holding the same keys as
+// its etcd directory would, e.g.
+//
+//	{"service-a": {"healthcheck": true, "path-regex": {"content": "/content/.*"}}}
+//
+// Only the servers of each service are still read from etcd.
+type desiredState struct {
+	path string
+	// last services read successfully, used while the file is broken
+	last []Service
+}
+
+// services reads the file, falling back to the last good read if it can't be parsed.
+func (d *desiredState) services() []Service {
+	services, err := readDesiredState(d.path)
+	if err != nil {
+		if d.last == nil {
+			log.Panicf("failed to read desired state from %s: %v\n", d.path, err)
+		}
+		builderLog.Errorf("failed to read desired state from %s, keeping the previous one: %v\n", d.path, err)
+		return d.last
+	}
+	d.last = services
+	return services
+}
+
+func readDesiredState(path string) ([]Service, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var file map[string]map[string]interface{}
+	if err := d.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var services []Service
+	for _, name := range names {
+		node, err := desiredStateNode("/"+name, file[name])
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		service := parseService(node)
+		if len(service.Addresses) > 0 {
+			builderLog.Warnf("ignoring servers of service %s in the desired state file, they are read from etcd\n", name)
+			service.Addresses = make(map[string]string)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// desiredStateNode converts a service from the desired state file, or a service document, to the
+// etcd nodes it would otherwise be read from. Values may be decoded from JSON or YAML.
+func desiredStateNode(key string, value interface{}) (*client.Node, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		node := &client.Node{Key: key, Dir: true}
+		for k, child := range v {
+			childNode, err := desiredStateNode(key+"/"+k, child)
+			if err != nil {
+				return nil, err
+			}
+			node.Nodes = append(node.Nodes, childNode)
+		}
+		return node, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, child := range v {
+			m[fmt.Sprint(k)] = child
+		}
+		return desiredStateNode(key, m)
+	case []interface{}:
+		// lists, e.g. of the addresses of a server, are kept as JSON
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value for %s: %v", key, err)
+		}
+		return &client.Node{Key: key, Value: string(b)}, nil
+	case string:
+		return &client.Node{Key: key, Value: v}, nil
+	case bool, json.Number, int, float64:
+		return &client.Node{Key: key, Value: fmt.Sprint(v)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value for %s: %v", key, value)
+	}
+}
+
+// withDynamicAddresses sets the servers of the desired services to those registered in etcd.
+// Services registered in etcd but missing from the desired state are not routed.
+func withDynamicAddresses(desired []Service, registered []Service) []Service {
+	addresses := make(map[string]map[string]string)
+	for _, service := range registered {
+		if addresses[service.Name] == nil {
+			addresses[service.Name] = make(map[string]string)
+		}
+		for id, address := range service.Addresses {
+			addresses[service.Name][id] = address
+		}
+	}
+
+	var services []Service
+	for _, service := range desired {
+		if addresses[service.Name] != nil {
+			service.Addresses = addresses[service.Name]
+		} else {
+			builderLog.Warnf("service %s has no servers registered in etcd\n", service.Name)
+		}
+		delete(addresses, service.Name)
+		services = append(services, service)
+	}
+	for name := range addresses {
+		builderLog.Infof("service %s is registered in etcd but not in the desired state, not routing it\n", name)
+	}
+	return services
+}
+
+// watchFile notifies when the file at path is modified, checking every interval.
+func (w *notifier) watchFile(path string, interval time.Duration) {
+	go func() {
+		var last time.Time
+		if info, err := os.Stat(path); err == nil {
+			last = info.ModTime()
+		}
+		for range time.Tick(interval) {
+			info, err := os.Stat(path)
+			if err != nil {
+				watcherLog.Warnf("failed to check %s for changes: %v\n", path, err)
+				continue
+			}
+			if info.ModTime().Equal(last) {
+				continue
+			}
+			last = info.ModTime()
+			if w.send() {
+				watcherLog.Debugf("%s changed, sent change message on notifier channel.", path)
+			} else {
+				watcherLog.Debugf("%s changed, not sending message on notifier channel, buffer full and no-one listening.", path)
+			}
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// keyDiff compares the keys a configuration generates with those vulcand has, e.g. to find out
+// during an incident whether vulcand is routing as vcb means it to.
+type keyDiff struct {
+	Compared time.Time `json:"compared"`
+	// Missing keys are generated, but not in vulcand
+	Missing map[string]string `json:"missing"`
+	// Extra keys are in vulcand, and managed by vcb, but not generated
+	Extra map[string]string `json:"extra"`
+	// Differing keys are in both, with different values
+	Differing map[string]valueDiff `json:"differing"`
+}
+
+type valueDiff struct {
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+}
+
+// empty reports whether vulcand has the configuration as it is generated.
+func (d keyDiff) empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Differing) == 0
+}
+
+// diffConf compares the keys of the configuration with the keys vcb manages in vulcand. Private
+// keys are redacted. The keys of locked services may differ, as they are left as they are.
+func diffConf(kapi client.KeysAPI, vc vulcanConf) (keyDiff, error) {
+	existing, _, err := readManagedKeys(kapi, vc)
+	if err != nil {
+		return keyDiff{}, err
+	}
+	d := keyDiff{
+		Compared:  time.Now(),
+		Missing:   make(map[string]string),
+		Extra:     make(map[string]string),
+		Differing: make(map[string]valueDiff),
+	}
+	emitVulcanConfKeys(vc, func(k, v string) {
+		actual, found := existing[k]
+		switch {
+		case !found:
+			d.Missing[k] = redactValue(k, v)
+		case actual != v:
+			d.Differing[k] = valueDiff{Desired: redactValue(k, v), Actual: redactValue(k, actual)}
+		}
+		delete(existing, k)
+	})
+	for k, v := range existing {
+		d.Extra[k] = redactValue(k, v)
+	}
+	return d, nil
+}
+
+// diffHandler serves the differences between the configuration generated by the most recent
+// rebuild and the production vulcand, or a 404 until there has been a rebuild. share, when set,
+// returns the part of the configuration vulcand is given.
+func diffHandler(latest *latestConfig, production func() (client.KeysAPI, error), share func(vc vulcanConf, services []string) vulcanConf) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vc, services, _ := latest.current()
+		if vc == nil {
+			http.Error(w, "no rebuild has run yet", http.StatusNotFound)
+			return
+		}
+		conf := *vc
+		if share != nil {
+			conf = share(conf, services)
+		}
+		kapi, err := production()
+		if err == nil {
+			var d keyDiff
+			d, err = diffConf(kapi, conf)
+			if err == nil {
+				writeDiff(w, d)
+				return
+			}
+		}
+		http.Error(w, "failed to read vulcand: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// diffCommand prints the differences between the configuration the next rebuild would apply and
+// vulcand, without changing anything. Like diff, it exits with 0 when there are none, 1 when there
+// are and 2 when they can't be compared, so that drift can be checked for in scripts.
+func diffCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: diff\n")
+		return 2
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 2
+	}
+	kapi := client.NewKeysAPI(etcd)
+	vc, _, _ := newRebuilder(kapi).generate(context.Background())
+	d, err := diffConf(vulcandKeys(kapi), vc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read vulcand: %v\n", err)
+		return 2
+	}
+	if err := printKeyDiff(os.Stdout, d); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to print diff: %v\n", err)
+		return 2
+	}
+	if d.empty() {
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%d keys missing, %d extra and %d differing\n", len(d.Missing), len(d.Extra), len(d.Differing))
+	return 1
+}
+
+// printKeyDiff prints the differences like a unified diff of vulcand and the generated
+// configuration, a line per key value in order of key, with what vulcand has as removed lines and
+// what is generated as added ones.
+func printKeyDiff(w io.Writer, d keyDiff) error {
+	if d.empty() {
+		return nil
+	}
+	var keys []string
+	for k := range d.Missing {
+		keys = append(keys, k)
+	}
+	for k := range d.Extra {
+		keys = append(keys, k)
+	}
+	for k := range d.Differing {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if _, err := fmt.Fprintf(w, "--- vulcand\n+++ generated\n"); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		var err error
+		if v, found := d.Missing[k]; found {
+			_, err = fmt.Fprintf(w, "+%s %s\n", k, v)
+		} else if v, found := d.Extra[k]; found {
+			_, err = fmt.Fprintf(w, "-%s %s\n", k, v)
+		} else {
+			_, err = fmt.Fprintf(w, "-%s %s\n+%s %s\n", k, d.Differing[k].Actual, k, d.Differing[k].Desired)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDiff(w http.ResponseWriter, d keyDiff) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(d); err != nil {
+		applierLog.Errorf("failed to write diff response: %v\n", err)
+	}
+}
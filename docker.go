@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// dockerSource reads services from the labels of the running containers on a Docker host, for
+// running the same routing locally without registering services in etcd:
+//
+//	vcb.service     the service the container is a server of
+//	vcb.port        the port the container serves on
+//	vcb.path-regex  a public path of the service
+//	vcb.config      a service document with any other keys, see serviceDocumentNodes
+//
+// Where the containers of a service disagree the first container, by name, wins.
+type dockerSource struct {
+	// api is the base URL requests are made to, over client
+	api    string
+	client *http.Client
+}
+
+// newDockerSource connects to DOCKER_HOST, or the local Docker socket.
+func newDockerSource() (*dockerSource, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		dialer := &net.Dialer{}
+		return &dockerSource{
+			api: "http://docker",
+			client: &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", u.Path)
+				},
+			}},
+		}, nil
+	case "tcp", "http":
+		return &dockerSource{api: "http://" + u.Host, client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST %s", host)
+	}
+}
+
+type dockerContainer struct {
+	Names  []string
+	Labels map[string]string
+	Ports  []struct {
+		IP          string
+		PrivatePort int
+		PublicPort  int
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+func (d *dockerSource) get(path string, query url.Values) (*http.Response, error) {
+	resp, err := d.client.Get(d.api + path + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (d *dockerSource) services() ([]Service, error) {
+	resp, err := d.get("/containers/json", url.Values{"filters": {`{"label":["vcb.service"]}`}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return dockerName(containers[i]) < dockerName(containers[j])
+	})
+
+	byName := make(map[string]*Service)
+	var names []string
+	for _, c := range containers {
+		name := c.Labels["vcb.service"]
+		service, found := byName[name]
+		if !found {
+			node := &client.Node{Key: "/" + name, Dir: true}
+			if config, found := c.Labels["vcb.config"]; found {
+				node.Nodes = append(node.Nodes, &client.Node{Key: node.Key + "/config", Value: config})
+			}
+			if pathRegex, found := c.Labels["vcb.path-regex"]; found {
+				node.Nodes = append(node.Nodes, &client.Node{Key: node.Key + "/path-regex", Dir: true, Nodes: []*client.Node{
+					{Key: node.Key + "/path-regex/" + name, Value: pathRegex},
+				}})
+			}
+			s := parseService(node)
+			s.Addresses = make(map[string]string)
+			service = &s
+			byName[name] = service
+			names = append(names, name)
+		}
+
+		address, err := dockerAddress(c)
+		if err != nil {
+			service.invalid("container %s of service %s: %v\n", dockerName(c), name, err)
+			continue
+		}
+		service.Addresses[dockerName(c)] = address
+	}
+
+	var services []Service
+	for _, name := range names {
+		services = append(services, *byName[name])
+	}
+	return services, nil
+}
+
+func dockerName(c dockerContainer) string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// dockerAddress returns the address the container serves vcb.port on: the host port it is
+// published on where it is, which is reachable from anywhere, and otherwise the container's IP.
+func dockerAddress(c dockerContainer) (string, error) {
+	port, err := strconv.Atoi(c.Labels["vcb.port"])
+	if err != nil {
+		return "", fmt.Errorf("invalid vcb.port %q", c.Labels["vcb.port"])
+	}
+	for _, p := range c.Ports {
+		if p.PrivatePort == port && p.PublicPort != 0 {
+			ip := p.IP
+			if ip == "" || ip == "0.0.0.0" || ip == "::" {
+				ip = "127.0.0.1"
+			}
+			return httpURL(ip, p.PublicPort), nil
+		}
+	}
+	var networks []string
+	for network := range c.NetworkSettings.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		if ip := c.NetworkSettings.Networks[network].IPAddress; ip != "" {
+			return httpURL(ip, port), nil
+		}
+	}
+	return "", fmt.Errorf("port %d is neither published nor on a network with an IP address", port)
+}
+
+// watch notifies on every container starting or stopping, reconnecting to the events API when it
+// fails.
+func (d *dockerSource) watch(w *notifier) {
+	go func() {
+		for {
+			if err := d.watchEvents(w); err != nil {
+				watcherLog.Errorf("watching Docker events failed: %v\n", err)
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func (d *dockerSource) watchEvents(w *notifier) error {
+	filters := `{"type":["container"],"event":["start","die"],"label":["vcb.service"]}`
+	resp, err := d.get("/events", url.Values{"filters": {filters}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		w.changed("Docker containers")
+	}
+}
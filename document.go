@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// serviceDocumentNodes converts the config document of a service, a JSON or YAML object holding
+// any of the service's other keys, e.g.
+//
+//	{"servers": {"srv1": "http://host1:8080"}, "path-regex": {"content": "/content/.*"}}
+//
+// to the etcd nodes the keys would otherwise be read from, so that a registrator can update a
+// service with a single write.
+func serviceDocumentNodes(key string, value string) ([]*client.Node, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	node, err := desiredStateNode(key, doc)
+	if err != nil {
+		return nil, err
+	}
+	return node.Nodes, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// serverDrains keeps servers which have disappeared from their service in its main backend for a
+// drain period, at weight 0, so that vulcand stops sending them requests without cutting off the
+// requests they are still serving. Their instance backends and health frontends are kept as well.
+// Servers of services which disappear altogether are removed straight away.
+type serverDrains struct {
+	sync.Mutex
+	period time.Duration
+	// last servers read of each service, by service name and server id
+	last map[string]map[string]string
+	// draining servers, by service name and server id
+	draining map[string]map[string]drainingServer
+}
+
+type drainingServer struct {
+	address string
+	since   time.Time
+}
+
+func newServerDrains(period time.Duration) *serverDrains {
+	return &serverDrains{
+		period:   period,
+		last:     make(map[string]map[string]string),
+		draining: make(map[string]map[string]drainingServer),
+	}
+}
+
+// apply adds the servers still draining at now back to their services, marked as draining.
+func (d *serverDrains) apply(services []Service, now time.Time) []Service {
+	d.Lock()
+	defer d.Unlock()
+
+	last := make(map[string]map[string]string)
+	draining := make(map[string]map[string]drainingServer)
+	for i, service := range services {
+		last[service.Name] = service.Addresses
+		for id, address := range d.last[service.Name] {
+			if _, found := service.Addresses[id]; found {
+				continue
+			}
+			if draining[service.Name] == nil {
+				draining[service.Name] = make(map[string]drainingServer)
+			}
+			draining[service.Name][id] = drainingServer{address: address, since: now}
+			builderLog.Infof("server %s of service %s disappeared, draining it for %v\n", id, service.Name, d.period)
+		}
+		for id, server := range d.draining[service.Name] {
+			if _, found := service.Addresses[id]; found {
+				continue
+			}
+			if now.Sub(server.since) >= d.period {
+				builderLog.Infof("server %s of service %s has drained, removing it\n", id, service.Name)
+				continue
+			}
+			if draining[service.Name] == nil {
+				draining[service.Name] = make(map[string]drainingServer)
+			}
+			draining[service.Name][id] = server
+		}
+
+		if len(draining[service.Name]) == 0 {
+			continue
+		}
+		addresses := make(map[string]string)
+		for id, address := range service.Addresses {
+			addresses[id] = address
+		}
+		services[i].draining = make(map[string]bool)
+		for id, server := range draining[service.Name] {
+			addresses[id] = server.address
+			services[i].draining[id] = true
+		}
+		services[i].Addresses = addresses
+	}
+	d.last = last
+	d.draining = draining
+	return services
+}
+
+// next returns when the next draining server has drained, or nil if there are none.
+func (d *serverDrains) next(now time.Time) <-chan time.Time {
+	d.Lock()
+	defer d.Unlock()
+	var first time.Time
+	for _, servers := range d.draining {
+		for _, server := range servers {
+			if first.IsZero() || server.since.Before(first) {
+				first = server.since
+			}
+		}
+	}
+	if first.IsZero() {
+		return nil
+	}
+	return time.After(first.Add(d.period).Sub(now))
+}
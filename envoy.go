@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// envoyRouteConfig is the name of the route configuration Envoy listeners request over RDS.
+const envoyRouteConfig = "vcb"
+
+// envoyXDS serves the routes of each rebuild to Envoy over gRPC, as CDS clusters, EDS endpoints and
+// an RDS route configuration. Every Envoy is sent the same configuration, whatever its node id.
+type envoyXDS struct {
+	cache   cachev3.SnapshotCache
+	version string
+}
+
+// envoyNodes puts every Envoy in the same group, so they share one snapshot.
+type envoyNodes struct{}
+
+func (envoyNodes) ID(node *corev3.Node) string {
+	return envoyRouteConfig
+}
+
+func newEnvoyXDS() *envoyXDS {
+	return &envoyXDS{cache: cachev3.NewSnapshotCache(true, envoyNodes{}, applierLog)}
+}
+
+// configuredXDS serves Envoy on VCB_ENVOY_XDS_ADDRESS, or returns nil when it is not set.
+func configuredXDS() *envoyXDS {
+	if envoyXDSAddress == "" {
+		return nil
+	}
+	xds := newEnvoyXDS()
+	go xds.serve(envoyXDSAddress)
+	return xds
+}
+
+// serve serves the aggregated and the individual discovery services on the address.
+func (x *envoyXDS) serve(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("failed to listen for Envoy xDS on %s: %v\n", address, err)
+	}
+	server := serverv3.NewServer(context.Background(), x.cache, nil)
+	g := grpc.NewServer()
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(g, server)
+	clusterservice.RegisterClusterDiscoveryServiceServer(g, server)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(g, server)
+	routeservice.RegisterRouteDiscoveryServiceServer(g, server)
+	log.Printf("serving Envoy xDS on %s\n", address)
+	log.Fatal(g.Serve(listener))
+}
+
+// update sends the configuration to the Envoys when it has changed. The version of a snapshot is a
+// hash of its resources, so rebuilds which change nothing aren't sent again.
+func (x *envoyXDS) update(services []Service, vc vulcanConf) error {
+	resources := envoyResources(services, vc)
+	version, err := envoyVersion(resources)
+	if err != nil {
+		return err
+	}
+	if version == x.version {
+		return nil
+	}
+	snapshot, err := cachev3.NewSnapshot(version, resources)
+	if err != nil {
+		return err
+	}
+	if err := x.cache.SetSnapshot(context.Background(), envoyRouteConfig, snapshot); err != nil {
+		return err
+	}
+	x.version = version
+	applierLog.Infof("serving Envoy configuration version %s\n", version)
+	return nil
+}
+
+func envoyVersion(resources map[resourcev3.Type][]types.Resource) (string, error) {
+	var typeURLs []string
+	for typeURL := range resources {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	h := sha256.New()
+	for _, typeURL := range typeURLs {
+		for _, r := range resources[typeURL] {
+			b, err := proto.MarshalOptions{Deterministic: true}.Marshal(r)
+			if err != nil {
+				return "", err
+			}
+			h.Write(b)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// envoyResources renders the routes of the services as Envoy resources. Each vulcand backend with
+// servers becomes a cluster of the same name, with its servers as endpoints, and the frontends are
+// routes of one route configuration, laid out as renderNginx lays out its servers: a virtual host
+// per host, and one for every other host, each holding the internal, health check and path routes.
+// The backends and rewrites are taken from the vulcand configuration.
+func envoyResources(services []Service, vc vulcanConf) map[resourcev3.Type][]types.Resource {
+	var clusters, endpoints []types.Resource
+	rendered := make(map[string]bool)
+	for _, id := range sortedBackendIDs(vc) {
+		servers := vc.Backends[id].Servers
+		assignment := &endpointv3.ClusterLoadAssignment{ClusterName: id}
+		locality := &endpointv3.LocalityLbEndpoints{}
+		tls := false
+		for _, serverID := range sortedServerIDs(servers) {
+			server := servers[serverID]
+			u, err := url.Parse(server.URL)
+			var port int
+			if err == nil {
+				port, _ = strconv.Atoi(u.Port())
+			}
+			if port == 0 || u.Hostname() == "" {
+				builderLog.Warnf("leaving server %s=%s out of Envoy cluster %s, it isn't a URL with a port\n", serverID, server.URL, id)
+				continue
+			}
+			tls = tls || u.Scheme == "https"
+			e := &endpointv3.LbEndpoint{
+				HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+						Address:       u.Hostname(),
+						PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(port)},
+					}}},
+				}},
+			}
+			if server.Weight > 0 {
+				e.LoadBalancingWeight = wrapperspb.UInt32(uint32(server.Weight))
+			}
+			if server.Draining {
+				// draining endpoints are sent no new requests, as at weight 0 in vulcand
+				e.HealthStatus = corev3.HealthStatus_DRAINING
+			}
+			locality.LbEndpoints = append(locality.LbEndpoints, e)
+		}
+		if len(locality.LbEndpoints) == 0 {
+			continue
+		}
+		assignment.Endpoints = []*endpointv3.LocalityLbEndpoints{locality}
+		endpoints = append(endpoints, assignment)
+
+		cluster := &clusterv3.Cluster{
+			Name:                 id,
+			ConnectTimeout:       durationpb.New(5 * time.Second),
+			ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+			EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+				EdsConfig: &corev3.ConfigSource{
+					ResourceApiVersion:    corev3.ApiVersion_V3,
+					ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+				},
+			},
+		}
+		if tls {
+			tlsContext, err := anypb.New(&tlsv3.UpstreamTlsContext{})
+			if err != nil {
+				// an empty message can always be marshalled
+				panic(err)
+			}
+			cluster.TransportSocket = &corev3.TransportSocket{
+				Name:       "envoy.transport_sockets.tls",
+				ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: tlsContext},
+			}
+		}
+		clusters = append(clusters, cluster)
+		rendered[id] = true
+	}
+
+	// route returns the route to the frontend's backend, or a 503 when it has no cluster, e.g. an
+	// empty backend or VCB_MAINTENANCE_BACKEND
+	route := func(name string, frontend vulcanFrontend, match *routev3.RouteMatch, prefixRewrite string) *routev3.Route {
+		r := &routev3.Route{Name: name, Match: match}
+		if !rendered[frontend.BackendID] {
+			r.Action = &routev3.Route_DirectResponse{DirectResponse: &routev3.DirectResponseAction{Status: 503}}
+			return r
+		}
+		action := &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: frontend.BackendID},
+			PrefixRewrite:    prefixRewrite,
+		}
+		if len(frontend.rewrites) > 0 && prefixRewrite == "" {
+			// Envoy applies a single rewrite, paths only have the one
+			rewrite := frontend.rewrites[0].Middleware
+			action.RegexRewrite = &matcherv3.RegexMatchAndSubstitute{
+				Pattern:      &matcherv3.RegexMatcher{Regex: rewrite.Regexp},
+				Substitution: backslashReplacement(rewrite.Replacement),
+			}
+		}
+		r.Action = &routev3.Route_Route{Route: action}
+		return r
+	}
+
+	var shared []*routev3.Route
+	hostRoutes := make(map[string][]*routev3.Route)
+	add := func(host string, r *routev3.Route) {
+		if host == "" {
+			shared = append(shared, r)
+		} else {
+			hostRoutes[host] = append(hostRoutes[host], r)
+		}
+	}
+
+	for _, service := range services {
+		name := managedPrefix + "internal-" + service.Name
+		if frontend, found := vc.FrontEnds[name]; found {
+			match := &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: fmt.Sprintf("/__%s/", service.Name)}}
+			add("", route(name, frontend, match, "/"))
+		}
+	}
+	for _, service := range services {
+		var serverIDs []string
+		for serverID := range service.Addresses {
+			serverIDs = append(serverIDs, serverID)
+		}
+		sort.Strings(serverIDs)
+		for _, serverID := range serverIDs {
+			name := fmt.Sprintf("%shealth-%s-%s", managedPrefix, service.Name, serverID)
+			frontend, found := vc.FrontEnds[name]
+			if !found {
+				continue
+			}
+			path := fmt.Sprintf("/health/%s-%s/__health", service.Name, serverID)
+			healthCheckPath := "/__health"
+			if len(frontend.rewrites) > 0 && frontend.rewrites[0].Middleware.Regexp == path {
+				healthCheckPath = frontend.rewrites[0].Middleware.Replacement
+			}
+			match := &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Path{Path: path}}
+			add("", route(name, frontend, match, healthCheckPath))
+		}
+	}
+	for _, p := range sortedPaths(services) {
+		s, pathName := p.service, p.name
+		name := fmt.Sprintf("%s%s-path-regex-%s", managedPrefix, s.Name, pathName)
+		frontend, found := vc.FrontEnds[name]
+		if !found {
+			continue
+		}
+		match := &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_SafeRegex{SafeRegex: unanchoredRegex(s.pathRegex(pathName))}}
+		if hostRegex, found := s.PathHostRegexes[pathName]; found {
+			match.Headers = append(match.Headers, regexHeader(":authority", hostRegex))
+		}
+		if methods := s.PathMethods[pathName]; len(methods) > 0 {
+			match.Headers = append(match.Headers, &routev3.HeaderMatcher{
+				Name: ":method",
+				HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{
+					MatchPattern: &matcherv3.StringMatcher_SafeRegex{SafeRegex: &matcherv3.RegexMatcher{Regex: strings.Join(methods, "|")}},
+				}},
+			})
+		}
+		if header, found := s.PathHeaders[pathName]; found {
+			if header.Regexp {
+				match.Headers = append(match.Headers, regexHeader(header.Name, header.Value))
+			} else {
+				match.Headers = append(match.Headers, &routev3.HeaderMatcher{
+					Name: header.Name,
+					HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{
+						MatchPattern: &matcherv3.StringMatcher_Exact{Exact: header.Value},
+					}},
+				})
+			}
+		}
+		add(strings.ToLower(s.PathHosts[pathName]), route(name, frontend, match, ""))
+	}
+	for _, service := range services {
+		name := managedPrefix + "byhostheader-" + service.Name
+		frontend, found := vc.FrontEnds[name]
+		if !found {
+			continue
+		}
+		for _, host := range hostHeaderHosts(service) {
+			match := &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}}
+			add(strings.ToLower(host), route(name, frontend, match, ""))
+		}
+	}
+
+	config := &routev3.RouteConfiguration{Name: envoyRouteConfig}
+	var hosts []string
+	for host := range hostRoutes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		// the shared routes come first, so a host's own paths are matched before its catch-all
+		routes := append(append([]*routev3.Route{}, shared...), hostRoutes[host]...)
+		config.VirtualHosts = append(config.VirtualHosts, &routev3.VirtualHost{
+			Name:    host,
+			Domains: []string{host, host + ":*"},
+			Routes:  routes,
+		})
+	}
+	config.VirtualHosts = append(config.VirtualHosts, &routev3.VirtualHost{Name: "default", Domains: []string{"*"}, Routes: shared})
+
+	return map[resourcev3.Type][]types.Resource{
+		resourcev3.ClusterType:  clusters,
+		resourcev3.EndpointType: endpoints,
+		resourcev3.RouteType:    []types.Resource{config},
+	}
+}
+
+// unanchoredRegex matches anywhere in a value, as vulcand regexes do, where Envoy matches whole
+// values.
+func unanchoredRegex(regex string) *matcherv3.RegexMatcher {
+	return &matcherv3.RegexMatcher{Regex: ".*(?:" + regex + ").*"}
+}
+
+func regexHeader(name string, regex string) *routev3.HeaderMatcher {
+	return &routev3.HeaderMatcher{
+		Name: name,
+		HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_SafeRegex{SafeRegex: unanchoredRegex(regex)},
+		}},
+	}
+}
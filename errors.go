@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorReporter reports panics, and applies which keep failing, to a Sentry compatible DSN, e.g.
+// https://<key>@sentry.example.com/<project>.
+type errorReporter struct {
+	store  string
+	auth   string
+	client *http.Client
+	// threshold is the number of consecutive failed applies which is reported, failed the number
+	// of applies which have failed since the last one which succeeded
+	threshold int
+	failed    int
+}
+
+// configuredErrorReporter returns the reporter configured by VCB_SENTRY_DSN and
+// VCB_SENTRY_FAILURES, or nil when errors aren't reported.
+func configuredErrorReporter() *errorReporter {
+	if sentryDSN == "" {
+		return nil
+	}
+	threshold := 3
+	if sentryFailures != "" {
+		n, err := strconv.Atoi(sentryFailures)
+		if err != nil || n < 1 {
+			log.Printf("WARN - The provided VCB_SENTRY_FAILURES=%s is invalid, using default value=%v", sentryFailures, threshold)
+		} else {
+			threshold = n
+		}
+	}
+	r, err := newErrorReporter(sentryDSN, threshold)
+	if err != nil {
+		log.Printf("WARN - The provided VCB_SENTRY_DSN is invalid, not reporting errors: %v\n", err)
+		return nil
+	}
+	return r
+}
+
+type errorEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Logger     string                 `json:"logger"`
+	Platform   string                 `json:"platform"`
+	ServerName string                 `json:"server_name,omitempty"`
+	Message    string                 `json:"message"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+func newErrorReporter(dsn string, threshold int) (*errorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("expected http(s)://<key>@<host>/<project>, got %s", dsn)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || path[i+1:] == "" {
+		return nil, fmt.Errorf("no project in %s", dsn)
+	}
+	auth := "Sentry sentry_version=7, sentry_client=vulcan-config-builder, sentry_key=" + u.User.Username()
+	if secret, found := u.User.Password(); found {
+		auth += ", sentry_secret=" + secret
+	}
+	return &errorReporter{
+		store:     fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], path[i+1:]),
+		auth:      auth,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		threshold: threshold,
+	}, nil
+}
+
+// applied reports the failed apply which makes threshold consecutive failures, with the keys which
+// failed. Applies which keep failing after that aren't reported again until one has succeeded.
+func (r *errorReporter) applied(err error, services int) {
+	if err == nil {
+		r.failed = 0
+		return
+	}
+	r.failed++
+	if r.failed != r.threshold {
+		return
+	}
+	extra := map[string]interface{}{"services": services, "consecutiveFailures": r.failed}
+	if ae, ok := err.(applyError); ok {
+		extra["failedKeys"] = ae.Failures
+	}
+	r.report("error", fmt.Sprintf("%d consecutive applies failed: %v", r.failed, err), extra)
+}
+
+// recoverPanic reports a panic and panics again, when deferred.
+func (r *errorReporter) recoverPanic() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	r.report("fatal", fmt.Sprintf("panic: %v", p), map[string]interface{}{"stack": string(debug.Stack())})
+	panic(p)
+}
+
+func (r *errorReporter) report(level string, message string, extra map[string]interface{}) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	event := errorEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:      level,
+		Logger:     "vulcan-config-builder",
+		Platform:   "go",
+		ServerName: hostname,
+		Message:    message,
+		Extra:      extra,
+	}
+	if err := r.send(event); err != nil {
+		log.Printf("WARN - failed to report %q: %v\n", message, err)
+	}
+}
+
+func (r *errorReporter) send(event errorEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.store, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+)
+
+// watch events which didn't schedule a rebuild, see eventFilter
+var watchEventsIgnored = expvar.NewInt("watch_events_ignored")
+
+// eventFilter reports whether a watch event could change the generated configuration, so that
+// events which can't, e.g. registrators refreshing the TTL of an unchanged server, don't schedule
+// a rebuild.
+type eventFilter func(response *client.Response) bool
+
+// valueChanged ignores writes which leave the value of a key as it was.
+func valueChanged(response *client.Response) bool {
+	if response == nil || response.Node == nil {
+		return true
+	}
+	switch response.Action {
+	case "set", "update", "compareAndSwap":
+		return response.PrevNode == nil || response.Node.Dir || response.PrevNode.Value != response.Node.Value
+	}
+	return true
+}
+
+// serviceEvents ignores, in addition to unchanged values, changes to keys under the services in
+// the prefix which readServices doesn't read.
+func serviceEvents(prefix string) eventFilter {
+	keys := serviceKeys()
+	return func(response *client.Response) bool {
+		if !valueChanged(response) {
+			return false
+		}
+		if response == nil || response.Node == nil {
+			return true
+		}
+		relative := strings.Trim(strings.TrimPrefix(response.Node.Key, strings.TrimSuffix(prefix, "/")), "/")
+		parts := strings.Split(relative, "/")
+		if len(parts) < 2 {
+			// the prefix itself or a whole service
+			return true
+		}
+		_, read := keys[parts[1]]
+		return read
+	}
+}
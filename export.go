@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// export is the configuration a rebuild would apply, as the /vulcand/ keys it is kept in.
+type export struct {
+	Created time.Time         `json:"created" yaml:"created"`
+	Keys    map[string]string `json:"keys" yaml:"keys"`
+}
+
+func encodeExport(e export, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(e, "", "  ")
+		return append(b, '\n'), err
+	case "yaml":
+		return yaml.Marshal(e)
+	default:
+		return nil, fmt.Errorf("unknown format %s, expected json or yaml", format)
+	}
+}
+
+// exportCommand writes the configuration the next rebuild would apply to a file, or stdout.
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("output", "-", "file to write the configuration to, - for stdout")
+	format := flags.String("format", "json", "json or yaml")
+	redact := flags.Bool("redact", false, "hide TLS private keys")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 1
+	}
+	vc, _, _ := newRebuilder(client.NewKeysAPI(etcd)).generate(context.Background())
+	e := export{Created: time.Now().UTC(), Keys: vulcanConfToEtcdKeys(vc)}
+	if *redact {
+		e.Keys = redactConfig(e.Keys)
+	}
+
+	b, err := encodeExport(e, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode configuration: %v\n", err)
+		return 1
+	}
+	if *output == "-" {
+		os.Stdout.Write(b)
+	} else if err := ioutil.WriteFile(*output, b, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write configuration: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d keys exported\n", len(e.Keys))
+	return 0
+}
+
+// decodeExport reads an export in either format.
+func decodeExport(b []byte) (export, error) {
+	var e export
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = json.Unmarshal(b, &e)
+	} else {
+		err = yaml.Unmarshal(b, &e)
+	}
+	return e, err
+}
+
+// restoredConf returns the configuration holding the keys of an export, and the keys under
+// /vulcand/ it leaves out as vcb doesn't manage them, e.g. the listeners in a snapshot. Hosts are
+// managed when the export holds any.
+func restoredConf(e export) (vulcanConf, []string, error) {
+	vc := vulcanConf{keys: make(map[string]string)}
+	for k := range e.Keys {
+		if isHostKey(k) {
+			vc.Hosts = make(map[string]vulcanHost)
+			break
+		}
+	}
+	var skipped []string
+	for k, v := range e.Keys {
+		switch {
+		case !strings.HasPrefix(k, "/vulcand/"):
+			return vc, nil, fmt.Errorf("%s is not a vulcand key", k)
+		case !vc.manages(k):
+			skipped = append(skipped, k)
+		case isHostKey(k) && strings.Contains(v, `"Key":"REDACTED"`):
+			return vc, nil, fmt.Errorf("the private key of %s was redacted when it was exported", k)
+		default:
+			vc.keys[k] = v
+		}
+	}
+	if len(vc.keys) == 0 {
+		return vc, nil, fmt.Errorf("no keys to restore")
+	}
+	sort.Strings(skipped)
+	return vc, skipped, nil
+}
+
+// restoreCommand applies the keys of an export written by exportCommand, or of a snapshot, e.g. to
+// recover a corrupted /vulcand/ tree, removing the managed keys it doesn't hold, and runs the
+// post-apply hooks.
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fromEtcd := flags.Bool("etcd", false, "restore the snapshot kept in the etcd directory given rather than a file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: restore [--etcd] <export file or etcd snapshot directory>\n")
+		return 2
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 1
+	}
+	kapi := client.NewKeysAPI(etcd)
+
+	var e export
+	if *fromEtcd {
+		e, err = readEtcdSnapshot(kapi, flags.Arg(0))
+	} else {
+		var b []byte
+		b, err = ioutil.ReadFile(flags.Arg(0))
+		if err == nil {
+			e, err = decodeExport(b)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read export: %v\n", err)
+		return 1
+	}
+	vc, skipped, err := restoredConf(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to restore export: %v\n", err)
+		return 1
+	}
+	for _, k := range skipped {
+		fmt.Fprintf(os.Stderr, "not restoring %s, vcb doesn't manage it\n", k)
+	}
+
+	changes, err := applyVulcanConf(vulcandKeys(kapi), vc)
+	newAuditLog(kapi).record("restore-"+newRebuildID(time.Now()), time.Now(), changes)
+	if len(changes) > 0 {
+		configuredPostApplyHooks().run(changes)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to restore export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d changes made restoring the export of %s\n", len(changes), e.Created.Format(time.RFC3339))
+	return 0
+}
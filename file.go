@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileSource reads services from a directory holding a YAML file per service, named after the
+// service, e.g. content-api.yaml. Each file is the service's document, servers included, see
+// serviceDocumentNodes.
+type fileSource struct {
+	dir string
+}
+
+func newFileSource() (*fileSource, error) {
+	dir := os.Getenv("VCB_SERVICES_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("VCB_SERVICES_DIR must be set with VCB_SOURCE=file")
+	}
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	return &fileSource{dir: dir}, nil
+}
+
+func isServiceFile(name string) bool {
+	ext := filepath.Ext(name)
+	return (ext == ".yaml" || ext == ".yml") && !strings.HasPrefix(filepath.Base(name), ".")
+}
+
+func (f *fileSource) services() ([]Service, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var services []Service
+	seen := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() || !isServiceFile(file.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if other, found := seen[name]; found {
+			builderLog.Warnf("ignoring %s, service %s is already read from %s\n", file.Name(), name, other)
+			continue
+		}
+		seen[name] = file.Name()
+		b, err := ioutil.ReadFile(filepath.Join(f.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// the file is read as the service's config document, so that a broken file is reported
+		// as a problem of its service rather than failing every other service
+		node := &client.Node{Key: "/" + name, Dir: true, Nodes: []*client.Node{
+			{Key: "/" + name + "/config", Value: string(b)},
+		}}
+		services = append(services, parseService(node))
+	}
+	return services, nil
+}
+
+// watch notifies on any service file in the directory being written, created, removed or renamed,
+// which covers editors replacing files rather than writing them.
+func (f *fileSource) watch(w *notifier) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		watcherLog.Errorf("failed to watch %s, changes won't be picked up: %v\n", f.dir, err)
+		return
+	}
+	if err := watcher.Add(f.dir); err != nil {
+		watcher.Close()
+		watcherLog.Errorf("failed to watch %s, changes won't be picked up: %v\n", f.dir, err)
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isServiceFile(event.Name) && event.Op != fsnotify.Chmod {
+					w.changed(event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				watcherLog.Errorf("watching %s failed: %v\n", f.dir, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// the vulcand frontend settings which may be set per service or by default for all services
+var frontendSettingsKeys = map[string]string{
+	"TrustForwardHeader": "bool",
+	"Hostname":           "string",
+	"Limits":             "object",
+}
+
+// defaultFrontendSettings are set on every frontend, under any per-service frontend-settings
+var defaultFrontendSettings map[string]interface{}
+
+// parseFrontendSettings parses and validates a JSON fragment of vulcand frontend settings, e.g.
+// {"TrustForwardHeader": true, "Limits": {"MaxBodyBytes": 1048576}}.
+func parseFrontendSettings(value string) (map[string]interface{}, error) {
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		return nil, err
+	}
+	for k, v := range settings {
+		var ok bool
+		switch frontendSettingsKeys[k] {
+		case "bool":
+			_, ok = v.(bool)
+		case "string":
+			_, ok = v.(string)
+		case "object":
+			_, ok = v.(map[string]interface{})
+		default:
+			return nil, fmt.Errorf("unsupported setting %s", k)
+		}
+		if !ok {
+			return nil, fmt.Errorf("setting %s must be a %s", k, frontendSettingsKeys[k])
+		}
+	}
+	return settings, nil
+}
+
+// cookieNameRegex matches the token an HTTP cookie name, or header name, must be.
+var cookieNameRegex = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+// withStickiness adds vulcand's sticky session setting, which pins each client to the server named
+// in its cookie, to the settings of the service's frontends routing to its main backend.
+func withStickiness(service Service, settings map[string]interface{}) map[string]interface{} {
+	if service.StickyCookie == "" {
+		return settings
+	}
+	return mergeSettings(settings, map[string]interface{}{
+		"Stickiness": map[string]interface{}{"CookieName": service.StickyCookie},
+	})
+}
+
+// frontendTypeRegex matches the frontend types vulcand registers, e.g. http.
+var frontendTypeRegex = regexp.MustCompile("^[a-z][a-z0-9-]*$")
+
+// frontendType returns the type of the frontends routing to the service's main backend.
+func (s Service) frontendType() string {
+	if s.FrontendType == "" {
+		return "http"
+	}
+	return s.FrontendType
+}
+
+// frontendValue returns the /vulcand/frontends/<fe>/frontend value of a frontend.
+func frontendValue(fe vulcanFrontend) string {
+	settings := mergeSettings(fe.Settings, map[string]interface{}{"FailoverPredicate": fe.FailoverPredicate})
+	return marshalValue(frontendKeyValue{
+		Type:      fe.Type,
+		BackendId: fe.BackendID,
+		Route:     fe.Route,
+		Settings:  settings,
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// renderHAProxy renders the routes of the services as an haproxy.cfg frontend and backends, to be
+// appended to the global and defaults sections, for HAProxy 2.2 or later. Each vulcand backend
+// becomes a backend of the same name, and each vulcand frontend an ACL choosing its backend, tried
+// in the order internal, health check, path (by path-priority) and host header routes. As with
+// renderNginx, the backends and rewrites are taken from the vulcand configuration.
+//
+// The route is chosen before any rewrite, and kept in the txn.route variable, so that rewriting
+// the path doesn't change which route the request takes.
+func renderHAProxy(services []Service, vc vulcanConf) []byte {
+	var routes, rewrites, backends []string
+	// route adds the frontend, matched by the ACL conditions, and its rewrites
+	route := func(name string, conditions ...string) {
+		frontend, found := vc.FrontEnds[name]
+		if !found {
+			return
+		}
+		routes = append(routes, fmt.Sprintf("    http-request set-var(txn.route) str(%s) if !{ var(txn.route) -m found } %s", name, strings.Join(conditions, " ")))
+		selected := fmt.Sprintf("{ var(txn.route) -m str %s }", name)
+		for _, rewrite := range frontend.rewrites {
+			rewrites = append(rewrites, fmt.Sprintf("    http-request replace-path %s %s if %s", haproxyQuote(rewrite.Middleware.Regexp), haproxyQuote(backslashReplacement(rewrite.Middleware.Replacement)), selected))
+		}
+		if _, found := vc.Backends[frontend.BackendID]; found {
+			backends = append(backends, fmt.Sprintf("    use_backend %s if %s", frontend.BackendID, selected))
+		} else {
+			// e.g. VCB_MAINTENANCE_BACKEND, which isn't one of vcb's
+			rewrites = append(rewrites, fmt.Sprintf("    http-request deny deny_status 503 if %s", selected))
+		}
+	}
+
+	for _, service := range services {
+		route(managedPrefix+"internal-"+service.Name, fmt.Sprintf("{ path_beg /__%s/ }", service.Name))
+	}
+	for _, service := range services {
+		var serverIDs []string
+		for serverID := range service.Addresses {
+			serverIDs = append(serverIDs, serverID)
+		}
+		sort.Strings(serverIDs)
+		for _, serverID := range serverIDs {
+			route(fmt.Sprintf("%shealth-%s-%s", managedPrefix, service.Name, serverID), fmt.Sprintf("{ path /health/%s-%s/__health }", service.Name, serverID))
+		}
+	}
+	for _, p := range sortedPaths(services) {
+		s, name := p.service, p.name
+		conditions := []string{fmt.Sprintf("{ path_reg %s }", haproxyQuote(s.pathRegex(name)))}
+		if host, found := s.PathHosts[name]; found {
+			conditions = append(conditions, fmt.Sprintf("{ req.hdr(host),field(1,:) -i %s }", haproxyQuote(host)))
+		}
+		if hostRegex, found := s.PathHostRegexes[name]; found {
+			conditions = append(conditions, fmt.Sprintf("{ req.hdr(host),field(1,:) -m reg -i %s }", haproxyQuote(hostRegex)))
+		}
+		if methods := s.PathMethods[name]; len(methods) > 0 {
+			conditions = append(conditions, fmt.Sprintf("{ method %s }", strings.Join(methods, " ")))
+		}
+		if header, found := s.PathHeaders[name]; found {
+			match := "str"
+			if header.Regexp {
+				match = "reg"
+			}
+			conditions = append(conditions, fmt.Sprintf("{ req.hdr(%s) -m %s %s }", header.Name, match, haproxyQuote(header.Value)))
+		}
+		route(fmt.Sprintf("%s%s-path-regex-%s", managedPrefix, s.Name, name), conditions...)
+	}
+	for _, service := range services {
+		var hosts []string
+		for _, host := range hostHeaderHosts(service) {
+			hosts = append(hosts, haproxyQuote(host))
+		}
+		if len(hosts) > 0 {
+			route(managedPrefix+"byhostheader-"+service.Name, fmt.Sprintf("{ req.hdr(host),field(1,:) -i %s }", strings.Join(hosts, " ")))
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# generated by vulcan-config-builder, changes are overwritten\n\n")
+	b.WriteString("frontend vcb\n    bind :80\n    mode http\n")
+	for _, lines := range [][]string{routes, rewrites, backends} {
+		if len(lines) > 0 {
+			fmt.Fprintf(&b, "%s\n", strings.Join(lines, "\n"))
+		}
+	}
+
+	for _, id := range sortedBackendIDs(vc) {
+		fmt.Fprintf(&b, "\nbackend %s\n    mode http\n", id)
+		servers := vc.Backends[id].Servers
+		for _, serverID := range sortedServerIDs(servers) {
+			server := servers[serverID]
+			u, err := url.Parse(server.URL)
+			if err != nil || u.Host == "" {
+				builderLog.Warnf("leaving server %s=%s out of HAProxy backend %s, it isn't a URL\n", serverID, server.URL, id)
+				continue
+			}
+			line := fmt.Sprintf("    server %s %s", serverID, u.Host)
+			if u.Scheme == "https" {
+				line += " ssl"
+			}
+			switch {
+			case server.Draining:
+				// sent no new requests, as in vulcand
+				line += " weight 0"
+			case server.Weight > 0:
+				line += fmt.Sprintf(" weight %d", server.Weight)
+			}
+			fmt.Fprintf(&b, "%s\n", line)
+		}
+	}
+	return b.Bytes()
+}
+
+// haproxyQuote quotes a string, e.g. a regex, in single quotes, in which HAProxy expands nothing.
+func haproxyQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rebuildRecord is everything needed to reconstruct what a rebuild saw and did.
+type rebuildRecord struct {
+	ID       string            `json:"id"`
+	Started  time.Time         `json:"started"`
+	Duration string            `json:"duration"`
+	Services []Service         `json:"services"`
+	Config   map[string]string `json:"config"`
+	Changes  []keyChange       `json:"changes"`
+	Failures []keyFailure      `json:"failures,omitempty"`
+}
+
+func newRebuildID(started time.Time) string {
+	return started.UTC().Format("20060102T150405.000Z")
+}
+
+// rebuildHistory persists a record of each rebuild as a JSON file in a directory, keeping at most
+// retention records. A history with no directory records nothing.
+type rebuildHistory struct {
+	dir       string
+	retention int
+}
+
+// configuredHistory returns the history configured by VCB_HISTORY_DIR and VCB_HISTORY_RETENTION.
+func configuredHistory() rebuildHistory {
+	history := rebuildHistory{dir: historyDir, retention: 100}
+	if historyRetention != "" {
+		retention, err := strconv.Atoi(historyRetention)
+		if err != nil {
+			log.Printf("WARN - The provided history retention=%s is invalid, using default value=100", historyRetention)
+		} else {
+			history.retention = retention
+		}
+	}
+	return history
+}
+
+func (h rebuildHistory) record(r rebuildRecord) {
+	if h.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		log.Printf("failed to create history directory %s: %v\n", h.dir, err)
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("failed to encode rebuild %s: %v\n", r.ID, err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(h.dir, r.ID+".json"), b, 0644); err != nil {
+		log.Printf("failed to write rebuild %s: %v\n", r.ID, err)
+		return
+	}
+	h.prune()
+}
+
+// ids returns the recorded rebuild ids, oldest first.
+func (h rebuildHistory) ids() ([]string, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (h rebuildHistory) load(id string) (rebuildRecord, error) {
+	var r rebuildRecord
+	b, err := ioutil.ReadFile(filepath.Join(h.dir, filepath.Base(id)+".json"))
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(b, &r)
+	return r, err
+}
+
+func (h rebuildHistory) prune() {
+	if h.retention <= 0 {
+		return
+	}
+	ids, err := h.ids()
+	if err != nil {
+		log.Printf("failed to list rebuild history: %v\n", err)
+		return
+	}
+	for len(ids) > h.retention {
+		if err := os.Remove(filepath.Join(h.dir, ids[0]+".json")); err != nil {
+			log.Printf("failed to remove old rebuild %s: %v\n", ids[0], err)
+		}
+		ids = ids[1:]
+	}
+}
+
+// recentApply is the changes an apply made, kept in memory.
+type recentApply struct {
+	ID       string       `json:"id"`
+	Started  time.Time    `json:"started"`
+	Duration string       `json:"duration"`
+	Changes  []keyChange  `json:"changes"`
+	Failures []keyFailure `json:"failures,omitempty"`
+}
+
+// recentApplies keeps the most recent applies in a ring buffer of size applies, e.g. to find out
+// whether a reconfiguration explains a traffic anomaly without access to the log.
+type recentApplies struct {
+	sync.RWMutex
+	applies []recentApply
+	next    int
+	full    bool
+}
+
+func newRecentApplies(size int) *recentApplies {
+	return &recentApplies{applies: make([]recentApply, size)}
+}
+
+// configuredRecentApplies returns the ring buffer of the VCB_RECENT_APPLIES most recent applies.
+func configuredRecentApplies() *recentApplies {
+	size := 50
+	if recentAppliesValue != "" {
+		n, err := strconv.Atoi(recentAppliesValue)
+		if err != nil || n < 1 {
+			log.Printf("WARN - The provided VCB_RECENT_APPLIES=%s is invalid, using default value=50", recentAppliesValue)
+		} else {
+			size = n
+		}
+	}
+	return newRecentApplies(size)
+}
+
+// record keeps the apply of the rebuild, with private keys redacted.
+func (h *recentApplies) record(r rebuildRecord) {
+	a := recentApply{ID: r.ID, Started: r.Started, Duration: r.Duration, Failures: r.Failures}
+	for _, c := range r.Changes {
+		c.OldValue = redactValue(c.Key, c.OldValue)
+		c.NewValue = redactValue(c.Key, c.NewValue)
+		a.Changes = append(a.Changes, c)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.applies[h.next] = a
+	h.next = (h.next + 1) % len(h.applies)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// since returns the applies started after since, newest first.
+func (h *recentApplies) since(since time.Time) []recentApply {
+	h.RLock()
+	defer h.RUnlock()
+	n := h.next
+	if h.full {
+		n = len(h.applies)
+	}
+	applies := []recentApply{}
+	for i := 1; i <= n; i++ {
+		a := h.applies[(h.next-i+len(h.applies))%len(h.applies)]
+		if !a.Started.After(since) {
+			break
+		}
+		applies = append(applies, a)
+	}
+	return applies
+}
+
+// historyHandler serves the recent applies, newest first, or those started after the RFC 3339
+// time of the since parameter.
+func historyHandler(h *recentApplies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "since must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetEscapeHTML(false)
+		e.SetIndent("", "  ")
+		if err := e.Encode(h.since(since)); err != nil {
+			log.Printf("failed to write history response: %v\n", err)
+		}
+	}
+}
+
+// showRebuildCommand prints a recorded rebuild, or lists the recorded rebuilds if no id is given.
+func showRebuildCommand(args []string) int {
+	h := rebuildHistory{dir: historyDir}
+	if h.dir == "" {
+		fmt.Fprintln(os.Stderr, "VCB_HISTORY_DIR is not set")
+		return 1
+	}
+
+	if len(args) == 0 {
+		ids, err := h.ids()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list rebuilds: %v\n", err)
+			return 1
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return 0
+	}
+
+	r, err := h.load(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read rebuild %s: %v\n", args[0], err)
+		return 1
+	}
+	printRebuild(r)
+	return 0
+}
+
+func printRebuild(r rebuildRecord) {
+	fmt.Printf("rebuild %s started %s took %s\n", r.ID, r.Started.Format(time.RFC3339), r.Duration)
+
+	fmt.Printf("\nservices (%d):\n", len(r.Services))
+	for _, s := range r.Services {
+		b, _ := json.MarshalIndent(s, "  ", "  ")
+		fmt.Printf("  %s\n", b)
+	}
+
+	fmt.Printf("\nconfig (%d keys):\n", len(r.Config))
+	var keys []string
+	for k := range r.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s %s\n", k, r.Config[k])
+	}
+
+	fmt.Printf("\nchanges (%d):\n", len(r.Changes))
+	for _, c := range r.Changes {
+		if c.Action == "delete" {
+			fmt.Printf("  - %s %s\n", c.Key, c.OldValue)
+		} else {
+			fmt.Printf("  + %s %s (was %q)\n", c.Key, c.NewValue, c.OldValue)
+		}
+	}
+
+	if len(r.Failures) > 0 {
+		fmt.Printf("\nfailures (%d):\n", len(r.Failures))
+		for _, f := range r.Failures {
+			fmt.Printf("  %s %s: %s\n", f.Action, f.Key, f.Error)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// postApplyHooks are run after an apply that changed something in etcd. Each hook receives the
+// list of changes as a JSON document, either on stdin (exec) or as the request body (webhook).
+// Notification webhooks receive a summary of the frontends and backends changed instead, as JSON
+// or as a Slack message.
+type postApplyHooks struct {
+	command  string
+	webhooks []string
+	notify   []string
+	slack    []string
+	client   *http.Client
+}
+
+func newPostApplyHooks(command string, webhooks string) postApplyHooks {
+	return postApplyHooks{
+		command:  command,
+		webhooks: splitURLs(webhooks),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// configuredPostApplyHooks returns the hooks configured by VCB_POST_APPLY_EXEC,
+// VCB_POST_APPLY_WEBHOOKS, VCB_NOTIFY_WEBHOOKS and VCB_SLACK_WEBHOOKS.
+func configuredPostApplyHooks() postApplyHooks {
+	h := newPostApplyHooks(postApplyExec, postApplyWebhooks)
+	h.notify = splitURLs(notifyWebhooks)
+	h.slack = splitURLs(slackWebhooks)
+	return h
+}
+
+func splitURLs(list string) []string {
+	var urls []string
+	for _, url := range strings.Split(list, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func (h postApplyHooks) run(changes []keyChange) {
+	h.notifyChanges(changes)
+	if h.command == "" && len(h.webhooks) == 0 {
+		return
+	}
+
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		log.Printf("failed to encode changes for post-apply hooks: %v\n", err)
+		return
+	}
+
+	if h.command != "" {
+		if err := h.runCommand(diff); err != nil {
+			log.Printf("post-apply command failed: %v\n", err)
+		}
+	}
+
+	for _, url := range h.webhooks {
+		if err := h.callWebhook(url, diff); err != nil {
+			log.Printf("post-apply webhook %s failed: %v\n", url, err)
+		}
+	}
+}
+
+func (h postApplyHooks) runCommand(diff []byte) error {
+	cmd := exec.Command("/bin/sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(diff)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("post-apply command output: %s\n", out)
+	}
+	return err
+}
+
+// routingSummary is the frontends and backends an apply created, updated and deleted. A frontend or
+// backend whose middlewares or servers changed is updated.
+type routingSummary struct {
+	Changes int           `json:"changes"`
+	Created routingChange `json:"created"`
+	Updated routingChange `json:"updated"`
+	Deleted routingChange `json:"deleted"`
+}
+
+type routingChange struct {
+	Frontends []string `json:"frontends"`
+	Backends  []string `json:"backends"`
+}
+
+// summarizeChanges returns the summary of the changes, including those made under the prefixes
+// of VCB_TARGETS. Changes to hosts aren't summarized.
+func summarizeChanges(changes []keyChange) routingSummary {
+	type entity struct{ kind, name string }
+	actions := make(map[entity]string)
+	for _, c := range changes {
+		for kind, dir := range map[string]string{"frontend": "/frontends/", "backend": "/backends/"} {
+			i := strings.Index(c.Key, dir)
+			if i < 0 {
+				continue
+			}
+			parts := strings.Split(c.Key[i+len(dir):], "/")
+			e := entity{kind, parts[0]}
+			action := "updated"
+			if len(parts) == 2 && parts[1] == kind {
+				// the frontend or backend itself, rather than one of its middlewares or servers
+				if c.Action == "delete" {
+					action = "deleted"
+				} else if c.OldValue == "" {
+					action = "created"
+				}
+			} else if actions[e] != "" {
+				continue
+			}
+			actions[e] = action
+		}
+	}
+
+	s := routingSummary{Changes: len(changes)}
+	for e, action := range actions {
+		change := map[string]*routingChange{"created": &s.Created, "updated": &s.Updated, "deleted": &s.Deleted}[action]
+		if e.kind == "frontend" {
+			change.Frontends = append(change.Frontends, e.name)
+		} else {
+			change.Backends = append(change.Backends, e.name)
+		}
+	}
+	for _, change := range []*routingChange{&s.Created, &s.Updated, &s.Deleted} {
+		sort.Strings(change.Frontends)
+		sort.Strings(change.Backends)
+	}
+	return s
+}
+
+// slackText is the summary as a Slack message, e.g. "vcb applied 3 changes: created frontends
+// vcb-foo; deleted backends vcb-bar".
+func (s routingSummary) slackText() string {
+	var parts []string
+	for _, c := range []struct {
+		action string
+		change routingChange
+	}{{"created", s.Created}, {"updated", s.Updated}, {"deleted", s.Deleted}} {
+		if len(c.change.Frontends) > 0 {
+			parts = append(parts, fmt.Sprintf("%s frontends %s", c.action, strings.Join(c.change.Frontends, ", ")))
+		}
+		if len(c.change.Backends) > 0 {
+			parts = append(parts, fmt.Sprintf("%s backends %s", c.action, strings.Join(c.change.Backends, ", ")))
+		}
+	}
+	return fmt.Sprintf("vcb applied %d changes: %s", s.Changes, strings.Join(parts, "; "))
+}
+
+func (s routingSummary) empty() bool {
+	for _, c := range []routingChange{s.Created, s.Updated, s.Deleted} {
+		if len(c.Frontends) > 0 || len(c.Backends) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyChanges sends the summary of the changes to the notification webhooks, unless only hosts
+// changed.
+func (h postApplyHooks) notifyChanges(changes []keyChange) {
+	if len(h.notify) == 0 && len(h.slack) == 0 {
+		return
+	}
+	summary := summarizeChanges(changes)
+	if summary.empty() {
+		return
+	}
+	body, err := json.Marshal(summary)
+	if err == nil {
+		for _, url := range h.notify {
+			if err := h.callWebhook(url, body); err != nil {
+				log.Printf("notification webhook %s failed: %v\n", url, err)
+			}
+		}
+	}
+	text, err := json.Marshal(map[string]string{"text": summary.slackText()})
+	if err == nil {
+		for _, url := range h.slack {
+			if err := h.callWebhook(url, text); err != nil {
+				log.Printf("slack webhook %s failed: %v\n", url, err)
+			}
+		}
+	}
+}
+
+func (h postApplyHooks) callWebhook(url string, diff []byte) error {
+	resp, err := h.client.Post(url, "application/json", bytes.NewReader(diff))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// vulcanHost is a vulcand host terminating TLS with a keypair.
+type vulcanHost struct {
+	Cert    string
+	Key     string
+	Default bool
+}
+
+// readTLSHosts reads the hosts and their keypairs from the etcd prefix, where each host is a
+// directory with the keys cert, key and optionally default, and from the directory, where each host
+// is a pair of files <host>.crt and <host>.key. Hosts in etcd take precedence. Keypairs which
+// don't parse are skipped.
+func readTLSHosts(kapi client.KeysAPI, prefix string, dir string) map[string]vulcanHost {
+	hosts := make(map[string]vulcanHost)
+
+	if dir != "" {
+		certs, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+		if err != nil {
+			builderLog.Errorf("failed to list TLS certificates in %s: %v\n", dir, err)
+		}
+		for _, certFile := range certs {
+			name := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+			cert, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				builderLog.Warnf("failed to read TLS certificate of host %s: %v\n", name, err)
+				continue
+			}
+			key, err := ioutil.ReadFile(filepath.Join(dir, name+".key"))
+			if err != nil {
+				builderLog.Warnf("failed to read TLS key of host %s: %v\n", name, err)
+				continue
+			}
+			hosts[name] = vulcanHost{Cert: string(cert), Key: string(key)}
+		}
+	}
+
+	if prefix != "" {
+		resp, err := kapi.Get(context.Background(), prefix, &client.GetOptions{Recursive: true})
+		if err != nil {
+			if e, _ := err.(client.Error); e.Code != etcderr.EcodeKeyNotFound {
+				log.Panicf("failed to read TLS hosts from etcd: %v\n", err.Error())
+			}
+		} else {
+			for _, node := range resp.Node.Nodes {
+				if !node.Dir {
+					continue
+				}
+				name := filepath.Base(node.Key)
+				var host vulcanHost
+				for _, child := range node.Nodes {
+					switch filepath.Base(child.Key) {
+					case "cert":
+						host.Cert = child.Value
+					case "key":
+						host.Key = child.Value
+					case "default":
+						host.Default = child.Value == "true"
+					}
+				}
+				if _, found := hosts[name]; found {
+					builderLog.Warnf("TLS keypair of host %s in etcd replaces the one in %s\n", name, dir)
+				}
+				hosts[name] = host
+			}
+		}
+	}
+
+	for name, host := range hosts {
+		if _, err := tls.X509KeyPair([]byte(host.Cert), []byte(host.Key)); err != nil {
+			builderLog.Warnf("skipping host %s with an invalid TLS keypair: %v\n", name, err)
+			delete(hosts, name)
+		}
+	}
+	return hosts
+}
+
+type hostSettings struct {
+	Default bool
+	KeyPair struct {
+		Cert string
+		Key  string
+	}
+}
+
+// hostValue returns the /vulcand/hosts/<host>/host value of a host.
+func hostValue(name string, host vulcanHost) string {
+	var settings hostSettings
+	settings.Default = host.Default
+	settings.KeyPair.Cert = host.Cert
+	settings.KeyPair.Key = host.Key
+	b, err := json.Marshal(struct {
+		Name     string
+		Settings hostSettings
+	}{name, settings})
+	if err != nil {
+		// plain strings can always be marshalled
+		panic(err)
+	}
+	return string(b)
+}
+
+// redactValue hides the private key in a host value, so it isn't recorded in the history or sent
+// to the post-apply hooks. Other values are returned as they are.
+func redactValue(key string, value string) string {
+	if !isHostKey(key) || value == "" {
+		return value
+	}
+	var host struct {
+		Name     string
+		Settings hostSettings
+	}
+	if err := json.Unmarshal([]byte(value), &host); err != nil {
+		return "REDACTED"
+	}
+	if host.Settings.KeyPair.Key != "" {
+		host.Settings.KeyPair.Key = "REDACTED"
+	}
+	b, _ := json.Marshal(host)
+	return string(b)
+}
+
+// redactConfig returns a copy of the configuration with the private keys hidden.
+func redactConfig(m map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for k, v := range m {
+		redacted[k] = redactValue(k, v)
+	}
+	return redacted
+}
+
+// isHostKey reports whether the key is the host entry of a vulcand host, rather than e.g. one of
+// its listeners.
+func isHostKey(key string) bool {
+	return strings.HasPrefix(key, "/vulcand/hosts/") && strings.HasSuffix(key, "/host")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// kubernetesSource reads services from the Kubernetes Services selected by a label selector and
+// their Endpoints. Each Service is routed like an etcd service whose keys are the document in its
+// vcb/config annotation, see serviceDocumentNodes, and whose servers are its ready endpoints.
+type kubernetesSource struct {
+	api       string
+	token     string
+	namespace string
+	selector  string
+	client    *http.Client
+}
+
+// newKubernetesSource connects to VCB_KUBERNETES_API, or when unset to the cluster vcb runs in
+// with its service account.
+func newKubernetesSource() (*kubernetesSource, error) {
+	k := &kubernetesSource{
+		api:       strings.TrimSuffix(os.Getenv("VCB_KUBERNETES_API"), "/"),
+		token:     os.Getenv("VCB_KUBERNETES_TOKEN"),
+		namespace: os.Getenv("VCB_KUBERNETES_NAMESPACE"),
+		selector:  os.Getenv("VCB_KUBERNETES_SELECTOR"),
+		client:    &http.Client{},
+	}
+	if k.api != "" {
+		return k, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("VCB_KUBERNETES_API must be set outside a Kubernetes cluster")
+	}
+	k.api = "https://" + host + ":" + port
+	if k.token == "" {
+		token, err := ioutil.ReadFile(kubernetesServiceAccountDir + "token")
+		if err != nil {
+			return nil, err
+		}
+		k.token = strings.TrimSpace(string(token))
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	k.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return k, nil
+}
+
+type kubernetesMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Annotations     map[string]string `json:"annotations"`
+	ResourceVersion string            `json:"resourceVersion"`
+}
+
+type kubernetesServiceList struct {
+	Metadata kubernetesMetadata `json:"metadata"`
+	Items    []struct {
+		Metadata kubernetesMetadata `json:"metadata"`
+	} `json:"items"`
+}
+
+type kubernetesEndpoints struct {
+	Metadata kubernetesMetadata `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP        string `json:"ip"`
+			TargetRef *struct {
+				Name string `json:"name"`
+			} `json:"targetRef"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type kubernetesEndpointsList struct {
+	Metadata kubernetesMetadata    `json:"metadata"`
+	Items    []kubernetesEndpoints `json:"items"`
+}
+
+// resourceURL returns the URL of the selected resources, e.g. services, in the namespace.
+func (k *kubernetesSource) resourceURL(resource string, query url.Values) string {
+	path := "/api/v1/" + resource
+	if k.namespace != "" {
+		path = "/api/v1/namespaces/" + k.namespace + "/" + resource
+	}
+	if k.selector != "" {
+		query.Set("labelSelector", k.selector)
+	}
+	return k.api + path + "?" + query.Encode()
+}
+
+func (k *kubernetesSource) get(resource string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", k.resourceURL(resource, query), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s listing %s", resp.Status, resource)
+	}
+	return resp, nil
+}
+
+func (k *kubernetesSource) list(resource string, v interface{}) error {
+	resp, err := k.get(resource, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (k *kubernetesSource) services() ([]Service, error) {
+	var services kubernetesServiceList
+	if err := k.list("services", &services); err != nil {
+		return nil, err
+	}
+	var endpoints kubernetesEndpointsList
+	if err := k.list("endpoints", &endpoints); err != nil {
+		return nil, err
+	}
+	endpointsOf := make(map[string]kubernetesEndpoints)
+	for _, e := range endpoints.Items {
+		endpointsOf[e.Metadata.Namespace+"/"+e.Metadata.Name] = e
+	}
+
+	sort.Slice(services.Items, func(i, j int) bool {
+		a, b := services.Items[i].Metadata, services.Items[j].Metadata
+		return a.Name < b.Name || (a.Name == b.Name && a.Namespace < b.Namespace)
+	})
+	var result []Service
+	seen := make(map[string]bool)
+	for _, item := range services.Items {
+		meta := item.Metadata
+		if seen[meta.Name] {
+			builderLog.Warnf("skipping Kubernetes service %s/%s, a service %s was already found in another namespace\n", meta.Namespace, meta.Name, meta.Name)
+			continue
+		}
+		seen[meta.Name] = true
+
+		node := &client.Node{Key: "/" + meta.Name, Dir: true}
+		if config, found := meta.Annotations["vcb/config"]; found {
+			node.Nodes = append(node.Nodes, &client.Node{Key: node.Key + "/config", Value: config})
+		}
+		service := parseService(node)
+		if len(service.Addresses) > 0 {
+			builderLog.Warnf("ignoring servers in the config of Kubernetes service %s, its endpoints are used\n", meta.Name)
+			service.Addresses = make(map[string]string)
+		}
+		kubernetesAddresses(&service, endpointsOf[meta.Namespace+"/"+meta.Name], meta.Annotations["vcb/port"])
+		result = append(result, service)
+	}
+	return result, nil
+}
+
+// kubernetesAddresses sets the servers of the service to the ready endpoints' addresses, on the
+// named port or the first one, identified by the pod they belong to where there is one.
+func kubernetesAddresses(service *Service, endpoints kubernetesEndpoints, portName string) {
+	for _, subset := range endpoints.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if p.Name == portName || (portName == "" && port == 0) {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			service.invalid("Kubernetes service %s has no port %s\n", service.Name, portName)
+			continue
+		}
+		for _, address := range subset.Addresses {
+			id := strings.NewReplacer(".", "-", ":", "-").Replace(address.IP)
+			if address.TargetRef != nil && address.TargetRef.Name != "" {
+				id = address.TargetRef.Name
+			}
+			service.Addresses[id] = httpURL(address.IP, port)
+		}
+	}
+}
+
+// watch notifies on every change to the selected Services and Endpoints, reconnecting when the
+// API server ends a watch.
+func (k *kubernetesSource) watch(w *notifier) {
+	for _, resource := range []string{"services", "endpoints"} {
+		go func(resource string) {
+			for {
+				if err := k.watchResource(resource, w); err != nil {
+					watcherLog.Errorf("watching Kubernetes %s failed: %v\n", resource, err)
+				}
+				time.Sleep(5 * time.Second)
+			}
+		}(resource)
+	}
+}
+
+func (k *kubernetesSource) watchResource(resource string, w *notifier) error {
+	resp, err := k.get(resource, url.Values{"watch": {"true"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := d.Decode(&event); err != nil {
+			return err
+		}
+		if event.Type != "BOOKMARK" {
+			w.changed("Kubernetes " + resource)
+		}
+	}
+}
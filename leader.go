@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// leaderElection elects one of the vcbs sharing a key as the leader, which alone applies the
+// configuration while the others stand by. The leader holds the key with a TTL which it keeps
+// refreshing, so that when it stops the key expires and a standby takes over.
+type leaderElection struct {
+	key string
+	id  string
+	ttl time.Duration
+
+	sync.RWMutex
+	leader bool
+	// held is when the leader last refreshed the key
+	held time.Time
+	// changed is notified when vcb becomes the leader or stops being it
+	changed chan struct{}
+}
+
+func newLeaderElection(key string, ttl time.Duration) *leaderElection {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "vcb"
+	}
+	return &leaderElection{
+		key:     key,
+		id:      fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		ttl:     ttl,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// configuredLeaderElection starts campaigning for VCB_LEADER_KEY, with VCB_LEADER_TTL_SECONDS,
+// until ctx is done, or returns nil when vcb doesn't stand for election. A standby applies nothing,
+// so the watchdog doesn't watch it.
+func configuredLeaderElection(ctx context.Context, kapi client.KeysAPI, watchdog *applyWatchdog) *leaderElection {
+	if leaderKey == "" {
+		return nil
+	}
+	if dryRun {
+		log.Printf("WARN - VCB_LEADER_KEY is ignored in a dry run, which applies nothing")
+		return nil
+	}
+	ttl := 30
+	if leaderTTLSeconds != "" {
+		n, err := strconv.Atoi(leaderTTLSeconds)
+		if err != nil || n < 3 {
+			log.Printf("WARN - The provided leader TTL seconds=%s is invalid, using default value=30", leaderTTLSeconds)
+		} else {
+			ttl = n
+		}
+	}
+	election := newLeaderElection(leaderKey, time.Duration(ttl)*time.Second)
+	if watchdog != nil {
+		watchdog.setActive(election.isLeader)
+	}
+	election.campaign(kapi)
+	go election.run(ctx, kapi)
+	return election
+}
+
+// run campaigns to be the leader, and keeps the key once elected, until ctx is done.
+func (e *leaderElection) run(ctx context.Context, kapi client.KeysAPI) {
+	for {
+		e.campaign(kapi)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.ttl / 3):
+		}
+	}
+}
+
+// campaign refreshes the key when vcb is the leader, and otherwise takes it when it is free. A
+// leader which can't reach etcd stays the leader until the key would have expired.
+func (e *leaderElection) campaign(kapi client.KeysAPI) bool {
+	var err error
+	if e.isLeader() {
+		_, err = kapi.Set(context.Background(), e.key, "", &client.SetOptions{TTL: e.ttl, Refresh: true, PrevValue: e.id})
+	} else {
+		_, err = kapi.Set(context.Background(), e.key, e.id, &client.SetOptions{TTL: e.ttl, PrevExist: client.PrevNoExist})
+	}
+
+	now := time.Now()
+	if err == nil {
+		e.set(true, now)
+		return true
+	}
+	if ee, ok := err.(client.Error); ok {
+		switch ee.Code {
+		case etcderr.EcodeKeyNotFound, etcderr.EcodeTestFailed, etcderr.EcodeNodeExist:
+			// another vcb holds the key
+			e.set(false, now)
+			return false
+		}
+	}
+	// etcd can't be reached, or refused the write for another reason
+	builderLog.Errorf("failed to campaign for %s: %v\n", e.key, err)
+	if e.isLeader() && now.Sub(e.lastHeld()) >= e.ttl {
+		e.set(false, now)
+	}
+	return e.isLeader()
+}
+
+// resign gives up the key, so that a standby takes over without waiting for it to expire.
+func (e *leaderElection) resign(kapi client.KeysAPI) {
+	if !e.isLeader() {
+		return
+	}
+	if _, err := kapi.Delete(context.Background(), e.key, &client.DeleteOptions{PrevValue: e.id}); err != nil {
+		builderLog.Errorf("failed to resign the leadership %s: %v\n", e.key, err)
+	}
+	e.set(false, time.Now())
+}
+
+func (e *leaderElection) set(leader bool, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	if leader {
+		e.held = now
+	}
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+	if leader {
+		builderLog.Infof("elected leader as %s with %s\n", e.id, e.key)
+	} else {
+		builderLog.Infof("standing by as %s, another vcb holds %s\n", e.id, e.key)
+	}
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (e *leaderElection) isLeader() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.leader
+}
+
+func (e *leaderElection) lastHeld() time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	return e.held
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// serviceLock freezes the vulcand configuration of a service while it is held. Locks are set as
+// JSON, e.g. {"holder":"jane","expires":"2016-11-01T18:00:00Z","reason":"launch"}, or as a
+// plain string naming the holder, in which case they never expire.
+type serviceLock struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+func (l serviceLock) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+// readLocks returns the unexpired locks under prefix, keyed by service name.
+func readLocks(kapi client.KeysAPI, prefix string) map[string]serviceLock {
+	locks := make(map[string]serviceLock)
+
+	resp, err := kapi.Get(context.Background(), prefix, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
+			return locks
+		}
+		log.Panicf("failed to read locks from etcd: %v\n", err.Error())
+	}
+
+	now := time.Now()
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		service := filepath.Base(node.Key)
+		var lock serviceLock
+		if err := json.Unmarshal([]byte(node.Value), &lock); err != nil {
+			lock = serviceLock{Holder: node.Value}
+		}
+		if lock.expired(now) {
+			builderLog.Infof("ignoring lock on service %s held by %s, expired at %v\n", service, lock.Holder, lock.Expires)
+			continue
+		}
+		builderLog.Infof("service %s is locked by %s until %v: %s\n", service, lock.Holder, lock.Expires, lock.Reason)
+		locks[service] = lock
+	}
+	return locks
+}
+
+// lockedNames returns a function reporting whether a vcb- frontend or backend name belongs to
+// a locked service. services are all known service names, which are needed to tell apart
+// services whose names prefix each other, e.g. "foo" and "foo-bar".
+func lockedNames(locks map[string]serviceLock, services []string) func(name string) bool {
+	if len(locks) == 0 {
+		return nil
+	}
+	all := append([]string{}, services...)
+	for service := range locks {
+		all = append(all, service)
+	}
+	return func(name string) bool {
+		_, locked := locks[ownerOf(name, all)]
+		return locked
+	}
+}
+
+// ownerOf returns which of the services a generated frontend or backend name belongs to, or ""
+// if none. The longest matching naming pattern wins.
+func ownerOf(name string, services []string) string {
+	owner := ""
+	longest := 0
+	for _, service := range services {
+		exact := []string{
+			managedPrefix + service,
+			managedPrefix + "byhostheader-" + service,
+			managedPrefix + "internal-" + service,
+		}
+		prefixed := []string{
+			managedPrefix + service + "-",
+			managedPrefix + "health-" + service + "-",
+		}
+		for _, pattern := range exact {
+			if name == pattern && len(pattern) > longest {
+				owner, longest = service, len(pattern)
+			}
+		}
+		for _, pattern := range prefixed {
+			if strings.HasPrefix(name, pattern) && len(pattern) > longest {
+				owner, longest = service, len(pattern)
+			}
+		}
+	}
+	return owner
+}
+
+// frontendOrBackendName returns the frontend or backend name from a /vulcand/ key.
+func frontendOrBackendName(key string) string {
+	for _, prefix := range []string{"/vulcand/frontends/", "/vulcand/backends/"} {
+		if strings.HasPrefix(key, prefix) {
+			return strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)[0]
+		}
+	}
+	return ""
+}
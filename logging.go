@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// defaultLogLevel is the level of the subsystems VCB_LOG_LEVELS doesn't configure, e.g.
+// VCB_LOG_LEVEL=warn. Each key written and each event watched is logged at debug.
+var defaultLogLevel = parseLogLevel(os.Getenv("VCB_LOG_LEVEL"))
+
+func parseLogLevel(value string) logLevel {
+	if value == "" {
+		return levelInfo
+	}
+	level, found := levelNames[strings.ToLower(strings.TrimSpace(value))]
+	if !found {
+		log.Printf("WARN - The provided VCB_LOG_LEVEL=%s is invalid, using default value=info\n", value)
+		return levelInfo
+	}
+	return level
+}
+
+// logLevels holds the configured level of each subsystem, e.g. VCB_LOG_LEVELS=watcher=warn,applier=debug.
+// Subsystems which are not configured log at the default level.
+var logLevels = parseLogLevels(os.Getenv("VCB_LOG_LEVELS"))
+
+func parseLogLevels(value string) map[string]logLevel {
+	levels := make(map[string]logLevel)
+	for _, setting := range strings.Split(value, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("WARN - ignoring invalid log level setting %q\n", setting)
+			continue
+		}
+		level, found := levelNames[strings.ToLower(strings.TrimSpace(parts[1]))]
+		if !found {
+			log.Printf("WARN - ignoring unknown log level %q for %s\n", parts[1], parts[0])
+			continue
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+	return levels
+}
+
+// subsystemLogger logs messages of at least the level configured for the named subsystem.
+type subsystemLogger string
+
+var (
+	watcherLog = subsystemLogger("watcher")
+	builderLog = subsystemLogger("builder")
+	applierLog = subsystemLogger("applier")
+)
+
+func (l subsystemLogger) enabled(level logLevel) bool {
+	configured, found := logLevels[string(l)]
+	if !found {
+		configured = defaultLogLevel
+	}
+	return level >= configured
+}
+
+func (l subsystemLogger) logf(level logLevel, prefix string, format string, args ...interface{}) {
+	if l.enabled(level) {
+		log.Output(3, prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+func (l subsystemLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, "DEBUG - ", format, args...)
+}
+
+func (l subsystemLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, "", format, args...)
+}
+
+func (l subsystemLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, "WARN - ", format, args...)
+}
+
+func (l subsystemLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, "ERROR - ", format, args...)
+}
+
+// logToSyslog sends the log to syslog instead of stderr, tagged with tag: "local" for the local
+// syslog daemon, or e.g. udp://syslog:514 or tcp://syslog:514 for a remote one. syslog timestamps
+// the messages, and sets their severity from their level.
+func logToSyslog(address, tag string) error {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return fmt.Errorf("expected local, or a udp:// or tcp:// address, got %s", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(syslogWriter{w})
+	return nil
+}
+
+// syslogSeverities is implemented by *syslog.Writer.
+type syslogSeverities interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// syslogWriter writes each message with the severity of its level prefix, which is removed.
+type syslogWriter struct {
+	w syslogSeverities
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	m := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case strings.HasPrefix(m, "DEBUG - "):
+		err = s.w.Debug(strings.TrimPrefix(m, "DEBUG - "))
+	case strings.HasPrefix(m, "WARN - "):
+		err = s.w.Warning(strings.TrimPrefix(m, "WARN - "))
+	case strings.HasPrefix(m, "ERROR - "):
+		err = s.w.Err(strings.TrimPrefix(m, "ERROR - "))
+	default:
+		err = s.w.Info(m)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
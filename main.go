@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,7 +9,9 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"strconv"
@@ -23,72 +26,816 @@ var (
 	socksProxy      = os.Getenv("VCB_SOCK_PROXY")
 	etcdPeers       = os.Getenv("VCB_ETCD_PEERS")
 	cooldownSeconds = os.Getenv("VCB_COOLDOWN_SECONDS")
+	servicesPrefix  = os.Getenv("VCB_SERVICES_PREFIX")
 
-	addressRegex = regexp.MustCompile(`^[\.\-:\/\w]*:[0-9]{2,5}$`)
+	// where services are read from instead of the services prefixes, see newServiceSource
+	sourceName = os.Getenv("VCB_SOURCE")
+
+	// when either is set, vcb manages the vulcand hosts and their TLS keypairs
+	tlsPrefix = os.Getenv("VCB_TLS_PREFIX")
+	tlsDir    = os.Getenv("VCB_TLS_DIR")
+
+	// comma separated, takes precedence over VCB_SERVICES_PREFIX
+	servicesPrefixList = os.Getenv("VCB_SERVICES_PREFIXES")
+
+	hostConflictPolicy = os.Getenv("VCB_HOST_CONFLICT_POLICY")
+
+	httpAddress = os.Getenv("VCB_HTTP_ADDRESS")
+
+	// when set, the privileged endpoints are served here rather than on VCB_HTTP_ADDRESS
+	adminAddress = os.Getenv("VCB_ADMIN_ADDRESS")
+	adminToken   = os.Getenv("VCB_ADMIN_TOKEN")
+	// the admin address is served over TLS when both are set, and requires client certificates
+	// signed by the CAs in VCB_ADMIN_CLIENT_CA when it is set
+	adminTLSCert  = os.Getenv("VCB_ADMIN_TLS_CERT")
+	adminTLSKey   = os.Getenv("VCB_ADMIN_TLS_KEY")
+	adminClientCA = os.Getenv("VCB_ADMIN_CLIENT_CA")
+
+	resolverRefreshSeconds = os.Getenv("VCB_RESOLVER_REFRESH_SECONDS")
+	drainSeconds           = os.Getenv("VCB_DRAIN_SECONDS")
+
+	addressPolicyValue = os.Getenv("VCB_ADDRESS_POLICY")
+	addressSchemes     = os.Getenv("VCB_ADDRESS_SCHEMES")
+	addressPorts       = os.Getenv("VCB_ADDRESS_PORTS")
+	defaultSchemeValue = os.Getenv("VCB_DEFAULT_SCHEME")
+
+	vulcandAPI = os.Getenv("VCB_VULCAND_API")
+	// JSON list of vulcand prefixes, replacing /vulcand/
+	vulcandTargets = os.Getenv("VCB_TARGETS")
+
+	nginxConf       = os.Getenv("VCB_NGINX_CONF")
+	nginxReloadExec = os.Getenv("VCB_NGINX_RELOAD_EXEC")
+
+	haproxyConf       = os.Getenv("VCB_HAPROXY_CONF")
+	haproxyReloadExec = os.Getenv("VCB_HAPROXY_RELOAD_EXEC")
+
+	traefikConf = os.Getenv("VCB_TRAEFIK_CONF")
+
+	envoyXDSAddress = os.Getenv("VCB_ENVOY_XDS_ADDRESS")
+
+	dryRunValue = os.Getenv("VCB_DRY_RUN")
+
+	// the runtime profiles are served on /debug/pprof/ alongside the other privileged endpoints
+	pprofValue = os.Getenv("VCB_PPROF")
+
+	snapshotDir       = os.Getenv("VCB_SNAPSHOT_DIR")
+	snapshotPrefix    = os.Getenv("VCB_SNAPSHOT_PREFIX")
+	snapshotRetention = os.Getenv("VCB_SNAPSHOT_RETENTION")
+
+	// the vcb- keys expire unless vcb sets or refreshes them again within the TTL
+	keyTTLSeconds = os.Getenv("VCB_KEY_TTL_SECONDS")
+
+	// the address vulcand reaches the HTTP endpoints on, registering vcb as a service when set
+	selfRegisterAddress = os.Getenv("VCB_SELF_REGISTER_ADDRESS")
+	selfRegisterName    = os.Getenv("VCB_SELF_REGISTER_NAME")
+
+	locksPrefix = os.Getenv("VCB_LOCKS_PREFIX")
+
+	serviceStatusPrefix = os.Getenv("VCB_SERVICE_STATUS_PREFIX")
+
+	// only the vcb elected leader with this key applies the configuration, the others stand by
+	leaderKey        = os.Getenv("VCB_LEADER_KEY")
+	leaderTTLSeconds = os.Getenv("VCB_LEADER_TTL_SECONDS")
+
+	// the time and checksum of each successful apply are written to this key, - to disable
+	heartbeatKey        = os.Getenv("VCB_HEARTBEAT_KEY")
+	heartbeatTTLSeconds = os.Getenv("VCB_HEARTBEAT_TTL_SECONDS")
+
+	// the configuration is reported stale when a change hasn't been applied within this many seconds
+	watchdogSeconds = os.Getenv("VCB_WATCHDOG_SECONDS")
+	watchdogWebhook = os.Getenv("VCB_WATCHDOG_WEBHOOK")
+
+	// after this many consecutive failed applies vcb is no longer ready, or exits
+	failedAppliesLimit  = os.Getenv("VCB_FAILED_APPLIES_LIMIT")
+	failedAppliesAction = os.Getenv("VCB_FAILED_APPLIES_ACTION")
+
+	// best-effort applies write and delete every key they can, fail-fast ones stop at the first
+	// failure and are retried
+	applyPolicy       = os.Getenv("VCB_APPLY_POLICY")
+	applyRetrySeconds = os.Getenv("VCB_APPLY_RETRY_SECONDS")
+
+	validationKey = os.Getenv("VCB_VALIDATION_KEY")
+
+	cleanupMaxDeletionsValue = os.Getenv("VCB_CLEANUP_MAX_DELETIONS")
+	cleanupRulesValue        = os.Getenv("VCB_CLEANUP_RULES")
+
+	frontendSettingsValue = os.Getenv("VCB_FRONTEND_SETTINGS")
+	backendSettingsValue  = os.Getenv("VCB_BACKEND_SETTINGS")
+
+	// backend the public frontends of services in maintenance route to, instead of being removed
+	maintenanceBackend = os.Getenv("VCB_MAINTENANCE_BACKEND")
+
+	managedPrefixValue = os.Getenv("VCB_MANAGED_PREFIX")
+
+	historyDir       = os.Getenv("VCB_HISTORY_DIR")
+	historyRetention = os.Getenv("VCB_HISTORY_RETENTION")
+	// the changes of this many recent applies are kept in memory, and served on /__history
+	recentAppliesValue = os.Getenv("VCB_RECENT_APPLIES")
+
+	// each change made to /vulcand/ is appended to the audit log in this directory, or etcd prefix
+	auditDir           = os.Getenv("VCB_AUDIT_DIR")
+	auditPrefix        = os.Getenv("VCB_AUDIT_PREFIX")
+	auditRetentionDays = os.Getenv("VCB_AUDIT_RETENTION_DAYS")
+
+	// when set, services and their routes come from this file and only servers from etcd
+	desiredStateFile = os.Getenv("VCB_DESIRED_STATE_FILE")
+
+	// rebuilds are applied and verified under the staging prefix before being promoted to /vulcand/
+	stagingPrefix    = os.Getenv("VCB_STAGING_PREFIX")
+	stagingEtcdPeers = os.Getenv("VCB_STAGING_ETCD_PEERS")
+	stagingSmokeExec = os.Getenv("VCB_STAGING_SMOKE_EXEC")
+
+	// each rebuild is traced to the OTLP/HTTP collector, e.g. http://otel-collector:4318
+	otlpEndpoint = os.Getenv("VCB_OTLP_ENDPOINT")
+
+	// panics, and applies which keep failing, are reported to this Sentry compatible DSN
+	sentryDSN      = os.Getenv("VCB_SENTRY_DSN")
+	sentryFailures = os.Getenv("VCB_SENTRY_FAILURES")
+
+	// the log is sent to syslog instead of stderr, e.g. local or udp://syslog:514
+	syslogAddress = os.Getenv("VCB_SYSLOG_ADDRESS")
+	syslogTag     = os.Getenv("VCB_SYSLOG_TAG")
+
+	postApplyExec     = os.Getenv("VCB_POST_APPLY_EXEC")
+	postApplyWebhooks = os.Getenv("VCB_POST_APPLY_WEBHOOKS")
+
+	// a summary of the frontends and backends each apply changed is posted to these webhooks
+	notifyWebhooks = os.Getenv("VCB_NOTIFY_WEBHOOKS")
+	slackWebhooks  = os.Getenv("VCB_SLACK_WEBHOOKS")
 )
 
 func main() {
-	if etcdPeers == "" {
-		etcdPeers = "http://localhost:2379"
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
 	}
+	// exited with once everything deferred has been done, e.g. the leadership resigned
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 
-	transport := client.DefaultTransport
-
-	if socksProxy != "" {
-		dialer, _ := proxy.SOCKS5("tcp", socksProxy, nil, proxy.Direct)
-		transport = &http.Transport{Dial: dialer.Dial}
+	if syslogAddress != "" {
+		if syslogTag == "" {
+			syslogTag = "vcb"
+		}
+		if err := logToSyslog(syslogAddress, syslogTag); err != nil {
+			log.Printf("WARN - failed to log to syslog at %s, logging to stderr: %v\n", syslogAddress, err)
+		}
 	}
 
-	peers := strings.Split(etcdPeers, ",")
-	log.Printf("etcd peers are %v\n", peers)
+	log.Printf("starting %s\n", currentBuildInfo())
+	configure()
 
-	cfg := client.Config{
-		Endpoints:               peers,
-		Transport:               transport,
-		HeaderTimeoutPerRequest: 5 * time.Second,
+	stopTracing := configuredTracing()
+	defer stopTracing()
+
+	reporter := configuredErrorReporter()
+	if reporter != nil {
+		defer reporter.recoverPanic()
 	}
 
+	if dryRun {
+		log.Printf("dry run, the changes of each rebuild are logged but not made\n")
+	}
+
+	cfg := etcdConfig()
+	log.Printf("etcd peers are %v\n", cfg.Endpoints)
 	etcd, err := client.New(cfg)
 	if err != nil {
 		log.Fatalf("failed to start etcd client: %v\n", err.Error())
 	}
+	kapi := client.NewKeysAPI(etcd)
 
-	cooldown := 30
-	if cooldownSeconds != "" {
-		cooldown, err = strconv.Atoi(cooldownSeconds)
-		if err != nil {
-			log.Printf("WARN - The provided cooldownPeriod=%s is invalid, using default value=%v", cooldownSeconds, cooldown)
-		}
+	cooldown := configuredCooldown()
+	keyTTL := configuredKeyTTL()
+	applyRetry := configuredApplyRetry()
+	status := configuredApplyStatus(kapi)
+	builder := newRebuilder(kapi)
+
+	applier := &rebuildApplier{
+		staging:   configuredStaging(cfg, kapi),
+		snapshots: configuredSnapshots(kapi),
+		// configuration files for other proxies are written alongside the vulcand configuration
+		outputs: configFiles(),
+		// and it is served to Envoy
+		xds: configuredXDS(),
+	}
+	applier.target, applier.targets = configuredTargets(kapi)
+	recorder := &rebuildRecorder{
+		kapi:     kapi,
+		reporter: reporter,
+		history:  configuredHistory(),
+		recent:   configuredRecentApplies(),
+		audit:    newAuditLog(kapi),
+		hooks:    configuredPostApplyHooks(),
 	}
 
-	kapi := client.NewKeysAPI(etcd)
-	notifier := newNotifier(kapi, "/ft/services/")
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	consistency := &startupConsistency{}
+	validation := &latestValidation{}
+	rebuilds := newRebuildTrigger()
+	desired := &latestConfig{}
+	adminEndpoints := adminMux(consistency, validation)
+	adminEndpoints.HandleFunc("/__rebuild", rebuildHandler(rebuilds))
+	adminEndpoints.HandleFunc("/__config", configHandler(desired))
+	adminEndpoints.HandleFunc("/__history", historyHandler(recorder.recent))
+	// the differences are with the vulcand the consistency check covers
+	production := func() (client.KeysAPI, error) {
+		return applier.target, nil
+	}
+	var share func(vulcanConf, []string) vulcanConf
+	if applier.targets != nil {
+		share = applier.targets[0].conf
+	}
+	adminEndpoints.HandleFunc("/__diff", diffHandler(desired, production, share))
+	serveEndpoints(status, adminEndpoints)
+
+	// the watchers are stopped on shutdown
+	watching, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	notifier := watchForChanges(watching, kapi, builder, status.watchdog)
+	rebuilds.onSignal(syscall.SIGUSR1)
+	shutdown := shutdownOnSignal(stopWatching)
+
+	election := configuredLeaderElection(watching, kapi, status.watchdog)
+	var elected <-chan struct{}
+	if election != nil {
+		defer election.resign(kapi)
+		elected = election.changed
+	}
+	// the registration is removed before exiting, and before the leadership is resigned
+	deregistered := startSelfRegistration(watching, kapi, builder, election)
+	defer func() {
+		stopWatching()
+		deregistered()
+	}()
 
 	for {
+		// a standby waits until it is elected, and then rebuilds straight away
+		if election != nil && !election.isLeader() {
+			select {
+			case <-elected:
+				continue
+			case <-shutdown:
+				log.Println("exiting")
+				return
+			}
+		}
+		// the leadership was just checked, so earlier changes of it can be ignored
+		drainChannel(elected)
+
 		s := time.Now()
 		log.Println("rebuilding configuration")
 		// since vcb reads all the changes made in etcd, all notifications still in the channel can be ignored.
 		drainChannel(notifier.notify())
 		log.Printf("drained notifications channel")
 
-		applyVulcanConf(kapi, buildVulcanConf(readServices(kapi)))
-		log.Printf("completed reconfiguration. %v\n", time.Now().Sub(s))
+		trace, rebuild := tracer.Start(context.Background(), "rebuild")
+		vc, services, symbolic := builder.generate(trace)
+		vc.ttl = keyTTL
+		vc.trace = trace
+		vc.failFast = applyPolicy == "fail-fast"
+		report := validateServices(services)
+		if !dryRun {
+			report.publish(kapi, validationKey)
+		}
+		validation.set(report)
+		desired.set(vc, serviceNames(services), s)
+
+		// nothing is applied until /vulcand/ can be read for the startup consistency check
+		var checkErr error
+		if consistency.get() == nil {
+			checkErr = consistency.check(applier.target, serviceNames(services))
+		}
+		// a fail-fast apply which failed, or one which the consistency check stopped, is retried,
+		// with the configuration as it then is
+		var retry <-chan time.Time
+		if dryRun {
+			if checkErr != nil {
+				applierLog.Errorf("%v\n", checkErr)
+			}
+			applier.dryRun(vc, services)
+			rebuild.End()
+		} else {
+			var changes []keyChange
+			err := checkErr
+			if err != nil {
+				applierLog.Errorf("not applying: %v\n", err)
+			} else {
+				changes, err = applier.apply(s, vc, services)
+			}
+			applier.writeOutputs(vc, services)
+			log.Printf("completed reconfiguration. %v\n", time.Now().Sub(s))
+			status.update(err)
+			if err == nil {
+				status.watchdog.applied(s)
+			}
+			if err != nil && (vc.failFast || checkErr != nil) {
+				log.Printf("WARN - retrying the failed apply in %v\n", applyRetry)
+				retry = time.After(applyRetry)
+			}
+			endRebuildTrace(rebuild, len(services), len(changes), err)
+			recorder.record(s, vc, services, changes, err)
+			if failed, tooOften := status.failedTooOften(); tooOften && failedAppliesAction == "exit" {
+				applierLog.Errorf("the last %d applies failed, exiting\n", failed)
+				exitCode = 1
+				return
+			}
+		}
+
+		// symbolic server values are resolved again once the refresh interval has passed
+		var refresh <-chan time.Time
+		if symbolic {
+			refresh = time.After(builder.resolved.refresh)
+		}
+		// and servers are removed once they have drained
+		var drained <-chan time.Time
+		if builder.drains != nil {
+			drained = builder.drains.next(time.Now())
+		}
+		// and the vcb- keys are refreshed well before they expire
+		var expiring <-chan time.Time
+		if keyTTL > 0 {
+			expiring = time.After(keyTTL / 3)
+		}
+		// and the heartbeat is written well before it expires, even when nothing has changed
+		var beating <-chan time.Time
+		if heartbeatKey != "-" && heartbeatTTL > 0 && !dryRun {
+			beating = time.After(heartbeatTTL / 3)
+		}
+
+		// a shutdown takes precedence over any change
+		select {
+		case <-shutdown:
+			log.Println("exiting")
+			return
+		default:
+		}
 
 		// wait for a change
 		select {
-		case <-c:
+		case <-shutdown:
 			log.Println("exiting")
 			return
 		case <-notifier.notify():
+		case <-refresh:
+			log.Println("refreshing resolved server addresses")
+		case <-drained:
+			log.Println("removing drained servers")
+		case <-expiring:
+			// without a cooldown, which could outlast the TTL
+			log.Println("refreshing the TTL of the vcb- keys")
+			continue
+		case <-beating:
+			log.Println("rebuilding to write the heartbeat")
+			continue
+		case <-retry:
+			log.Println("retrying the failed apply")
+			continue
+		case <-elected:
+			// no longer the leader
+			continue
+		case <-rebuilds:
+			log.Println("rebuild requested, skipping the cooldown period")
+			continue
+		}
+
+		log.Printf("change detected, waiting in cooldown period for %v", cooldown)
+		select {
+		case <-time.After(cooldown):
+		case <-rebuilds:
+			log.Println("rebuild requested, ending the cooldown period")
+		case <-shutdown:
+			log.Println("exiting")
+			return
+		}
+	}
+
+}
+
+// rebuildApplier applies each rebuild to the vulcand target, or targets, through staging when set,
+// snapshotting the target first, and then writes it for the other proxies.
+type rebuildApplier struct {
+	target    client.KeysAPI
+	targets   []*vulcandTarget
+	staging   *stagingTarget
+	snapshots *vulcandSnapshots
+	outputs   []*configFile
+	xds       *envoyXDS
+}
+
+// apply applies the configuration of the rebuild started at s, returning the changes it made.
+func (a *rebuildApplier) apply(s time.Time, vc vulcanConf, services []Service) ([]keyChange, error) {
+	apply := func(vc vulcanConf) ([]keyChange, error) {
+		if a.snapshots != nil {
+			if err := a.snapshots.take(a.target, newRebuildID(s), s); err != nil {
+				applierLog.Errorf("failed to take a snapshot before applying: %v\n", err)
+			}
+		}
+		if a.targets != nil {
+			return applyVulcandTargets(a.targets, vc, serviceNames(services))
+		}
+		return applyVulcanConf(a.target, vc)
+	}
+	if a.staging != nil {
+		return a.staging.promote(vc, apply)
+	}
+	return apply(vc)
+}
+
+// dryRun logs the changes apply would make.
+func (a *rebuildApplier) dryRun(vc vulcanConf, services []Service) {
+	if a.targets == nil {
+		logDryRun(a.target, vc)
+		return
+	}
+	for _, t := range a.targets {
+		applierLog.Infof("dry run of %s, keys under /vulcand/ are under it\n", t.Prefix)
+		logDryRun(t.kapi, t.conf(vc, serviceNames(services)))
+	}
+}
+
+// writeOutputs writes the configuration files of the other proxies, and serves it to Envoy.
+func (a *rebuildApplier) writeOutputs(vc vulcanConf, services []Service) {
+	for _, output := range a.outputs {
+		if err := output.write(services, vc); err != nil {
+			applierLog.Errorf("failed to write %s configuration: %v\n", output.name, err)
+		}
+	}
+	if a.xds != nil {
+		if err := a.xds.update(services, vc); err != nil {
+			applierLog.Errorf("failed to update the Envoy configuration: %v\n", err)
+		}
+	}
+}
+
+// rebuildRecorder records the outcome of each applied rebuild, in the metrics, the history, the
+// audit log and the service statuses, reports it, and runs the post-apply hooks.
+type rebuildRecorder struct {
+	kapi     client.KeysAPI
+	reporter *errorReporter
+	history  rebuildHistory
+	recent   *recentApplies
+	audit    auditLog
+	hooks    postApplyHooks
+}
+
+// record records the changes made by the rebuild started at s, and err when it failed.
+func (r *rebuildRecorder) record(s time.Time, vc vulcanConf, services []Service, changes []keyChange, err error) {
+	recordChanges(changes)
+	if r.reporter != nil {
+		r.reporter.applied(err, len(services))
+	}
+
+	record := rebuildRecord{
+		ID:       newRebuildID(s),
+		Started:  s,
+		Duration: time.Now().Sub(s).String(),
+		Services: services,
+		Changes:  changes,
+	}
+	if r.history.dir != "" {
+		// the full configuration is only generated when it is recorded
+		record.Config = redactConfig(vulcanConfToEtcdKeys(vc))
+	}
+	if ae, ok := err.(applyError); ok {
+		record.Failures = ae.Failures
+	}
+	r.history.record(record)
+	r.recent.record(record)
+	r.audit.record(record.ID, time.Now(), changes)
+	if serviceStatusPrefix != "-" {
+		writeServiceStatuses(r.kapi, serviceStatusPrefix, serviceStatuses(services, vc, time.Now(), err))
+	}
+	if heartbeatKey != "-" && err == nil {
+		writeHeartbeat(r.kapi, heartbeatKey, vc, time.Now(), heartbeatTTL)
+	}
+	if err != nil {
+		log.Printf("WARN - not running post-apply hooks: %v\n", err)
+	} else if len(changes) > 0 {
+		r.hooks.run(changes)
+	}
+}
+
+// configuredCooldown returns how long VCB_COOLDOWN_SECONDS waits after a change before
+// rebuilding, so that the changes which follow it are applied together.
+func configuredCooldown() time.Duration {
+	cooldown := 30
+	if cooldownSeconds != "" {
+		n, err := strconv.Atoi(cooldownSeconds)
+		if err != nil {
+			log.Printf("WARN - The provided cooldownPeriod=%s is invalid, using default value=%v", cooldownSeconds, cooldown)
+		} else {
+			cooldown = n
+		}
+	}
+	return time.Duration(cooldown) * time.Second
+}
+
+// configuredKeyTTL returns the VCB_KEY_TTL_SECONDS the vcb- keys are set with, none when 0.
+func configuredKeyTTL() time.Duration {
+	var keyTTL time.Duration
+	if keyTTLSeconds != "" {
+		seconds, err := strconv.Atoi(keyTTLSeconds)
+		if err != nil || seconds < 0 {
+			log.Printf("WARN - The provided key TTL seconds=%s is invalid, using no TTL", keyTTLSeconds)
+		} else if vulcandAPI != "" && vulcandTargets == "" {
+			log.Printf("WARN - The key TTL is ignored with VCB_VULCAND_API")
+		} else {
+			keyTTL = time.Duration(seconds) * time.Second
+		}
+	}
+	if keyTTL > 0 {
+		log.Printf("the vcb- keys expire %v after they are last set or refreshed\n", keyTTL)
+	}
+	return keyTTL
+}
+
+// configuredApplyRetry returns how long VCB_APPLY_RETRY_SECONDS waits before retrying a failed
+// apply.
+func configuredApplyRetry() time.Duration {
+	if applyRetrySeconds != "" {
+		seconds, err := strconv.Atoi(applyRetrySeconds)
+		if err != nil || seconds < 1 {
+			log.Printf("WARN - The provided VCB_APPLY_RETRY_SECONDS=%s is invalid, using default value=10", applyRetrySeconds)
+		} else {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 10 * time.Second
+}
+
+// watchForChanges notifies of the changes to the services builder reads, the locks, the TLS
+// certificates and the desired state file, until ctx is done, and runs the watchdog, when set.
+func watchForChanges(ctx context.Context, kapi client.KeysAPI, builder *rebuilder, watchdog *applyWatchdog) *notifier {
+	watched := []string{locksPrefix}
+	if tlsPrefix != "" {
+		watched = append(watched, tlsPrefix)
+	}
+	notifier := newNotifier(ctx, kapi, watchdog, watched...)
+	if watchdog != nil {
+		go watchdog.run(ctx)
+	}
+	if builder.source != nil {
+		builder.source.source.watch(&notifier)
+	} else {
+		for _, prefix := range builder.servicesPrefixes {
+			notifier.watch(kapi, prefix, serviceEvents(prefix))
+		}
+	}
+	if builder.desired != nil {
+		notifier.watchFile(builder.desired.path, 5*time.Second)
+	}
+	return &notifier
+}
+
+// shutdownOnSignal returns a channel closed on SIGINT or SIGTERM, once stop has been called, so
+// that a rebuild is finished before exiting rather than leaving the configuration half applied. A
+// second signal exits straight away.
+func shutdownOnSignal(stop func()) <-chan struct{} {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-c
+		log.Printf("received %v, exiting once the current rebuild is done\n", sig)
+		stop()
+		close(shutdown)
+		sig = <-c
+		log.Printf("WARN - received %v again, exiting without finishing the current rebuild\n", sig)
+		os.Exit(1)
+	}()
+	return shutdown
+}
+
+var (
+	// a dry run logs the changes each rebuild would make, and writes nothing to etcd
+	dryRun bool
+	// heartbeatTTL is the TTL of heartbeatKey, none when 0
+	heartbeatTTL time.Duration
+)
+
+// configure applies the defaults to, and validates, the settings read from the environment which
+// are shared by the builder loop and the commands generating configuration.
+func configure() {
+	if etcdPeers == "" {
+		etcdPeers = "http://localhost:2379"
+	}
+
+	dryRun = dryRunValue == "true"
+
+	if locksPrefix == "" {
+		locksPrefix = "/ft/locks/"
+	}
+
+	if serviceStatusPrefix == "" {
+		serviceStatusPrefix = "/ft/service-status/"
+	}
+
+	if heartbeatKey == "" {
+		heartbeatKey = "/ft/vcb/last-applied"
+	}
+	if heartbeatTTLSeconds != "" {
+		seconds, err := strconv.Atoi(heartbeatTTLSeconds)
+		if err != nil || seconds < 0 {
+			log.Printf("WARN - The provided heartbeat TTL seconds=%s is invalid, using no TTL", heartbeatTTLSeconds)
+		} else {
+			heartbeatTTL = time.Duration(seconds) * time.Second
+		}
+	}
+
+	switch applyPolicy {
+	case "best-effort", "fail-fast":
+	case "":
+		applyPolicy = "best-effort"
+	default:
+		log.Printf("WARN - The provided VCB_APPLY_POLICY=%s is invalid, using default value=best-effort", applyPolicy)
+		applyPolicy = "best-effort"
+	}
+
+	if validationKey == "" {
+		validationKey = "/ft/services-validation"
+	}
+
+	if managedPrefixValue != "" {
+		if !managedPrefixRegex.MatchString(managedPrefixValue) {
+			log.Printf("WARN - The provided managed prefix=%s is invalid, using default value=%s", managedPrefixValue, defaultManagedPrefix)
+		} else if managedPrefixValue != defaultManagedPrefix && prefixesOverlap(managedPrefixValue, defaultManagedPrefix) {
+			log.Printf("WARN - The provided managed prefix=%s overlaps with the default prefix of other deployments, using default value=%s", managedPrefixValue, defaultManagedPrefix)
+			managedPrefix = defaultManagedPrefix
+		} else {
+			managedPrefix = managedPrefixValue
+		}
+	}
+
+	switch hostConflictPolicy {
+	case conflictPolicyAlphabetical, conflictPolicyPriority, conflictPolicyReject:
+	case "":
+		hostConflictPolicy = conflictPolicyAlphabetical
+	default:
+		log.Printf("WARN - The provided host conflict policy=%s is invalid, using default value=%s", hostConflictPolicy, conflictPolicyAlphabetical)
+		hostConflictPolicy = conflictPolicyAlphabetical
+	}
+
+	var err error
+	if cleanupMaxDeletionsValue != "" {
+		limit, err := strconv.Atoi(cleanupMaxDeletionsValue)
+		if err != nil || limit < 0 {
+			log.Printf("WARN - The provided cleanup max deletions=%s is invalid, using default value=%d", cleanupMaxDeletionsValue, cleanupMaxDeletions)
+		} else {
+			cleanupMaxDeletions = limit
+		}
+	}
+	if cleanupRulesValue != "" {
+		rules, err := parseCleanupRules(cleanupRulesValue)
+		if err != nil {
+			log.Printf("WARN - The provided VCB_CLEANUP_RULES=%s are invalid, using the default rules: %v", cleanupRulesValue, err)
+		} else {
+			vulcandCleanupRules = rules
 		}
+	}
+
+	addressValidation, err = parseAddressPolicy(addressPolicyValue, addressSchemes, addressPorts)
+	if err != nil {
+		log.Printf("WARN - The provided address policy=%s, schemes=%s and ports=%s are invalid, using the default lenient policy: %v", addressPolicyValue, addressSchemes, addressPorts, err)
+		addressValidation, _ = parseAddressPolicy("", "", "")
+	}
+
+	if defaultSchemeValue != "" {
+		if validScheme(defaultSchemeValue) {
+			defaultScheme = defaultSchemeValue
+		} else {
+			log.Printf("WARN - The provided default scheme=%s is invalid, leaving bare addresses as they are", defaultSchemeValue)
+		}
+	}
 
-		log.Printf("change detected, waiting in cooldown period for %v seconds", cooldown)
-		<-time.After(time.Duration(cooldown) * time.Second)
+	if frontendSettingsValue != "" {
+		defaultFrontendSettings, err = parseFrontendSettings(frontendSettingsValue)
+		if err != nil {
+			log.Printf("WARN - The provided frontend settings=%s are invalid, using no default settings: %v", frontendSettingsValue, err)
+			defaultFrontendSettings = nil
+		}
 	}
 
+	if backendSettingsValue != "" {
+		configuredBackendSettings, err = parseBackendSettings(backendSettingsValue)
+		if err != nil {
+			log.Printf("WARN - The provided backend settings=%s are invalid, using the built in settings: %v", backendSettingsValue, err)
+			configuredBackendSettings = nil
+		}
+	}
+}
+
+// etcdConfig returns the configuration of the etcd client, reaching the peers through the SOCKS
+// proxy if there is one.
+func etcdConfig() client.Config {
+	transport := client.DefaultTransport
+
+	if socksProxy != "" {
+		dialer, _ := proxy.SOCKS5("tcp", socksProxy, nil, proxy.Direct)
+		transport = &http.Transport{Dial: dialer.Dial}
+	}
+
+	return client.Config{
+		Endpoints:               strings.Split(etcdPeers, ","),
+		Transport:               transport,
+		HeaderTimeoutPerRequest: 5 * time.Second,
+	}
+}
+
+// rebuilder reads the services and generates the configuration of each rebuild.
+type rebuilder struct {
+	kapi             client.KeysAPI
+	servicesPrefixes []string
+	// source is set when services are read from somewhere other than the services prefixes
+	source *sourcedServices
+	// desired is set when services and their routes come from the desired state file
+	desired  *desiredState
+	resolved *resolvedAddresses
+	// drains is set when servers which disappear are drained before they are removed
+	drains *serverDrains
+}
+
+func newRebuilder(kapi client.KeysAPI) *rebuilder {
+	servicesPrefixes := parseServicesPrefixes(servicesPrefixList, servicesPrefix)
+	log.Printf("services prefixes are %v\n", servicesPrefixes)
+
+	resolverRefresh := 60
+	if resolverRefreshSeconds != "" {
+		var err error
+		resolverRefresh, err = strconv.Atoi(resolverRefreshSeconds)
+		if err != nil || resolverRefresh < 1 {
+			log.Printf("WARN - The provided resolver refresh seconds=%s is invalid, using default value=60", resolverRefreshSeconds)
+			resolverRefresh = 60
+		}
+	}
+
+	var drains *serverDrains
+	if drainSeconds != "" {
+		drain, err := strconv.Atoi(drainSeconds)
+		if err != nil || drain < 0 {
+			log.Printf("WARN - The provided drain seconds=%s is invalid, using default value=0", drainSeconds)
+		} else if drain > 0 {
+			drains = newServerDrains(time.Duration(drain) * time.Second)
+		}
+	}
+
+	var sourced *sourcedServices
+	source, err := newServiceSource(sourceName)
+	if err != nil {
+		log.Fatalf("failed to set up source %s: %v\n", sourceName, err)
+	}
+	if source != nil {
+		log.Printf("reading services from %s\n", sourceName)
+		sourced = &sourcedServices{source: source}
+	}
+
+	var desired *desiredState
+	if desiredStateFile != "" {
+		log.Printf("reading desired state from %s\n", desiredStateFile)
+		desired = &desiredState{path: desiredStateFile}
+	}
+
+	return &rebuilder{
+		kapi:             kapi,
+		servicesPrefixes: servicesPrefixes,
+		source:           sourced,
+		desired:          desired,
+		resolved:         newResolvedAddresses(time.Duration(resolverRefresh) * time.Second),
+		drains:           drains,
+	}
+}
+
+// generate returns the configuration for the services as they are now, the services it was
+// generated from, and whether any of their servers were symbolic.
+func (r *rebuilder) generate(ctx context.Context) (vulcanConf, []Service, bool) {
+	_, span := tracer.Start(ctx, "readServices")
+	var services []Service
+	if r.source != nil {
+		services = r.source.services()
+	} else {
+		services = readServicesFromPrefixes(r.kapi, r.servicesPrefixes)
+	}
+	if r.desired != nil {
+		services = withDynamicAddresses(r.desired.services(), services)
+	}
+	services, symbolic := r.resolved.expandAddresses(services)
+	if r.drains != nil {
+		services = r.drains.apply(services, time.Now())
+	}
+	services = resolveAuthSecrets(r.kapi, services)
+	services, _ = resolveHostConflicts(services, hostConflictPolicy)
+	span.End()
+
+	_, span = tracer.Start(ctx, "buildVulcanConf")
+	defer span.End()
+	vc := buildVulcanConf(services)
+	vc.frozen = lockedNames(readLocks(r.kapi, locksPrefix), serviceNames(services))
+	if tlsPrefix != "" || tlsDir != "" {
+		vc.Hosts = readTLSHosts(r.kapi, tlsPrefix, tlsDir)
+	}
+	return vc, services, symbolic
 }
 
 func drainChannel(ch <-chan struct{}) {
@@ -102,21 +849,84 @@ func drainChannel(ch <-chan struct{}) {
 	}
 }
 
+// parseServicesPrefixes returns the etcd directories services are read from. A comma separated list
+// takes precedence over a single prefix, and /ft/services/ is used if neither is set.
+func parseServicesPrefixes(list string, single string) []string {
+	if list == "" {
+		list = single
+	}
+	var prefixes []string
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix = prefix + "/"
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{"/ft/services/"}
+	}
+	return prefixes
+}
+
 type Service struct {
-	Name              string
-	HasHealthCheck    bool
-	Addresses         map[string]string
-	PathPrefixes      map[string]string
-	PathHosts         map[string]string
-	FailoverPredicate string
+	Name                   string
+	HasHealthCheck         bool
+	Maintenance            bool
+	HealthCheckPath        string
+	HealthCheckPaths       map[string]string
+	DefaultScheme          string
+	Addresses              map[string]string
+	Weights                map[string]int
+	CanaryWeight           *int
+	HostAliases            []string
+	BackendSettings        map[string]interface{}
+	FrontendSettings       map[string]interface{}
+	FrontendType           string
+	StickyCookie           string
+	Middlewares            map[string]string
+	RateLimit              *rateLimit
+	ConnLimit              *connLimit
+	Headers                *headers
+	CircuitBreaker         *circuitBreaker
+	Auth                   *basicAuth
+	MiddlewarePriorities   map[string]int
+	PathPrefixes           map[string]string
+	PathHosts              map[string]string
+	PathHostRegexes        map[string]string
+	PathNormalise          map[string]bool
+	PathStripPrefix        map[string]bool
+	PathRewrites           map[string]vulcanRewriteMw
+	PathMethods            map[string][]string
+	PathHeaders            map[string]headerMatcher
+	PathFailoverPredicates map[string]string
+	PathPriorities         map[string]int
+	FailoverPredicate      string
+	Priority               int
+
+	// hosts claimed by this service which were given to another service, see resolveHostConflicts
+	rejectedHosts map[string]bool
+	// problems found reading the service, reported in its status
+	problems []string
+	// servers kept at weight 0 while they drain, see serverDrains
+	draining map[string]bool
 }
 
-func readServices(kapi client.KeysAPI) []Service {
-	resp, err := kapi.Get(context.Background(), "/ft/services/", &client.GetOptions{Recursive: true})
+// invalid logs and records a problem with the service's keys.
+func (s *Service) invalid(format string, args ...interface{}) {
+	builderLog.Warnf(format, args...)
+	s.problems = append(s.problems, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func readServices(kapi client.KeysAPI, prefix string) []Service {
+	resp, err := kapi.Get(context.Background(), prefix, &client.GetOptions{Recursive: true})
 	if err != nil {
-		log.Println("error reading etcd keys")
+		builderLog.Warnf("error reading etcd keys")
 		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
-			log.Println("core key not found")
+			builderLog.Warnf("core key not found")
 			return []Service{}
 		}
 		log.Panicf("failed to read from etcd: %v\n", err.Error())
@@ -128,38 +938,369 @@ func readServices(kapi client.KeysAPI) []Service {
 	var services []Service
 	for _, node := range resp.Node.Nodes {
 		if !node.Dir {
-			log.Printf("skipping non-directory %v\n", node.Key)
+			builderLog.Infof("skipping non-directory %v\n", node.Key)
 			continue
 		}
-		service := Service{
-			Name:         filepath.Base(node.Key),
-			Addresses:    make(map[string]string),
-			PathPrefixes: make(map[string]string),
-			PathHosts:    make(map[string]string),
+		services = append(services, parseService(node))
+	}
+	return services
+}
+
+// parseService reads a service from its directory of keys.
+func parseService(node *client.Node) Service {
+	service := Service{
+		Name:                   filepath.Base(node.Key),
+		Addresses:              make(map[string]string),
+		Weights:                make(map[string]int),
+		HealthCheckPaths:       make(map[string]string),
+		Middlewares:            make(map[string]string),
+		MiddlewarePriorities:   make(map[string]int),
+		PathPrefixes:           make(map[string]string),
+		PathHosts:              make(map[string]string),
+		PathHostRegexes:        make(map[string]string),
+		PathNormalise:          make(map[string]bool),
+		PathStripPrefix:        make(map[string]bool),
+		PathRewrites:           make(map[string]vulcanRewriteMw),
+		PathMethods:            make(map[string][]string),
+		PathHeaders:            make(map[string]headerMatcher),
+		PathFailoverPredicates: make(map[string]string),
+		PathPriorities:         make(map[string]int),
+	}
+	children := node.Nodes
+	for _, child := range node.Nodes {
+		if filepath.Base(child.Key) == "config" && !child.Dir {
+			doc, err := serviceDocumentNodes(node.Key, child.Value)
+			if err != nil {
+				service.invalid("invalid config document for service %s: %v\n", service.Name, err)
+				continue
+			}
+			// the keys of the document are read first, so that the service's own keys override them
+			children = append(doc, node.Nodes...)
 		}
-		for _, child := range node.Nodes {
-			switch filepath.Base(child.Key) {
-			case "healthcheck":
-				service.HasHealthCheck = child.Value == "true"
-			case "servers":
-				for _, server := range child.Nodes {
-					service.Addresses[filepath.Base(server.Key)] = server.Value
+	}
+	for _, child := range children {
+		switch filepath.Base(child.Key) {
+		case "config":
+			// read above
+		case "healthcheck":
+			service.HasHealthCheck = child.Value == "true"
+		case "maintenance":
+			service.Maintenance = child.Value == "true"
+		case "stickiness":
+			if !cookieNameRegex.MatchString(child.Value) {
+				service.invalid("invalid stickiness cookie name %v for service %s\n", child.Value, service.Name)
+				continue
+			}
+			service.StickyCookie = child.Value
+		case "healthcheck-path":
+			service.HealthCheckPath = child.Value
+			if !strings.HasPrefix(service.HealthCheckPath, "/") {
+				service.HealthCheckPath = "/" + service.HealthCheckPath
+			}
+		case "healthcheck-paths":
+			for _, server := range child.Nodes {
+				path := server.Value
+				if !strings.HasPrefix(path, "/") {
+					path = "/" + path
+				}
+				service.HealthCheckPaths[filepath.Base(server.Key)] = path
+			}
+		case "servers":
+			for _, server := range child.Nodes {
+				if isCanary(filepath.Base(server.Key)) {
+					service.invalid("server %s of service %s is named like a canary server, skipping it\n", filepath.Base(server.Key), service.Name)
+					continue
+				}
+				service.Addresses[filepath.Base(server.Key)] = serverValue(server)
+			}
+		case "canary":
+			for _, server := range child.Nodes {
+				service.Addresses[canaryPrefix+filepath.Base(server.Key)] = serverValue(server)
+			}
+		case "default-scheme":
+			if !validScheme(child.Value) {
+				service.invalid("invalid default-scheme %v for service %s\n", child.Value, service.Name)
+				continue
+			}
+			service.DefaultScheme = child.Value
+		case "canary-weight":
+			weight, err := strconv.Atoi(child.Value)
+			if err != nil || weight < 0 || weight > 100 {
+				service.invalid("invalid canary weight %v for service %s\n", child.Value, service.Name)
+				continue
+			}
+			service.CanaryWeight = &weight
+		case "weights":
+			for _, weight := range child.Nodes {
+				w, err := strconv.Atoi(weight.Value)
+				if err != nil || w < 0 {
+					service.invalid("invalid weight %v for server %s of service %s\n", weight.Value, filepath.Base(weight.Key), service.Name)
+					continue
+				}
+				service.Weights[filepath.Base(weight.Key)] = w
+			}
+		case "host-aliases":
+			if child.Dir {
+				for _, alias := range child.Nodes {
+					service.HostAliases = append(service.HostAliases, parseHostAliases(alias.Value)...)
+				}
+			} else {
+				service.HostAliases = parseHostAliases(child.Value)
+			}
+		case "backend-settings":
+			settings, err := parseBackendSettings(child.Value)
+			if err != nil {
+				service.invalid("invalid backend-settings for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.BackendSettings = settings
+		case "frontend-settings":
+			settings, err := parseFrontendSettings(child.Value)
+			if err != nil {
+				service.invalid("invalid frontend-settings for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.FrontendSettings = settings
+		case "middlewares":
+			for _, mw := range child.Nodes {
+				id := filepath.Base(mw.Key)
+				if id == "rewrite" || strings.HasPrefix(id, manualMiddlewarePrefix) {
+					service.invalid("middleware id %s of service %s is reserved, skipping it\n", id, service.Name)
+					continue
+				}
+				if !json.Valid([]byte(mw.Value)) {
+					service.invalid("invalid middleware %s for service %s: not JSON\n", id, service.Name)
+					continue
+				}
+				service.Middlewares[id] = mw.Value
+			}
+		case "middleware-priorities":
+			for _, p := range child.Nodes {
+				priority, err := strconv.Atoi(p.Value)
+				if err != nil {
+					service.invalid("invalid priority %v for middleware %s of service %s\n", p.Value, filepath.Base(p.Key), service.Name)
+					continue
+				}
+				service.MiddlewarePriorities[filepath.Base(p.Key)] = priority
+			}
+		case "ratelimit":
+			rl, err := parseRateLimit(child)
+			if err != nil {
+				service.invalid("invalid ratelimit for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.RateLimit = rl
+		case "connlimit":
+			cl, err := parseConnLimit(child)
+			if err != nil {
+				service.invalid("invalid connlimit for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.ConnLimit = cl
+		case "headers":
+			h, err := parseHeaders(child)
+			if err != nil {
+				service.invalid("invalid headers for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.Headers = h
+		case "cbreaker":
+			cb, err := parseCircuitBreaker(child)
+			if err != nil {
+				service.invalid("invalid cbreaker for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.CircuitBreaker = cb
+		case "auth":
+			auth, err := parseBasicAuth(child)
+			if err != nil {
+				service.invalid("invalid auth for service %s, refusing all requests to its paths: %v\n", service.Name, err)
+			}
+			service.Auth = auth
+		case "path-regex":
+			for _, path := range child.Nodes {
+				if _, err := regexp.Compile(path.Value); err != nil {
+					service.invalid("invalid path-regex for path %s of service %s: %v\n", filepath.Base(path.Key), service.Name, err)
+					continue
+				}
+				if !strings.HasPrefix(path.Value, "^") {
+					builderLog.Warnf("path-regex %s of path %s of service %s isn't anchored with ^, it is anchored to the start of the path\n", path.Value, filepath.Base(path.Key), service.Name)
 				}
-			case "path-regex":
-				for _, path := range child.Nodes {
-					service.PathPrefixes[filepath.Base(path.Key)] = path.Value
+				service.PathPrefixes[filepath.Base(path.Key)] = path.Value
+			}
+		case "path-host":
+			for _, path := range child.Nodes {
+				service.PathHosts[filepath.Base(path.Key)] = path.Value
+			}
+		case "path-host-regex":
+			for _, path := range child.Nodes {
+				if _, err := regexp.Compile(path.Value); err != nil {
+					service.invalid("invalid path-host-regex for path %s of service %s: %v\n", filepath.Base(path.Key), service.Name, err)
+					continue
+				}
+				service.PathHostRegexes[filepath.Base(path.Key)] = path.Value
+			}
+		case "path-normalise":
+			for _, path := range child.Nodes {
+				service.PathNormalise[filepath.Base(path.Key)] = path.Value == "true"
+			}
+		case "path-strip-prefix":
+			for _, path := range child.Nodes {
+				service.PathStripPrefix[filepath.Base(path.Key)] = path.Value == "true"
+			}
+		case "path-rewrite":
+			for _, path := range child.Nodes {
+				rewrite, err := parsePathRewrite(path.Value)
+				if err != nil {
+					service.invalid("invalid path-rewrite for path %s of service %s: %v\n", filepath.Base(path.Key), service.Name, err)
+					continue
+				}
+				service.PathRewrites[filepath.Base(path.Key)] = rewrite
+			}
+		case "path-methods":
+			for _, path := range child.Nodes {
+				service.PathMethods[filepath.Base(path.Key)] = parseMethods(path.Value)
+			}
+		case "path-header", "path-header-regex":
+			for _, path := range child.Nodes {
+				header, err := parseHeaderMatcher(path.Value, filepath.Base(child.Key) == "path-header-regex")
+				if err == nil && header.Regexp {
+					_, err = regexp.Compile(header.Value)
+				}
+				if err != nil {
+					service.invalid("invalid %s for path %s of service %s: %v\n", filepath.Base(child.Key), filepath.Base(path.Key), service.Name, err)
+					continue
+				}
+				service.PathHeaders[filepath.Base(path.Key)] = header
+			}
+		case "path-failover-predicate":
+			for _, path := range child.Nodes {
+				if err := checkPredicate(path.Value, failoverPredicateFunctions); err != nil {
+					service.invalid("invalid path-failover-predicate for path %s of service %s: %v\n", filepath.Base(path.Key), service.Name, err)
+					continue
 				}
-			case "path-host":
-				for _, path := range child.Nodes {
-					service.PathHosts[filepath.Base(path.Key)] = path.Value
+				service.PathFailoverPredicates[filepath.Base(path.Key)] = path.Value
+			}
+		case "path-priority":
+			for _, path := range child.Nodes {
+				priority, err := strconv.Atoi(path.Value)
+				if err != nil {
+					service.invalid("invalid priority %v for path %s of service %s\n", path.Value, filepath.Base(path.Key), service.Name)
+					continue
 				}
-			case "failover-predicate":
-				service.FailoverPredicate = child.Value
-			default:
-				fmt.Printf("skipped key %v for node %v\n", child.Key, child)
+				service.PathPriorities[filepath.Base(path.Key)] = priority
+			}
+		case "frontend-type":
+			if !frontendTypeRegex.MatchString(child.Value) {
+				service.invalid("invalid frontend-type %v for service %s\n", child.Value, service.Name)
+				continue
 			}
+			service.FrontendType = child.Value
+		case "failover-predicate":
+			if err := checkPredicate(child.Value, failoverPredicateFunctions); err != nil {
+				service.invalid("invalid failover-predicate for service %s: %v\n", service.Name, err)
+				continue
+			}
+			service.FailoverPredicate = child.Value
+		case "priority":
+			priority, err := strconv.Atoi(child.Value)
+			if err != nil {
+				service.invalid("invalid priority %v for service %s\n", child.Value, service.Name)
+				continue
+			}
+			service.Priority = priority
+		default:
+			service.invalid("unknown key %s of service %s\n", filepath.Base(child.Key), service.Name)
+		}
+	}
+	return service
+}
+
+func serviceNames(services []Service) []string {
+	var names []string
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+	return names
+}
+
+func parseHostAliases(value string) []string {
+	var aliases []string
+	for _, alias := range strings.Split(value, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// hostHeaderHosts returns the hosts the host header frontend of the service matches.
+func hostHeaderHosts(service Service) []string {
+	var hosts []string
+	for _, host := range claimedHosts(service) {
+		if !service.rejectedHosts[strings.ToLower(host)] {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hostsMatcher returns a route expression matching any of the given hosts.
+func hostsMatcher(hosts []string) string {
+	var matchers []string
+	for _, host := range hosts {
+		matchers = append(matchers, fmt.Sprintf("Host(`%s`)", host))
+	}
+	if len(matchers) == 1 {
+		return matchers[0]
+	}
+	return "(" + strings.Join(matchers, " || ") + ")"
+}
+
+// headerMatcher matches requests with a header equal to, or matching the regex, Value.
+type headerMatcher struct {
+	Name   string
+	Value  string
+	Regexp bool
+}
+
+// parseHeaderMatcher parses a header in the form "Name: value".
+func parseHeaderMatcher(value string, regexp bool) (headerMatcher, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return headerMatcher{}, fmt.Errorf("expected \"Header-Name: value\" but got %q", value)
+	}
+	return headerMatcher{
+		Name:   strings.TrimSpace(parts[0]),
+		Value:  strings.TrimSpace(parts[1]),
+		Regexp: regexp,
+	}, nil
+}
+
+func (h headerMatcher) matcher() string {
+	if h.Regexp {
+		return fmt.Sprintf("HeaderRegexp(`%s`, `%s`)", h.Name, h.Value)
+	}
+	return fmt.Sprintf("Header(`%s`, `%s`)", h.Name, h.Value)
+}
+
+// parseMethods parses a comma separated list of HTTP methods, e.g. "GET,HEAD".
+func parseMethods(value string) []string {
+	var methods []string
+	for _, method := range strings.Split(value, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			methods = append(methods, method)
 		}
-		services = append(services, service)
+	}
+	return methods
+}
+
+// readServicesFromPrefixes reads and combines the services from each prefix, in prefix order. The
+// same service name may appear more than once; see resolveHostConflicts.
+func readServicesFromPrefixes(kapi client.KeysAPI, prefixes []string) []Service {
+	var services []Service
+	for _, prefix := range prefixes {
+		services = append(services, readServices(kapi, prefix)...)
 	}
 	return services
 }
@@ -167,14 +1308,36 @@ func readServices(kapi client.KeysAPI) []Service {
 type vulcanConf struct {
 	FrontEnds map[string]vulcanFrontend
 	Backends  map[string]vulcanBackend
+	// Hosts are only managed when not nil, in which case any other host entries are removed
+	Hosts map[string]vulcanHost
+	// frozen reports whether the existing keys of a frontend or backend must be kept as they are
+	frozen func(name string) bool
+	// keys, when set, are the keys of the configuration as they are, e.g. restored from an export,
+	// rather than generated from the frontends and backends
+	keys map[string]string
+	// ttl, when set, is the TTL the vcb- keys are set and refreshed with
+	ttl time.Duration
+	// trace, when set, is the trace of the rebuild applying the configuration
+	trace context.Context
+	// services are the names of the services the frontends and backends belong to, each of which
+	// is applied in turn
+	services []string
+	// failFast stops applying the configuration at the first key which fails to be written or
+	// deleted, rather than applying all the others
+	failFast bool
 }
 
 type vulcanFrontend struct {
-	BackendID         string
-	Route             string
-	Type              string
-	rewrite           vulcanRewrite
+	BackendID string
+	Route     string
+	Type      string
+	// rewrites are given unique middleware ids when the keys are generated, see vulcanConfToEtcdKeys
+	rewrites []vulcanRewrite
+	// middlewares are raw vulcand middleware JSON keyed by middleware id
+	middlewares       map[string]string
 	FailoverPredicate string
+	// Settings are set alongside the FailoverPredicate
+	Settings map[string]interface{}
 }
 
 type vulcanRewrite struct {
@@ -191,10 +1354,16 @@ type vulcanRewriteMw struct {
 
 type vulcanBackend struct {
 	Servers map[string]vulcanServer
+	// Settings are merged over the default backend settings
+	Settings map[string]interface{}
 }
 
 type vulcanServer struct {
 	URL string
+	// Weight is only emitted when set, leaving vulcand's default for unweighted servers
+	Weight int
+	// Draining servers are emitted with a weight of 0, so they are sent no new requests
+	Draining bool
 }
 
 func buildVulcanConf(services []Service) vulcanConf {
@@ -202,87 +1371,147 @@ func buildVulcanConf(services []Service) vulcanConf {
 		Backends:  make(map[string]vulcanBackend),
 		FrontEnds: make(map[string]vulcanFrontend),
 	}
+	precedence, hostHeaderPrecedence := pathPrecedence(services)
 
 	for _, service := range services {
+		vc.services = append(vc.services, service.Name)
+		middlewares := serviceMiddlewares(service)
+		mainMiddlewares := withCircuitBreaker(service, middlewares)
+		pathMiddlewares := withBasicAuth(service, mainMiddlewares)
+		var frontendSettings map[string]interface{}
+		if len(defaultFrontendSettings) > 0 || len(service.FrontendSettings) > 0 {
+			frontendSettings = mergeSettings(defaultFrontendSettings, service.FrontendSettings)
+		}
+		mainFrontendSettings := withStickiness(service, frontendSettings)
 
 		// "main" backend
-		mainBackend := vulcanBackend{Servers: make(map[string]vulcanServer)}
-		backendName := fmt.Sprintf("vcb-%s", service.Name)
+		mainBackend := vulcanBackend{Servers: make(map[string]vulcanServer), Settings: service.BackendSettings}
+		backendName := managedPrefix + service.Name
+		mainWeights := service.mainBackendWeights()
 		for svrID, sa := range service.Addresses {
-			if addressRegex.MatchString(sa) {
-				mainBackend.Servers[svrID] = vulcanServer{sa}
-			} else {
-				log.Printf("Skipping invalid backend address: %v for service %s\n", sa, service.Name)
+			weight, found := mainWeights[svrID]
+			if !found && !service.draining[svrID] {
+				continue
+			}
+			sa = service.serverURL(sa)
+			// rejected addresses are logged and counted once, with the instance backends
+			if validAddress(sa) {
+				mainBackend.Servers[svrID] = vulcanServer{URL: sa, Weight: weight, Draining: service.draining[svrID]}
 			}
 
 		}
 		vc.Backends[backendName] = mainBackend
 
-		// Host header front end
-		frontEndName := fmt.Sprintf("vcb-byhostheader-%s", service.Name)
-		vc.FrontEnds[frontEndName] = vulcanFrontend{
-			Type:              "http",
-			BackendID:         backendName,
-			Route:             fmt.Sprintf("PathRegexp(`/.*`) && Host(`%s`)", service.Name),
-			FailoverPredicate: service.FailoverPredicate,
+		// the public frontends of a service in maintenance route to the maintenance backend, or
+		// are removed if there isn't one. The internal and health check frontends are kept.
+		public := true
+		publicBackend := backendName
+		publicMiddlewares := mainMiddlewares
+		publicFrontendSettings := mainFrontendSettings
+		publicType := service.frontendType()
+		pathPrefixes := service.PathPrefixes
+		if service.Maintenance {
+			public = maintenanceBackend != ""
+			publicBackend = maintenanceBackend
+			// the circuit breaker and basic auth only guard the service's own backend
+			publicMiddlewares, pathMiddlewares = middlewares, middlewares
+			publicFrontendSettings = frontendSettings
+			publicType = "http"
+			if !public {
+				pathPrefixes = nil
+			}
+		}
+
+		// Host header front end, matching the service name and any aliases it hasn't lost to another service
+		if hosts := hostHeaderHosts(service); len(hosts) > 0 && public {
+			frontEndName := fmt.Sprintf("%sbyhostheader-%s", managedPrefix, service.Name)
+			vc.FrontEnds[frontEndName] = vulcanFrontend{
+				Settings:          publicFrontendSettings,
+				Type:              publicType,
+				BackendID:         publicBackend,
+				Route:             fmt.Sprintf("PathRegexp(`%s/.*`) && %s", hostHeaderPrecedence, hostsMatcher(hosts)),
+				middlewares:       publicMiddlewares,
+				FailoverPredicate: service.FailoverPredicate,
+			}
 		}
 
 		// instance backends
 		for svrID, sa := range service.Addresses {
-			instanceBackend := vulcanBackend{Servers: make(map[string]vulcanServer)}
-			if addressRegex.MatchString(sa) {
-				instanceBackend.Servers[svrID] = vulcanServer{sa}
+			instanceBackend := vulcanBackend{Servers: make(map[string]vulcanServer), Settings: service.BackendSettings}
+			sa = service.serverURL(sa)
+			if err := addressValidation.check(sa); err == nil {
+				instanceBackend.Servers[svrID] = vulcanServer{URL: sa}
 			} else {
-				log.Printf("Skipping invalid backend address: %v for service %s\n", sa, service.Name)
+				builderLog.Warnf("Skipping invalid backend address: %v for service %s: %v\n", sa, service.Name, err)
+				addressesRejected.Add(service.Name, 1)
 			}
-			backendName := fmt.Sprintf("vcb-%s-%s", service.Name, svrID)
+			backendName := fmt.Sprintf("%s%s-%s", managedPrefix, service.Name, svrID)
 			vc.Backends[backendName] = instanceBackend
 		}
 
 		// health check front ends
 		if service.HasHealthCheck {
 			for svrID := range service.Addresses {
-				frontEndName := fmt.Sprintf("vcb-health-%s-%s", service.Name, svrID)
-				backendName := fmt.Sprintf("vcb-%s-%s", service.Name, svrID)
+				frontEndName := fmt.Sprintf("%shealth-%s-%s", managedPrefix, service.Name, svrID)
+				backendName := fmt.Sprintf("%s%s-%s", managedPrefix, service.Name, svrID)
+
+				// by default strip the /health/<service>-<id> prefix, which leaves /__health.
+				// a custom health check path replaces the whole of the public path instead.
+				rewriteMw := vulcanRewriteMw{
+					Regexp:      fmt.Sprintf("/health/%s-%s(.*)", service.Name, svrID),
+					Replacement: "$1",
+				}
+				healthCheckPath, found := service.HealthCheckPaths[svrID]
+				if !found {
+					healthCheckPath = service.HealthCheckPath
+				}
+				if healthCheckPath != "" {
+					rewriteMw = vulcanRewriteMw{
+						Regexp:      fmt.Sprintf("/health/%s-%s/__health", service.Name, svrID),
+						Replacement: healthCheckPath,
+					}
+				}
 
 				vc.FrontEnds[frontEndName] = vulcanFrontend{
+					Settings:  frontendSettings,
 					Type:      "http",
 					BackendID: backendName,
 					Route:     fmt.Sprintf("Path(`/health/%s-%s/__health`)", service.Name, svrID),
-					rewrite: vulcanRewrite{
-						ID:       "rewrite",
-						Type:     "rewrite",
-						Priority: 1,
-						Middleware: vulcanRewriteMw{
-							Regexp:      fmt.Sprintf("/health/%s-%s(.*)", service.Name, svrID),
-							Replacement: "$1",
-						},
-					},
+					rewrites: []vulcanRewrite{{
+						ID:         "rewrite",
+						Type:       "rewrite",
+						Priority:   service.middlewarePriority("rewrite", 1),
+						Middleware: rewriteMw,
+					}},
+					middlewares: middlewares,
 				}
 
 			}
 		}
 
 		// internal frontend
-		internalFrontEndName := fmt.Sprintf("vcb-internal-%s", service.Name)
+		internalFrontEndName := fmt.Sprintf("%sinternal-%s", managedPrefix, service.Name)
 		vc.FrontEnds[internalFrontEndName] = vulcanFrontend{
-			Type:      "http",
+			Settings:  mainFrontendSettings,
+			Type:      service.frontendType(),
 			BackendID: backendName,
 			Route:     fmt.Sprintf("PathRegexp(`/__%s/.*`)", service.Name),
-			rewrite: vulcanRewrite{
+			rewrites: []vulcanRewrite{{
 				ID:       "rewrite",
 				Type:     "rewrite",
-				Priority: 1,
+				Priority: service.middlewarePriority("rewrite", 1),
 				Middleware: vulcanRewriteMw{
 					Regexp:      fmt.Sprintf("/__%s(/.*)", service.Name),
 					Replacement: "$1",
 				},
-			},
+			}},
+			middlewares:       mainMiddlewares,
 			FailoverPredicate: service.FailoverPredicate,
 		}
 
 		// public path front ends
-		for pathName, pathRegex := range service.PathPrefixes {
+		for pathName := range pathPrefixes {
+			pathRegex := precedence[service.PathPriorities[pathName]] + service.pathRegex(pathName)
 			customHost, customHostExists := service.PathHosts[pathName]
 			var route string
 			if customHostExists {
@@ -290,11 +1519,53 @@ func buildVulcanConf(services []Service) vulcanConf {
 			} else {
 				route = fmt.Sprintf("PathRegexp(`%s`)", pathRegex)
 			}
-			vc.FrontEnds[fmt.Sprintf("vcb-%s-path-regex-%s", service.Name, pathName)] = vulcanFrontend{
-				Type:              "http",
-				BackendID:         backendName,
+			if hostRegex, found := service.PathHostRegexes[pathName]; found {
+				route = fmt.Sprintf("%s && HostRegexp(`%s`)", route, hostRegex)
+			}
+			if methods := service.PathMethods[pathName]; len(methods) > 0 {
+				route = fmt.Sprintf("%s && %s", route, methodsMatcher(methods))
+			}
+			if header, found := service.PathHeaders[pathName]; found {
+				route = fmt.Sprintf("%s && %s", route, header.matcher())
+			}
+			failoverPredicate, found := service.PathFailoverPredicates[pathName]
+			if !found {
+				failoverPredicate = service.FailoverPredicate
+			}
+			var rewrites []vulcanRewrite
+			if rewrite, found := service.PathRewrites[pathName]; found {
+				if service.PathStripPrefix[pathName] {
+					builderLog.Warnf("path-rewrite of path %s of service %s replaces its path-strip-prefix\n", pathName, service.Name)
+				}
+				rewrites = append(rewrites, vulcanRewrite{
+					ID:         "rewrite",
+					Type:       "rewrite",
+					Priority:   service.middlewarePriority("rewrite", 1),
+					Middleware: rewrite,
+				})
+			} else if service.PathStripPrefix[pathName] {
+				if prefix := strippedPrefix(service.PathPrefixes[pathName]); prefix != "" {
+					rewrites = append(rewrites, vulcanRewrite{
+						ID:       "rewrite",
+						Type:     "rewrite",
+						Priority: service.middlewarePriority("rewrite", 1),
+						Middleware: vulcanRewriteMw{
+							Regexp:      prefix + "/?(.*)",
+							Replacement: "/$1",
+						},
+					})
+				} else {
+					builderLog.Warnf("path %s of service %s has no prefix to strip\n", pathName, service.Name)
+				}
+			}
+			vc.FrontEnds[fmt.Sprintf("%s%s-path-regex-%s", managedPrefix, service.Name, pathName)] = vulcanFrontend{
+				Settings:          publicFrontendSettings,
+				Type:              publicType,
+				BackendID:         publicBackend,
 				Route:             route,
-				FailoverPredicate: service.FailoverPredicate,
+				rewrites:          rewrites,
+				middlewares:       pathMiddlewares,
+				FailoverPredicate: failoverPredicate,
 			}
 		}
 	}
@@ -302,210 +1573,709 @@ func buildVulcanConf(services []Service) vulcanConf {
 	return vc
 }
 
-func applyVulcanConf(kapi client.KeysAPI, vc vulcanConf) {
+// methodsMatcher returns a route expression matching any of the given HTTP methods.
+func methodsMatcher(methods []string) string {
+	var matchers []string
+	for _, method := range methods {
+		matchers = append(matchers, fmt.Sprintf("Method(`%s`)", method))
+	}
+	if len(matchers) == 1 {
+		return matchers[0]
+	}
+	return "(" + strings.Join(matchers, " || ") + ")"
+}
+
+// pathPrecedence returns the prefix to give the path regexes of each path priority, so that paths
+// with higher priorities are matched first. vulcand has no frontend priority, but tries routes in
+// reverse lexical order, and each empty group "(?:)" in front of a regex sorts it after the regexes
+// with fewer of them without changing what it matches. Paths of the highest priority, or of any
+// priority when all are equal, are left as they are.
+//
+// It also returns the prefix of the host header frontends' catch-all regex, which sorts them after
+// every path, as they are without priorities, rather than before the paths with lower priorities.
+func pathPrecedence(services []Service) (map[int]string, string) {
+	seen := make(map[int]bool)
+	var priorities []int
+	for _, service := range services {
+		for pathName := range service.PathPrefixes {
+			priority := service.PathPriorities[pathName]
+			if !seen[priority] {
+				seen[priority] = true
+				priorities = append(priorities, priority)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	prefixes := make(map[int]string)
+	for rank, priority := range priorities {
+		prefixes[priority] = strings.Repeat("(?:)", rank)
+	}
+	if len(priorities) < 2 {
+		return prefixes, ""
+	}
+	return prefixes, strings.Repeat("(?:)", len(priorities))
+}
+
+// pathRegex returns the regex the frontends of a public path match, in vulcand and every other
+// output, anchored to the start of the path and normalised when the path has path-normalise.
+func (s Service) pathRegex(name string) string {
+	if s.PathNormalise[name] {
+		return normalisePathRegex(s.PathPrefixes[name])
+	}
+	return anchorPathRegex(s.PathPrefixes[name])
+}
+
+// anchorPathRegex anchors a path regex to the start of the path, as vulcand's PathRegexp isn't, so
+// that e.g. "/foo/.*" doesn't match "/bar/foo/".
+func anchorPathRegex(pathRegex string) string {
+	if !strings.HasPrefix(pathRegex, "^") {
+		pathRegex = "^" + pathRegex
+	}
+	return pathRegex
+}
 
-	newConf := vulcanConfToEtcdKeys(vc)
+// normalisePathRegex anchors a path regex to the start of the path and makes a trailing slash
+// optional, so that e.g. "/foo/.*" matches "/foo", "/foo/" and "/foo/bar". A regex ending with a
+// slash is anchored to the end of the path too, so that "/foo" doesn't match "/foobar".
+func normalisePathRegex(pathRegex string) string {
+	pathRegex = anchorPathRegex(pathRegex)
+	switch {
+	case strings.HasSuffix(pathRegex, "/.*"):
+		pathRegex = strings.TrimSuffix(pathRegex, "/.*") + "(/.*)?$"
+	case strings.HasSuffix(pathRegex, "/") && pathRegex != "^/":
+		pathRegex = pathRegex + "?$"
+	}
+	return pathRegex
+}
 
-	existing, err := readAllKeysFromEtcd(kapi, "/vulcand/")
-	if err != nil {
-		panic(err)
+// parsePathRewrite reads a JSON rewrite of a path, e.g.
+// {"Regexp": "/products/(.*)", "Replacement": "/content/$1"}.
+func parsePathRewrite(value string) (vulcanRewriteMw, error) {
+	var rewrite vulcanRewriteMw
+	d := json.NewDecoder(strings.NewReader(value))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&rewrite); err != nil {
+		return rewrite, err
+	}
+	if rewrite.Regexp == "" {
+		return rewrite, fmt.Errorf("Regexp is required")
+	}
+	if _, err := regexp.Compile(rewrite.Regexp); err != nil {
+		return rewrite, err
+	}
+	return rewrite, nil
+}
+
+// strippedPrefix returns the regex of the prefix a path regex matches the paths under, e.g.
+// "/products/x" for "/products/x/.*", or "" if it doesn't have one.
+func strippedPrefix(pathRegex string) string {
+	prefix := strings.TrimPrefix(pathRegex, "^")
+	for _, suffix := range []string{"(/.*)?$", "/?$", "(/.*)?", "/.*", ".*", "/"} {
+		prefix = strings.TrimSuffix(prefix, suffix)
+	}
+	return prefix
+}
+
+// keyChange describes a single write or delete performed against etcd by applyVulcanConf.
+type keyChange struct {
+	Action   string `json:"action"`
+	Key      string `json:"key"`
+	OldValue string `json:"oldValue,omitempty"`
+	NewValue string `json:"newValue,omitempty"`
+}
+
+// keyFailure describes a write or delete that applyVulcanConf failed to perform.
+type keyFailure struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Error  string `json:"error"`
+}
+
+// applyError is returned by applyVulcanConf when some of the etcd operations failed.
+type applyError struct {
+	Failures []keyFailure
+}
+
+func (e applyError) Error() string {
+	return fmt.Sprintf("%d etcd operations failed", len(e.Failures))
+}
+
+func applyVulcanConf(kapi client.KeysAPI, vc vulcanConf) ([]keyChange, error) {
+	timer := newPhaseTimer(vc.trace)
+
+	// only the names of the existing frontends, backends and hosts are listed up front, the keys of
+	// each are read when it is applied
+	present := make(map[string]bool)
+	dirs := []string{"/vulcand/backends/", "/vulcand/frontends/"}
+	if vc.Hosts != nil {
+		dirs = append(dirs, "/vulcand/hosts/")
+	}
+	for _, dir := range dirs {
+		entities, err := listEntities(kapi, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+		}
+		for _, e := range entities {
+			present[e] = true
+		}
+	}
+	timer.done("read-existing")
+
+	// neither create, modify nor remove anything for frozen frontends and backends
+	frozen := func(dir string) bool {
+		return vc.frozen != nil && vc.frozen(frontendOrBackendName(dir))
+	}
+
+	wanted := wantedEntities(vc)
+	var units []serviceUnit
+	for _, unit := range serviceUnits(wanted, vc.services) {
+		unit.backends, unit.frontends = unfrozen(unit.backends, frozen), unfrozen(unit.frontends, frozen)
+		units = append(units, unit)
+	}
+
+	// generate returns the keys and values of a frontend, backend or host, restored ones being
+	// grouped by entity once rather than searched for each
+	var restored map[string]map[string]string
+	if vc.keys != nil {
+		restored = make(map[string]map[string]string)
+		for k, v := range vc.keys {
+			dir := entityDir(k)
+			if restored[dir] == nil {
+				restored[dir] = make(map[string]string)
+			}
+			restored[dir][k] = v
+		}
+	}
+	generate := func(dir string) map[string]string {
+		if restored != nil {
+			return restored[dir]
+		}
+		return generateEntityKeys(vc, dir)
 	}
 
-	for k, v := range existing {
-		// keep the keys not created by us
-		if !strings.HasPrefix(k, "/vulcand/backends/vcb-") && !strings.HasPrefix(k, "/vulcand/frontends/vcb-") {
-			newConf[k] = v
+	// the TTL a key is set with, hosts never expire
+	ttl := func(k string) time.Duration {
+		if isHostKey(k) {
+			return 0
 		}
+		return vc.ttl
 	}
 
+	timer.done("diff")
+
 	changed := false
-	// remove unwanted frontends
-	for k := range existing {
-		if strings.HasPrefix(k, "/vulcand/frontends/vcb-") {
-			_, found := newConf[k]
-			if !found {
-				changed = true
-				log.Printf("deleting frontend %s\n", k)
-				_, err := kapi.Delete(context.Background(), k, &client.DeleteOptions{Recursive: false})
-				if err != nil {
-					log.Printf("error deleting frontend %v\n", k)
-				}
+	var failures []keyFailure
+	var changes []keyChange
+	// nothing more is written or deleted once a fail-fast apply has failed
+	aborted := func() bool {
+		return vc.failFast && len(failures) > 0
+	}
+
+	// read returns the existing values of the managed keys of a frontend, backend or host, and which
+	// of them have a TTL, or false when they couldn't be read, in which case it is left as it is
+	read := func(dir string) (entityKeys, bool) {
+		e := entityKeys{values: make(map[string]string), expiring: make(map[string]bool)}
+		if !present[dir] {
+			return e, true
+		}
+		if aborted() {
+			return e, false
+		}
+		values, expiring, err := readManagedEntity(kapi, dir, vc)
+		if err != nil {
+			failures = append(failures, keyFailure{Action: "read", Key: dir, Error: err.Error()})
+			applierLog.Errorf("error reading %s: %v\n", dir, err)
+			return e, false
+		}
+		return entityKeys{values: values, expiring: expiring}, true
+	}
+
+	deleteKey := func(kind, k, old string) {
+		if aborted() {
+			return
+		}
+		changed = true
+		applierLog.Debugf("deleting %s %s\n", kind, k)
+		if _, err := kapi.Delete(context.Background(), k, &client.DeleteOptions{Recursive: false}); err != nil {
+			failures = append(failures, keyFailure{Action: "delete", Key: k, Error: err.Error()})
+			applierLog.Errorf("error deleting %s %v\n", kind, k)
+			return
+		}
+		changes = append(changes, keyChange{Action: "delete", Key: k, OldValue: redactValue(k, old)})
+	}
+
+	setKey := func(kind, k, v, old string) {
+		if aborted() {
+			return
+		}
+		changed = true
+		applierLog.Debugf("setting %s%s to %s\n", kind, k, redactValue(k, v))
+		var opts *client.SetOptions
+		if ttl(k) > 0 {
+			opts = &client.SetOptions{TTL: ttl(k)}
+		}
+		if _, err := kapi.Set(context.Background(), k, v, opts); err != nil {
+			failures = append(failures, keyFailure{Action: "set", Key: k, Error: err.Error()})
+			applierLog.Errorf("error setting %s to %s\n", k, redactValue(k, v))
+			return
+		}
+		changes = append(changes, keyChange{Action: "set", Key: k, OldValue: redactValue(k, old), NewValue: redactValue(k, v)})
+	}
+
+	refreshKey := func(k string) {
+		if aborted() {
+			return
+		}
+		if _, err := kapi.Set(context.Background(), k, "", &client.SetOptions{TTL: ttl(k), Refresh: true, PrevExist: client.PrevExist}); err != nil {
+			failures = append(failures, keyFailure{Action: "refresh", Key: k, Error: err.Error()})
+			applierLog.Errorf("error refreshing the TTL of %s\n", k)
+		}
+	}
+
+	// writeKeys writes the generated keys of a frontend, backend or host which are missing or
+	// differ, or which expire without a TTL, and refreshes the TTL of the others
+	writeKeys := func(kind string, existing entityKeys, generated map[string]string) {
+		keys := make([]string, 0, len(generated))
+		for k := range generated {
+			keys = append(keys, k)
+		}
+		sortByCreationOrder(keys)
+		for _, k := range keys {
+			v := generated[k]
+			if v != existing.values[k] || (existing.expiring[k] && ttl(k) == 0) {
+				setKey(kind, k, v, existing.values[k])
+			} else if ttl(k) > 0 {
+				refreshKey(k)
 			}
 		}
 	}
 
-	// remove unwanted backends
-	for k := range existing {
-		if strings.HasPrefix(k, "/vulcand/backends/vcb-") {
-			_, found := newConf[k]
-			if !found {
-				changed = true
-				log.Printf("deleting backend%s\n", k)
-				_, err := kapi.Delete(context.Background(), k, &client.DeleteOptions{Recursive: false})
-				if err != nil {
-					log.Printf("error deleting backend %v\n", k)
-				}
+	// deleteKeys removes the existing keys of a frontend, backend or host which aren't generated,
+	// the middlewares and servers under a frontend or backend before it, the reverse of the order
+	// they are created in
+	deleteKeys := func(kind string, existing entityKeys, generated map[string]string) {
+		var keys []string
+		for k := range existing.values {
+			if _, ok := generated[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sortByCreationOrder(keys)
+		for i := len(keys) - 1; i >= 0; i-- {
+			deleteKey(kind, keys[i], existing.values[keys[i]])
+		}
+	}
+
+	// removed returns the existing frontends, backends or hosts under dir which aren't wanted, of
+	// them only those named with the managed prefix when managed is set
+	removed := func(dir string, managed bool) []string {
+		var gone []string
+		for _, e := range entitiesUnder(present, dir) {
+			if !wanted[e] && (!managed || strings.HasPrefix(e, dir+managedPrefix)) && !frozen(e) {
+				gone = append(gone, e)
 			}
 		}
+		return gone
 	}
 
-	// add or modify backends
-	for k, v := range newConf {
-		if strings.HasPrefix(k, "/vulcand/backends") {
-			oldVal := existing[k]
-			if v != oldVal {
-				changed = true
-				log.Printf("setting backend %s to %s\n", k, v)
-				if _, err := kapi.Set(context.Background(), k, v, nil); err != nil {
-					log.Printf("error setting %s to %s\n", k, v)
-				}
+	// remove unwanted frontends, before any others are written which could have the same routes
+	for _, e := range removed("/vulcand/frontends/", true) {
+		existing, _ := read(e)
+		deleteKeys("frontend", existing, nil)
+	}
+
+	timer.done("delete-frontends")
+
+	// remove unwanted hosts, and add or modify the others
+	if vc.Hosts != nil {
+		for _, e := range removed("/vulcand/hosts/", false) {
+			existing, _ := read(e)
+			deleteKeys("host", existing, nil)
+		}
+		timer.done("delete-hosts")
+
+		for _, e := range entitiesUnder(wanted, "/vulcand/hosts/") {
+			if existing, ok := read(e); ok {
+				writeKeys("host ", existing, generate(e))
 			}
 		}
+		timer.done("write-hosts")
 	}
 
-	// add or modify frontends
-	for k, v := range newConf {
-		if strings.HasPrefix(k, "/vulcand/frontends") && !strings.HasSuffix(k, "/middlewares/rewrite") {
-			oldVal := existing[k]
-			if v != oldVal {
-				changed = true
-				log.Printf("setting frontend %s to %s\n", k, v)
-				if _, err := kapi.Set(context.Background(), k, v, nil); err != nil {
-					log.Printf("error setting %s to %s\n", k, v)
-				}
+	// add or modify the backends of each service, and then the frontends and middlewares routing to
+	// them, and remove their superseded servers and middlewares. Only the keys of one service are
+	// held at once.
+	for _, unit := range units {
+		if aborted() {
+			break
+		}
+		existing := make(map[string]entityKeys)
+		generated := make(map[string]map[string]string)
+		for _, e := range append(unit.backends, unit.frontends...) {
+			var ok bool
+			if existing[e], ok = read(e); ok {
+				generated[e] = generate(e)
 			}
 		}
+		for _, e := range unit.backends {
+			writeKeys("backend ", existing[e], generated[e])
+		}
+		for _, e := range unit.frontends {
+			writeKeys("frontend ", existing[e], generated[e])
+		}
+		for _, e := range unit.frontends {
+			deleteKeys("middleware", existing[e], generated[e])
+		}
+		for _, e := range unit.backends {
+			deleteKeys("server", existing[e], generated[e])
+		}
 	}
 
-	// add or modify everything else
-	for k, v := range newConf {
-		oldVal := existing[k]
-		if v != oldVal {
-			changed = true
-			log.Printf("setting %s to %s\n", k, v)
-			if _, err := kapi.Set(context.Background(), k, v, nil); err != nil {
-				log.Printf("error setting %s to %s\n", k, v)
+	timer.done("apply-services")
+
+	// remove unwanted backends, once no frontend routes to them
+	for _, e := range removed("/vulcand/backends/", true) {
+		existing, _ := read(e)
+		deleteKeys("backend", existing, nil)
+	}
+
+	timer.done("delete-backends")
+
+	// the keys of frozen frontends and backends are kept as they are, but mustn't expire
+	if vc.ttl > 0 {
+		for _, e := range append(entitiesUnder(present, "/vulcand/backends/"), entitiesUnder(present, "/vulcand/frontends/")...) {
+			if !frozen(e) {
+				continue
+			}
+			existing, _ := read(e)
+			for k := range existing.values {
+				if ttl(k) > 0 {
+					refreshKey(k)
+				}
 			}
 		}
+		timer.done("refresh-frozen")
 	}
 
-	log.Printf("changes occured in etcd: %t ", changed)
+	applierLog.Infof("changes occured in etcd: %t, %d keys changed\n", changed, len(changes))
+	if aborted() {
+		applierLog.Errorf("apply stopped after failing to %s %s\n", failures[0].Action, failures[0].Key)
+		return changes, applyError{failures}
+	}
 	// some cleanup of known possible empty directories
-	cleanFrontends(kapi)
-	cleanBackends(kapi)
+	_, cleanupFailures := cleanEmptyEntries(kapi, vulcandCleanupRules, cleanupMaxDeletions)
+	failures = append(failures, cleanupFailures...)
+	timer.done("cleanup")
+	applierLog.Infof("apply phases: %s\n", timer)
+
+	if len(failures) > 0 {
+		return changes, applyError{failures}
+	}
+	return changes, nil
 }
 
-func cleanFrontends(kapi client.KeysAPI) {
+// managedPrefix starts the names of the frontends and backends vcb creates and removes, so that
+// deployments with different prefixes can share one vulcand.
+var managedPrefix = defaultManagedPrefix
 
-	resp, err := kapi.Get(context.Background(), "/vulcand/frontends/", &client.GetOptions{Recursive: true})
-	if err != nil {
-		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
-			return
-		}
-		panic(err)
+const defaultManagedPrefix = "vcb-"
+
+// prefixesOverlap reports whether one prefix starts the other, in which case the deployment with
+// the shorter one would remove the frontends and backends of the other, e.g. vcb- those of
+// vcb-team-b-.
+func prefixesOverlap(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// managedPrefixRegex matches the prefixes which can start a vulcand frontend or backend name.
+var managedPrefixRegex = regexp.MustCompile("^[a-z0-9][a-z0-9-]*-$")
+
+// manages reports whether the key is one vcb creates and removes. Any other key under /vulcand/
+// is left to whoever created it.
+func (vc vulcanConf) manages(k string) bool {
+	if isManualMiddlewareKey(k) {
+		return false
 	}
-	if !resp.Node.Dir {
-		log.Println("/vulcand/frontends is not a directory.")
-		return
+	return strings.HasPrefix(k, "/vulcand/backends/"+managedPrefix) || strings.HasPrefix(k, "/vulcand/frontends/"+managedPrefix) || (vc.Hosts != nil && isHostKey(k))
+}
+
+// readManagedKeys reads the existing values of the keys vcb manages, one frontend, backend or host
+// at a time so that only one of them is held as an etcd response at once, and which of them have
+// a TTL.
+func readManagedKeys(kapi client.KeysAPI, vc vulcanConf) (map[string]string, map[string]bool, error) {
+	m := make(map[string]string)
+	expiring := make(map[string]bool)
+	dirs := []string{"/vulcand/backends/", "/vulcand/frontends/"}
+	if vc.Hosts != nil {
+		dirs = append(dirs, "/vulcand/hosts/")
 	}
-	for _, fe := range resp.Node.Nodes {
-		feHasContent := false
-		if fe.Dir {
-			for _, child := range fe.Nodes {
-				// anything apart from an empty "middlewares" dir means this is needed.
-				if filepath.Base(child.Key) != "middlewares" || len(child.Nodes) > 0 {
-					feHasContent = true
-					break
-				}
-			}
+	for _, dir := range dirs {
+		entities, err := listEntities(kapi, dir)
+		if err != nil {
+			return nil, nil, err
 		}
-		if !feHasContent {
-			_, err := kapi.Delete(context.Background(), fe.Key, &client.DeleteOptions{Recursive: true})
+		for _, e := range entities {
+			values, expires, err := readManagedEntity(kapi, e, vc)
 			if err != nil {
-				log.Printf("failed to remove unwanted frontend %v\n", fe.Key)
+				return nil, nil, err
+			}
+			for k, v := range values {
+				m[k] = v
+				expiring[k] = expires[k]
 			}
 		}
 	}
+	return m, expiring, nil
+}
 
+// entityKeys are the existing values of the managed keys of a frontend, backend or host, and which
+// of them have a TTL.
+type entityKeys struct {
+	values   map[string]string
+	expiring map[string]bool
 }
 
-func cleanBackends(kapi client.KeysAPI) {
+// listEntities returns the directories of the frontends, backends or hosts under dir, e.g.
+// /vulcand/frontends/vcb-foo/ under /vulcand/frontends/, without reading their keys.
+func listEntities(kapi client.KeysAPI, dir string) ([]string, error) {
+	resp, err := kapi.Get(context.Background(), dir, &client.GetOptions{Sort: true})
+	if err != nil {
+		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entities []string
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			entities = append(entities, node.Key+"/")
+		}
+	}
+	return entities, nil
+}
 
-	resp, err := kapi.Get(context.Background(), "/vulcand/backends/", &client.GetOptions{Recursive: true})
+// readManagedEntity reads the existing values of the keys vcb manages under the directory of one
+// frontend, backend or host, and which of them have a TTL.
+func readManagedEntity(kapi client.KeysAPI, dir string, vc vulcanConf) (map[string]string, map[string]bool, error) {
+	m := make(map[string]string)
+	expiring := make(map[string]bool)
+	resp, err := kapi.Get(context.Background(), dir, &client.GetOptions{Recursive: true})
 	if err != nil {
 		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
-			return
+			return m, expiring, nil
 		}
-		panic(err)
+		return nil, nil, err
 	}
-	if !resp.Node.Dir {
-		log.Println("/vulcand/backends is not a directory.")
-		return
+	addManagedValuesToMap(m, expiring, resp.Node, vc)
+	return m, expiring, nil
+}
+
+func addManagedValuesToMap(m map[string]string, expiring map[string]bool, node *client.Node, vc vulcanConf) {
+	if node.Dir {
+		for _, child := range node.Nodes {
+			addManagedValuesToMap(m, expiring, child, vc)
+		}
+	} else if vc.manages(node.Key) {
+		m[node.Key] = node.Value
+		if node.Expiration != nil {
+			expiring[node.Key] = true
+		}
 	}
-	for _, be := range resp.Node.Nodes {
-		beHasContent := false
-		if be.Dir {
-			for _, child := range be.Nodes {
-				// anything apart from an empty "servers" dir means this is needed.
-				if filepath.Base(child.Key) != "servers" || len(child.Nodes) > 0 {
-					beHasContent = true
-					break
-				}
-			}
+}
+
+// wantedEntities returns the directories of the frontends, backends and hosts of the configuration.
+func wantedEntities(vc vulcanConf) map[string]bool {
+	wanted := make(map[string]bool)
+	if vc.keys != nil {
+		for k := range vc.keys {
+			wanted[entityDir(k)] = true
 		}
-		if !beHasContent {
-			_, err := kapi.Delete(context.Background(), be.Key, &client.DeleteOptions{Recursive: true})
-			if err != nil {
-				log.Printf("failed to remove unwanted backend %v\n", be.Key)
+		return wanted
+	}
+	for name := range vc.Backends {
+		wanted["/vulcand/backends/"+name+"/"] = true
+	}
+	for name := range vc.FrontEnds {
+		wanted["/vulcand/frontends/"+name+"/"] = true
+	}
+	for name := range vc.Hosts {
+		wanted["/vulcand/hosts/"+name+"/"] = true
+	}
+	return wanted
+}
+
+// entitiesUnder returns the frontends, backends or hosts of entities under dir, in order.
+func entitiesUnder(entities map[string]bool, dir string) []string {
+	var under []string
+	for e := range entities {
+		if strings.HasPrefix(e, dir) {
+			under = append(under, e)
+		}
+	}
+	sort.Strings(under)
+	return under
+}
+
+// serviceUnit is the backends and frontends of one service, which are applied together.
+type serviceUnit struct {
+	backends  []string
+	frontends []string
+}
+
+// serviceUnits groups the frontends and backends of entities by the service they belong to, those
+// of no service, e.g. restored ones, in one more unit.
+func serviceUnits(entities map[string]bool, services []string) []serviceUnit {
+	byService := make(map[string]*serviceUnit)
+	var names []string
+	for _, dir := range []string{"/vulcand/backends/", "/vulcand/frontends/"} {
+		for _, e := range entitiesUnder(entities, dir) {
+			owner := ownerOf(frontendOrBackendName(e), services)
+			unit, ok := byService[owner]
+			if !ok {
+				unit = &serviceUnit{}
+				byService[owner] = unit
+				names = append(names, owner)
+			}
+			if dir == "/vulcand/backends/" {
+				unit.backends = append(unit.backends, e)
+			} else {
+				unit.frontends = append(unit.frontends, e)
 			}
 		}
 	}
+	sort.Strings(names)
+	units := make([]serviceUnit, 0, len(names))
+	for _, name := range names {
+		units = append(units, *byService[name])
+	}
+	return units
+}
+
+// unfrozen returns the frontends or backends which aren't frozen.
+func unfrozen(entities []string, frozen func(dir string) bool) []string {
+	var kept []string
+	for _, e := range entities {
+		if !frozen(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// sortByCreationOrder sorts keys so that each frontend or backend key comes before the middlewares
+// or servers under it, which vulcand can only add to an existing frontend or backend. The keys of
+// each frontend or backend are kept together, so that a removed one is deleted in one go.
+func sortByCreationOrder(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		if ei, ej := entityDir(keys[i]), entityDir(keys[j]); ei != ej {
+			return ei < ej
+		}
+		if di, dj := strings.Count(keys[i], "/"), strings.Count(keys[j], "/"); di != dj {
+			return di < dj
+		}
+		return keys[i] < keys[j]
+	})
+}
 
+// entityDir returns the directory of the frontend, backend or host a key is under, e.g.
+// /vulcand/frontends/vcb-foo/ for /vulcand/frontends/vcb-foo/middlewares/rewrite.
+func entityDir(key string) string {
+	parts := strings.SplitN(key, "/", 5)
+	if len(parts) < 5 {
+		return key
+	}
+	return strings.Join(parts[:4], "/") + "/"
 }
 
 func vulcanConfToEtcdKeys(vc vulcanConf) map[string]string {
 	m := make(map[string]string)
-
-	// create backends
-	for beName, be := range vc.Backends {
-		k := fmt.Sprintf("/vulcand/backends/%s/backend", beName)
-		v := `{"Type": "http", "Settings": {"KeepAlive": {"MaxIdleConnsPerHost": 256, "Period": "35s"}}}`
+	emitVulcanConfKeys(vc, func(k, v string) {
 		m[k] = v
+	})
+	return m
+}
 
-		for sName, s := range be.Servers {
-			k := fmt.Sprintf("/vulcand/backends/%s/servers/%s", beName, sName)
-			v := fmt.Sprintf(`{"url":"%s"}`, s.URL)
-			m[k] = v
+// emitVulcanConfKeys generates the etcd keys and values of the configuration one at a time, so
+// that they needn't all be held in memory at once.
+func emitVulcanConfKeys(vc vulcanConf, emit func(k, v string)) {
+	if vc.keys != nil {
+		keys := make([]string, 0, len(vc.keys))
+		for k := range vc.keys {
+			keys = append(keys, k)
 		}
+		sortByCreationOrder(keys)
+		for _, k := range keys {
+			emit(k, vc.keys[k])
+		}
+		return
+	}
 
+	for beName, be := range vc.Backends {
+		emitBackendKeys(beName, be, emit)
 	}
+	for feName, fe := range vc.FrontEnds {
+		emitFrontendKeys(feName, fe, emit)
+	}
+	for name, host := range vc.Hosts {
+		emit(fmt.Sprintf("/vulcand/hosts/%s/host", name), hostValue(name, host))
+	}
+}
 
-	// create frontends
-	for feName, be := range vc.FrontEnds {
-		k := fmt.Sprintf("/vulcand/frontends/%s/frontend", feName)
-		v := fmt.Sprintf(`{"Type":"%s", "BackendId":"%s", "Route":"%s", "Settings": {"FailoverPredicate":"%s"}}`, be.Type, be.BackendID, be.Route, be.FailoverPredicate)
+// generateEntityKeys returns the generated keys and values of one frontend, backend or host of the
+// configuration, e.g. of /vulcand/backends/vcb-foo/.
+func generateEntityKeys(vc vulcanConf, dir string) map[string]string {
+	m := make(map[string]string)
+	emit := func(k, v string) {
 		m[k] = v
-		if be.rewrite.ID != "" {
-			k := fmt.Sprintf("/vulcand/frontends/%s/middlewares/rewrite", feName)
-			v := fmt.Sprintf(
-
-				`{"Id":"%s", "Type":"%s", "Priority":%d, "Middleware": {"Regexp":"%s", "Replacement":"%s"}}`,
-				be.rewrite.ID,
-				be.rewrite.Type,
-				be.rewrite.Priority,
-				be.rewrite.Middleware.Regexp,
-				be.rewrite.Middleware.Replacement,
-			)
-			m[k] = v
+	}
+	name := strings.Split(dir, "/")[3]
+	switch {
+	case strings.HasPrefix(dir, "/vulcand/backends/"):
+		if be, ok := vc.Backends[name]; ok {
+			emitBackendKeys(name, be, emit)
+		}
+	case strings.HasPrefix(dir, "/vulcand/frontends/"):
+		if fe, ok := vc.FrontEnds[name]; ok {
+			emitFrontendKeys(name, fe, emit)
+		}
+	case strings.HasPrefix(dir, "/vulcand/hosts/"):
+		if host, ok := vc.Hosts[name]; ok {
+			emit(fmt.Sprintf("/vulcand/hosts/%s/host", name), hostValue(name, host))
 		}
 	}
-
 	return m
 }
 
-func newNotifier(kapi client.KeysAPI, path string) notifier {
-	w := notifier{make(chan struct{}, 1)}
+func emitBackendKeys(beName string, be vulcanBackend, emit func(k, v string)) {
+	emit(fmt.Sprintf("/vulcand/backends/%s/backend", beName), backendValue(be.Settings))
+	for sName, s := range be.Servers {
+		emit(fmt.Sprintf("/vulcand/backends/%s/servers/%s", beName, sName), backendServerValue(s))
+	}
+}
+
+func emitFrontendKeys(feName string, fe vulcanFrontend, emit func(k, v string)) {
+	emit(fmt.Sprintf("/vulcand/frontends/%s/frontend", feName), frontendValue(fe))
+	used := make(map[string]bool)
+	for id, mw := range fe.middlewares {
+		emit(fmt.Sprintf("/vulcand/frontends/%s/middlewares/%s", feName, id), mw)
+		used[id] = true
+	}
+	for _, rewrite := range fe.rewrites {
+		id := uniqueMiddlewareID(rewrite.ID, used)
+		emit(fmt.Sprintf("/vulcand/frontends/%s/middlewares/%s", feName, id), rewriteValue(id, rewrite))
+	}
+}
+
+func newNotifier(ctx context.Context, kapi client.KeysAPI, watchdog *applyWatchdog, paths ...string) notifier {
+	w := notifier{ch: make(chan struct{}, 1), ctx: ctx, watchdog: watchdog}
+	for _, path := range paths {
+		w.watch(kapi, path, valueChanged)
+	}
+	return w
+}
 
+func (w *notifier) watch(kapi client.KeysAPI, path string, relevant eventFilter) {
 	go func() {
 
 		for {
@@ -514,51 +2284,79 @@ func newNotifier(kapi client.KeysAPI, path string) notifier {
 			var err error
 			var response *client.Response
 			for err == nil {
-				response, err = watcher.Next(context.Background())
+				response, err = watcher.Next(w.context())
 				logResponse(response)
-				select {
-				case w.ch <- struct{}{}:
-					log.Println("received event from watcher, sent change message on notifier channel.")
-				default:
-					log.Println("received event from watcher, not sending message on notifier channel, buffer full and no-one listening.")
+				if err == nil && !relevant(response) {
+					watchEventsIgnored.Add(1)
+					watcherLog.Debugf("ignoring event from watcher, it can't change the configuration.")
+					continue
+				}
+				if w.send() {
+					watcherLog.Debugf("received event from watcher, sent change message on notifier channel.")
+				} else {
+					watcherLog.Debugf("received event from watcher, not sending message on notifier channel, buffer full and no-one listening.")
 				}
 			}
 
-			if err == context.Canceled {
-				log.Println("context cancelled error")
+			if w.context().Err() != nil {
+				watcherLog.Infof("stopped watching %s\n", path)
+				return
+			} else if err == context.Canceled {
+				watcherLog.Warnf("context cancelled error")
 			} else if err == context.DeadlineExceeded {
-				log.Println("deadline exceeded error")
+				watcherLog.Warnf("deadline exceeded error")
 			} else if cerr, ok := err.(*client.ClusterError); ok {
-				log.Printf("cluster error. Details: %v\n", cerr.Detail())
+				watcherLog.Errorf("cluster error. Details: %v\n", cerr.Detail())
 			} else {
 				// bad cluster endpoints, which are not etcd servers
-				log.Println(err.Error())
+				watcherLog.Errorf("%v", err.Error())
 			}
 
-			log.Println("sleeping for 15s before rebuilding config due to error")
+			watcherLog.Warnf("sleeping for 15s before rebuilding config due to error")
 			time.Sleep(15 * time.Second)
 		}
 	}()
-
-	return w
 }
 
 func logResponse(response *client.Response) {
 	if response == nil {
 		return
 	}
-	log.Println("Event from watcher:")
-	log.Printf("Action: %s\n", response.Action)
+	watcherLog.Debugf("Event from watcher:")
+	watcherLog.Debugf("Action: %s\n", response.Action)
 	if response.PrevNode != nil {
-		log.Printf("Old key:value  %s:%s\n", response.PrevNode.Key, response.PrevNode.Value)
+		watcherLog.Debugf("Old key:value  %s:%s\n", response.PrevNode.Key, response.PrevNode.Value)
 	}
 	if response.Node != nil {
-		log.Printf("New key:value  %s:%s\n", response.Node.Key, response.Node.Value)
+		watcherLog.Debugf("New key:value  %s:%s\n", response.Node.Key, response.Node.Value)
 	}
 }
 
 type notifier struct {
 	ch chan struct{}
+	// ctx, when set, stops the etcd watchers when it is done
+	ctx context.Context
+	// watchdog, when set, is told of every change
+	watchdog *applyWatchdog
+}
+
+// send notifies the builder loop of a change, returning false when a change it hasn't taken yet
+// was already notified.
+func (w *notifier) send() bool {
+	w.watchdog.notified(time.Now())
+	select {
+	case w.ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *notifier) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
 }
 
 func (w *notifier) notify() <-chan struct{} {
@@ -573,7 +2371,7 @@ func readAllKeysFromEtcd(kapi client.KeysAPI, root string) (map[string]string, e
 		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
 			return m, nil
 		}
-		panic(err)
+		return nil, err
 	}
 	addAllValuesToMap(m, resp.Node)
 	return m, nil
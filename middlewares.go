@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// middlewares with ids starting with manualMiddlewarePrefix are added to vcb- frontends by hand,
+// and are never overwritten or deleted by vcb
+const manualMiddlewarePrefix = "manual-"
+
+// isManualMiddlewareKey reports whether a key is of a middleware added to a frontend by hand.
+func isManualMiddlewareKey(key string) bool {
+	i := strings.Index(key, "/middlewares/")
+	return strings.HasPrefix(key, "/vulcand/frontends/") && i >= 0 && strings.HasPrefix(key[i+len("/middlewares/"):], manualMiddlewarePrefix)
+}
+
+// rateLimit is the spec of a vulcand ratelimit middleware.
+type rateLimit struct {
+	Requests      int
+	PeriodSeconds int
+	Burst         int
+	Variable      string
+}
+
+// parseRateLimit reads a ratelimit directory with the keys requests, period (e.g. 1s or 1m),
+// variable (defaults to client.ip) and burst (defaults to 1).
+func parseRateLimit(node *client.Node) (*rateLimit, error) {
+	rl := &rateLimit{PeriodSeconds: 1, Burst: 1, Variable: "client.ip"}
+	for _, child := range node.Nodes {
+		var err error
+		switch filepath.Base(child.Key) {
+		case "requests":
+			rl.Requests, err = strconv.Atoi(child.Value)
+		case "period":
+			var period time.Duration
+			period, err = time.ParseDuration(child.Value)
+			rl.PeriodSeconds = int(period / time.Second)
+		case "burst":
+			rl.Burst, err = strconv.Atoi(child.Value)
+		case "variable":
+			rl.Variable = child.Value
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(child.Key), err)
+		}
+	}
+	if rl.Requests < 1 {
+		return nil, fmt.Errorf("requests must be at least 1")
+	}
+	if rl.PeriodSeconds < 1 {
+		return nil, fmt.Errorf("period must be at least 1s")
+	}
+	if rl.Burst < 1 {
+		return nil, fmt.Errorf("burst must be at least 1")
+	}
+	return rl, nil
+}
+
+// connLimit is the spec of a vulcand connlimit middleware.
+type connLimit struct {
+	Connections int
+	Variable    string
+}
+
+// parseConnLimit reads a connlimit directory with the keys connections and variable (defaults to
+// client.ip).
+func parseConnLimit(node *client.Node) (*connLimit, error) {
+	cl := &connLimit{Variable: "client.ip"}
+	for _, child := range node.Nodes {
+		var err error
+		switch filepath.Base(child.Key) {
+		case "connections":
+			cl.Connections, err = strconv.Atoi(child.Value)
+		case "variable":
+			cl.Variable = child.Value
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(child.Key), err)
+		}
+	}
+	if cl.Connections < 1 {
+		return nil, fmt.Errorf("connections must be at least 1")
+	}
+	return cl, nil
+}
+
+// headers is the spec of a headers middleware, adding and removing request and response headers,
+// for vulcand built with one registered as headers.
+type headers struct {
+	AddRequestHeaders     map[string]string `json:",omitempty"`
+	RemoveRequestHeaders  []string          `json:",omitempty"`
+	AddResponseHeaders    map[string]string `json:",omitempty"`
+	RemoveResponseHeaders []string          `json:",omitempty"`
+}
+
+// parseHeaders reads a headers directory with the directories request-add and response-add, of
+// values keyed by header name, and the keys request-remove and response-remove, comma separated
+// header names.
+func parseHeaders(node *client.Node) (*headers, error) {
+	h := &headers{}
+	for _, child := range node.Nodes {
+		var err error
+		switch filepath.Base(child.Key) {
+		case "request-add":
+			h.AddRequestHeaders, err = parseHeaderValues(child)
+		case "response-add":
+			h.AddResponseHeaders, err = parseHeaderValues(child)
+		case "request-remove":
+			h.RemoveRequestHeaders, err = parseHeaderNames(child.Value)
+		case "response-remove":
+			h.RemoveResponseHeaders, err = parseHeaderNames(child.Value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(child.Key), err)
+		}
+	}
+	if h.AddRequestHeaders == nil && h.RemoveRequestHeaders == nil && h.AddResponseHeaders == nil && h.RemoveResponseHeaders == nil {
+		return nil, fmt.Errorf("no headers to add or remove")
+	}
+	return h, nil
+}
+
+func parseHeaderValues(node *client.Node) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, header := range node.Nodes {
+		name := filepath.Base(header.Key)
+		if !cookieNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		values[name] = header.Value
+	}
+	return values, nil
+}
+
+func parseHeaderNames(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !cookieNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// circuitBreaker is the spec of a vulcand cbreaker middleware.
+type circuitBreaker struct {
+	Condition        string
+	Fallback         json.RawMessage
+	FallbackDuration string `json:",omitempty"`
+	RecoveryDuration string `json:",omitempty"`
+	CheckPeriod      string `json:",omitempty"`
+}
+
+// parseCircuitBreaker reads a cbreaker directory with the keys condition, e.g.
+// NetworkErrorRatio() > 0.5, fallback, the JSON fallback spec, and optionally fallback-duration,
+// recovery-duration and check-period.
+func parseCircuitBreaker(node *client.Node) (*circuitBreaker, error) {
+	cb := &circuitBreaker{}
+	for _, child := range node.Nodes {
+		var err error
+		duration := func(d *string) {
+			if _, err = time.ParseDuration(child.Value); err == nil {
+				*d = child.Value
+			}
+		}
+		switch filepath.Base(child.Key) {
+		case "condition":
+			err = checkPredicate(child.Value, circuitBreakerFunctions)
+			cb.Condition = child.Value
+		case "fallback":
+			if !json.Valid([]byte(child.Value)) {
+				err = fmt.Errorf("not JSON")
+			}
+			cb.Fallback = json.RawMessage(child.Value)
+		case "fallback-duration":
+			duration(&cb.FallbackDuration)
+		case "recovery-duration":
+			duration(&cb.RecoveryDuration)
+		case "check-period":
+			duration(&cb.CheckPeriod)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(child.Key), err)
+		}
+	}
+	if cb.Condition == "" {
+		return nil, fmt.Errorf("condition is required")
+	}
+	if cb.Fallback == nil {
+		return nil, fmt.Errorf("fallback is required")
+	}
+	return cb, nil
+}
+
+// middlewarePriority returns the priority configured for one of the middlewares generated for the
+// service, or def if there is none.
+func (s Service) middlewarePriority(id string, def int) int {
+	if priority, found := s.MiddlewarePriorities[id]; found {
+		return priority
+	}
+	return def
+}
+
+// uniqueMiddlewareID returns id, or id with the lowest numeric suffix making it unique among the
+// used ids of a frontend, and marks it as used.
+func uniqueMiddlewareID(id string, used map[string]bool) string {
+	unique := id
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", id, n)
+	}
+	used[unique] = true
+	return unique
+}
+
+// middlewareValue returns the /vulcand/frontends/<fe>/middlewares/<id> value for a middleware.
+func middlewareValue(id string, mwType string, priority int, spec interface{}) string {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	// keep expressions such as "NetworkErrorRatio() > 0.5" readable
+	e.SetEscapeHTML(false)
+	err := e.Encode(map[string]interface{}{
+		"Id":         id,
+		"Type":       mwType,
+		"Priority":   priority,
+		"Middleware": spec,
+	})
+	if err != nil {
+		// specs are plain structs, so can always be marshalled
+		panic(err)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// serviceMiddlewares returns the middlewares set on every frontend of a service: those declared
+// as raw JSON, and those generated from its settings, which take precedence.
+func serviceMiddlewares(service Service) map[string]string {
+	middlewares := make(map[string]string)
+	for id, mw := range service.Middlewares {
+		middlewares[id] = mw
+	}
+	generated := func(id string, mwType string, spec interface{}) {
+		if _, found := middlewares[id]; found {
+			builderLog.Warnf("middleware %s of service %s is replaced by its %s settings\n", id, service.Name, mwType)
+		}
+		middlewares[id] = middlewareValue(id, mwType, service.middlewarePriority(id, 0), spec)
+	}
+	if service.RateLimit != nil {
+		generated("ratelimit", "ratelimit", service.RateLimit)
+	}
+	if service.ConnLimit != nil {
+		generated("connlimit", "connlimit", service.ConnLimit)
+	}
+	if service.Headers != nil {
+		generated("headers", "headers", service.Headers)
+	}
+	if len(middlewares) == 0 {
+		return nil
+	}
+	return middlewares
+}
+
+// withCircuitBreaker returns the middlewares of the frontends routing to a service's main backend,
+// which are those of all its frontends plus its circuit breaker.
+func withCircuitBreaker(service Service, middlewares map[string]string) map[string]string {
+	if service.CircuitBreaker == nil {
+		return middlewares
+	}
+	if _, found := middlewares["cbreaker"]; found {
+		builderLog.Warnf("middleware cbreaker of service %s is replaced by its cbreaker settings\n", service.Name)
+	}
+	withCB := map[string]string{"cbreaker": middlewareValue("cbreaker", "cbreaker", service.middlewarePriority("cbreaker", 0), service.CircuitBreaker)}
+	for id, mw := range middlewares {
+		if id != "cbreaker" {
+			withCB[id] = mw
+		}
+	}
+	return withCB
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// renderNginx renders the routes of the services as an nginx configuration, to be included in the
+// http block of nginx.conf. Each vulcand backend becomes an upstream of the same name, each host a
+// server, and the internal, health check and path frontends are locations of every server. The
+// backends and rewrites are taken from the vulcand configuration, so that e.g. weights, draining
+// and maintenance are the same as they are in vulcand.
+//
+// nginx can't express the path-host-regex, path-methods and path-header conditions of paths, so
+// paths with them are left out.
+func renderNginx(services []Service, vc vulcanConf) []byte {
+	var b bytes.Buffer
+	b.WriteString("# generated by vulcan-config-builder, changes are overwritten\n\n")
+	b.WriteString("proxy_set_header Host $host;\n\n")
+
+	// upstreams, with the scheme proxy_pass uses for each of them
+	schemes := make(map[string]string)
+	for _, id := range sortedBackendIDs(vc) {
+		servers := vc.Backends[id].Servers
+		var lines []string
+		for _, serverID := range sortedServerIDs(servers) {
+			server := servers[serverID]
+			u, err := url.Parse(server.URL)
+			if err != nil || u.Host == "" {
+				builderLog.Warnf("leaving server %s=%s out of nginx upstream %s, it isn't a URL\n", serverID, server.URL, id)
+				continue
+			}
+			if _, found := schemes[id]; !found {
+				schemes[id] = u.Scheme
+			}
+			line := "    server " + u.Host
+			switch {
+			case server.Draining:
+				line += " down"
+			case server.Weight > 0:
+				line += fmt.Sprintf(" weight=%d", server.Weight)
+			}
+			lines = append(lines, line+";")
+		}
+		if len(lines) == 0 {
+			// nginx refuses upstreams without servers
+			continue
+		}
+		fmt.Fprintf(&b, "upstream %s {\n%s\n}\n\n", id, strings.Join(lines, "\n"))
+	}
+
+	// proxy returns the directives proxying to the frontend's backend after its rewrites, or
+	// answering 503 when the backend has no upstream, e.g. an empty one or VCB_MAINTENANCE_BACKEND.
+	proxy := func(frontend vulcanFrontend, uri string) []string {
+		var directives []string
+		for _, rewrite := range frontend.rewrites {
+			directives = append(directives, fmt.Sprintf("rewrite %s %s break;", nginxQuote(rewrite.Middleware.Regexp), nginxQuote(rewrite.Middleware.Replacement)))
+		}
+		scheme, found := schemes[frontend.BackendID]
+		if !found {
+			return []string{"return 503;"}
+		}
+		return append(directives, fmt.Sprintf("proxy_pass %s://%s%s;", scheme, frontend.BackendID, uri))
+	}
+
+	// locations of every server, and of the servers of particular hosts
+	var shared []string
+	hostLocations := make(map[string][]string)
+	location := func(host string, match string, directives []string) {
+		l := fmt.Sprintf("    location %s {\n        %s\n    }", match, strings.Join(directives, "\n        "))
+		if host == "" {
+			shared = append(shared, l)
+		} else {
+			hostLocations[host] = append(hostLocations[host], l)
+		}
+	}
+
+	for _, service := range services {
+		if frontend, found := vc.FrontEnds[managedPrefix+"internal-"+service.Name]; found {
+			// the prefix is replaced by proxy_pass rather than the frontend's rewrite, and takes
+			// precedence over the path regexes as the internal frontend does in vulcand
+			frontend.rewrites = nil
+			location("", fmt.Sprintf("^~ /__%s/", service.Name), proxy(frontend, "/"))
+		}
+		var serverIDs []string
+		for serverID := range service.Addresses {
+			serverIDs = append(serverIDs, serverID)
+		}
+		sort.Strings(serverIDs)
+		for _, serverID := range serverIDs {
+			frontend, found := vc.FrontEnds[fmt.Sprintf("%shealth-%s-%s", managedPrefix, service.Name, serverID)]
+			if !found {
+				continue
+			}
+			path := fmt.Sprintf("/health/%s-%s/__health", service.Name, serverID)
+			healthCheckPath := "/__health"
+			if len(frontend.rewrites) > 0 && frontend.rewrites[0].Middleware.Regexp == path {
+				healthCheckPath = frontend.rewrites[0].Middleware.Replacement
+			}
+			frontend.rewrites = nil
+			location("", "= "+path, proxy(frontend, healthCheckPath))
+		}
+		for _, host := range hostHeaderHosts(service) {
+			if frontend, found := vc.FrontEnds[managedPrefix+"byhostheader-"+service.Name]; found {
+				location(strings.ToLower(host), "/", proxy(frontend, ""))
+			}
+		}
+	}
+
+	// paths, highest priority first as nginx uses the first regex location matching
+	for _, p := range sortedPaths(services) {
+		s, name := p.service, p.name
+		frontend, found := vc.FrontEnds[fmt.Sprintf("%s%s-path-regex-%s", managedPrefix, s.Name, name)]
+		if !found {
+			continue
+		}
+		_, hostRegex := s.PathHostRegexes[name]
+		_, header := s.PathHeaders[name]
+		if hostRegex || header || len(s.PathMethods[name]) > 0 {
+			builderLog.Warnf("leaving path %s of service %s out of the nginx configuration, nginx can't match its host regex, methods or header\n", name, s.Name)
+			continue
+		}
+		location(strings.ToLower(s.PathHosts[name]), "~ "+nginxQuote(s.pathRegex(name)), proxy(frontend, ""))
+	}
+
+	fmt.Fprintf(&b, "server {\n    listen 80 default_server;\n    server_name _;\n\n%s\n}\n", strings.Join(shared, "\n\n"))
+	var hosts []string
+	for host := range hostLocations {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		// the shared locations come first, so a host's own paths are matched before its catch-all
+		locations := append(append([]string{}, shared...), hostLocations[host]...)
+		fmt.Fprintf(&b, "\nserver {\n    listen 80;\n    server_name %s;\n\n%s\n}\n", host, strings.Join(locations, "\n\n"))
+	}
+	return b.Bytes()
+}
+
+// nginxQuote quotes a string, e.g. a regex which may hold braces or semicolons, for nginx.
+func nginxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// the exit codes of --once
+const (
+	onceUnchanged = 0
+	onceFailed    = 1
+	onceChanged   = 2
+)
+
+// onceCommand rebuilds and applies the configuration once, e.g. as a reconciliation job of a
+// deployment pipeline, instead of watching etcd. It exits with 0 when vulcand already had the
+// configuration, 2 when it was changed to it and 1 when it couldn't be. A dry run only logs the
+// changes, exiting with 2 when there are any.
+func onceCommand(args []string) (code int) {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: --once\n")
+		return onceFailed
+	}
+	// a panic, e.g. failing to read /vulcand/, would otherwise exit with 2
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Fprintf(os.Stderr, "failed to apply: %v\n", p)
+			code = onceFailed
+		}
+	}()
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return onceFailed
+	}
+	kapi := client.NewKeysAPI(etcd)
+	var targets []*vulcandTarget
+	if vulcandTargets != "" {
+		if targets, err = parseVulcandTargets(kapi, vulcandTargets); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid VCB_TARGETS: %v\n", err)
+			return onceFailed
+		}
+	}
+
+	vc, services, _ := newRebuilder(kapi).generate(context.Background())
+	vc.failFast = applyPolicy == "fail-fast"
+	if dryRun {
+		return dryRunOnce(vulcandKeys(kapi), targets, vc, serviceNames(services))
+	}
+	code = reconcileOnce(kapi, vulcandKeys(kapi), targets, vc, serviceNames(services))
+	if code != onceFailed && heartbeatKey != "-" {
+		writeHeartbeat(kapi, heartbeatKey, vc, time.Now(), heartbeatTTL)
+	}
+	return code
+}
+
+// dryRunOnce logs the changes reconcileOnce would make, without making them. It returns the exit
+// code of --once as though they had been made.
+func dryRunOnce(target client.KeysAPI, targets []*vulcandTarget, vc vulcanConf, services []string) int {
+	planned := 0
+	if targets != nil {
+		for _, t := range targets {
+			applierLog.Infof("dry run of %s, keys under /vulcand/ are under it\n", t.Prefix)
+			n, err := logDryRun(t.kapi, t.conf(vc, services))
+			if err != nil {
+				return onceFailed
+			}
+			planned += n
+		}
+	} else {
+		n, err := logDryRun(target, vc)
+		if err != nil {
+			return onceFailed
+		}
+		planned = n
+	}
+	if planned == 0 {
+		return onceUnchanged
+	}
+	return onceChanged
+}
+
+// reconcileOnce applies the configuration to the target, or targets when they are set, records
+// the changes in the audit log and runs the post-apply hooks. It returns the exit code of --once.
+func reconcileOnce(kapi client.KeysAPI, target client.KeysAPI, targets []*vulcandTarget, vc vulcanConf, services []string) int {
+	started := time.Now()
+	var changes []keyChange
+	var err error
+	if targets != nil {
+		changes, err = applyVulcandTargets(targets, vc, services)
+	} else {
+		changes, err = applyVulcanConf(target, vc)
+	}
+	newAuditLog(kapi).record("once-"+newRebuildID(started), time.Now(), changes)
+	if len(changes) > 0 {
+		configuredPostApplyHooks().run(changes)
+	}
+
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "failed to apply: %v\n", err)
+		return onceFailed
+	case len(changes) == 0:
+		fmt.Fprintf(os.Stderr, "vulcand already has the configuration\n")
+		return onceUnchanged
+	default:
+		fmt.Fprintf(os.Stderr, "%d changes applied\n", len(changes))
+		return onceChanged
+	}
+}
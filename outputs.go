@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// configFile is the configuration of a proxy other than vulcand, e.g. nginx, rendered from each
+// rebuild. It is only written when its content changes, after which its reload command is run.
+type configFile struct {
+	name          string
+	path          string
+	reloadCommand string
+	render        func(services []Service, vc vulcanConf) []byte
+}
+
+// configFiles returns the configuration files enabled in the environment.
+func configFiles() []*configFile {
+	var files []*configFile
+	if nginxConf != "" {
+		files = append(files, &configFile{name: "nginx", path: nginxConf, reloadCommand: nginxReloadExec, render: renderNginx})
+	}
+	if haproxyConf != "" {
+		files = append(files, &configFile{name: "HAProxy", path: haproxyConf, reloadCommand: haproxyReloadExec, render: renderHAProxy})
+	}
+	if traefikConf != "" {
+		// Traefik's file provider watches the file itself
+		files = append(files, &configFile{name: "Traefik", path: traefikConf, render: renderTraefik})
+	}
+	return files
+}
+
+// write renders the file and, if it changed, replaces it and runs the reload command.
+func (f *configFile) write(services []Service, vc vulcanConf) error {
+	content := f.render(services, vc)
+	if existing, err := ioutil.ReadFile(f.path); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+
+	// the file is replaced by a rename so the proxy never reads half of it
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	applierLog.Infof("wrote %s configuration to %s\n", f.name, f.path)
+
+	if f.reloadCommand == "" {
+		return nil
+	}
+	out, err := exec.Command("/bin/sh", "-c", f.reloadCommand).CombinedOutput()
+	if len(out) > 0 {
+		applierLog.Infof("%s reload output: %s\n", f.name, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s reload failed: %v", f.name, err)
+	}
+	return nil
+}
+
+func sortedBackendIDs(vc vulcanConf) []string {
+	var ids []string
+	for id := range vc.Backends {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedServerIDs(servers map[string]vulcanServer) []string {
+	var ids []string
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// servicePath is a path of a service, see sortedPaths.
+type servicePath struct {
+	service Service
+	name    string
+}
+
+// sortedPaths returns the paths of the services in the order proxies matching the first route
+// should try them: highest path-priority first, then by service and path name.
+func sortedPaths(services []Service) []servicePath {
+	var paths []servicePath
+	for _, service := range services {
+		for name := range service.PathPrefixes {
+			paths = append(paths, servicePath{service, name})
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		pi, pj := paths[i].service.PathPriorities[paths[i].name], paths[j].service.PathPriorities[paths[j].name]
+		if pi != pj {
+			return pi > pj
+		}
+		if paths[i].service.Name != paths[j].service.Name {
+			return paths[i].service.Name < paths[j].service.Name
+		}
+		return paths[i].name < paths[j].name
+	})
+	return paths
+}
+
+var replacementGroupRegex = regexp.MustCompile(`\$\{?([0-9]+)\}?`)
+
+// backslashReplacement converts the $1 groups of a vulcand rewrite replacement to the \1 of
+// HAProxy and Envoy.
+func backslashReplacement(replacement string) string {
+	return replacementGroupRegex.ReplaceAllString(replacement, `\$1`)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// duration of each apply phase in the most recent apply, and in total since startup
+	applyPhaseLastSeconds  = expvar.NewMap("apply_phase_last_seconds")
+	applyPhaseTotalSeconds = expvar.NewMap("apply_phase_total_seconds")
+
+	// frontends, middlewares, backends and servers created, updated and deleted by the most recent
+	// apply, and in total since startup, e.g. servers_created
+	applyChangesLast  = expvar.NewMap("apply_changes_last")
+	applyChangesTotal = expvar.NewMap("apply_changes_total")
+	// applies, and those which changed nothing
+	appliesTotal = expvar.NewInt("applies_total")
+	appliesNoop  = expvar.NewInt("applies_noop")
+	// applies which failed in total, and since the last one which succeeded, and the keys which
+	// failed to be written or deleted in the most recent apply
+	appliesFailed            = expvar.NewInt("applies_failed")
+	appliesFailedConsecutive = expvar.NewInt("applies_failed_consecutive")
+	applyFailedKeysLast      = expvar.NewInt("apply_failed_keys_last")
+)
+
+// phaseTimer times consecutive named phases of an apply, tracing each as a span of trace when it
+// is set.
+type phaseTimer struct {
+	last   time.Time
+	phases []string
+	trace  context.Context
+}
+
+func newPhaseTimer(trace context.Context) *phaseTimer {
+	return &phaseTimer{last: time.Now(), trace: trace}
+}
+
+// done ends the current phase, recording the time since the previous phase ended.
+func (t *phaseTimer) done(phase string) {
+	now := time.Now()
+	d := now.Sub(t.last)
+	traceSince(t.trace, phase, t.last, now)
+	t.last = now
+
+	f := new(expvar.Float)
+	f.Set(d.Seconds())
+	applyPhaseLastSeconds.Set(phase, f)
+	applyPhaseTotalSeconds.AddFloat(phase, d.Seconds())
+
+	t.phases = append(t.phases, phase+"="+d.String())
+}
+
+func (t *phaseTimer) String() string {
+	return strings.Join(t.phases, " ")
+}
+
+// recordChanges counts the changes made by an apply, including those under the prefixes of
+// VCB_TARGETS. Changes to hosts aren't counted.
+func recordChanges(changes []keyChange) {
+	counts := make(map[string]int64)
+	for _, kind := range []string{"frontends", "middlewares", "backends", "servers"} {
+		for _, action := range []string{"created", "updated", "deleted"} {
+			counts[kind+"_"+action] = 0
+		}
+	}
+	for _, c := range changes {
+		kind := changedKind(c.Key)
+		if kind == "" {
+			continue
+		}
+		action := "updated"
+		if c.Action == "delete" {
+			action = "deleted"
+		} else if c.OldValue == "" {
+			action = "created"
+		}
+		counts[kind+"_"+action]++
+	}
+
+	for name, count := range counts {
+		n := new(expvar.Int)
+		n.Set(count)
+		applyChangesLast.Set(name, n)
+		applyChangesTotal.Add(name, count)
+	}
+	appliesTotal.Add(1)
+	if len(changes) == 0 {
+		appliesNoop.Add(1)
+	}
+}
+
+// changedKind returns whether the key is of a frontend, a middleware, a backend or a server.
+func changedKind(key string) string {
+	for _, dir := range []string{"/frontends/", "/backends/"} {
+		i := strings.Index(key, dir)
+		if i < 0 {
+			continue
+		}
+		parts := strings.Split(key[i+len(dir):], "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "frontend":
+			return "frontends"
+		case len(parts) == 2 && parts[1] == "backend":
+			return "backends"
+		case len(parts) == 3 && parts[1] == "middlewares":
+			return "middlewares"
+		case len(parts) == 3 && parts[1] == "servers":
+			return "servers"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// plan is the changes a rebuild would make to /vulcand/, made by `vcb plan` so that they can be
+// reviewed before `vcb apply` makes them. Unlike the history, it holds the values unredacted.
+type plan struct {
+	Created time.Time   `json:"created"`
+	Changes []keyChange `json:"changes"`
+}
+
+// makePlan returns the changes applyVulcanConf would make, in the order it would make them.
+func makePlan(kapi client.KeysAPI, vc vulcanConf) (plan, error) {
+	recorder := &recordingKeysAPI{KeysAPI: kapi}
+	if _, err := applyVulcanConf(recorder, vc); err != nil {
+		return plan{}, err
+	}
+	return plan{Created: time.Now().UTC(), Changes: recorder.changes}, nil
+}
+
+// applyPlan makes the changes of the plan, after checking that none of the keys it changes have
+// changed since it was made.
+func applyPlan(kapi client.KeysAPI, p plan) ([]keyChange, error) {
+	for _, c := range p.Changes {
+		current, err := currentValue(kapi, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		if current != c.OldValue {
+			return nil, fmt.Errorf("%s has changed since the plan was made", c.Key)
+		}
+	}
+
+	var failures []keyFailure
+	var changes []keyChange
+	for _, c := range p.Changes {
+		var err error
+		switch c.Action {
+		case "set":
+			applierLog.Debugf("setting %s to %s\n", c.Key, redactValue(c.Key, c.NewValue))
+			_, err = kapi.Set(context.Background(), c.Key, c.NewValue, nil)
+		case "delete":
+			applierLog.Debugf("deleting %s\n", c.Key)
+			_, err = kapi.Delete(context.Background(), c.Key, nil)
+		default:
+			err = fmt.Errorf("unknown action %s", c.Action)
+		}
+		if err != nil {
+			applierLog.Errorf("error applying %s of %s: %v\n", c.Action, c.Key, err)
+			failures = append(failures, keyFailure{Action: c.Action, Key: c.Key, Error: err.Error()})
+			continue
+		}
+		changes = append(changes, keyChange{Action: c.Action, Key: c.Key, OldValue: redactValue(c.Key, c.OldValue), NewValue: redactValue(c.Key, c.NewValue)})
+	}
+	_, cleanupFailures := cleanEmptyEntries(kapi, vulcandCleanupRules, cleanupMaxDeletions)
+	failures = append(failures, cleanupFailures...)
+
+	if len(failures) > 0 {
+		return changes, applyError{failures}
+	}
+	return changes, nil
+}
+
+// logDryRun logs the changes applying the configuration would make, with the values they replace,
+// without making them. It returns the number of changes.
+func logDryRun(kapi client.KeysAPI, vc vulcanConf) (int, error) {
+	p, err := makePlan(kapi, vc)
+	if err != nil {
+		applierLog.Errorf("dry run failed: %v\n", err)
+		return 0, err
+	}
+	for _, c := range p.Changes {
+		switch c.Action {
+		case "set":
+			applierLog.Infof("dry run: would set %s from %q to %q\n", c.Key, redactValue(c.Key, c.OldValue), redactValue(c.Key, c.NewValue))
+		case "delete":
+			applierLog.Infof("dry run: would delete %s, which is %q\n", c.Key, redactValue(c.Key, c.OldValue))
+		}
+	}
+	applierLog.Infof("dry run: %d changes planned\n", len(p.Changes))
+	return len(p.Changes), nil
+}
+
+// recordingKeysAPI records the keys set and deleted through it, with the values they replace,
+// rather than setting or deleting them. Recursive deletes, which only the cleanup of empty
+// directories makes, are ignored, as the apply cleans up after itself.
+type recordingKeysAPI struct {
+	client.KeysAPI
+	changes []keyChange
+}
+
+func (r *recordingKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if opts != nil && opts.Refresh {
+		// refreshing a TTL leaves the value as it is
+		return &client.Response{Action: "update", Node: &client.Node{Key: key}}, nil
+	}
+	old, err := currentValue(r.KeysAPI, key)
+	if err != nil {
+		return nil, err
+	}
+	r.changes = append(r.changes, keyChange{Action: "set", Key: key, OldValue: old, NewValue: value})
+	return &client.Response{Action: "set", Node: &client.Node{Key: key, Value: value}}, nil
+}
+
+func (r *recordingKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	if opts != nil && opts.Recursive {
+		return &client.Response{Action: "delete", Node: &client.Node{Key: key}}, nil
+	}
+	old, err := currentValue(r.KeysAPI, key)
+	if err != nil {
+		return nil, err
+	}
+	r.changes = append(r.changes, keyChange{Action: "delete", Key: key, OldValue: old})
+	return &client.Response{Action: "delete", Node: &client.Node{Key: key}}, nil
+}
+
+// currentValue returns the value of the key, or "" if it doesn't exist.
+func currentValue(kapi client.KeysAPI, key string) (string, error) {
+	resp, err := kapi.Get(context.Background(), key, nil)
+	if err != nil {
+		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+// planCommand writes the changes the next rebuild would make to a file, or stdout.
+func planCommand(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	output := flags.String("output", "-", "file to write the plan to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 1
+	}
+	kapi := client.NewKeysAPI(etcd)
+	vc, _, _ := newRebuilder(kapi).generate(context.Background())
+	p, err := makePlan(vulcandKeys(kapi), vc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to make plan: %v\n", err)
+		return 1
+	}
+
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode plan: %v\n", err)
+		return 1
+	}
+	if *output == "-" {
+		fmt.Println(string(b))
+	} else if err := ioutil.WriteFile(*output, append(b, '\n'), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write plan: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d changes planned\n", len(p.Changes))
+	return 0
+}
+
+// applyCommand makes the changes of a plan written by planCommand, and runs the post-apply hooks.
+func applyCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: apply <plan file>\n")
+		return 2
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read plan: %v\n", err)
+		return 1
+	}
+	var p plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode plan: %v\n", err)
+		return 1
+	}
+
+	configure()
+	etcd, err := client.New(etcdConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+		return 1
+	}
+	changes, err := applyPlan(vulcandKeys(client.NewKeysAPI(etcd)), p)
+	if len(changes) > 0 {
+		configuredPostApplyHooks().run(changes)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to apply plan: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d changes applied\n", len(changes))
+	return 0
+}
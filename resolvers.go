@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// addressResolver expands a symbolic server value, e.g. aws:tag:Name=content-api:8080, into the
+// addresses of the servers it stands for, keyed by a suffix identifying each of them.
+type addressResolver interface {
+	resolve(value string) (map[string]string, error)
+}
+
+// addressResolvers are keyed by the scheme of the symbolic values they resolve.
+var addressResolvers = map[string]addressResolver{
+	"aws": newEC2Resolver(),
+}
+
+// resolvedAddresses caches what symbolic server values resolved to, so that they are resolved at
+// most once per refresh interval and a failing resolver keeps the servers it last found.
+type resolvedAddresses struct {
+	sync.Mutex
+	refresh time.Duration
+	entries map[string]resolvedEntry
+}
+
+type resolvedEntry struct {
+	addresses map[string]string
+	resolved  time.Time
+}
+
+func newResolvedAddresses(refresh time.Duration) *resolvedAddresses {
+	return &resolvedAddresses{refresh: refresh, entries: make(map[string]resolvedEntry)}
+}
+
+func (r *resolvedAddresses) resolve(resolver addressResolver, value string) (map[string]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	entry, found := r.entries[value]
+	if found && time.Since(entry.resolved) < r.refresh {
+		return entry.addresses, nil
+	}
+	addresses, err := resolver.resolve(value)
+	if err != nil {
+		if found {
+			builderLog.Errorf("failed to resolve %s, keeping the servers last resolved: %v\n", value, err)
+			return entry.addresses, nil
+		}
+		return nil, err
+	}
+	r.entries[value] = resolvedEntry{addresses: addresses, resolved: time.Now()}
+	return addresses, nil
+}
+
+// expandAddresses replaces the symbolic server values of the services with the servers they
+// resolve to, and the values of servers with several addresses with a server per address, both as
+// <server-id>-<suffix>. It returns whether any values were symbolic.
+func (r *resolvedAddresses) expandAddresses(services []Service) ([]Service, bool) {
+	symbolic := false
+	for i, service := range services {
+		addresses := make(map[string]string)
+		weights := make(map[string]int)
+		healthCheckPaths := make(map[string]string)
+		// add adds a server standing for all or part of the server with the id
+		add := func(id string, expandedID string, address string) {
+			addresses[expandedID] = address
+			if w, found := service.Weights[id]; found {
+				weights[expandedID] = w
+			}
+			if path, found := service.HealthCheckPaths[id]; found {
+				healthCheckPaths[expandedID] = path
+			}
+		}
+		for id, value := range service.Addresses {
+			if multiple, found, err := multipleAddresses(value); found {
+				if err != nil {
+					services[i].invalid("invalid addresses of server %s of service %s: %v\n", id, service.Name, err)
+					continue
+				}
+				for suffix, address := range multiple {
+					add(id, id+"-"+suffix, address)
+				}
+				continue
+			}
+			scheme := strings.SplitN(value, ":", 2)[0]
+			resolver, found := addressResolvers[scheme]
+			if !found {
+				add(id, id, value)
+				continue
+			}
+			symbolic = true
+			resolved, err := r.resolve(resolver, value)
+			if err != nil {
+				services[i].invalid("failed to resolve server %s=%s of service %s: %v\n", id, value, service.Name, err)
+				continue
+			}
+			for suffix, address := range resolved {
+				add(id, id+"-"+suffix, address)
+			}
+		}
+		services[i].Addresses = addresses
+		services[i].Weights = weights
+		services[i].HealthCheckPaths = healthCheckPaths
+	}
+	return services, symbolic
+}
+
+// multipleAddresses reads the value of a server with several addresses, e.g. an internal and an
+// external port: a JSON array of addresses, keyed by their position from 1, or a JSON object of
+// addresses keyed by name, as serverValue makes of a server's directory. It returns whether the
+// value is one of those.
+func multipleAddresses(value string) (map[string]string, bool, error) {
+	value = strings.TrimSpace(value)
+	addresses := make(map[string]string)
+	switch {
+	case strings.HasPrefix(value, "["):
+		var list []string
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, true, err
+		}
+		for n, address := range list {
+			addresses[strconv.Itoa(n+1)] = address
+		}
+	case strings.HasPrefix(value, "{"):
+		if err := json.Unmarshal([]byte(value), &addresses); err != nil {
+			return nil, true, err
+		}
+	default:
+		return nil, false, nil
+	}
+	if len(addresses) == 0 {
+		return nil, true, fmt.Errorf("no addresses")
+	}
+	return addresses, true, nil
+}
+
+// serverValue returns the value of a server read from its etcd node, which is a JSON object of the
+// addresses under it, keyed by name, for a server with a directory of addresses.
+func serverValue(node *client.Node) string {
+	if !node.Dir {
+		return node.Value
+	}
+	addresses := make(map[string]string)
+	for _, address := range node.Nodes {
+		addresses[filepath.Base(address.Key)] = address.Value
+	}
+	b, err := json.Marshal(addresses)
+	if err != nil {
+		// strings can always be marshalled
+		panic(err)
+	}
+	return string(b)
+}
+
+// ec2Resolver resolves aws:tag:<tag>=<value>:<port> to the private IP addresses of the running
+// EC2 instances with that tag, keyed by instance id. Credentials and region are read from the
+// standard AWS_ environment variables.
+type ec2Resolver struct {
+	endpoint string
+	region   string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newEC2Resolver() ec2Resolver {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return ec2Resolver{
+		endpoint: fmt.Sprintf("https://ec2.%s.amazonaws.com/", region),
+		region:   region,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+type ec2Instances struct {
+	Reservations []struct {
+		Instances []struct {
+			ID        string `xml:"instanceId"`
+			PrivateIP string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+}
+
+func (r ec2Resolver) resolve(value string) (map[string]string, error) {
+	spec := strings.TrimPrefix(value, "aws:tag:")
+	i := strings.LastIndex(spec, ":")
+	if spec == value || i < 0 {
+		return nil, fmt.Errorf("expected aws:tag:<tag>=<value>:<port>")
+	}
+	port, err := strconv.Atoi(spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %v", err)
+	}
+	tag := strings.SplitN(spec[:i], "=", 2)
+	if len(tag) != 2 {
+		return nil, fmt.Errorf("expected aws:tag:<tag>=<value>:<port>")
+	}
+
+	params := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {"2016-11-15"},
+		"Filter.1.Name":    {"tag:" + tag[0]},
+		"Filter.1.Value.1": {tag[1]},
+		"Filter.2.Name":    {"instance-state-name"},
+		"Filter.2.Value.1": {"running"},
+	}
+	req, err := r.signedRequest(params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var instances ec2Instances
+	if err := xml.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]string)
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.PrivateIP != "" {
+				addresses[instance.ID] = httpURL(instance.PrivateIP, port)
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// signedRequest returns a GET of the EC2 API signed with AWS signature version 4.
+func (r ec2Resolver) signedRequest(params url.Values) (*http.Request, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	token := os.Getenv("AWS_SESSION_TOKEN")
+	if accessKey == "" || secretKey == "" || r.region == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION must be set")
+	}
+
+	u, err := url.Parse(r.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var query []string
+	for _, k := range keys {
+		query = append(query, awsEscape(k)+"="+awsEscape(params.Get(k)))
+	}
+	u.RawQuery = strings.Join(query, "&")
+
+	t := r.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	headers := "host:" + u.Host + "\nx-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-date"
+	if token != "" {
+		headers += "x-amz-security-token:" + token + "\n"
+		signedHeaders += ";x-amz-security-token"
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{"GET", path, u.RawQuery, headers, signedHeaders, sha256Hex("")}, "\n")
+	scope := date + "/" + r.region + "/ec2/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonical)}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, r.region, "ec2", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// schema helpers, each returning a JSON Schema fragment for an etcd value or directory
+
+func stringValue(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func patternValue(description string, pattern string) map[string]interface{} {
+	v := stringValue(description)
+	v["pattern"] = pattern
+	return v
+}
+
+func enumValue(description string, values ...string) map[string]interface{} {
+	v := stringValue(description)
+	v["enum"] = values
+	return v
+}
+
+// dirOf is a directory whose keys are ids chosen by the service, e.g. server or path names.
+func dirOf(description string, value map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                 "object",
+		"description":          description,
+		"additionalProperties": value,
+	}
+}
+
+// dirWith is a directory with a fixed set of keys.
+func dirWith(description string, required []string, keys map[string]interface{}) map[string]interface{} {
+	d := map[string]interface{}{
+		"type":                 "object",
+		"description":          description,
+		"properties":           keys,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		d["required"] = required
+	}
+	return d
+}
+
+const (
+	integerPattern  = `^-?[0-9]+$`
+	durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+	// a server URL, or a symbolic value resolved by one of the addressResolvers
+	symbolicAddressPattern = `^([\.\-:\/\w]*:[0-9]{1,5}|[a-z]+://\[[0-9A-Fa-f:\.%\w]+\]:[0-9]{1,5}|aws:tag:[^=]+=.*:[0-9]+)$`
+)
+
+// serverValueSchema describes a server: its address, or the addresses of a server with several.
+func serverValueSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			patternValue("server URL, or symbolic value such as aws:tag:Name=content-api:8080", symbolicAddressPattern),
+			patternValue("JSON array of server URLs", `^\s*\[.*\]\s*$`),
+			dirOf("server URLs keyed by name", stringValue("server URL")),
+		},
+	}
+}
+
+// serviceKeys describes every key readServices understands in a service's directory.
+func serviceKeys() map[string]interface{} {
+	return map[string]interface{}{
+		"config":            stringValue("JSON or YAML document holding any of the other keys, as the JSON objects and strings described here. Keys set individually override it"),
+		"healthcheck":       enumValue("whether the service's servers have health check frontends", "true", "false"),
+		"maintenance":       enumValue("whether the service's public frontends are removed, or routed to VCB_MAINTENANCE_BACKEND, keeping its internal and health check frontends", "true", "false"),
+		"healthcheck-path":  stringValue("path the service serves its health check on, defaults to /__health"),
+		"healthcheck-paths": dirOf("health check paths of individual servers overriding healthcheck-path, keyed by server id", stringValue("path")),
+		"servers":           dirOf("servers of the service, keyed by server id", serverValueSchema()),
+		"weights":           dirOf("weights of the servers in the main backend, keyed by server id", patternValue("non-negative integer weight", `^[0-9]+$`)),
+		"canary":            dirOf("canary servers of the service, keyed by server id, which is prefixed with canary-", serverValueSchema()),
+		"default-scheme":    enumValue("scheme prepended to the service's bare host:port server addresses, overriding VCB_DEFAULT_SCHEME", "http", "https"),
+		"canary-weight":     patternValue("percentage of the main backend's requests sent to the canary servers", `^([0-9]|[1-9][0-9]|100)$`),
+		"host-aliases": map[string]interface{}{
+			"description": "hostnames the host header frontend matches as well as the service name",
+			"oneOf": []interface{}{
+				stringValue("comma separated hostnames"),
+				dirOf("hostnames", stringValue("comma separated hostnames")),
+			},
+		},
+		"backend-settings":      stringValue("JSON object of vulcand backend settings (Timeouts, KeepAlive and/or TLS) merged over VCB_BACKEND_SETTINGS"),
+		"frontend-settings":     stringValue("JSON object of vulcand frontend settings (TrustForwardHeader, Hostname and/or Limits) merged over VCB_FRONTEND_SETTINGS"),
+		"frontend-type":         patternValue("vulcand type of the frontends routing to the main backend, defaults to http", frontendTypeRegex.String()),
+		"stickiness":            patternValue("name of the cookie pinning clients to a server of the main backend", cookieNameRegex.String()),
+		"middlewares":           dirOf("raw vulcand middlewares set on every frontend of the service, keyed by middleware id (rewrite is reserved)", stringValue("vulcand middleware JSON")),
+		"middleware-priorities": dirOf("priorities of the generated middlewares, keyed by middleware id", patternValue("integer priority", integerPattern)),
+		"ratelimit": dirWith("vulcand ratelimit middleware set on every frontend of the service", []string{"requests"}, map[string]interface{}{
+			"requests": patternValue("requests allowed per period", `^[0-9]+$`),
+			"period":   patternValue("period, defaults to 1s", durationPattern),
+			"burst":    patternValue("burst allowed, defaults to 1", `^[0-9]+$`),
+			"variable": stringValue("variable requests are limited by, defaults to client.ip"),
+		}),
+		"connlimit": dirWith("vulcand connlimit middleware set on every frontend of the service", []string{"connections"}, map[string]interface{}{
+			"connections": patternValue("concurrent connections allowed", `^[0-9]+$`),
+			"variable":    stringValue("variable connections are limited by, defaults to client.ip"),
+		}),
+		"headers": dirWith("headers middleware set on every frontend of the service", nil, map[string]interface{}{
+			"request-add":     dirOf("request headers to add, keyed by header name", stringValue("header value")),
+			"request-remove":  stringValue("comma separated request headers to remove"),
+			"response-add":    dirOf("response headers to add, keyed by header name", stringValue("header value")),
+			"response-remove": stringValue("comma separated response headers to remove"),
+		}),
+		"cbreaker": dirWith("vulcand cbreaker middleware set on the frontends routing to the main backend", []string{"condition", "fallback"}, map[string]interface{}{
+			"condition":         stringValue("vulcand expression tripping the circuit breaker, e.g. NetworkErrorRatio() > 0.5"),
+			"fallback":          stringValue("JSON fallback spec"),
+			"fallback-duration": patternValue("fallback duration", durationPattern),
+			"recovery-duration": patternValue("recovery duration", durationPattern),
+			"check-period":      patternValue("check period", durationPattern),
+		}),
+		"auth": dirWith("basic auth middleware set on the path frontends, with one of password-hash and password-hash-key", []string{"username"}, map[string]interface{}{
+			"username":          stringValue("username"),
+			"password-hash":     patternValue("bcrypt password hash", bcryptHashRegex.String()),
+			"password-hash-key": stringValue("etcd key holding the bcrypt password hash"),
+		}),
+		"path-regex":              dirOf("public paths routed to the service, keyed by path name", stringValue("vulcand path regex")),
+		"path-host":               dirOf("host the path's frontend additionally requires, keyed by path name", stringValue("hostname")),
+		"path-host-regex":         dirOf("regex of the hosts the path's frontend additionally requires, keyed by path name", stringValue("vulcand host regex")),
+		"path-normalise":          dirOf("whether to anchor the path regex and make a trailing slash optional, keyed by path name", enumValue("", "true", "false")),
+		"path-strip-prefix":       dirOf("whether to strip the prefix the path regex matches before proxying, keyed by path name", enumValue("", "true", "false")),
+		"path-rewrite":            dirOf("rewrite applied by the path's frontend before proxying, keyed by path name", stringValue(`JSON object with the Regexp and Replacement of a vulcand rewrite, e.g. {"Regexp": "/products/(.*)", "Replacement": "/content/$1"}`)),
+		"path-methods":            dirOf("HTTP methods the path's frontend matches, keyed by path name", stringValue("comma separated HTTP methods")),
+		"path-header":             dirOf("header the path's frontend additionally requires, keyed by path name", patternValue("Header-Name: value", `^[^:]+:.*$`)),
+		"path-header-regex":       dirOf("header matching a regex the path's frontend additionally requires, keyed by path name", patternValue("Header-Name: regex", `^[^:]+:.*$`)),
+		"path-priority":           dirOf("priority of the path's frontend over overlapping paths, higher first, keyed by path name", patternValue("integer priority", integerPattern)),
+		"path-failover-predicate": dirOf("failover predicate of the path's frontend, keyed by path name", stringValue("vulcand failover predicate")),
+		"failover-predicate":      stringValue("vulcand failover predicate of the service's frontends"),
+		"priority":                patternValue("priority deciding which service keeps a contested host", integerPattern),
+	}
+}
+
+// servicesSchema is a JSON Schema of a services directory, e.g. /ft/services/, as a JSON object
+// keyed by service name in which etcd directories are objects and values are strings.
+func servicesSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "vulcan-config-builder services",
+		"description":          "services directory, e.g. /ft/services/, keyed by service name",
+		"type":                 "object",
+		"additionalProperties": dirWith("service", nil, serviceKeys()),
+	}
+}
+
+// schemaCommand prints the JSON Schema of the services directory.
+func schemaCommand(args []string) int {
+	b, err := json.MarshalIndent(servicesSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode schema: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
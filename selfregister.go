@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// selfRegistration registers vcb as a service, so its HTTP endpoints are routed by vulcand like
+// any other service's. The keys have a TTL and are refreshed, so they disappear with vcb.
+type selfRegistration struct {
+	prefix  string
+	name    string
+	id      string
+	address string
+	ttl     time.Duration
+}
+
+func newSelfRegistration(prefix string, name string, address string) selfRegistration {
+	id, err := os.Hostname()
+	if err != nil || id == "" {
+		id = "1"
+	}
+	return selfRegistration{prefix: prefix, name: name, id: id, address: address, ttl: 60 * time.Second}
+}
+
+// startSelfRegistration registers vcb as VCB_SELF_REGISTER_NAME, with VCB_SELF_REGISTER_ADDRESS,
+// under the first services prefix of builder while it is the leader of election, when set, until
+// ctx is done. The returned function waits for the registration to be removed.
+func startSelfRegistration(ctx context.Context, kapi client.KeysAPI, builder *rebuilder, election *leaderElection) func() {
+	if selfRegisterAddress == "" || dryRun {
+		return func() {}
+	}
+	if selfRegisterName == "" {
+		selfRegisterName = "vcb"
+	}
+	if httpAddress == "" {
+		log.Printf("WARN - registering as service %s, but VCB_HTTP_ADDRESS is not set so nothing is served", selfRegisterName)
+	}
+	if builder.source != nil {
+		log.Printf("WARN - not registering as service %s, services are read from %s", selfRegisterName, sourceName)
+		return func() {}
+	}
+	if !validAddress(selfRegisterAddress) {
+		log.Printf("WARN - The provided self register address=%s is invalid, not registering", selfRegisterAddress)
+		return func() {}
+	}
+	if err := selfRegistrationExposure(selfRegisterAddress, adminAddress, adminToken); err != nil {
+		log.Printf("WARN - not registering as service %s, vulcand would route to the privileged endpoints: %v", selfRegisterName, err)
+		return func() {}
+	}
+	// only the leader is registered
+	var active func() bool
+	if election != nil {
+		active = election.isLeader
+	}
+	registration := newSelfRegistration(builder.servicesPrefixes[0], selfRegisterName, selfRegisterAddress)
+	deregistered := make(chan struct{})
+	go func() {
+		registration.run(ctx, kapi, active)
+		close(deregistered)
+	}()
+	return func() {
+		<-deregistered
+	}
+}
+
+// selfRegistrationExposure returns why registering address would let anyone reaching vulcand use
+// the privileged endpoints, e.g. /__rebuild, or nil when they are protected by a token or served
+// on another port. Without VCB_ADMIN_ADDRESS they are served on VCB_HTTP_ADDRESS.
+func selfRegistrationExposure(address string, adminAddress string, adminToken string) error {
+	if adminToken != "" {
+		return nil
+	}
+	if adminAddress == "" {
+		return fmt.Errorf("the privileged endpoints are served on VCB_HTTP_ADDRESS, and VCB_ADMIN_TOKEN is not set")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if _, adminPort, err := net.SplitHostPort(adminAddress); err == nil && u.Port() == adminPort {
+		return fmt.Errorf("%s is on the port of VCB_ADMIN_ADDRESS, and VCB_ADMIN_TOKEN is not set", address)
+	}
+	return nil
+}
+
+// run registers vcb while active, when set, reports that it should be, e.g. while it is the
+// leader, and keeps refreshing the registration, until ctx is done. The registration is then
+// removed rather than left to expire.
+func (r selfRegistration) run(ctx context.Context, kapi client.KeysAPI, active func() bool) {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	registered := false
+	for {
+		if active == nil || active() {
+			if !registered {
+				builderLog.Infof("registering as service %s with server %s=%s\n", r.name, r.id, r.address)
+			}
+			r.register(kapi)
+			registered = true
+		} else if registered {
+			builderLog.Infof("no longer the leader, deregistering as service %s\n", r.name)
+			r.deregister(kapi)
+			registered = false
+		}
+		select {
+		case <-ctx.Done():
+			if registered {
+				r.deregister(kapi)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r selfRegistration) register(kapi client.KeysAPI) {
+	dir := r.prefix + r.name + "/"
+	if _, err := kapi.Set(context.Background(), dir+"healthcheck", "true", &client.SetOptions{TTL: r.ttl}); err != nil {
+		builderLog.Errorf("failed to register health check of %s: %v\n", r.name, err)
+	}
+	if _, err := kapi.Set(context.Background(), dir+"servers/"+r.id, r.address, &client.SetOptions{TTL: r.ttl}); err != nil {
+		builderLog.Errorf("failed to register server %s of %s: %v\n", r.id, r.name, err)
+	}
+}
+
+// deregister removes the server and health check keys, without waiting long for an etcd which
+// can't be reached, as they expire anyway.
+func (r selfRegistration) deregister(kapi client.KeysAPI) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dir := r.prefix + r.name + "/"
+	for _, k := range []string{dir + "servers/" + r.id, dir + "healthcheck"} {
+		if _, err := kapi.Delete(ctx, k, nil); err != nil {
+			builderLog.Errorf("failed to deregister %s: %v\n", k, err)
+		}
+	}
+}
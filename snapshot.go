@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// vulcandSnapshots copy the /vulcand/ tree before each apply, as an export file in a directory
+// and/or under an etcd prefix, so that a bad rebuild can be rolled back with the restore command.
+// A tree which hasn't changed since the last snapshot isn't copied again, and at most retention
+// snapshots are kept in each place.
+type vulcandSnapshots struct {
+	dir       string
+	prefix    string
+	retention int
+	// kapi is the etcd the snapshots under prefix are kept in
+	kapi client.KeysAPI
+	last map[string]string
+}
+
+func newVulcandSnapshots(kapi client.KeysAPI, dir string, prefix string, retention int) *vulcandSnapshots {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &vulcandSnapshots{dir: dir, prefix: prefix, retention: retention, kapi: kapi}
+}
+
+// configuredSnapshots returns the snapshots configured by VCB_SNAPSHOT_DIR, VCB_SNAPSHOT_PREFIX and
+// VCB_SNAPSHOT_RETENTION, or nil when none are taken.
+func configuredSnapshots(kapi client.KeysAPI) *vulcandSnapshots {
+	if snapshotDir == "" && snapshotPrefix == "" {
+		return nil
+	}
+	retention := 20
+	if snapshotRetention != "" {
+		n, err := strconv.Atoi(snapshotRetention)
+		if err != nil {
+			log.Printf("WARN - The provided snapshot retention=%s is invalid, using default value=20", snapshotRetention)
+		} else {
+			retention = n
+		}
+	}
+	return newVulcandSnapshots(kapi, snapshotDir, snapshotPrefix, retention)
+}
+
+// take copies the tree, read from kapi, as the snapshot with the id, e.g. of the rebuild.
+func (s *vulcandSnapshots) take(kapi client.KeysAPI, id string, taken time.Time) error {
+	keys, err := readAllKeysFromEtcd(kapi, "/vulcand/")
+	if err != nil {
+		return err
+	}
+	if s.last != nil && reflect.DeepEqual(keys, s.last) {
+		return nil
+	}
+
+	if s.dir != "" {
+		if err := s.write(export{Created: taken.UTC(), Keys: keys}, id); err != nil {
+			return err
+		}
+	}
+	if s.prefix != "" {
+		for k, v := range keys {
+			if _, err := s.kapi.Set(context.Background(), s.prefix+id+strings.TrimPrefix(k, "/vulcand"), v, nil); err != nil {
+				return fmt.Errorf("failed to copy %s to snapshot %s: %v", k, id, err)
+			}
+		}
+		s.pruneEtcd()
+	}
+	s.last = keys
+	applierLog.Infof("took snapshot %s of %d keys\n", id, len(keys))
+	return nil
+}
+
+func (s *vulcandSnapshots) write(e export, id string) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	// snapshots hold TLS private keys, like exports
+	if err := ioutil.WriteFile(filepath.Join(s.dir, id+".json"), b, 0600); err != nil {
+		return err
+	}
+
+	if s.retention <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > s.retention {
+		if err := os.Remove(files[0]); err != nil {
+			applierLog.Warnf("failed to remove old snapshot %s: %v\n", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (s *vulcandSnapshots) pruneEtcd() {
+	if s.retention <= 0 {
+		return
+	}
+	resp, err := s.kapi.Get(context.Background(), s.prefix, &client.GetOptions{Sort: true})
+	if err != nil {
+		applierLog.Warnf("failed to list snapshots under %s: %v\n", s.prefix, err)
+		return
+	}
+	snapshots := resp.Node.Nodes
+	for len(snapshots) > s.retention {
+		if _, err := s.kapi.Delete(context.Background(), snapshots[0].Key, &client.DeleteOptions{Recursive: true}); err != nil {
+			applierLog.Warnf("failed to remove old snapshot %s: %v\n", snapshots[0].Key, err)
+		}
+		snapshots = snapshots[1:]
+	}
+}
+
+// readEtcdSnapshot reads a snapshot kept under an etcd prefix, e.g. /vulcand-backups/<id>, as an
+// export.
+func readEtcdSnapshot(kapi client.KeysAPI, dir string) (export, error) {
+	dir = strings.TrimSuffix(dir, "/")
+	resp, err := kapi.Get(context.Background(), dir, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if e, _ := err.(client.Error); e.Code == etcderr.EcodeKeyNotFound {
+			return export{}, fmt.Errorf("there is no snapshot %s", dir)
+		}
+		return export{}, err
+	}
+	keys := make(map[string]string)
+	addAllValuesToMap(keys, resp.Node)
+	e := export{Keys: make(map[string]string)}
+	for k, v := range keys {
+		e.Keys["/vulcand"+strings.TrimPrefix(k, dir)] = v
+	}
+	if created, err := time.Parse("20060102T150405.000Z", filepath.Base(dir)); err == nil {
+		e.Created = created
+	}
+	return e, nil
+}
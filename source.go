@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// serviceSource is somewhere other than the services prefixes in etcd which services are read
+// from, selected with VCB_SOURCE. The configuration is still written to, and locks and TLS hosts
+// still read from, etcd.
+type serviceSource interface {
+	services() ([]Service, error)
+	// watch notifies when the services may have changed
+	watch(w *notifier)
+}
+
+// newServiceSource returns the source named, or nil for etcd.
+func newServiceSource(name string) (serviceSource, error) {
+	switch name {
+	case "", "etcd":
+		return nil, nil
+	case "kubernetes":
+		return newKubernetesSource()
+	case "consul":
+		return newConsulSource()
+	case "docker":
+		return newDockerSource()
+	case "file":
+		return newFileSource()
+	default:
+		return nil, fmt.Errorf("unknown source %s", name)
+	}
+}
+
+// sourcedServices reads the services from a source, keeping the last services read while it fails.
+type sourcedServices struct {
+	source serviceSource
+	last   []Service
+}
+
+func (s *sourcedServices) services() []Service {
+	services, err := s.source.services()
+	if err != nil {
+		if s.last == nil {
+			log.Panicf("failed to read services from %s: %v\n", sourceName, err)
+		}
+		builderLog.Errorf("failed to read services from %s, keeping the previous ones: %v\n", sourceName, err)
+		return s.last
+	}
+	s.last = services
+	return services
+}
+
+// changed notifies that something the configuration is generated from has changed.
+func (w *notifier) changed(what string) {
+	if w.send() {
+		watcherLog.Debugf("%s changed, sent change message on notifier channel.", what)
+	} else {
+		watcherLog.Debugf("%s changed, not sending message on notifier channel, buffer full and no-one listening.", what)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// stagingTarget is a vulcand configuration each rebuild is applied to, and verified, before it is
+// promoted to production. It is kept under its own prefix, optionally in another etcd cluster, and
+// would normally be read by a separate vulcand started with that prefix as its etcd key.
+type stagingTarget struct {
+	kapi client.KeysAPI
+	// smokeCommand is run with the changes made to the staging configuration as JSON on stdin,
+	// and failing it stops the rebuild from being promoted to production.
+	smokeCommand string
+}
+
+func newStagingTarget(kapi client.KeysAPI, prefix string, smokeCommand string) *stagingTarget {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &stagingTarget{
+		kapi:         rebasedKeysAPI{KeysAPI: kapi, from: "/vulcand/", to: prefix},
+		smokeCommand: smokeCommand,
+	}
+}
+
+// configuredStaging returns the staging configured by VCB_STAGING_PREFIX, in the etcd of kapi or
+// that of VCB_STAGING_ETCD_PEERS, connected to like cfg, or nil when there is none.
+func configuredStaging(cfg client.Config, kapi client.KeysAPI) *stagingTarget {
+	if stagingPrefix == "" {
+		return nil
+	}
+	if stagingEtcdPeers != "" {
+		cfg.Endpoints = strings.Split(stagingEtcdPeers, ",")
+		etcd, err := client.New(cfg)
+		if err != nil {
+			log.Fatalf("failed to start staging etcd client: %v\n", err.Error())
+		}
+		kapi = client.NewKeysAPI(etcd)
+	}
+	log.Printf("applying to staging prefix %s before promoting to production\n", stagingPrefix)
+	return newStagingTarget(kapi, stagingPrefix, stagingSmokeExec)
+}
+
+// promote applies the configuration to staging and verifies it, and only then applies it to
+// production with apply, e.g. applyVulcanConf. Production is changed key by key, but with the
+// verified configuration only, and in the order of any apply, so that vulcand never routes to a
+// backend which doesn't exist yet. It returns the changes made to production.
+func (s *stagingTarget) promote(vc vulcanConf, apply func(vc vulcanConf) ([]keyChange, error)) ([]keyChange, error) {
+	if _, err := s.verify(s.kapi, vc); err != nil {
+		applierLog.Warnf("not promoting to production: %v\n", err)
+		return nil, err
+	}
+	return apply(vc)
+}
+
+// verify applies the configuration to the keys and runs the smoke verification against them.
+func (s *stagingTarget) verify(kapi client.KeysAPI, vc vulcanConf) ([]keyChange, error) {
+	changes, err := applyVulcanConf(kapi, vc)
+	if err != nil {
+		return nil, fmt.Errorf("staging apply failed: %v", err)
+	}
+	if s.smokeCommand == "" {
+		return changes, nil
+	}
+
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode staging changes: %v", err)
+	}
+	cmd := exec.Command("/bin/sh", "-c", s.smokeCommand)
+	cmd.Stdin = bytes.NewReader(diff)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		applierLog.Infof("staging smoke verification output: %s\n", out)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("staging smoke verification failed: %v", err)
+	}
+	return changes, nil
+}
+
+// rebasedKeysAPI moves the keys under one prefix to another, so that code written against
+// /vulcand/ can manage a configuration kept elsewhere. Only Get, Set and Delete are rebased.
+type rebasedKeysAPI struct {
+	client.KeysAPI
+	from string
+	to   string
+}
+
+func (r rebasedKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	resp, err := r.KeysAPI.Get(ctx, r.rebase(key), opts)
+	if resp != nil && resp.Node != nil {
+		resp.Node = r.unrebaseNode(resp.Node)
+	}
+	return resp, err
+}
+
+func (r rebasedKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	return r.KeysAPI.Set(ctx, r.rebase(key), value, opts)
+}
+
+func (r rebasedKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	return r.KeysAPI.Delete(ctx, r.rebase(key), opts)
+}
+
+func (r rebasedKeysAPI) rebase(key string) string {
+	if strings.HasPrefix(key, r.from) {
+		return r.to + strings.TrimPrefix(key, r.from)
+	}
+	return key
+}
+
+func (r rebasedKeysAPI) unrebaseNode(node *client.Node) *client.Node {
+	n := *node
+	if strings.HasPrefix(n.Key, r.to) {
+		n.Key = r.from + strings.TrimPrefix(n.Key, r.to)
+	} else if n.Key+"/" == r.to {
+		n.Key = strings.TrimSuffix(r.from, "/")
+	}
+	n.Nodes = nil
+	for _, child := range node.Nodes {
+		n.Nodes = append(n.Nodes, r.unrebaseNode(child))
+	}
+	return &n
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// serviceStatus tells registrators whether their service has been routed, and what was wrong with
+// its keys, so deployment pipelines can poll for it rather than wait.
+type serviceStatus struct {
+	AppliedAt  time.Time `json:"appliedAt"`
+	Applied    bool      `json:"applied"`
+	ApplyError string    `json:"applyError,omitempty"`
+	Frontends  int       `json:"frontends"`
+	// the service is in maintenance, see the maintenance key
+	Maintenance bool     `json:"maintenance,omitempty"`
+	Errors      []string `json:"errors"`
+}
+
+// serviceStatuses returns the status of each service after a rebuild which generated vc and
+// ended with applyErr.
+func serviceStatuses(services []Service, vc vulcanConf, appliedAt time.Time, applyErr error) map[string]serviceStatus {
+	names := serviceNames(services)
+	frontends := make(map[string]int)
+	for fe := range vc.FrontEnds {
+		frontends[ownerOf(fe, names)]++
+	}
+
+	statuses := make(map[string]serviceStatus)
+	for _, service := range services {
+		status := serviceStatus{
+			AppliedAt:   appliedAt,
+			Applied:     applyErr == nil,
+			Frontends:   frontends[service.Name],
+			Maintenance: service.Maintenance,
+			Errors:      service.violations(),
+		}
+		if applyErr != nil {
+			status.ApplyError = applyErr.Error()
+		}
+		statuses[service.Name] = status
+	}
+	return statuses
+}
+
+// writeServiceStatuses sets <prefix><service> to the status of each service, and removes the
+// statuses of services which no longer exist.
+func writeServiceStatuses(kapi client.KeysAPI, prefix string, statuses map[string]serviceStatus) {
+	resp, err := kapi.Get(context.Background(), prefix, nil)
+	if err == nil {
+		for _, node := range resp.Node.Nodes {
+			name := filepath.Base(node.Key)
+			if _, found := statuses[name]; !found && !node.Dir {
+				if _, err := kapi.Delete(context.Background(), node.Key, nil); err != nil {
+					builderLog.Errorf("failed to remove status of service %s: %v\n", name, err)
+				}
+			}
+		}
+	} else if e, _ := err.(client.Error); e.Code != etcderr.EcodeKeyNotFound {
+		builderLog.Errorf("failed to read service statuses: %v\n", err)
+	}
+
+	for name, status := range statuses {
+		b, err := json.Marshal(status)
+		if err != nil {
+			builderLog.Errorf("failed to encode status of service %s: %v\n", name, err)
+			continue
+		}
+		key := strings.TrimSuffix(prefix, "/") + "/" + name
+		if _, err := kapi.Set(context.Background(), key, string(b), nil); err != nil {
+			builderLog.Errorf("failed to write status of service %s: %v\n", name, err)
+		}
+	}
+}
+
+// heartbeat is written after each successful apply, so that other systems can tell a builder which
+// has stalled or died from one which has had nothing to change.
+type heartbeat struct {
+	Applied time.Time `json:"applied"`
+	// Checksum identifies the configuration applied, e.g. to compare the builders of clusters
+	Checksum string `json:"checksum"`
+}
+
+// configChecksum returns the SHA-256 of the keys and values of the configuration.
+func configChecksum(vc vulcanConf) string {
+	keys := vulcanConfToEtcdKeys(vc)
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, k := range names {
+		h.Write([]byte(k + "=" + keys[k] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHeartbeat writes the heartbeat of the configuration applied to key, expiring after ttl
+// when it is set.
+func writeHeartbeat(kapi client.KeysAPI, key string, vc vulcanConf, applied time.Time, ttl time.Duration) {
+	b, err := json.Marshal(heartbeat{Applied: applied, Checksum: configChecksum(vc)})
+	if err != nil {
+		builderLog.Errorf("failed to encode the heartbeat: %v\n", err)
+		return
+	}
+	if _, err := kapi.Set(context.Background(), key, string(b), &client.SetOptions{TTL: ttl}); err != nil {
+		builderLog.Errorf("failed to write the heartbeat to %s: %v\n", key, err)
+	}
+}
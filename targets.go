@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+)
+
+// vulcandTarget is one of several vulcands the configuration is applied to, each reading its own
+// etcd prefix, e.g. a public and an internal vulcand, and each given the frontends and backends
+// of a subset of the services.
+type vulcandTarget struct {
+	Prefix string `json:"prefix"`
+	// Services is a regex of the names of the services the target routes, or all of them when empty
+	Services string `json:"services"`
+	// Frontends is a regex of the names of the frontends the target is given, e.g. ^vcb-internal-,
+	// or all of them when empty
+	Frontends string `json:"frontends"`
+
+	services  *regexp.Regexp
+	frontends *regexp.Regexp
+	kapi      client.KeysAPI
+}
+
+// configuredTargets returns the vulcand the configuration is applied to, in etcd or through
+// VCB_VULCAND_API, or the VCB_TARGETS it is shared between along with the first of them, which
+// the consistency check, snapshots and /__diff cover.
+func configuredTargets(kapi client.KeysAPI) (client.KeysAPI, []*vulcandTarget) {
+	if vulcandTargets == "" {
+		if vulcandAPI != "" {
+			log.Printf("applying the configuration through the vulcand API at %s\n", vulcandAPI)
+		}
+		return vulcandKeys(kapi), nil
+	}
+	targets, err := parseVulcandTargets(kapi, vulcandTargets)
+	if err != nil {
+		log.Fatalf("invalid VCB_TARGETS: %v\n", err)
+	}
+	if vulcandAPI != "" {
+		log.Printf("WARN - VCB_VULCAND_API is ignored with VCB_TARGETS")
+	}
+	for _, t := range targets {
+		log.Printf("applying the configuration to %s\n", t.Prefix)
+	}
+	return targets[0].kapi, targets
+}
+
+// parseVulcandTargets reads a JSON list of targets, e.g.
+// [{"prefix": "/vulcand-public/", "services": "^public-"}, {"prefix": "/vulcand-internal/"}].
+func parseVulcandTargets(kapi client.KeysAPI, value string) ([]*vulcandTarget, error) {
+	var targets []*vulcandTarget
+	d := json.NewDecoder(strings.NewReader(value))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&targets); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	for _, t := range targets {
+		if !strings.HasPrefix(t.Prefix, "/") {
+			return nil, fmt.Errorf("target prefix %q is not an etcd directory", t.Prefix)
+		}
+		if !strings.HasSuffix(t.Prefix, "/") {
+			t.Prefix = t.Prefix + "/"
+		}
+		var err error
+		if t.services, err = regexp.Compile(t.Services); err != nil {
+			return nil, fmt.Errorf("invalid services of target %s: %v", t.Prefix, err)
+		}
+		if t.frontends, err = regexp.Compile(t.Frontends); err != nil {
+			return nil, fmt.Errorf("invalid frontends of target %s: %v", t.Prefix, err)
+		}
+		t.kapi = rebasedKeysAPI{KeysAPI: kapi, from: "/vulcand/", to: t.Prefix}
+	}
+	return targets, nil
+}
+
+// conf returns the part of the configuration the target is given. services are all the service
+// names, telling which service each frontend and backend belongs to.
+func (t *vulcandTarget) conf(vc vulcanConf, services []string) vulcanConf {
+	filtered := vulcanConf{
+		FrontEnds: make(map[string]vulcanFrontend),
+		Backends:  make(map[string]vulcanBackend),
+		Hosts:     vc.Hosts,
+		frozen:    vc.frozen,
+		ttl:       vc.ttl,
+		services:  vc.services,
+		failFast:  vc.failFast,
+	}
+	for name, frontend := range vc.FrontEnds {
+		if t.services.MatchString(ownerOf(name, services)) && t.frontends.MatchString(name) {
+			filtered.FrontEnds[name] = frontend
+		}
+	}
+	for name, backend := range vc.Backends {
+		if t.services.MatchString(ownerOf(name, services)) {
+			filtered.Backends[name] = backend
+		}
+	}
+	return filtered
+}
+
+// applyVulcandTargets applies the configuration to each of the targets, returning the changes made
+// with the keys they were made to, and the failures of all of them.
+func applyVulcandTargets(targets []*vulcandTarget, vc vulcanConf, services []string) ([]keyChange, error) {
+	var changes []keyChange
+	var failures []keyFailure
+	for _, t := range targets {
+		targetChanges, err := applyVulcanConf(t.kapi, t.conf(vc, services))
+		for _, c := range targetChanges {
+			c.Key = t.Prefix + strings.TrimPrefix(c.Key, "/vulcand/")
+			changes = append(changes, c)
+		}
+		if ae, ok := err.(applyError); ok {
+			for _, f := range ae.Failures {
+				f.Key = t.Prefix + strings.TrimPrefix(f.Key, "/vulcand/")
+				failures = append(failures, f)
+			}
+			// the remaining targets aren't applied once a fail-fast apply has failed
+			if vc.failFast {
+				break
+			}
+		} else if err != nil {
+			return changes, fmt.Errorf("failed to apply to %s: %v", t.Prefix, err)
+		}
+	}
+	if len(failures) > 0 {
+		return changes, applyError{failures}
+	}
+	return changes, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// tracer traces each rebuild, with a span for reading the services, building the configuration
+// and each apply phase. Nothing is traced until startTracing is called.
+var tracer = otel.Tracer("github.com/Financial-Times/vulcan-config-builder")
+
+// configuredTracing starts tracing to VCB_OTLP_ENDPOINT when it is set, returning the function
+// exporting the spans not yet exported.
+func configuredTracing() func() {
+	if otlpEndpoint == "" {
+		return func() {}
+	}
+	shutdown, err := startTracing(otlpEndpoint)
+	if err != nil {
+		log.Printf("WARN - The provided VCB_OTLP_ENDPOINT=%s is invalid, not tracing: %v\n", otlpEndpoint, err)
+		return func() {}
+	}
+	log.Printf("tracing rebuilds to %s\n", otlpEndpoint)
+	return shutdown
+}
+
+// startTracing exports the traces over OTLP/HTTP to the collector at endpoint, e.g.
+// http://otel-collector:4318. The returned function exports the spans not yet exported.
+func startTracing(endpoint string) (func(), error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected an http:// or https:// address, got %s", endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "vulcan-config-builder"))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("WARN - failed to export the remaining traces: %v\n", err)
+		}
+	}, nil
+}
+
+// traceSince records a span which has already ended, e.g. an apply phase.
+func traceSince(ctx context.Context, name string, start time.Time, end time.Time) {
+	if ctx == nil {
+		return
+	}
+	_, span := tracer.Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
+
+// endRebuildTrace ends the span of a rebuild which applied the configuration.
+func endRebuildTrace(span trace.Span, services int, changes int, err error) {
+	span.SetAttributes(attribute.Int("services", services), attribute.Int("changes", changes))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// traefikConfig is a Traefik v3 dynamic configuration, as read by its file provider.
+type traefikConfig struct {
+	HTTP struct {
+		Routers     map[string]traefikRouter     `yaml:"routers,omitempty"`
+		Services    map[string]traefikService    `yaml:"services,omitempty"`
+		Middlewares map[string]traefikMiddleware `yaml:"middlewares,omitempty"`
+	} `yaml:"http"`
+}
+
+type traefikRouter struct {
+	Rule        string   `yaml:"rule"`
+	Service     string   `yaml:"service"`
+	Priority    int      `yaml:"priority"`
+	Middlewares []string `yaml:"middlewares,omitempty"`
+}
+
+type traefikService struct {
+	LoadBalancer struct {
+		Servers []traefikServer `yaml:"servers"`
+	} `yaml:"loadBalancer"`
+}
+
+type traefikServer struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+type traefikMiddleware struct {
+	ReplacePathRegex struct {
+		Regex       string `yaml:"regex"`
+		Replacement string `yaml:"replacement"`
+	} `yaml:"replacePathRegex"`
+}
+
+// renderTraefik renders the routes of the services as a Traefik v3 file provider document. Each
+// vulcand backend becomes a service and each vulcand frontend a router of the same name, keeping
+// its route, which Traefik v3 rules are a superset of, and its rewrites as replacePathRegex
+// middlewares. Routers are given priorities in the order internal, health check, path (by
+// path-priority) and host header routes, as nginx and HAProxy try them.
+//
+// Traefik has no weight 0, so draining servers are left out, and routers of backends which aren't
+// rendered, e.g. VCB_MAINTENANCE_BACKEND, are left out too.
+func renderTraefik(services []Service, vc vulcanConf) []byte {
+	var conf traefikConfig
+	conf.HTTP.Routers = make(map[string]traefikRouter)
+	conf.HTTP.Services = make(map[string]traefikService)
+	conf.HTTP.Middlewares = make(map[string]traefikMiddleware)
+
+	for id, backend := range vc.Backends {
+		var service traefikService
+		for _, serverID := range sortedServerIDs(backend.Servers) {
+			server := backend.Servers[serverID]
+			if server.Draining {
+				continue
+			}
+			service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, traefikServer{URL: server.URL, Weight: server.Weight})
+		}
+		if len(service.LoadBalancer.Servers) > 0 {
+			conf.HTTP.Services[id] = service
+		}
+	}
+
+	names := routeOrder(services)
+	for i, name := range names {
+		frontend, found := vc.FrontEnds[name]
+		if !found {
+			continue
+		}
+		if _, found := conf.HTTP.Services[frontend.BackendID]; !found {
+			builderLog.Debugf("leaving router %s out of the Traefik configuration, backend %s has no servers in it\n", name, frontend.BackendID)
+			continue
+		}
+		router := traefikRouter{Rule: frontend.Route, Service: frontend.BackendID, Priority: len(names) - i}
+		for _, rewrite := range frontend.rewrites {
+			var m traefikMiddleware
+			m.ReplacePathRegex.Regex = rewrite.Middleware.Regexp
+			m.ReplacePathRegex.Replacement = rewrite.Middleware.Replacement
+			id := fmt.Sprintf("%s-%s", name, rewrite.ID)
+			conf.HTTP.Middlewares[id] = m
+			router.Middlewares = append(router.Middlewares, id)
+		}
+		conf.HTTP.Routers[name] = router
+	}
+
+	b, err := yaml.Marshal(conf)
+	if err != nil {
+		// the configuration only holds strings, ints and maps of them
+		panic(err)
+	}
+	return append([]byte("# generated by vulcan-config-builder, changes are overwritten\n"), b...)
+}
+
+// routeOrder returns the names of the vulcand frontends of the services in the order proxies
+// matching the first route should try them: internal, health check, path (by path-priority) and
+// host header routes. Frontends the services don't have, e.g. of a service in maintenance, are
+// included, and should be skipped.
+func routeOrder(services []Service) []string {
+	var names []string
+	for _, service := range services {
+		names = append(names, managedPrefix+"internal-"+service.Name)
+	}
+	for _, service := range services {
+		var serverIDs []string
+		for serverID := range service.Addresses {
+			serverIDs = append(serverIDs, serverID)
+		}
+		sort.Strings(serverIDs)
+		for _, serverID := range serverIDs {
+			names = append(names, fmt.Sprintf("%shealth-%s-%s", managedPrefix, service.Name, serverID))
+		}
+	}
+	for _, p := range sortedPaths(services) {
+		names = append(names, fmt.Sprintf("%s%s-path-regex-%s", managedPrefix, p.service.Name, p.name))
+	}
+	for _, service := range services {
+		names = append(names, managedPrefix+"byhostheader-"+service.Name)
+	}
+	return names
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// the functions vulcand's failover predicates and circuit breaker conditions may call
+var (
+	failoverPredicateFunctions = map[string]bool{
+		"IsNetworkError": true,
+		"Attempts":       true,
+		"ResponseCode":   true,
+		"RequestMethod":  true,
+	}
+	circuitBreakerFunctions = map[string]bool{
+		"NetworkErrorRatio":   true,
+		"LatencyAtQuantileMS": true,
+		"ResponseCodeRatio":   true,
+	}
+)
+
+// checkPredicate checks the syntax of a vulcand predicate, e.g. IsNetworkError() && Attempts() <= 2,
+// which vulcand parses as a Go expression calling the given functions.
+func checkPredicate(predicate string, functions map[string]bool) error {
+	expr, err := parser.ParseExpr(predicate)
+	if err != nil {
+		return err
+	}
+	var check func(e ast.Expr) error
+	check = func(e ast.Expr) error {
+		switch e := e.(type) {
+		case *ast.BinaryExpr:
+			switch e.Op {
+			case token.LAND, token.LOR, token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			default:
+				return fmt.Errorf("unsupported operator %s", e.Op)
+			}
+			if err := check(e.X); err != nil {
+				return err
+			}
+			return check(e.Y)
+		case *ast.UnaryExpr:
+			if e.Op != token.NOT {
+				return fmt.Errorf("unsupported operator %s", e.Op)
+			}
+			return check(e.X)
+		case *ast.ParenExpr:
+			return check(e.X)
+		case *ast.CallExpr:
+			name, ok := e.Fun.(*ast.Ident)
+			if !ok || !functions[name.Name] {
+				return fmt.Errorf("unknown function %s", predicate[e.Fun.Pos()-1:e.Fun.End()-1])
+			}
+			for _, arg := range e.Args {
+				if err := check(arg); err != nil {
+					return err
+				}
+			}
+			return nil
+		case *ast.BasicLit:
+			return nil
+		case *ast.Ident:
+			if e.Name == "true" || e.Name == "false" {
+				return nil
+			}
+			return fmt.Errorf("unknown identifier %s", e.Name)
+		default:
+			return fmt.Errorf("unsupported expression %s", predicate[e.Pos()-1:e.End()-1])
+		}
+	}
+	return check(expr)
+}
+
+// violations returns everything wrong with the service's keys: those ignored as invalid or
+// unknown when it was read, its invalid server addresses and the hosts it lost to other services.
+func (s Service) violations() []string {
+	violations := append([]string{}, s.problems...)
+	var ids []string
+	for id := range s.Addresses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := addressValidation.check(s.serverURL(s.Addresses[id])); err != nil {
+			violations = append(violations, "invalid address "+s.Addresses[id]+" for server "+id+": "+err.Error())
+		}
+	}
+	var hosts []string
+	for host := range s.rejectedHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		violations = append(violations, "host "+host+" is claimed by another service")
+	}
+	return violations
+}
+
+// validationReport lists the violations of each service with any, as found by a rebuild.
+type validationReport struct {
+	Checked  time.Time           `json:"checked"`
+	Services map[string][]string `json:"services"`
+}
+
+func validateServices(services []Service) validationReport {
+	report := validationReport{Checked: time.Now(), Services: make(map[string][]string)}
+	for _, service := range services {
+		if violations := service.violations(); len(violations) > 0 {
+			report.Services[service.Name] = violations
+		}
+	}
+	return report
+}
+
+// publish logs the report and writes it to the etcd key, unless the key is "-".
+func (r validationReport) publish(kapi client.KeysAPI, key string) {
+	var names []string
+	for name := range r.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		builderLog.Warnf("service %s has %d violations: %s\n", name, len(r.Services[name]), strings.Join(r.Services[name], "; "))
+	}
+
+	if key == "-" {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		builderLog.Errorf("failed to encode validation report: %v\n", err)
+		return
+	}
+	if _, err := kapi.Set(context.Background(), key, string(b), nil); err != nil {
+		builderLog.Errorf("failed to write validation report to %s: %v\n", key, err)
+	}
+}
+
+// latestValidation holds the report of the most recent rebuild, for serving over HTTP.
+type latestValidation struct {
+	sync.RWMutex
+	report *validationReport
+}
+
+func (v *latestValidation) set(report validationReport) {
+	v.Lock()
+	defer v.Unlock()
+	v.report = &report
+}
+
+func (v *latestValidation) get() *validationReport {
+	v.RLock()
+	defer v.RUnlock()
+	return v.report
+}
+
+// validationHandler serves the validation report of the most recent rebuild, or a 404 until
+// there has been one.
+func validationHandler(validation *latestValidation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := validation.get()
+		if report == nil {
+			http.Error(w, "no rebuild has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			builderLog.Errorf("failed to write validation response: %v\n", err)
+		}
+	}
+}
+
+// validateCommand validates the services, from the service files in a directory when one is given
+// and otherwise as a rebuild reads them, e.g. to gate a deployment on them. It prints the report,
+// and exits with 1 when any service has violations. Nothing is written to etcd.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "usage: validate [--json] [<service files directory>]\n")
+		return 2
+	}
+
+	configure()
+	var services []Service
+	if flags.NArg() == 1 {
+		var err error
+		services, err = (&fileSource{dir: flags.Arg(0)}).services()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read services: %v\n", err)
+			return 1
+		}
+		services, _ = resolveHostConflicts(services, hostConflictPolicy)
+	} else {
+		etcd, err := client.New(etcdConfig())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start etcd client: %v\n", err)
+			return 1
+		}
+		_, services, _ = newRebuilder(client.NewKeysAPI(etcd)).generate(context.Background())
+	}
+
+	report := validateServices(services)
+	if *asJSON {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode report: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(b))
+	} else {
+		var names []string
+		for name := range report.Services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s:\n", name)
+			for _, violation := range report.Services[name] {
+				fmt.Printf("  %s\n", violation)
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d services validated, %d with violations\n", len(services), len(report.Services))
+	if len(report.Services) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// the values of the vulcand keys, which are marshalled rather than formatted so that quotes and
+// backslashes in routes, predicates and rewrites are escaped
+
+type backendKeyValue struct {
+	Type     string
+	Settings map[string]interface{}
+}
+
+type serverKeyValue struct {
+	URL string `json:"url"`
+	// Weight is a pointer so that a draining server's weight of 0 is emitted
+	Weight *int `json:"weight,omitempty"`
+}
+
+type frontendKeyValue struct {
+	Type      string
+	BackendId string
+	Route     string
+	Settings  map[string]interface{}
+}
+
+type rewriteKeyValue struct {
+	Id         string
+	Type       string
+	Priority   int
+	Middleware vulcanRewriteMw
+}
+
+// backendServerValue returns the /vulcand/backends/<be>/servers/<srv> value of a server.
+func backendServerValue(s vulcanServer) string {
+	v := serverKeyValue{URL: s.URL}
+	if s.Draining {
+		weight := 0
+		v.Weight = &weight
+	} else if s.Weight > 0 {
+		v.Weight = &s.Weight
+	}
+	return marshalValue(v)
+}
+
+// rewriteValue returns the /vulcand/frontends/<fe>/middlewares/<id> value of a rewrite.
+func rewriteValue(id string, rewrite vulcanRewrite) string {
+	return marshalValue(rewriteKeyValue{
+		Id:         id,
+		Type:       rewrite.Type,
+		Priority:   rewrite.Priority,
+		Middleware: rewrite.Middleware,
+	})
+}
+
+// marshalValue returns the JSON of a key value, leaving the && and || of routes unescaped.
+func marshalValue(v interface{}) string {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		// values are strings, numbers and settings which come from parsed JSON, so can always
+		// be marshalled
+		panic(err)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
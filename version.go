@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// the version of vcb, set when it is built, e.g.
+// go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// currentBuildInfo returns the version vcb was built with. The commit is read from the build
+// settings of the Go toolchain when it isn't set.
+func currentBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && b.Commit == "" {
+				b.Commit = setting.Value
+			}
+			if setting.Key == "vcs.time" && b.BuildDate == "" {
+				b.BuildDate = setting.Value
+			}
+		}
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	s := "vulcan-config-builder " + b.Version
+	if b.Commit != "" {
+		s += " commit " + b.Commit
+	}
+	if b.BuildDate != "" {
+		s += " built " + b.BuildDate
+	}
+	return s + " with " + b.GoVersion
+}
+
+// versionCommand prints the version vcb was built with.
+func versionCommand(args []string) int {
+	fmt.Println(currentBuildInfo())
+	return 0
+}
+
+func buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuildInfo()); err != nil {
+		log.Printf("failed to write build info response: %v\n", err)
+	}
+}
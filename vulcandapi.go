@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	etcderr "github.com/coreos/etcd/error"
+	"golang.org/x/net/context"
+)
+
+// vulcandKeys returns where the vulcand configuration is applied: etcd, or the vulcand API at
+// VCB_VULCAND_API.
+func vulcandKeys(kapi client.KeysAPI) client.KeysAPI {
+	if vulcandAPI == "" {
+		return kapi
+	}
+	return newVulcandAPIKeys(vulcandAPI)
+}
+
+// vulcandAPIKeys configures vulcand through its HTTP API, for vulcand instances which don't read
+// their configuration from our etcd cluster, e.g. ones running with the in-memory backend. It
+// presents the configuration as the etcd keys it would otherwise be kept in, so that it is applied
+// like any other. Only Get, Set and Delete are implemented.
+//
+// Values read back are those last set by vcb where it set them, as the API doesn't return them as
+// they were written, so an entity created by someone else, or before vcb started, is set again
+// once.
+type vulcandAPIKeys struct {
+	client.KeysAPI
+	api    string
+	client *http.Client
+
+	sync.Mutex
+	// values last set, by key
+	values map[string]string
+}
+
+func newVulcandAPIKeys(api string) *vulcandAPIKeys {
+	return &vulcandAPIKeys{
+		api:    strings.TrimSuffix(api, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+		values: make(map[string]string),
+	}
+}
+
+// do makes a request of the API, decoding a JSON response into v if it isn't nil.
+func (a *vulcandAPIKeys) do(method string, path string, body interface{}, v interface{}) error {
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, a.api+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return client.Error{Code: etcderr.EcodeKeyNotFound, Message: method + " " + path + " not found"}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s failed with status %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// entity is a vulcand backend, server, frontend, middleware or host as the API returns it.
+type entity map[string]interface{}
+
+func (e entity) id() string {
+	if id, ok := e["Id"].(string); ok {
+		return id
+	}
+	name, _ := e["Name"].(string)
+	return name
+}
+
+// tree reads the whole vulcand configuration as the etcd nodes it would be kept in.
+func (a *vulcandAPIKeys) tree() (*client.Node, error) {
+	root := &client.Node{Key: "/vulcand", Dir: true}
+	dir := func(parent *client.Node, name string) *client.Node {
+		node := &client.Node{Key: parent.Key + "/" + name, Dir: true}
+		parent.Nodes = append(parent.Nodes, node)
+		return node
+	}
+	value := func(parent *client.Node, name string, e entity) {
+		key := parent.Key + "/" + name
+		a.Lock()
+		v, found := a.values[key]
+		a.Unlock()
+		if !found {
+			delete(e, "Id")
+			delete(e, "Name")
+			b, _ := json.Marshal(e)
+			v = string(b)
+		}
+		parent.Nodes = append(parent.Nodes, &client.Node{Key: key, Value: v})
+	}
+
+	var backends struct{ Backends []entity }
+	if err := a.do("GET", "/v2/backends", nil, &backends); err != nil {
+		return nil, err
+	}
+	backendsDir := dir(root, "backends")
+	for _, backend := range backends.Backends {
+		id := backend.id()
+		var servers struct{ Servers []entity }
+		if err := a.do("GET", "/v2/backends/"+url.PathEscape(id)+"/servers", nil, &servers); err != nil {
+			return nil, err
+		}
+		backendDir := dir(backendsDir, id)
+		value(backendDir, "backend", backend)
+		serversDir := dir(backendDir, "servers")
+		for _, server := range servers.Servers {
+			value(serversDir, server.id(), server)
+		}
+	}
+
+	var frontends struct{ Frontends []entity }
+	if err := a.do("GET", "/v2/frontends", nil, &frontends); err != nil {
+		return nil, err
+	}
+	frontendsDir := dir(root, "frontends")
+	for _, frontend := range frontends.Frontends {
+		id := frontend.id()
+		var middlewares struct{ Middlewares []entity }
+		if err := a.do("GET", "/v2/frontends/"+url.PathEscape(id)+"/middlewares", nil, &middlewares); err != nil {
+			return nil, err
+		}
+		frontendDir := dir(frontendsDir, id)
+		value(frontendDir, "frontend", frontend)
+		middlewaresDir := dir(frontendDir, "middlewares")
+		for _, middleware := range middlewares.Middlewares {
+			value(middlewaresDir, middleware.id(), middleware)
+		}
+	}
+
+	var hosts struct{ Hosts []entity }
+	if err := a.do("GET", "/v2/hosts", nil, &hosts); err != nil {
+		return nil, err
+	}
+	hostsDir := dir(root, "hosts")
+	for _, host := range hosts.Hosts {
+		value(dir(hostsDir, host.id()), "host", host)
+	}
+	return root, nil
+}
+
+func findNode(node *client.Node, key string) *client.Node {
+	if node.Key == key {
+		return node
+	}
+	for _, child := range node.Nodes {
+		if key == child.Key || strings.HasPrefix(key, child.Key+"/") {
+			return findNode(child, key)
+		}
+	}
+	return nil
+}
+
+func (a *vulcandAPIKeys) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	root, err := a.tree()
+	if err != nil {
+		return nil, err
+	}
+	node := findNode(root, strings.TrimSuffix(key, "/"))
+	if node == nil {
+		return nil, client.Error{Code: etcderr.EcodeKeyNotFound, Message: key + " not found"}
+	}
+	return &client.Response{Action: "get", Node: node}, nil
+}
+
+// vulcandPath returns the API path and the kind of the entity a key holds, e.g. a server.
+func vulcandPath(key string) (path string, kind string, err error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(key, "/vulcand/"), "/"), "/")
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	switch {
+	case len(parts) == 4 && parts[0] == "backends" && parts[2] == "servers":
+		return "/v2/backends/" + escaped[1] + "/servers/" + escaped[3], "Server", nil
+	case len(parts) == 4 && parts[0] == "frontends" && parts[2] == "middlewares":
+		return "/v2/frontends/" + escaped[1] + "/middlewares/" + escaped[3], "Middleware", nil
+	case entityKey(parts, "backends", "backend"):
+		return "/v2/backends/" + escaped[1], "Backend", nil
+	case entityKey(parts, "frontends", "frontend"):
+		return "/v2/frontends/" + escaped[1], "Frontend", nil
+	case entityKey(parts, "hosts", "host"):
+		return "/v2/hosts/" + escaped[1], "Host", nil
+	default:
+		return "", "", fmt.Errorf("%s is not a vulcand entity", key)
+	}
+}
+
+// entityKey reports whether the key split into parts is the directory, e.g. backends/<backend>, or
+// the value, e.g. backends/<backend>/backend, of an entity of the collection.
+func entityKey(parts []string, collection string, value string) bool {
+	return parts[0] == collection && (len(parts) == 2 || len(parts) == 3 && parts[2] == value)
+}
+
+// Set creates or replaces the entity the key holds, e.g. /vulcand/backends/<backend>/backend.
+func (a *vulcandAPIKeys) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	path, kind, err := vulcandPath(key)
+	if err != nil {
+		return nil, err
+	}
+	var e entity
+	if err := json.Unmarshal([]byte(value), &e); err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", key, err)
+	}
+	if kind == "Host" {
+		e["Name"] = key[len("/vulcand/hosts/") : len(key)-len("/host")]
+	} else {
+		e["Id"] = path[strings.LastIndex(path, "/")+1:]
+		if unescaped, err := url.PathUnescape(e["Id"].(string)); err == nil {
+			e["Id"] = unescaped
+		}
+	}
+	// entities are created by posting them to the collection they are in
+	collection := path[:strings.LastIndex(path, "/")]
+	if err := a.do("POST", collection, map[string]interface{}{kind: e}, nil); err != nil {
+		return nil, err
+	}
+	a.Lock()
+	a.values[key] = value
+	a.Unlock()
+	return &client.Response{Action: "set", Node: &client.Node{Key: key, Value: value}}, nil
+}
+
+// Delete removes the entity the key holds, with everything in it, e.g. a backend with its servers.
+// Entities which are already gone are ignored.
+func (a *vulcandAPIKeys) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	path, _, err := vulcandPath(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.do("DELETE", path, nil, nil); err != nil {
+		if e, _ := err.(client.Error); e.Code != etcderr.EcodeKeyNotFound {
+			return nil, err
+		}
+	}
+	// forget the values of the entity and everything in it
+	entity := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(key, "/"), "/backend"), "/frontend")
+	entity = strings.TrimSuffix(entity, "/host")
+	a.Lock()
+	for k := range a.values {
+		if k == key || strings.HasPrefix(k, entity+"/") {
+			delete(a.values, k)
+		}
+	}
+	a.Unlock()
+	return &client.Response{Action: "delete", Node: &client.Node{Key: key}}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// configStale is 1 while the watchdog finds the configuration stale, and 0 otherwise.
+var configStale = expvar.NewInt("config_stale")
+
+// applyWatchdog alerts when a change has been notified but no apply has succeeded within the
+// window since, e.g. because the builder loop or a goroutine it waits on is wedged. It is told of
+// changes by the watchers rather than by the builder loop, so that it still sees them when the
+// loop has stopped taking them.
+type applyWatchdog struct {
+	window time.Duration
+	// webhook, when set, is posted a JSON alert when the configuration becomes stale
+	webhook string
+	client  *http.Client
+
+	sync.Mutex
+	// pending is when the oldest change which hasn't been applied yet was notified
+	pending time.Time
+	stale   bool
+	// active, when set, reports whether vcb is expected to apply the changes, e.g. isn't standing
+	// by for another vcb which is the leader
+	active func() bool
+}
+
+type watchdogAlert struct {
+	Text         string    `json:"text"`
+	PendingSince time.Time `json:"pendingSince"`
+	Window       string    `json:"window"`
+}
+
+func newApplyWatchdog(window time.Duration, webhook string) *applyWatchdog {
+	return &applyWatchdog{window: window, webhook: webhook, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// notified records a change, which is pending until an apply started after it has succeeded.
+func (d *applyWatchdog) notified(at time.Time) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.pending.IsZero() {
+		d.pending = at
+	}
+}
+
+// applied records an apply which succeeded, having started at the time given.
+func (d *applyWatchdog) applied(started time.Time) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if !d.pending.IsZero() && !d.pending.After(started) {
+		d.pending = time.Time{}
+	}
+}
+
+func (d *applyWatchdog) setActive(active func() bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.active = active
+}
+
+// check returns why the configuration is stale, or nil when it isn't, alerting when it becomes
+// stale.
+func (d *applyWatchdog) check(now time.Time) error {
+	if d == nil {
+		return nil
+	}
+	d.Lock()
+	if d.active != nil && !d.active() {
+		d.pending = time.Time{}
+	}
+	var err error
+	if !d.pending.IsZero() && now.Sub(d.pending) > d.window {
+		err = fmt.Errorf("no apply has succeeded since a change %v ago", now.Sub(d.pending).Truncate(time.Second))
+	}
+	became := err != nil && !d.stale
+	recovered := err == nil && d.stale
+	d.stale = err != nil
+	pending := d.pending
+	d.Unlock()
+
+	if became {
+		configStale.Set(1)
+		builderLog.Errorf("the configuration is stale: %v\n", err)
+		d.alert(watchdogAlert{Text: "vcb configuration is stale: " + err.Error(), PendingSince: pending, Window: d.window.String()})
+	} else if recovered {
+		configStale.Set(0)
+		builderLog.Infof("an apply has succeeded, the configuration is no longer stale\n")
+	}
+	return err
+}
+
+func (d *applyWatchdog) alert(a watchdogAlert) {
+	if d.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(a)
+	if err == nil {
+		var resp *http.Response
+		resp, err = d.client.Post(d.webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		builderLog.Errorf("watchdog webhook %s failed: %v\n", d.webhook, err)
+	}
+}
+
+// run checks the configuration a few times per window, until ctx is done.
+func (d *applyWatchdog) run(ctx context.Context) {
+	interval := d.window / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.check(now)
+		}
+	}
+}